@@ -1,65 +1,337 @@
 package main
 
 import (
-	"go-auth-totp/internal/auth/enroll"
+	"context"
+	"errors"
+	"go-auth-totp/internal/audit"
+	"go-auth-totp/internal/auth/account"
+	"go-auth-totp/internal/auth/apikey"
+	"go-auth-totp/internal/auth/device"
 	"go-auth-totp/internal/auth/ratelimit"
 	"go-auth-totp/internal/auth/recovery"
-	"go-auth-totp/internal/auth/totp"
+	"go-auth-totp/internal/auth/validate"
 	"go-auth-totp/internal/config"
 	"go-auth-totp/internal/crypto"
+	internalGrpc "go-auth-totp/internal/grpc"
 	internalHttp "go-auth-totp/internal/http"
+	"go-auth-totp/internal/logging"
+	"go-auth-totp/internal/metrics"
+	"go-auth-totp/internal/radius"
 	"go-auth-totp/internal/storage"
-	"log"
+	"go-auth-totp/internal/tenant"
+	"go-auth-totp/internal/tlsutil"
+	"go-auth-totp/internal/webhook"
+	"go-auth-totp/pkg/assertion"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 func main() {
+	// Everything, including the standard log package, goes out as redacted
+	// JSON; the level is adjusted once the config is loaded.
+	var logLevel slog.LevelVar
+	logger := logging.New(os.Stderr, &logLevel)
+	slog.SetDefault(logger)
+
 	// 1. Load Config
 	cfg, err := config.Load()
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		fatal("Failed to load config", err)
 	}
+	logLevel.Set(cfg.LogLevel)
 
-	cryptoSvc, err := crypto.NewAESGCMEncryption(cfg.MasterKey)
+	// Each tenant has its own issuer, TOTP policy and encryption key.
+	tenants, err := tenant.Load(cfg)
 	if err != nil {
-		log.Fatalf("Failed to init crypto: %v", err)
+		fatal("Failed to load tenants", err)
+	}
+
+	var m *metrics.Metrics
+	if cfg.MetricsEnabled {
+		m = metrics.New()
+		for _, id := range tenants.IDs() {
+			t, _ := tenants.Get(id)
+			t.Crypto = crypto.WithDecryptHook(t.Crypto, m.DecryptFailed)
+		}
 	}
 
 	// 2. Setup Services
-	repo, err := storage.NewSQLiteRepository(cfg.DBPath)
+	sqliteRepo, err := storage.NewSQLiteRepository(cfg.DBPath, cfg.SQLiteOptions())
 	if err != nil {
-		log.Fatalf("Failed to init db: %v", err)
+		fatal("Failed to init db", err)
+	}
+	var repo storage.Repository = sqliteRepo
+	if m != nil {
+		// Below the cache, so latency reflects database round trips.
+		repo = storage.NewObservedRepository(repo, m.ObserveRepository)
+	}
+	if cfg.CacheTTL > 0 && cfg.CacheMaxEntries > 0 {
+		repo = storage.NewCachedRepository(repo, storage.CacheOptions{
+			TTL:        cfg.CacheTTL,
+			MaxEntries: cfg.CacheMaxEntries,
+		})
 	}
 
-	enrollSvc := enroll.NewService(cfg.AppName, cryptoSvc)
 	recoverySvc := recovery.NewService()
-	// Pass nil to use RealClock
-	verifier := totp.NewVerifier(nil, cfg)
 	// Limit: 3 attempts, refill 1 every 30s
 	limiter := ratelimit.NewInMemoryLimiter(30*time.Second, 3)
+	limiter.StartJanitor(5 * time.Minute)
+	m.WatchLimiter("code", limiter.Len)
+
+	// API keys live next to the users; lookups bypass the user cache.
+	auth := apikey.NewAuthenticator(sqliteRepo, tenants, apikey.Options{
+		Required:         cfg.APIAuthRequired,
+		DefaultRateLimit: cfg.APIKeyRateLimit,
+		MaxSkew:          cfg.APISignatureMaxSkew,
+	})
+	if !cfg.APIAuthRequired {
+		slog.Warn("API_AUTH_REQUIRED=false, requests without an API key are accepted")
+	}
+
+	var signer *assertion.Signer
+	if cfg.AssertionKeyFile != "" {
+		key, err := assertion.LoadPrivateKeyFile(cfg.AssertionKeyFile)
+		if err != nil {
+			fatal("Failed to load assertion key", err)
+		}
+		signer = assertion.NewSigner(key, assertion.SignerOptions{Issuer: cfg.AssertionIssuer, TTL: cfg.AssertionTTL})
+		slog.Info("Assertions enabled", "kid", signer.KeyID(), "issuer", cfg.AssertionIssuer)
+		for _, id := range tenants.IDs() {
+			if t, _ := tenants.Get(id); len(t.AssertionAudiences) == 0 {
+				slog.Warn("Tenant has no assertion audiences, its assertion requests are refused", "tenant", id)
+			}
+		}
+	}
 
-	// 3. Setup Handlers
+	// 3. Setup Handlers. The HTTP, gRPC and RADIUS frontends share the
+	// services, and with them the rate limiter. Like API keys, the audit
+	// log, webhook outbox and trusted devices bypass the cache.
+	notifier := webhook.NewNotifier(sqliteRepo)
+	accounts := account.NewService(repo, limiter, account.Options{
+		Recovery:         recoverySvc,
+		Webhooks:         notifier,
+		LowRecoveryCodes: cfg.WebhookLowRecoveryCodes,
+	})
+	codes := validate.NewService(repo, limiter)
 	h := &internalHttp.Handlers{
-		Repo:        repo,
-		Crypto:      cryptoSvc,
-		EnrollSvc:   enrollSvc,
-		RecoverySvc: recoverySvc,
-		Verifier:    verifier,
-		Limiter:     limiter,
+		Repo:         repo,
+		Auth:         auth,
+		Tenants:      tenants,
+		Accounts:     accounts,
+		Codes:        codes,
+		MaxBodyBytes: cfg.HTTPMaxBodyBytes,
+		Metrics:      m,
+		Audit:        audit.NewRecorder(sqliteRepo),
+		Webhooks:     notifier,
+		Assertions:   signer,
+		Devices:      device.NewService(sqliteRepo, cfg.DeviceTrustTTL, nil),
+	}
+
+	// Webhooks are sent from the outbox in the background; deliveries
+	// still pending at shutdown go out after the next start.
+	dispatcher := webhook.NewDispatcher(sqliteRepo, tenants, webhook.Options{
+		MaxAttempts:  cfg.WebhookMaxAttempts,
+		RetryBase:    cfg.WebhookRetryBase,
+		PollInterval: cfg.WebhookPollInterval,
+		Timeout:      cfg.WebhookTimeout,
+	})
+	dispatchCtx, stopDispatch := context.WithCancel(context.Background())
+	dispatchDone := make(chan struct{})
+	go func() {
+		defer close(dispatchDone)
+		dispatcher.Run(dispatchCtx)
+	}()
+
+	// The RADIUS frontend shares the repository, limiter and audit log
+	// with the HTTP API.
+	var radiusConn net.PacketConn
+	radiusDone := make(chan struct{})
+	if cfg.RadiusAddr == "" {
+		close(radiusDone)
+	} else {
+		if cfg.RadiusClientsFile == "" {
+			slog.Error("RADIUS_ADDR is set but RADIUS_CLIENTS_FILE is not")
+			os.Exit(1)
+		}
+		clients, err := radius.LoadClients(cfg.RadiusClientsFile, tenants)
+		if err != nil {
+			fatal("Failed to load RADIUS clients", err)
+		}
+		radiusConn, err = net.ListenPacket("udp", cfg.RadiusAddr)
+		if err != nil {
+			fatal("Failed to listen for RADIUS", err)
+		}
+		radiusSrv := radius.NewServer(clients, codes, h.Audit, m)
+		go func() {
+			defer close(radiusDone)
+			if err := radiusSrv.Serve(radiusConn); err != nil {
+				slog.Error("RADIUS server failed", "error", err)
+			}
+		}()
+		slog.Info("RADIUS listening", "addr", radiusConn.LocalAddr().String(), "clients", len(clients))
 	}
 
-	r := mux.NewRouter()
-	r.HandleFunc("/enroll", h.EnrollHandler).Methods("POST")
-	r.HandleFunc("/verify", h.VerifyHandler).Methods("POST")
-	r.HandleFunc("/validate", h.ValidateHandler).Methods("POST")
-	r.HandleFunc("/recover", h.RecoverHandler).Methods("POST")
+	r := internalHttp.NewRouter(h)
 
 	// 4. Start Server
-	log.Printf("Server listening on :%s", cfg.Port)
-	if err := http.ListenAndServe(":"+cfg.Port, r); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	srv := &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           r,
+		ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+		ReadTimeout:       cfg.HTTPReadTimeout,
+		WriteTimeout:      cfg.HTTPWriteTimeout,
+		IdleTimeout:       cfg.HTTPIdleTimeout,
+		MaxHeaderBytes:    cfg.HTTPMaxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
 	}
+	serve := srv.ListenAndServe
+	var reloader *tlsutil.Reloader
+	if cfg.TLSCertFile == "" {
+		slog.Warn("TLS_CERT_FILE not set; serving plain HTTP, terminate TLS in front of this server")
+		slog.Info("Server listening", "port", cfg.Port, "tls", false, "tenants", tenants.IDs())
+	} else {
+		reloader, err = tlsutil.NewReloader(tlsutil.Options{
+			CertFile:     cfg.TLSCertFile,
+			KeyFile:      cfg.TLSKeyFile,
+			ClientCAFile: cfg.TLSClientCAFile,
+			ClientAuth:   cfg.TLSClientAuth,
+		})
+		if err != nil {
+			fatal("Failed to load TLS configuration", err)
+		}
+		srv.TLSConfig = reloader.TLSConfig()
+		serve = func() error { return srv.ListenAndServeTLS("", "") }
+		go reloadOnSIGHUP(reloader)
+		slog.Info("Server listening", "port", cfg.Port, "tls", true, "mutual_tls", reloader.MutualTLS(), "tenants", tenants.IDs())
+	}
+
+	// The gRPC API runs on its own port with the same services, keys and
+	// certificate as the HTTP API.
+	var grpcSrv *grpc.Server
+	grpcDone := make(chan struct{})
+	if cfg.GRPCAddr == "" {
+		close(grpcDone)
+	} else {
+		var grpcOpts []grpc.ServerOption
+		if reloader != nil {
+			grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(reloader.GRPCConfig())))
+		}
+		grpcSrv = internalGrpc.NewServer(internalGrpc.Options{
+			Auth:       auth,
+			Tenants:    tenants,
+			Accounts:   accounts,
+			Codes:      codes,
+			Metrics:    m,
+			Audit:      h.Audit,
+			Assertions: signer,
+		}, grpcOpts...)
+		lis, err := net.Listen("tcp", cfg.GRPCAddr)
+		if err != nil {
+			fatal("Failed to listen for gRPC", err)
+		}
+		go func() {
+			defer close(grpcDone)
+			if err := grpcSrv.Serve(lis); err != nil {
+				slog.Error("gRPC server failed", "error", err)
+			}
+		}()
+		slog.Info("gRPC listening", "addr", lis.Addr().String(), "tls", reloader != nil)
+	}
+
+	// Probes get their own plain-HTTP listener when asked for, since under
+	// TLS_CLIENT_AUTH=require the main listener wants a client certificate.
+	var healthSrv *http.Server
+	if cfg.HealthAddr != "" {
+		healthSrv = &http.Server{
+			Addr:              cfg.HealthAddr,
+			Handler:           internalHttp.NewHealthRouter(h),
+			ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+			ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+		}
+		go func() {
+			if err := healthSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Health listener failed", "error", err)
+			}
+		}()
+		slog.Info("Health listening", "addr", cfg.HealthAddr)
+	}
+
+	stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- serve() }()
+
+	select {
+	case err := <-serveErr:
+		fatal("Server failed", err)
+	case <-stop.Done():
+	}
+	cancel() // a second signal kills the process
+
+	// 5. Shut down: stop accepting, drain in-flight requests, then release
+	// the database so no transaction is cut off.
+	slog.Info("Shutting down, draining requests", "timeout", cfg.ShutdownTimeout.String())
+	h.SetDraining()
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelShutdown()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("Graceful shutdown incomplete, closing remaining connections", "error", err)
+		srv.Close()
+	}
+	if grpcSrv != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcSrv.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			slog.Warn("Graceful gRPC shutdown incomplete, closing remaining connections")
+			grpcSrv.Stop()
+		}
+	}
+	<-grpcDone
+	if healthSrv != nil {
+		healthSrv.Close()
+	}
+	if radiusConn != nil {
+		radiusConn.Close()
+	}
+	<-radiusDone
+	stopDispatch()
+	<-dispatchDone
+	limiter.Close()
+	if err := sqliteRepo.Close(); err != nil {
+		slog.Error("Closing database failed", "error", err)
+	}
+	slog.Info("Server stopped")
+}
+
+// reloadOnSIGHUP re-reads the certificate files whenever the process gets
+// SIGHUP; a failed reload keeps the previous certificates.
+func reloadOnSIGHUP(reloader *tlsutil.Reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := reloader.Reload(); err != nil {
+			slog.Error("TLS reload failed, keeping previous certificates", "error", err)
+			continue
+		}
+		slog.Info("TLS certificates reloaded")
+	}
+}
+
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
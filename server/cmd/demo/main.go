@@ -13,12 +13,12 @@ import (
 	"github.com/mdp/qrterminal/v3"
 )
 
-const baseURL = "http://localhost:8080"
+const baseURL = "http://localhost:8080/v1"
 
 type EnrollResponse struct {
-	Secret        string   `json:"Secret"`
-	OTPAuthURL    string   `json:"OTPAuthURL"`
-	RecoveryCodes []string `json:"RecoveryCodes"`
+	Secret        string   `json:"secret"`
+	OTPAuthURL    string   `json:"otpauth_url"`
+	RecoveryCodes []string `json:"recovery_codes"`
 }
 
 type StatusResponse struct {
@@ -41,7 +41,7 @@ func main() {
 
 	// 1. Enroll
 	fmt.Printf("\n[1] Enrolling user '%s'...\n", username)
-	resp, err := http.Post(
+	resp, err := post(
 		baseURL+"/enroll",
 		"application/json",
 		bytes.NewBufferString(fmt.Sprintf(`{"user_id": "%s"}`, username)),
@@ -87,7 +87,7 @@ func main() {
 	code, _ := reader.ReadString('\n')
 	code = strings.TrimSpace(code)
 
-	verifyResp, err := http.Post(
+	verifyResp, err := post(
 		baseURL+"/verify",
 		"application/json",
 		bytes.NewBufferString(fmt.Sprintf(`{"user_id": "%s", "code": "%s"}`, username, code)),
@@ -121,7 +121,7 @@ func main() {
 
 		if len(input) == 6 {
 			// Assume TOTP
-			res, err := http.Post(
+			res, err := post(
 				baseURL+"/validate",
 				"application/json",
 				bytes.NewBufferString(fmt.Sprintf(`{"user_id": "%s", "code": "%s"}`, username, input)),
@@ -136,7 +136,7 @@ func main() {
 
 		} else {
 			// Try Recovery
-			res, err := http.Post(
+			res, err := post(
 				baseURL+"/recover",
 				"application/json",
 				bytes.NewBufferString(fmt.Sprintf(`{"user_id": "%s", "code": "%s"}`, username, input)),
@@ -151,3 +151,17 @@ func main() {
 		}
 	}
 }
+
+// post sends a JSON request, authenticated with TOTP_API_KEY when set.
+// Create a key with: go run ./cmd/totpctl keys create -name demo -scopes enroll,validate
+func post(url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if key := os.Getenv("TOTP_API_KEY"); key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	return http.DefaultClient.Do(req)
+}
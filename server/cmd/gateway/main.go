@@ -0,0 +1,135 @@
+// Command gateway is the forward-auth gateway: reverse proxies ask it
+// whether a request is signed in, and send users without a session to its
+// login page. See the README's "Forward-Auth Gateway" section.
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-auth-totp/internal/audit"
+	"go-auth-totp/internal/auth/ratelimit"
+	"go-auth-totp/internal/auth/validate"
+	"go-auth-totp/internal/config"
+	"go-auth-totp/internal/gateway"
+	"go-auth-totp/internal/logging"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	var logLevel slog.LevelVar
+	logger := logging.New(os.Stderr, &logLevel)
+	slog.SetDefault(logger)
+
+	cfg, err := config.Load()
+	if err != nil {
+		fatal("Failed to load config", err)
+	}
+	logLevel.Set(cfg.LogLevel)
+
+	tenants, err := tenant.Load(cfg)
+	if err != nil {
+		fatal("Failed to load tenants", err)
+	}
+	// The gateway signs in the users of a single tenant.
+	t, ok := tenants.Default()
+	if cfg.GatewayTenant != "" {
+		t, ok = tenants.Get(cfg.GatewayTenant)
+	}
+	if !ok {
+		fatal("Invalid GATEWAY_TENANT", fmt.Errorf("tenant %q is not configured", cfg.GatewayTenant))
+	}
+
+	if cfg.GatewayPublicURL == "" {
+		slog.Error("GATEWAY_PUBLIC_URL is required, e.g. https://auth.example.com")
+		os.Exit(1)
+	}
+	publicURL, err := url.Parse(cfg.GatewayPublicURL)
+	if err != nil {
+		fatal("Invalid GATEWAY_PUBLIC_URL", err)
+	}
+	if cfg.GatewaySessionKey == nil {
+		slog.Warn("GATEWAY_SESSION_KEY not set; using a random key, sessions end when the gateway restarts")
+	}
+	if !cfg.GatewayCookieSecure {
+		slog.Warn("GATEWAY_COOKIE_SECURE=false, session cookies are sent over plain HTTP")
+	}
+
+	sqliteRepo, err := storage.NewSQLiteRepository(cfg.DBPath, cfg.SQLiteOptions())
+	if err != nil {
+		fatal("Failed to init db", err)
+	}
+	var repo storage.Repository = sqliteRepo
+	if cfg.CacheTTL > 0 && cfg.CacheMaxEntries > 0 {
+		repo = storage.NewCachedRepository(repo, storage.CacheOptions{
+			TTL:        cfg.CacheTTL,
+			MaxEntries: cfg.CacheMaxEntries,
+		})
+	}
+
+	// Same budget as the API, but kept in this process.
+	limiter := ratelimit.NewInMemoryLimiter(30*time.Second, 3)
+	limiter.StartJanitor(5 * time.Minute)
+
+	gw, err := gateway.New(repo, t, validate.NewService(repo, limiter), audit.NewRecorder(sqliteRepo), gateway.Options{
+		PublicURL:    publicURL,
+		SessionKey:   cfg.GatewaySessionKey,
+		SessionTTL:   cfg.GatewaySessionTTL,
+		CookieName:   cfg.GatewayCookieName,
+		CookieDomain: cfg.GatewayCookieDomain,
+		CookieSecure: cfg.GatewayCookieSecure,
+		AppName:      t.Issuer,
+	})
+	if err != nil {
+		fatal("Failed to init gateway", err)
+	}
+
+	srv := &http.Server{
+		Addr:              ":" + cfg.GatewayPort,
+		Handler:           http.MaxBytesHandler(gw.Handler(), cfg.HTTPMaxBodyBytes),
+		ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+		ReadTimeout:       cfg.HTTPReadTimeout,
+		WriteTimeout:      cfg.HTTPWriteTimeout,
+		IdleTimeout:       cfg.HTTPIdleTimeout,
+		MaxHeaderBytes:    cfg.HTTPMaxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	slog.Info("Gateway listening", "port", cfg.GatewayPort, "public_url", publicURL.String(), "tenant", t.ID)
+
+	stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-serveErr:
+		fatal("Gateway failed", err)
+	case <-stop.Done():
+	}
+	cancel()
+
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelShutdown()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("Graceful shutdown incomplete, closing remaining connections", "error", err)
+		srv.Close()
+	}
+	limiter.Close()
+	if err := sqliteRepo.Close(); err != nil {
+		slog.Error("Closing database failed", "error", err)
+	}
+	slog.Info("Gateway stopped")
+}
+
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
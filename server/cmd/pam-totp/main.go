@@ -0,0 +1,167 @@
+// Command pam-totp is a pam_exec(8) helper that asks for a TOTP code on
+// SSH and sudo logins. See the README's "PAM (SSH and sudo)" section.
+//
+//	auth required pam_exec.so expose_authtok quiet log=/var/log/pam-totp.log /usr/local/sbin/pam-totp -server https://totp.internal -api-key-file /etc/pam-totp/api-key
+//
+// Exit status 0 allows the login; anything else denies it.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"go-auth-totp/internal/auth/ratelimit"
+	"go-auth-totp/internal/auth/validate"
+	"go-auth-totp/internal/config"
+	"go-auth-totp/internal/logging"
+	"go-auth-totp/internal/pamexec"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+	"go-auth-totp/pkg/stepup"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+const (
+	exitAllow  = 0
+	exitDeny   = 1
+	exitConfig = 2
+)
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	fs := flag.NewFlagSet("pam-totp", flag.ContinueOnError)
+	server := fs.String("server", "", "TOTP server URL, e.g. https://totp.internal or https://totp.internal/t/acme")
+	apiKeyFile := fs.String("api-key-file", "", "file holding an API key with the validate scope")
+	dbPath := fs.String("db", "", "check codes against this database instead of -server")
+	envFile := fs.String("env-file", "", "with -db: file setting TOTP_MASTER_KEY, TENANTS_FILE and the like")
+	tenantID := fs.String("tenant", "", "with -db: tenant of the users (default: the default tenant)")
+	failMode := fs.String("fail", "closed", "when the server cannot answer: closed (deny) or open (allow)")
+	nullOK := fs.Bool("nullok", false, "allow users who have not enrolled")
+	cacheDir := fs.String("cache-dir", "/var/cache/pam-totp", "where successful logins are remembered")
+	offlineGrace := fs.Duration("offline-grace", 0, "allow users who logged in this recently while the server is unreachable (0 disables)")
+	timeout := fs.Duration("timeout", 5*time.Second, "time allowed to check a code")
+	user := fs.String("user", "", "user to check (default: PAM_USER)")
+	if err := fs.Parse(args); err != nil {
+		return exitConfig
+	}
+
+	logger := logging.New(os.Stderr, slog.LevelInfo)
+	slog.SetDefault(logger)
+
+	// Only the auth stack asks for a code; account and session pass.
+	if t := os.Getenv("PAM_TYPE"); t != "" && t != "auth" {
+		return exitAllow
+	}
+	if *user == "" {
+		*user = os.Getenv("PAM_USER")
+	}
+	if *user == "" {
+		slog.Error("No user: PAM_USER is not set")
+		return exitConfig
+	}
+	if *failMode != "closed" && *failMode != "open" {
+		slog.Error("Invalid -fail, want closed or open", "fail", *failMode)
+		return exitConfig
+	}
+
+	codes, closeCodes, err := checker(*server, *apiKeyFile, *dbPath, *envFile, *tenantID)
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		return exitConfig
+	}
+	defer closeCodes()
+
+	opts := pamexec.Options{Codes: codes, FailOpen: *failMode == "open", NullOK: *nullOK}
+	if *offlineGrace > 0 {
+		if opts.Cache, err = pamexec.NewCache(*cacheDir, *offlineGrace); err != nil {
+			slog.Warn("Offline cache disabled", "error", err)
+		}
+	}
+
+	code, err := pamexec.ReadCode(os.Stdin)
+	if err != nil {
+		slog.Warn("Login denied", "user", *user, "error", err)
+		return exitDeny
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	d := pamexec.Authenticate(ctx, opts, *user, code)
+	log := slog.Info
+	if !d.Allow || d.Reason != pamexec.ReasonValid {
+		log = slog.Warn
+	}
+	log("PAM login", "user", *user, "service", os.Getenv("PAM_SERVICE"), "rhost", os.Getenv("PAM_RHOST"),
+		"allow", d.Allow, "reason", d.Reason)
+	if d.Allow {
+		return exitAllow
+	}
+	return exitDeny
+}
+
+// checker returns the code checker for either -server or -db.
+func checker(server, apiKeyFile, dbPath, envFile, tenantID string) (stepup.CodeChecker, func(), error) {
+	switch {
+	case server != "" && dbPath != "":
+		return nil, nil, errors.New("-server and -db are exclusive")
+	case server != "":
+		var apiKey string
+		if apiKeyFile != "" {
+			b, err := os.ReadFile(apiKeyFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("read -api-key-file: %w", err)
+			}
+			apiKey = strings.TrimSpace(string(b))
+		}
+		return stepup.NewRemote(server, apiKey, ""), func() {}, nil
+	case dbPath != "":
+		return local(dbPath, envFile, tenantID)
+	}
+	return nil, nil, errors.New("one of -server or -db is required")
+}
+
+func local(dbPath, envFile, tenantID string) (stepup.CodeChecker, func(), error) {
+	// pam_exec runs us with an almost empty environment.
+	if envFile != "" {
+		if err := godotenv.Load(envFile); err != nil {
+			return nil, nil, fmt.Errorf("load -env-file: %w", err)
+		}
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, nil, err
+	}
+	reg, err := tenant.Load(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	t, ok := reg.Default()
+	if tenantID != "" {
+		t, ok = reg.Get(tenantID)
+	}
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown tenant %q (configured: %v)", tenantID, reg.IDs())
+	}
+	if t.EphemeralKey {
+		return nil, nil, errors.New("TOTP_MASTER_KEY must be set to check codes against the database")
+	}
+	repo, err := storage.NewSQLiteRepository(dbPath, cfg.SQLiteOptions())
+	if err != nil {
+		return nil, nil, err
+	}
+	limiter := ratelimit.NewInMemoryLimiter(30*time.Second, 3)
+	closeAll := func() {
+		limiter.Close()
+		repo.Close()
+	}
+	return &pamexec.Local{Codes: validate.NewService(repo, limiter), Tenant: t}, closeAll, nil
+}
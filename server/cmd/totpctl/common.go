@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-auth-totp/internal/config"
+	"go-auth-totp/internal/crypto"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+)
+
+// openRepository opens the configured database, or dbPath when set.
+func openRepository(cfg *config.Config, dbPath string) (*storage.SQLiteRepository, error) {
+	if dbPath == "" {
+		dbPath = cfg.DBPath
+	}
+	return storage.NewSQLiteRepository(dbPath, cfg.SQLiteOptions())
+}
+
+// loadTenant returns the configured tenant with the given ID.
+// Commands that touch secrets refuse to run with a throwaway key.
+func loadTenant(cfg *config.Config, id string) (*tenant.Tenant, error) {
+	reg, err := tenant.Load(cfg)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := reg.Get(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown tenant %q (configured: %v)", id, reg.IDs())
+	}
+	if t.EphemeralKey {
+		return nil, errors.New("TOTP_MASTER_KEY must be set for this command")
+	}
+	return t, nil
+}
+
+// cryptoFromHex builds an encryption service from a 32-byte hex key flag.
+func cryptoFromHex(flagName, keyHex string) (*crypto.AESGCMEncryption, error) {
+	key, err := hex.DecodeString(keyHex)
+	if err != nil {
+		return nil, fmt.Errorf("-%s: invalid hex: %w", flagName, err)
+	}
+	svc, err := crypto.NewAESGCMEncryption(key)
+	if err != nil {
+		return nil, fmt.Errorf("-%s: %w", flagName, err)
+	}
+	return svc, nil
+}
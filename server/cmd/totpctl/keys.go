@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"go-auth-totp/internal/audit"
+	"go-auth-totp/internal/auth/apikey"
+	"go-auth-totp/internal/config"
+	"go-auth-totp/internal/storage"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func runKeys(args []string) error {
+	sub := map[string]func([]string) error{
+		"create": runKeysCreate,
+		"list":   runKeysList,
+		"revoke": runKeysRevoke,
+	}
+	if len(args) == 0 || sub[args[0]] == nil {
+		return fmt.Errorf("usage: totpctl keys create|list|revoke [flags]")
+	}
+	return sub[args[0]](args[1:])
+}
+
+func runKeysCreate(args []string) error {
+	fs := flag.NewFlagSet("keys create", flag.ExitOnError)
+	dbPath := fs.String("db", "", "Path to the SQLite database (defaults to DB_PATH)")
+	tenantID := fs.String("tenant", storage.DefaultTenant, "Tenant the key acts for")
+	name := fs.String("name", "", "Human-readable name, e.g. the calling service")
+	scopes := fs.String("scopes", "", "Comma-separated scopes: enroll, validate, admin")
+	rateLimit := fs.Int("rate-limit", 0, "Requests per minute (0 uses API_KEY_RATE_LIMIT)")
+	signed := fs.Bool("signed", false, "Require HMAC-signed requests")
+	certSubject := fs.String("cert-subject", "", `Client certificate subject that authenticates as this key under mutual TLS, e.g. "CN=billing,O=Acme"`)
+	fs.Parse(args)
+
+	parsedScopes, err := apikey.ParseScopes(*scopes)
+	if err != nil {
+		return fmt.Errorf("-scopes: %w", err)
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	t, err := loadTenant(cfg, *tenantID)
+	if err != nil {
+		return err
+	}
+	repo, err := openRepository(cfg, *dbPath)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	issued, err := apikey.Issue(context.Background(), repo, t, apikey.IssueOptions{
+		Name:        *name,
+		Scopes:      parsedScopes,
+		RateLimit:   *rateLimit,
+		Signed:      *signed,
+		CertSubject: *certSubject,
+	})
+	if err != nil {
+		return err
+	}
+	audit.NewRecorder(repo).RecordActor(storage.WithTenant(context.Background(), t.ID), auditActor, audit.Event{
+		Type:       audit.EventAPIKeyCreated,
+		Credential: audit.CredentialAPIKey,
+		Outcome:    audit.OutcomeSuccess,
+		Detail:     "key " + issued.Key.ID,
+	})
+
+	fmt.Fprintf(os.Stderr, "Created key %s for tenant %s. It is shown only once:\n", issued.Key.ID, t.ID)
+	fmt.Printf("api_key=%s\n", issued.Token)
+	if issued.SigningSecret != nil {
+		fmt.Printf("signing_secret=%s\n", hex.EncodeToString(issued.SigningSecret))
+	}
+	return nil
+}
+
+func runKeysList(args []string) error {
+	fs := flag.NewFlagSet("keys list", flag.ExitOnError)
+	dbPath := fs.String("db", "", "Path to the SQLite database (defaults to DB_PATH)")
+	tenantID := fs.String("tenant", "", "Only list keys of this tenant")
+	fs.Parse(args)
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	repo, err := openRepository(cfg, *dbPath)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	keys, err := repo.ListAPIKeys(context.Background(), *tenantID)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTENANT\tNAME\tSCOPES\tRATE/MIN\tSIGNED\tCERT SUBJECT\tCREATED\tREVOKED")
+	for _, k := range keys {
+		rate, certSubject, revoked := "default", "-", "-"
+		if k.CertSubject != "" {
+			certSubject = k.CertSubject
+		}
+		if k.RateLimit > 0 {
+			rate = fmt.Sprint(k.RateLimit)
+		}
+		if k.Revoked() {
+			revoked = k.RevokedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%v\t%s\t%s\t%s\n", k.ID, k.TenantID, k.Name,
+			strings.Join(k.Scopes, ","), rate, k.SigningSecret != "", certSubject, k.CreatedAt.Format(time.RFC3339), revoked)
+	}
+	return tw.Flush()
+}
+
+func runKeysRevoke(args []string) error {
+	fs := flag.NewFlagSet("keys revoke", flag.ExitOnError)
+	dbPath := fs.String("db", "", "Path to the SQLite database (defaults to DB_PATH)")
+	id := fs.String("id", "", "ID of the key to revoke (the part after tk_)")
+	fs.Parse(args)
+	if *id == "" {
+		return fmt.Errorf("-id is required")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	repo, err := openRepository(cfg, *dbPath)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	key, err := repo.GetAPIKey(context.Background(), *id)
+	if err != nil {
+		return err
+	}
+	if err := repo.RevokeAPIKey(context.Background(), *id, time.Now()); err != nil {
+		return err
+	}
+	audit.NewRecorder(repo).RecordActor(storage.WithTenant(context.Background(), key.TenantID), auditActor, audit.Event{
+		Type:       audit.EventAPIKeyRevoked,
+		Credential: audit.CredentialAPIKey,
+		Outcome:    audit.OutcomeSuccess,
+		Detail:     "key " + *id,
+	})
+	fmt.Fprintf(os.Stderr, "Revoked key %s\n", *id)
+	return nil
+}
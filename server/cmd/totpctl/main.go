@@ -0,0 +1,56 @@
+// Command totpctl is the admin CLI for the TOTP backend.
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+type command struct {
+	summary string
+	run     func(args []string) error
+}
+
+var commands = map[string]command{
+	"migrate":  {"Apply pending database migrations", runMigrate},
+	"backup":   {"Write an online backup of the database", runBackup},
+	"export":   {"Export users as JSON Lines", runExport},
+	"import":   {"Import users from a JSON Lines export", runImport},
+	"keys":     {"Create, list or revoke API keys", runKeys},
+	"audit":    {"Export or verify the audit log", runAudit},
+	"webhooks": {"Add, list or remove webhook endpoints", runWebhooks},
+	"password": {"Set or clear a user's static RADIUS password", runPassword},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: totpctl <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].summary)
+	}
+}
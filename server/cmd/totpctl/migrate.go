@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go-auth-totp/internal/config"
+	"go-auth-totp/internal/storage"
+)
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dbPath := fs.String("db", "", "Path to the SQLite database (defaults to DB_PATH)")
+	dryRun := fs.Bool("dry-run", false, "Print pending migrations without applying them")
+	fs.Parse(args)
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	if *dbPath == "" {
+		*dbPath = cfg.DBPath
+	}
+
+	db, err := storage.OpenSQLite(*dbPath, cfg.SQLiteOptions())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := storage.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	current, err := migrator.CurrentVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Database %s at version %d (binary supports %d)\n", *dbPath, current, migrator.Latest())
+
+	migrations, err := migrator.Migrate(*dryRun)
+	for _, m := range migrations {
+		if *dryRun {
+			fmt.Printf("-- pending %04d_%s\n%s\n", m.Version, m.Name, m.SQL)
+		} else {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(migrations) == 0 {
+		fmt.Println("Nothing to do.")
+	}
+	return nil
+}
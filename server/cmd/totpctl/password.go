@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"go-auth-totp/internal/audit"
+	"go-auth-totp/internal/auth/account"
+	"go-auth-totp/internal/config"
+	"go-auth-totp/internal/storage"
+	"io"
+	"os"
+	"strings"
+)
+
+func runPassword(args []string) error {
+	sub := map[string]func([]string) error{
+		"set":   func(args []string) error { return runPasswordChange("set", args) },
+		"clear": func(args []string) error { return runPasswordChange("clear", args) },
+	}
+	if len(args) == 0 || sub[args[0]] == nil {
+		return fmt.Errorf("usage: totpctl password set|clear -user <id> [flags]")
+	}
+	return sub[args[0]](args[1:])
+}
+
+// runPasswordChange sets the user's static password, read from the first
+// line of standard input so that it stays out of the shell history, or
+// clears it.
+func runPasswordChange(action string, args []string) error {
+	fs := flag.NewFlagSet("password "+action, flag.ExitOnError)
+	dbPath := fs.String("db", "", "Path to the SQLite database (defaults to DB_PATH)")
+	tenantID := fs.String("tenant", storage.DefaultTenant, "Tenant of the user")
+	userID := fs.String("user", "", "ID of the user")
+	fs.Parse(args)
+	if *userID == "" {
+		return fmt.Errorf("-user is required")
+	}
+
+	var staticPassword string
+	if action == "set" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("read password: %w", err)
+		}
+		if staticPassword = strings.TrimRight(line, "\r\n"); staticPassword == "" {
+			return fmt.Errorf("no password on standard input")
+		}
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	t, err := loadTenant(cfg, *tenantID)
+	if err != nil {
+		return err
+	}
+	repo, err := openRepository(cfg, *dbPath)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	accounts := account.NewService(repo, nil, account.Options{})
+	if err := accounts.SetStaticPassword(context.Background(), t, *userID, staticPassword); err != nil {
+		return err
+	}
+	audit.NewRecorder(repo).RecordActor(storage.WithTenant(context.Background(), t.ID), auditActor, audit.Event{
+		Type:       audit.EventPasswordChanged,
+		UserID:     *userID,
+		Credential: audit.CredentialPassword,
+		Outcome:    audit.OutcomeSuccess,
+		Detail:     action,
+	})
+	if action == "set" {
+		fmt.Fprintf(os.Stderr, "Set the static password of %s in tenant %s\n", *userID, t.ID)
+	} else {
+		fmt.Fprintf(os.Stderr, "Cleared the static password of %s in tenant %s\n", *userID, t.ID)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go-auth-totp/internal/config"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/transfer"
+	"io"
+	"os"
+)
+
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dbPath := fs.String("db", "", "Path to the SQLite database (defaults to DB_PATH)")
+	out := fs.String("out", "", "Destination file for the backup (must not exist)")
+	fs.Parse(args)
+	if *out == "" {
+		return fmt.Errorf("-out is required")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	if *dbPath == "" {
+		*dbPath = cfg.DBPath
+	}
+	// Open without the repository constructor: a backup must copy the
+	// database as it is, never migrate it first.
+	db, err := storage.OpenSQLite(*dbPath, cfg.SQLiteOptions())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := storage.BackupSQLite(context.Background(), db, *out); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Backup written to %s\n", *out)
+	return nil
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dbPath := fs.String("db", "", "Path to the SQLite database (defaults to DB_PATH)")
+	out := fs.String("out", "-", "Output file, - for stdout")
+	tenantID := fs.String("tenant", storage.DefaultTenant, "Tenant whose users are exported")
+	targetKey := fs.String("target-key", "", "Hex master key of the target deployment; secrets are re-wrapped for it")
+	fs.Parse(args)
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	repo, err := openRepository(cfg, *dbPath)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	var rw *transfer.Rewrapper
+	if *targetKey != "" {
+		local, err := loadTenant(cfg, *tenantID)
+		if err != nil {
+			return err
+		}
+		target, err := cryptoFromHex("target-key", *targetKey)
+		if err != nil {
+			return err
+		}
+		rw = &transfer.Rewrapper{From: local.Crypto, To: target}
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	ctx := storage.WithTenant(context.Background(), *tenantID)
+	n, err := transfer.Export(ctx, repo, w, rw)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d users\n", n)
+	return nil
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dbPath := fs.String("db", "", "Path to the SQLite database (defaults to DB_PATH)")
+	in := fs.String("in", "-", "Export file, - for stdin")
+	tenantID := fs.String("tenant", storage.DefaultTenant, "Tenant to import the users into")
+	sourceKey := fs.String("source-key", "", "Hex master key the export was written with, if different from ours")
+	dryRun := fs.Bool("dry-run", false, "Report what would be imported without writing")
+	fs.Parse(args)
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	local, err := loadTenant(cfg, *tenantID)
+	if err != nil {
+		return err
+	}
+	repo, err := openRepository(cfg, *dbPath)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	opts := transfer.ImportOptions{Crypto: local.Crypto, DryRun: *dryRun}
+	if *sourceKey != "" {
+		source, err := cryptoFromHex("source-key", *sourceKey)
+		if err != nil {
+			return err
+		}
+		opts.Rewrap = &transfer.Rewrapper{From: source, To: local.Crypto}
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	ctx := storage.WithTenant(context.Background(), *tenantID)
+	result, err := transfer.Import(ctx, repo, r, opts)
+	if result != nil {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+	}
+	if err != nil {
+		return err
+	}
+	if result.Conflicts > 0 || result.Failed > 0 {
+		return fmt.Errorf("%d conflicts, %d failed records", result.Conflicts, result.Failed)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"go-auth-totp/internal/config"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/webhook"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func runWebhooks(args []string) error {
+	sub := map[string]func([]string) error{
+		"add":    runWebhooksAdd,
+		"list":   runWebhooksList,
+		"remove": runWebhooksRemove,
+	}
+	if len(args) == 0 || sub[args[0]] == nil {
+		return fmt.Errorf("usage: totpctl webhooks add|list|remove [flags]")
+	}
+	return sub[args[0]](args[1:])
+}
+
+func runWebhooksAdd(args []string) error {
+	fs := flag.NewFlagSet("webhooks add", flag.ExitOnError)
+	dbPath := fs.String("db", "", "Path to the SQLite database (defaults to DB_PATH)")
+	tenantID := fs.String("tenant", storage.DefaultTenant, "Tenant whose events are sent")
+	url := fs.String("url", "", "Endpoint URL (http or https)")
+	events := fs.String("events", "*", "Comma-separated events: totp.enabled, totp.disabled, recovery_code.used, recovery_codes.low, or * for all")
+	fs.Parse(args)
+
+	parsedEvents, err := webhook.ParseEvents(*events)
+	if err != nil {
+		return fmt.Errorf("-events: %w", err)
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	t, err := loadTenant(cfg, *tenantID)
+	if err != nil {
+		return err
+	}
+	repo, err := openRepository(cfg, *dbPath)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	reg, err := webhook.Register(context.Background(), repo, t, *url, parsedEvents)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Added webhook %s for tenant %s. The signing secret is shown only once:\n", reg.Endpoint.ID, t.ID)
+	fmt.Printf("signing_secret=%s\n", hex.EncodeToString(reg.Secret))
+	return nil
+}
+
+func runWebhooksList(args []string) error {
+	fs := flag.NewFlagSet("webhooks list", flag.ExitOnError)
+	dbPath := fs.String("db", "", "Path to the SQLite database (defaults to DB_PATH)")
+	tenantID := fs.String("tenant", "", "Only list webhooks of this tenant")
+	fs.Parse(args)
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	repo, err := openRepository(cfg, *dbPath)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	endpoints, err := repo.ListWebhookEndpoints(context.Background(), *tenantID)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTENANT\tURL\tEVENTS\tCREATED")
+	for _, e := range endpoints {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", e.ID, e.TenantID, e.URL, strings.Join(e.Events, ","),
+			e.CreatedAt.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+func runWebhooksRemove(args []string) error {
+	fs := flag.NewFlagSet("webhooks remove", flag.ExitOnError)
+	dbPath := fs.String("db", "", "Path to the SQLite database (defaults to DB_PATH)")
+	id := fs.String("id", "", "ID of the webhook to remove")
+	fs.Parse(args)
+	if *id == "" {
+		return fmt.Errorf("-id is required")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	repo, err := openRepository(cfg, *dbPath)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	if err := repo.DeleteWebhookEndpoint(context.Background(), *id); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Removed webhook %s; its pending deliveries will be dead-lettered\n", *id)
+	return nil
+}
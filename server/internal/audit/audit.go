@@ -0,0 +1,246 @@
+// Package audit records security-relevant events (enrollments, code
+// checks, recovery code use, API key and admin actions) in the
+// hash-chained audit log kept by storage.AuditStore.
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-auth-totp/internal/auth/apikey"
+	"go-auth-totp/internal/logging"
+	"go-auth-totp/internal/storage"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	EventEnroll          = "enroll"
+	EventVerify          = "verify"
+	EventValidate        = "validate"
+	EventRecover         = "recover"
+	EventUserDisabled    = "user_disabled"
+	EventUserDeleted     = "user_deleted"
+	EventAPIAuth         = "api_auth"
+	EventAPIKeyCreated   = "api_key_created"
+	EventAPIKeyRevoked   = "api_key_revoked"
+	EventDeviceTrusted   = "device_trusted"
+	EventDeviceCheck     = "device_check"
+	EventDeviceRevoked   = "device_revoked"
+	EventPasswordChanged = "static_password_changed"
+)
+
+// Credentials an event can be about.
+const (
+	CredentialTOTP         = "totp"
+	CredentialRecoveryCode = "recovery_code"
+	CredentialAPIKey       = "api_key"
+	CredentialDevice       = "device"
+	CredentialPassword     = "static_password"
+)
+
+// Outcomes.
+const (
+	OutcomeSuccess     = "success"
+	OutcomeInvalidCode = "invalid_code"
+	OutcomeRateLimited = "rate_limited"
+	OutcomeNotEnabled  = "not_enabled"
+	OutcomeDenied      = "denied"
+	OutcomeError       = "error"
+)
+
+// ActorAnonymous is the actor of requests made without an API key.
+const ActorAnonymous = "anonymous"
+
+// maxUserAgent bounds the stored User-Agent, which callers control.
+const maxUserAgent = 256
+
+// RejectionWindow is how long the rejections of one key for one reason
+// share a single audit event.
+const RejectionWindow = time.Minute
+
+// Event is what callers describe; the Recorder adds who, where and when.
+type Event struct {
+	Type       string
+	UserID     string
+	Credential string
+	Outcome    string
+	// Detail is a short note, e.g. the device label or the RADIUS
+	// client. It must never contain codes, secrets or keys.
+	Detail string
+}
+
+// Recorder appends events to an AuditStore. A nil *Recorder records
+// nothing.
+type Recorder struct {
+	store storage.AuditStore
+
+	mu         sync.Mutex
+	rejections map[rejectionKey]*rejectionWindow
+	swept      time.Time
+}
+
+type rejectionKey struct{ tenantID, actor, reason string }
+
+// rejectionWindow counts the rejections left out since the last one
+// recorded, at start.
+type rejectionWindow struct {
+	start      time.Time
+	suppressed int
+}
+
+// NewRecorder returns a Recorder writing to store.
+func NewRecorder(store storage.AuditStore) *Recorder {
+	return &Recorder{store: store}
+}
+
+// Record appends e for the HTTP request r, under the request's tenant.
+// The actor is the caller's API key, if any. Failures are logged, not
+// returned: the request has already been handled.
+func (rec *Recorder) Record(r *http.Request, e Event) {
+	if rec == nil {
+		return
+	}
+	rec.RecordRemote(r.Context(), Actor(r.Context()), clientIP(r), r.UserAgent(), e)
+}
+
+// RecordRemote appends e for a call that did not come over HTTP, such as
+// a gRPC call, from the client at ip.
+func (rec *Recorder) RecordRemote(ctx context.Context, actor, ip, userAgent string, e Event) {
+	if rec == nil {
+		return
+	}
+	if len(userAgent) > maxUserAgent {
+		userAgent = userAgent[:maxUserAgent]
+	}
+	rec.append(ctx, &storage.AuditEvent{
+		Actor:     actor,
+		IP:        ip,
+		UserAgent: userAgent,
+	}, e)
+}
+
+// RecordRejection appends an api_auth event for the HTTP request r, whose
+// API key was refused with err (see apikey.Authenticator). The tenant is
+// the key's, or r's for keys that do not exist.
+func (rec *Recorder) RecordRejection(r *http.Request, err error) {
+	if rec == nil {
+		return
+	}
+	rec.RecordRemoteRejection(r.Context(), clientIP(r), r.UserAgent(), err)
+}
+
+// RecordRemoteRejection is RecordRejection for a call that did not come
+// over HTTP. So that callers without a valid key cannot flood the chain,
+// only the first rejection of a key for a reason in each RejectionWindow
+// is appended; the next event appended for them says how many were left
+// out. Keys that do not exist are all rejections of the anonymous actor.
+func (rec *Recorder) RecordRemoteRejection(ctx context.Context, ip, userAgent string, err error) {
+	if rec == nil {
+		return
+	}
+	actor := ActorAnonymous
+	var ke *apikey.KeyError
+	if errors.As(err, &ke) {
+		actor = "key:" + ke.KeyID
+		ctx = storage.WithTenant(ctx, ke.TenantID)
+	}
+	tenantID, terr := storage.TenantFromContext(ctx)
+	if terr != nil {
+		slog.ErrorContext(ctx, "Audit event not recorded", "type", EventAPIAuth, "error", terr)
+		return
+	}
+	reason := apikey.RejectReason(err)
+	suppressed, ok := rec.admitRejection(rejectionKey{tenantID, actor, reason}, time.Now())
+	if !ok {
+		return
+	}
+
+	outcome := OutcomeDenied
+	if reason == apikey.RejectRateLimited {
+		outcome = OutcomeRateLimited
+	}
+	detail := reason
+	if suppressed > 0 {
+		detail = fmt.Sprintf("%s (%d more not recorded)", reason, suppressed)
+	}
+	rec.RecordRemote(ctx, actor, ip, userAgent, Event{Type: EventAPIAuth, Credential: CredentialAPIKey, Outcome: outcome, Detail: detail})
+}
+
+// admitRejection reports whether a rejection for k opens a new window,
+// and how many rejections the previous window left out.
+func (rec *Recorder) admitRejection(k rejectionKey, now time.Time) (suppressed int, ok bool) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.rejections == nil {
+		rec.rejections = make(map[rejectionKey]*rejectionWindow)
+	}
+	if now.Sub(rec.swept) > RejectionWindow {
+		// Windows with nothing left to report are no longer needed.
+		for k, w := range rec.rejections {
+			if w.suppressed == 0 && now.Sub(w.start) >= RejectionWindow {
+				delete(rec.rejections, k)
+			}
+		}
+		rec.swept = now
+	}
+	if w, seen := rec.rejections[k]; seen {
+		if now.Sub(w.start) < RejectionWindow {
+			w.suppressed++
+			return 0, false
+		}
+		suppressed = w.suppressed
+	}
+	rec.rejections[k] = &rejectionWindow{start: now}
+	return suppressed, true
+}
+
+// Actor names the caller of a request: its API key, if any.
+func Actor(ctx context.Context) string {
+	if p, ok := apikey.FromContext(ctx); ok {
+		return "key:" + p.KeyID
+	}
+	return ActorAnonymous
+}
+
+// RecordActor appends e on behalf of actor outside of an HTTP request,
+// e.g. for totpctl. The tenant comes from ctx.
+func (rec *Recorder) RecordActor(ctx context.Context, actor string, e Event) {
+	if rec == nil {
+		return
+	}
+	rec.append(ctx, &storage.AuditEvent{Actor: actor}, e)
+}
+
+// List returns the events matching q, for the query endpoint.
+func (rec *Recorder) List(ctx context.Context, q storage.AuditQuery) ([]storage.AuditEvent, error) {
+	return rec.store.ListAuditEvents(ctx, q)
+}
+
+func (rec *Recorder) append(ctx context.Context, ae *storage.AuditEvent, e Event) {
+	ae.Type = e.Type
+	ae.UserID = e.UserID
+	ae.Credential = e.Credential
+	ae.Outcome = e.Outcome
+	ae.Detail = e.Detail
+	ae.RequestID = logging.RequestID(ctx)
+	// A canceled request must still leave its trace.
+	if err := rec.store.AppendAuditEvent(context.WithoutCancel(ctx), ae); err != nil {
+		slog.ErrorContext(ctx, "Audit event not recorded", "type", e.Type, "user_id", e.UserID, "error", err)
+	}
+}
+
+// clientIP is the host part of the connection's remote address. Proxy
+// headers are ignored: they are set by the client unless a trusted proxy
+// rewrites them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
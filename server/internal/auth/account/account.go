@@ -0,0 +1,249 @@
+// Package account enrolls users, enables TOTP on their first code and
+// redeems recovery codes. It is what /enroll, /verify and /recover do,
+// shared with the gRPC API so both apply the same rate limit, concurrency
+// handling and webhooks. Code checks of enrolled users are in package
+// validate.
+package account
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-auth-totp/internal/auth/enroll"
+	"go-auth-totp/internal/auth/password"
+	"go-auth-totp/internal/auth/ratelimit"
+	"go-auth-totp/internal/auth/recovery"
+	"go-auth-totp/internal/auth/validate"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+	"go-auth-totp/internal/webhook"
+	"log/slog"
+	"time"
+)
+
+// The errors shared with validate, so callers map both the same way.
+var (
+	ErrRateLimited = validate.ErrRateLimited
+	ErrNotEnabled  = validate.ErrNotEnabled
+	ErrInvalidCode = validate.ErrInvalidCode
+	ErrDecrypt     = validate.ErrDecrypt
+	ErrVerify      = validate.ErrVerify
+)
+
+var (
+	// ErrEnroll wraps a failure to generate or encrypt a new secret.
+	ErrEnroll = errors.New("failed to generate secret")
+	// ErrAlreadyEnabled is returned by Verify for a user who finished
+	// enrolling; enrolling again resets the user.
+	ErrAlreadyEnabled = errors.New("totp already enabled")
+)
+
+// maxSaveAttempts bounds the optimistic-concurrency retry loop in update.
+const maxSaveAttempts = 3
+
+// Options configure a Service.
+type Options struct {
+	Recovery *recovery.Service
+	// Webhooks queues events for webhook endpoints; nil disables them.
+	Webhooks *webhook.Notifier
+	// LowRecoveryCodes is the number of remaining recovery codes at or
+	// below which a recovery also sends recovery_codes.low.
+	LowRecoveryCodes int
+}
+
+// Service manages users in a repository.
+type Service struct {
+	repo    storage.Repository
+	limiter ratelimit.Limiter
+	opts    Options
+}
+
+// NewService returns a Service storing users in repo.
+func NewService(repo storage.Repository, limiter ratelimit.Limiter, opts Options) *Service {
+	if opts.Recovery == nil {
+		opts.Recovery = recovery.NewService()
+	}
+	return &Service{repo: repo, limiter: limiter, opts: opts}
+}
+
+// Enroll generates a new secret and recovery codes for userID of tenant t
+// and stores them disabled until Verify. Enrolling an existing user
+// replaces its secret and codes.
+func (s *Service) Enroll(ctx context.Context, t *tenant.Tenant, userID string) (*enroll.EnrollmentResponse, error) {
+	ctx = storage.WithTenant(ctx, t.ID)
+	resp, err := t.Enroll.Enroll(userID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEnroll, err)
+	}
+
+	err = s.update(ctx, userID, true, func(user *storage.User) ([]webhook.Event, error) {
+		// Re-enrolling an enabled user turns 2FA off until the new secret
+		// is verified.
+		var events []webhook.Event
+		if user.Enabled {
+			events = append(events, webhook.Event{Type: webhook.EventTOTPDisabled, UserID: userID})
+		}
+		user.EncryptedSecret = resp.EncryptedBlob
+		user.RecoveryCodes = storage.NewRecoveryCodes(resp.HashedCodes)
+		user.Enabled = false // IMPORTANT: Not enabled until verified
+		user.EnabledAt = time.Time{}
+		return events, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Verify checks the first code of userID and enables TOTP. Besides the
+// errors above it returns the repository's errors.
+func (s *Service) Verify(ctx context.Context, t *tenant.Tenant, userID, code string) error {
+	ctx = storage.WithTenant(ctx, t.ID)
+	if !s.limiter.Allow(validate.LimiterKey(t, userID)) {
+		return ErrRateLimited
+	}
+
+	// Load, verify and enable in one optimistic update so a concurrent
+	// request for the same user cannot be silently overwritten.
+	err := s.update(ctx, userID, false, func(user *storage.User) ([]webhook.Event, error) {
+		if user.Enabled {
+			return nil, ErrAlreadyEnabled
+		}
+		secret, err := t.Crypto.Decrypt(user.EncryptedSecret)
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		valid, err := t.Verifier.Verify(secret, code)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrVerify, err)
+		}
+		if !valid {
+			return nil, ErrInvalidCode
+		}
+		user.Enabled = true
+		user.EnabledAt = time.Now().UTC()
+		return []webhook.Event{{Type: webhook.EventTOTPEnabled, UserID: userID}}, nil
+	})
+	if errors.Is(err, ErrInvalidCode) {
+		s.recordAttempt(ctx, userID, false)
+	}
+	if err != nil {
+		return err
+	}
+	s.recordAttempt(ctx, userID, true)
+	return nil
+}
+
+// Recovery is a redeemed recovery code.
+type Recovery struct {
+	// Index is the position of the code among the user's codes.
+	Index int
+	// Remaining counts the codes still unused.
+	Remaining int
+}
+
+// Recover spends one of userID's recovery codes. Besides the errors above
+// it returns the repository's errors.
+func (s *Service) Recover(ctx context.Context, t *tenant.Tenant, userID, code string) (*Recovery, error) {
+	ctx = storage.WithTenant(ctx, t.ID)
+	if !s.limiter.Allow(validate.LimiterKey(t, userID)) {
+		return nil, ErrRateLimited
+	}
+
+	// Consuming the code is a read-modify-write: on a version conflict the
+	// user is reloaded, so two requests cannot both spend the same code.
+	var rec Recovery
+	err := s.update(ctx, userID, false, func(user *storage.User) ([]webhook.Event, error) {
+		if !user.Enabled {
+			return nil, ErrNotEnabled
+		}
+		for i, c := range user.RecoveryCodes {
+			if !c.Used() && s.opts.Recovery.Matches(code, c.Hash) {
+				// Kept for the audit trail, never accepted again.
+				user.RecoveryCodes[i].UsedAt = time.Now().UTC()
+				rec = Recovery{Index: i, Remaining: user.RemainingRecoveryCodes()}
+				data := map[string]any{"remaining": rec.Remaining}
+				events := []webhook.Event{{Type: webhook.EventRecoveryCodeUsed, UserID: userID, Data: data}}
+				if rec.Remaining <= s.opts.LowRecoveryCodes {
+					events = append(events, webhook.Event{Type: webhook.EventRecoveryCodesLow, UserID: userID, Data: data})
+				}
+				return events, nil
+			}
+		}
+		return nil, ErrInvalidCode
+	})
+	if errors.Is(err, ErrInvalidCode) {
+		s.recordAttempt(ctx, userID, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.recordAttempt(ctx, userID, true)
+	return &rec, nil
+}
+
+// Get returns userID of tenant t.
+func (s *Service) Get(ctx context.Context, t *tenant.Tenant, userID string) (*storage.User, error) {
+	return s.repo.GetUser(storage.WithTenant(ctx, t.ID), userID)
+}
+
+// SetStaticPassword stores the hash of userID's static password, which
+// RADIUS clients with static_password check along with the code. An empty
+// staticPassword removes it.
+func (s *Service) SetStaticPassword(ctx context.Context, t *tenant.Tenant, userID, staticPassword string) error {
+	var hash string
+	if staticPassword != "" {
+		var err error
+		if hash, err = password.Hash(staticPassword); err != nil {
+			return err
+		}
+	}
+	return s.update(storage.WithTenant(ctx, t.ID), userID, false, func(user *storage.User) ([]webhook.Event, error) {
+		user.StaticPasswordHash = hash
+		return nil, nil
+	})
+}
+
+// update loads a user, applies mutate and saves the result together with
+// the webhook events mutate returns. If another request saved the same
+// user in between (version mismatch, or a concurrent insert when create is
+// set), the user is reloaded and mutate runs again against the fresh
+// state. With create set, a missing user is passed to mutate as a new
+// record instead of failing with ErrUserNotFound.
+func (s *Service) update(ctx context.Context, id string, create bool, mutate func(*storage.User) ([]webhook.Event, error)) error {
+	var err error
+	for attempt := 0; attempt < maxSaveAttempts; attempt++ {
+		var user *storage.User
+		var events []webhook.Event
+		var saveCtx context.Context
+		user, err = s.repo.GetUser(ctx, id)
+		if errors.Is(err, storage.ErrUserNotFound) && create {
+			user, err = &storage.User{ID: id}, nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if events, err = mutate(user); err != nil {
+			return err
+		}
+		if saveCtx, err = s.opts.Webhooks.WithEvents(ctx, events...); err != nil {
+			return err
+		}
+
+		err = s.repo.SaveUser(saveCtx, user)
+		if !errors.Is(err, storage.ErrVersionMismatch) && !errors.Is(err, storage.ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// recordAttempt updates the user's usage metadata after a code check.
+// Errors are logged rather than returned: the check already happened and
+// bookkeeping must not change its outcome.
+func (s *Service) recordAttempt(ctx context.Context, id string, success bool) {
+	if err := s.repo.RecordAttempt(ctx, id, success, time.Now()); err != nil {
+		slog.ErrorContext(ctx, "RecordAttempt failed", "user_id", id, "error", err)
+	}
+}
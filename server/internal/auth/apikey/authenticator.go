@@ -0,0 +1,325 @@
+package apikey
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"go-auth-totp/internal/auth/ratelimit"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+	"go-auth-totp/pkg/timeutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HeaderAPIKey carries the key. "Authorization: Bearer <key>" works too.
+const HeaderAPIKey = "X-API-Key"
+
+var (
+	ErrMissingKey       = errors.New("API key required")
+	ErrInvalidKey       = errors.New("invalid API key")
+	ErrRevokedKey       = errors.New("API key revoked")
+	ErrInvalidSignature = errors.New("invalid request signature")
+	ErrReplayedRequest  = errors.New("request nonce already used")
+	ErrRateLimited      = errors.New("API key rate limit exceeded")
+)
+
+// KeyError is a rejection of a key that exists: revoked, presented with
+// the wrong secret or signature, of an unconfigured tenant, or over its
+// rate limit. It names the key so that the rejection can be audited
+// against it.
+type KeyError struct {
+	KeyID    string
+	TenantID string
+	Err      error
+}
+
+func (e *KeyError) Error() string { return e.Err.Error() }
+
+func (e *KeyError) Unwrap() error { return e.Err }
+
+func rejectKey(key *storage.APIKey, err error) error {
+	return &KeyError{KeyID: key.ID, TenantID: key.TenantID, Err: err}
+}
+
+// Reasons a key was rejected, for metrics labels and audit details.
+const (
+	RejectMissingKey       = "missing_key"
+	RejectInvalidKey       = "invalid_key"
+	RejectRevokedKey       = "revoked_key"
+	RejectInvalidSignature = "invalid_signature"
+	RejectRateLimited      = "rate_limited"
+)
+
+// RejectReasons lists every reason RejectReason returns.
+var RejectReasons = []string{RejectMissingKey, RejectInvalidKey, RejectRevokedKey, RejectInvalidSignature, RejectRateLimited}
+
+// RejectReason classifies an Authenticator error.
+func RejectReason(err error) string {
+	switch {
+	case errors.Is(err, ErrMissingKey):
+		return RejectMissingKey
+	case errors.Is(err, ErrRevokedKey):
+		return RejectRevokedKey
+	case errors.Is(err, ErrInvalidSignature), errors.Is(err, ErrReplayedRequest):
+		return RejectInvalidSignature
+	case errors.Is(err, ErrRateLimited):
+		return RejectRateLimited
+	default:
+		return RejectInvalidKey
+	}
+}
+
+// ClientMessage returns the fixed message for a caller rejected with err.
+// The wrapped detail (key ID, tenant, certificate subject) is for the logs
+// only.
+func ClientMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrMissingKey):
+		return "API key required"
+	case errors.Is(err, ErrInvalidSignature), errors.Is(err, ErrReplayedRequest):
+		return "Invalid request signature"
+	default:
+		return "Invalid API key"
+	}
+}
+
+// Principal is the authenticated caller.
+type Principal struct {
+	KeyID    string
+	Name     string
+	TenantID string
+	Scopes   []Scope
+
+	rateLimit int // requests per minute, see Authenticator.Allow
+}
+
+// HasScope reports whether the principal may use endpoints of scope.
+func (p *Principal) HasScope(scope Scope) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// NewContext attaches p to ctx.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal attached by NewContext.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// Options configures an Authenticator.
+type Options struct {
+	// Required rejects requests without a key. When false they pass as
+	// anonymous, which is only meant for local development.
+	Required bool
+	// DefaultRateLimit is the requests per minute of keys without their own limit.
+	DefaultRateLimit int
+	// MaxSkew is how far a signed request's timestamp may be from now.
+	MaxSkew time.Duration
+	// Clock defaults to the real clock.
+	Clock timeutil.Clock
+}
+
+// Authenticator checks API keys, request signatures and per-key rate limits.
+type Authenticator struct {
+	store        storage.KeyStore
+	tenants      *tenant.Registry
+	required     bool
+	defaultLimit int
+	maxSkew      time.Duration
+	clock        timeutil.Clock
+	nonces       *nonceCache
+
+	mu       sync.Mutex
+	limiters map[int]*ratelimit.InMemoryLimiter // by requests per minute
+}
+
+// NewAuthenticator creates an Authenticator. Signing secrets are decrypted
+// with the key's tenant from tenants.
+func NewAuthenticator(store storage.KeyStore, tenants *tenant.Registry, opts Options) *Authenticator {
+	if opts.Clock == nil {
+		opts.Clock = timeutil.RealClock{}
+	}
+	if opts.MaxSkew <= 0 {
+		opts.MaxSkew = 5 * time.Minute
+	}
+	return &Authenticator{
+		store:        store,
+		tenants:      tenants,
+		required:     opts.Required,
+		defaultLimit: opts.DefaultRateLimit,
+		maxSkew:      opts.MaxSkew,
+		clock:        opts.Clock,
+		nonces:       newNonceCache(),
+		limiters:     make(map[int]*ratelimit.InMemoryLimiter),
+	}
+}
+
+// Required reports whether requests without a key are rejected.
+func (a *Authenticator) Required() bool {
+	return a.required
+}
+
+// Authenticate identifies the caller of r by the key it presents or, under
+// mutual TLS, by the verified client certificate bound to a key. A
+// presented key takes precedence over the certificate. It returns
+// ErrMissingKey when r carries neither; storage failures are returned as
+// they are.
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key, err := a.lookupKey(r)
+	if err != nil {
+		return nil, err
+	}
+	if key.Revoked() {
+		return nil, rejectKey(key, ErrRevokedKey)
+	}
+	t, ok := a.tenants.Get(key.TenantID)
+	if !ok {
+		return nil, rejectKey(key, fmt.Errorf("%w: tenant %s is not configured", ErrInvalidKey, key.TenantID))
+	}
+
+	if key.SigningSecret != "" {
+		signingSecret, err := t.Crypto.Decrypt(key.SigningSecret)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt signing secret of key %s: %w", key.ID, err)
+		}
+		if err := a.verifySignature(r, key.ID, signingSecret); err != nil {
+			return nil, rejectKey(key, err)
+		}
+	}
+
+	p := newPrincipal(key)
+	if !a.Allow(p) {
+		return nil, rejectKey(key, ErrRateLimited)
+	}
+	return p, nil
+}
+
+// AuthenticateToken identifies a caller that presents token outside an
+// HTTP request, such as in gRPC metadata. Keys that require signed
+// requests are refused, since a signature covers an HTTP request. Unlike
+// Authenticate it leaves the per-key rate limit to the caller (see Allow).
+func (a *Authenticator) AuthenticateToken(ctx context.Context, token string) (*Principal, error) {
+	if token == "" {
+		return nil, ErrMissingKey
+	}
+	key, err := a.keyByToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if key.Revoked() {
+		return nil, rejectKey(key, ErrRevokedKey)
+	}
+	if _, ok := a.tenants.Get(key.TenantID); !ok {
+		return nil, rejectKey(key, fmt.Errorf("%w: tenant %s is not configured", ErrInvalidKey, key.TenantID))
+	}
+	if key.SigningSecret != "" {
+		return nil, rejectKey(key, fmt.Errorf("%w: key %s requires signed HTTP requests", ErrInvalidSignature, key.ID))
+	}
+	return newPrincipal(key), nil
+}
+
+// Allow takes one request from p's per-key rate limit.
+func (a *Authenticator) Allow(p *Principal) bool {
+	return a.limiter(p.rateLimit).Allow(p.KeyID)
+}
+
+func newPrincipal(key *storage.APIKey) *Principal {
+	p := &Principal{KeyID: key.ID, Name: key.Name, TenantID: key.TenantID, rateLimit: key.RateLimit}
+	for _, s := range key.Scopes {
+		p.Scopes = append(p.Scopes, Scope(s))
+	}
+	return p
+}
+
+func (a *Authenticator) lookupKey(r *http.Request) (*storage.APIKey, error) {
+	if token := presentedKey(r); token != "" {
+		return a.keyByToken(r.Context(), token)
+	}
+
+	// Only certificates that chained to the configured client CA count;
+	// r.TLS.PeerCertificates alone are unverified.
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		subject := CertSubject(r.TLS.VerifiedChains[0][0])
+		key, err := a.store.GetAPIKeyByCertSubject(r.Context(), subject)
+		if errors.Is(err, storage.ErrKeyNotFound) {
+			return nil, fmt.Errorf("%w: client certificate %q is not bound to a key", ErrInvalidKey, subject)
+		}
+		return key, err
+	}
+	return nil, ErrMissingKey
+}
+
+func (a *Authenticator) keyByToken(ctx context.Context, token string) (*storage.APIKey, error) {
+	id, secret, ok := parseToken(token)
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+	key, err := a.store.GetAPIKey(ctx, id)
+	if errors.Is(err, storage.ErrKeyNotFound) {
+		return nil, ErrInvalidKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(key.SecretHash)) != 1 {
+		return nil, rejectKey(key, ErrInvalidKey)
+	}
+	return key, nil
+}
+
+// CertSubject is the form in which client certificate subjects are bound
+// to keys, e.g. "CN=billing,O=Acme".
+func CertSubject(cert *x509.Certificate) string {
+	return cert.Subject.String()
+}
+
+func presentedKey(r *http.Request) string {
+	if key := r.Header.Get(HeaderAPIKey); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if key, ok := strings.CutPrefix(auth, "Bearer "); ok {
+			return strings.TrimSpace(key)
+		}
+	}
+	return ""
+}
+
+// limiter returns the shared limiter for keys allowing perMinute requests
+// per minute, as a bucket of that size refilled evenly over the minute.
+func (a *Authenticator) limiter(perMinute int) ratelimit.Limiter {
+	if perMinute <= 0 {
+		perMinute = a.defaultLimit
+	}
+	if perMinute <= 0 {
+		return unlimited{}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	l, ok := a.limiters[perMinute]
+	if !ok {
+		l = ratelimit.NewInMemoryLimiter(time.Minute/time.Duration(perMinute), perMinute)
+		a.limiters[perMinute] = l
+	}
+	return l
+}
+
+type unlimited struct{}
+
+func (unlimited) Allow(string) bool { return true }
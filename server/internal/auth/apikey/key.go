@@ -0,0 +1,155 @@
+// Package apikey authenticates callers of the HTTP API.
+//
+// A key is presented as "tk_<id>_<secret>". The ID is stored in clear and
+// identifies the key; only a SHA-256 hash of the secret is stored. Keys
+// belong to one tenant, carry scopes and a rate limit, may require
+// HMAC-signed requests (see SignRequest), and may be bound to a mutual-TLS
+// client certificate.
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+	"strings"
+)
+
+// Scope grants access to a group of endpoints.
+type Scope string
+
+const (
+	// ScopeEnroll covers /enroll and /verify.
+	ScopeEnroll Scope = "enroll"
+	// ScopeValidate covers /validate and /recover.
+	ScopeValidate Scope = "validate"
+	// ScopeAdmin covers /admin/.
+	ScopeAdmin Scope = "admin"
+)
+
+var validScopes = map[Scope]bool{ScopeEnroll: true, ScopeValidate: true, ScopeAdmin: true}
+
+// ParseScopes parses a comma-separated scope list such as "enroll,validate".
+func ParseScopes(s string) ([]Scope, error) {
+	var scopes []Scope
+	seen := make(map[Scope]bool)
+	for _, part := range strings.Split(s, ",") {
+		scope := Scope(strings.TrimSpace(part))
+		if scope == "" {
+			continue
+		}
+		if !validScopes[scope] {
+			return nil, fmt.Errorf("unknown scope %q (want enroll, validate or admin)", scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return scopes, nil
+}
+
+const tokenPrefix = "tk_"
+
+// parseToken splits a presented key into its ID and secret.
+func parseToken(token string) (id, secret string, ok bool) {
+	rest, ok := strings.CutPrefix(token, tokenPrefix)
+	if !ok {
+		return "", "", false
+	}
+	id, secret, ok = strings.Cut(rest, "_")
+	return id, secret, ok && id != "" && secret != ""
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// IssueOptions describes a new key.
+type IssueOptions struct {
+	Name   string
+	Scopes []Scope
+	// RateLimit is requests per minute; zero uses the server default.
+	RateLimit int
+	// Signed requires every request made with the key to be HMAC-signed.
+	Signed bool
+	// CertSubject binds the key to a mutual-TLS client certificate subject
+	// (see CertSubject), so that certificate authenticates without the token.
+	CertSubject string
+}
+
+// Issued is a newly created key. Token and SigningSecret are only available
+// here; the store keeps a hash and an encrypted copy respectively.
+type Issued struct {
+	Key           *storage.APIKey
+	Token         string
+	SigningSecret []byte // nil unless IssueOptions.Signed
+}
+
+// Issue creates a key for t and saves it in store.
+func Issue(ctx context.Context, store storage.KeyStore, t *tenant.Tenant, opts IssueOptions) (*Issued, error) {
+	if opts.Name == "" {
+		return nil, errors.New("key name is required")
+	}
+	if len(opts.Scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	if opts.RateLimit < 0 {
+		return nil, errors.New("rate limit must not be negative")
+	}
+
+	idBytes, err := randomBytes(6)
+	if err != nil {
+		return nil, err
+	}
+	secretBytes, err := randomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(idBytes)
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+
+	key := &storage.APIKey{
+		ID:          id,
+		TenantID:    t.ID,
+		Name:        opts.Name,
+		SecretHash:  hashSecret(secret),
+		RateLimit:   opts.RateLimit,
+		CertSubject: opts.CertSubject,
+	}
+	for _, s := range opts.Scopes {
+		key.Scopes = append(key.Scopes, string(s))
+	}
+
+	issued := &Issued{Key: key, Token: tokenPrefix + id + "_" + secret}
+	if opts.Signed {
+		if issued.SigningSecret, err = randomBytes(32); err != nil {
+			return nil, err
+		}
+		if key.SigningSecret, err = t.Crypto.Encrypt(issued.SigningSecret); err != nil {
+			return nil, fmt.Errorf("encrypt signing secret: %w", err)
+		}
+	}
+
+	if err := store.CreateAPIKey(ctx, key); err != nil {
+		return nil, err
+	}
+	return issued, nil
+}
@@ -0,0 +1,45 @@
+package apikey
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := ParseScopes(" validate,enroll,validate ")
+	if err != nil || len(scopes) != 2 || scopes[0] != ScopeValidate || scopes[1] != ScopeEnroll {
+		t.Fatalf("ParseScopes = %v, %v", scopes, err)
+	}
+	for _, bad := range []string{"", ",", "root", "enroll,root"} {
+		if _, err := ParseScopes(bad); err == nil {
+			t.Errorf("ParseScopes(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	// Secrets are base64url and may themselves contain underscores.
+	id, secret, ok := parseToken("tk_0a1b2c3d4e5f_ab_cd-ef")
+	if !ok || id != "0a1b2c3d4e5f" || secret != "ab_cd-ef" {
+		t.Fatalf("parseToken = %q, %q, %v", id, secret, ok)
+	}
+	for _, bad := range []string{"", "tk_", "tk_abc", "tk__secret", "tk_abc_", "xx_abc_secret"} {
+		if _, _, ok := parseToken(bad); ok {
+			t.Errorf("parseToken(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestNonceCacheExpires(t *testing.T) {
+	c := newNonceCache()
+	now := time.Unix(1000, 0)
+	if !c.add("n", now, time.Minute) {
+		t.Fatal("first use rejected")
+	}
+	if c.add("n", now.Add(30*time.Second), time.Minute) {
+		t.Fatal("reuse within TTL accepted")
+	}
+	if !c.add("n", now.Add(2*time.Minute), time.Minute) {
+		t.Fatal("reuse after TTL rejected")
+	}
+}
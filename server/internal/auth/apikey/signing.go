@@ -0,0 +1,148 @@
+package apikey
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers of a signed request.
+const (
+	HeaderTimestamp = "X-Timestamp" // Unix seconds
+	HeaderNonce     = "X-Nonce"     // unique per request, at most 64 characters
+	HeaderSignature = "X-Signature" // hex HMAC-SHA256, see signature
+)
+
+const (
+	// MaxSignedBody bounds the request body read to verify a signature.
+	MaxSignedBody = 1 << 20
+	maxNonceLen   = 64
+)
+
+// signature is HMAC-SHA256 over the method, request URI (path and query),
+// timestamp, nonce and the hex SHA-256 of the body, separated by newlines.
+func signature(secret []byte, method, uri, timestamp, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%x", method, uri, timestamp, nonce, bodyHash)
+	return mac.Sum(nil)
+}
+
+// SignRequest adds the signature headers to an outgoing request made with
+// a key that requires signing.
+func SignRequest(r *http.Request, secret []byte, now time.Time) error {
+	body, err := readBody(r, MaxSignedBody)
+	if err != nil {
+		return err
+	}
+	nonceBytes, err := randomBytes(16)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	nonce := hex.EncodeToString(nonceBytes)
+
+	r.Header.Set(HeaderTimestamp, timestamp)
+	r.Header.Set(HeaderNonce, nonce)
+	r.Header.Set(HeaderSignature, hex.EncodeToString(signature(secret, r.Method, r.URL.RequestURI(), timestamp, nonce, body)))
+	return nil
+}
+
+// readBody reads at most limit bytes of r's body and puts them back so
+// the handler can read the body again.
+func readBody(r *http.Request, limit int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("request body exceeds %d bytes", limit)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	return body, nil
+}
+
+// verifySignature checks the signature headers of r against secret.
+// Nonces are remembered per key until their timestamp can no longer pass
+// the skew check, so a captured request cannot be replayed.
+func (a *Authenticator) verifySignature(r *http.Request, keyID string, secret []byte) error {
+	timestamp := r.Header.Get(HeaderTimestamp)
+	nonce := r.Header.Get(HeaderNonce)
+	sig := r.Header.Get(HeaderSignature)
+	if timestamp == "" || nonce == "" || sig == "" {
+		return fmt.Errorf("%w: key requires %s, %s and %s", ErrInvalidSignature, HeaderTimestamp, HeaderNonce, HeaderSignature)
+	}
+	if len(nonce) > maxNonceLen {
+		return fmt.Errorf("%w: nonce too long", ErrInvalidSignature)
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: malformed timestamp", ErrInvalidSignature)
+	}
+	now := a.clock.Now()
+	skew := now.Sub(time.Unix(unix, 0))
+	if skew < -a.maxSkew || skew > a.maxSkew {
+		return fmt.Errorf("%w: timestamp outside the allowed window", ErrInvalidSignature)
+	}
+
+	body, err := readBody(r, MaxSignedBody)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, signature(secret, r.Method, r.URL.RequestURI(), timestamp, nonce, body)) {
+		return ErrInvalidSignature
+	}
+
+	// Only remember nonces of valid signatures, so unauthenticated callers
+	// cannot fill the cache.
+	if !a.nonces.add(keyID+":"+nonce, now, 2*a.maxSkew) {
+		return ErrReplayedRequest
+	}
+	return nil
+}
+
+// nonceCache remembers recently used nonces.
+type nonceCache struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time // nonce -> expiry
+	nextSweep time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{seen: make(map[string]time.Time)}
+}
+
+// add records nonce and reports whether it was unused.
+func (c *nonceCache) add(nonce string, now time.Time, ttl time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.After(c.nextSweep) {
+		for n, expiry := range c.seen {
+			if now.After(expiry) {
+				delete(c.seen, n)
+			}
+		}
+		c.nextSweep = now.Add(ttl)
+	}
+
+	if expiry, ok := c.seen[nonce]; ok && !now.After(expiry) {
+		return false
+	}
+	c.seen[nonce] = now.Add(ttl)
+	return true
+}
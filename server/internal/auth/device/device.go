@@ -0,0 +1,189 @@
+// Package device issues and checks "remember this device" tokens.
+//
+// After a successful /validate a user may trust the device they are on.
+// The device gets a token "td_<id>_<secret>"; like API keys, the ID is
+// stored in clear and only a SHA-256 hash of the secret is kept. Presenting
+// the token later lets the caller skip the TOTP prompt on that device until
+// it expires, is revoked, or the user's enrollment changes (see
+// storage.DeviceStore).
+package device
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/pkg/timeutil"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultTTL is how long a device stays trusted when no TTL is configured.
+const DefaultTTL = 30 * 24 * time.Hour
+
+// MaxLabelLength bounds a device label, in characters.
+const MaxLabelLength = 64
+
+var (
+	// ErrUntrusted is returned by Check for a token that is malformed,
+	// unknown, expired or belongs to another user.
+	ErrUntrusted = errors.New("device not trusted")
+	// ErrInvalidLabel is returned for an empty or overlong label.
+	ErrInvalidLabel = errors.New("device label must be 1 to 64 characters")
+)
+
+const tokenPrefix = "td_"
+
+// parseToken splits a presented token into its ID and secret.
+func parseToken(token string) (id, secret string, ok bool) {
+	rest, ok := strings.CutPrefix(token, tokenPrefix)
+	if !ok {
+		return "", "", false
+	}
+	id, secret, ok = strings.Cut(rest, "_")
+	return id, secret, ok && id != "" && secret != ""
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidLabel reports whether label can name a device.
+func ValidLabel(label string) bool {
+	n := utf8.RuneCountInString(label)
+	return strings.TrimSpace(label) != "" && n <= MaxLabelLength && utf8.ValidString(label)
+}
+
+// Service trusts, checks and revokes devices.
+type Service struct {
+	store storage.DeviceStore
+	ttl   time.Duration
+	clock timeutil.Clock
+}
+
+// NewService returns a Service keeping devices in store. A ttl of zero
+// means DefaultTTL.
+func NewService(store storage.DeviceStore, ttl time.Duration, clock timeutil.Clock) *Service {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	if clock == nil {
+		clock = timeutil.RealClock{}
+	}
+	return &Service{store: store, ttl: ttl, clock: clock}
+}
+
+// Issued is a newly trusted device. Token is only available here.
+type Issued struct {
+	Device *storage.TrustedDevice
+	Token  string
+}
+
+// Trust issues a token for a device of userID, who must have just passed a
+// TOTP check.
+func (s *Service) Trust(ctx context.Context, userID, label string) (*Issued, error) {
+	if !ValidLabel(label) {
+		return nil, ErrInvalidLabel
+	}
+	idBytes := make([]byte, 8)
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(idBytes)
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+
+	now := s.clock.Now().UTC()
+	d := &storage.TrustedDevice{
+		ID:        id,
+		UserID:    userID,
+		Label:     strings.TrimSpace(label),
+		TokenHash: hashSecret(secret),
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	}
+	if err := s.store.CreateTrustedDevice(ctx, d); err != nil {
+		return nil, err
+	}
+	return &Issued{Device: d, Token: tokenPrefix + id + "_" + secret}, nil
+}
+
+// Check returns the device token identifies if it is trusted for userID,
+// and records its use. Expired devices are removed.
+func (s *Service) Check(ctx context.Context, userID, token string) (*storage.TrustedDevice, error) {
+	id, secret, ok := parseToken(token)
+	if !ok {
+		return nil, ErrUntrusted
+	}
+	d, err := s.store.GetTrustedDevice(ctx, id)
+	if errors.Is(err, storage.ErrDeviceNotFound) {
+		return nil, ErrUntrusted
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(d.TokenHash)) != 1 || d.UserID != userID {
+		return nil, ErrUntrusted
+	}
+
+	now := s.clock.Now().UTC()
+	if d.Expired(now) {
+		if err := s.store.DeleteTrustedDevice(ctx, id); err != nil && !errors.Is(err, storage.ErrDeviceNotFound) {
+			return nil, err
+		}
+		return nil, ErrUntrusted
+	}
+	if err := s.store.TouchTrustedDevice(ctx, id, now); err != nil {
+		if errors.Is(err, storage.ErrDeviceNotFound) {
+			// Revoked since we read it.
+			return nil, ErrUntrusted
+		}
+		return nil, err
+	}
+	d.LastUsedAt = now
+	return d, nil
+}
+
+// List returns userID's devices that have not expired, oldest first.
+func (s *Service) List(ctx context.Context, userID string) ([]*storage.TrustedDevice, error) {
+	devices, err := s.store.ListTrustedDevices(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	now := s.clock.Now()
+	trusted := devices[:0]
+	for _, d := range devices {
+		if !d.Expired(now) {
+			trusted = append(trusted, d)
+		}
+	}
+	return trusted, nil
+}
+
+// Revoke stops trusting one of userID's devices. Devices of other users
+// are reported as storage.ErrDeviceNotFound.
+func (s *Service) Revoke(ctx context.Context, userID, id string) error {
+	d, err := s.store.GetTrustedDevice(ctx, id)
+	if err != nil {
+		return err
+	}
+	if d.UserID != userID {
+		return storage.ErrDeviceNotFound
+	}
+	return s.store.DeleteTrustedDevice(ctx, id)
+}
+
+// RevokeAll stops trusting all of userID's devices and returns how many
+// there were.
+func (s *Service) RevokeAll(ctx context.Context, userID string) (int, error) {
+	return s.store.DeleteTrustedDevices(ctx, userID)
+}
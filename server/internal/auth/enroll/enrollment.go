@@ -6,20 +6,30 @@ import (
 	"fmt"
 	"go-auth-totp/internal/auth/recovery"
 	"go-auth-totp/internal/crypto"
+	"go-auth-totp/pkg/totp"
 	"net/url"
+	"strconv"
 )
 
 // Service handles new TOTP enrollments.
 type Service struct {
 	issuer      string
+	policy      totp.Policy
 	crypto      crypto.CryptoService
 	recoverySvc *recovery.Service
 }
 
-// NewService creates a new enrollment service.
+// NewService creates a new enrollment service using totp.DefaultPolicy.
 func NewService(issuer string, cryptoService crypto.CryptoService) *Service {
+	return NewPolicyService(issuer, cryptoService, totp.DefaultPolicy())
+}
+
+// NewPolicyService creates an enrollment service whose otpauth URLs ask
+// authenticator apps for the digits and period of policy.
+func NewPolicyService(issuer string, cryptoService crypto.CryptoService, policy totp.Policy) *Service {
 	return &Service{
 		issuer:      issuer,
+		policy:      policy,
 		crypto:      cryptoService,
 		recoverySvc: recovery.NewService(),
 	}
@@ -63,8 +73,8 @@ func (s *Service) Enroll(accountName string) (*EnrollmentResponse, error) {
 	v.Set("secret", secretBase32)
 	v.Set("issuer", s.issuer)
 	v.Set("algorithm", "SHA1")
-	v.Set("digits", "6")
-	v.Set("period", "30")
+	v.Set("digits", strconv.Itoa(s.policy.Digits))
+	v.Set("period", strconv.FormatUint(s.policy.Period, 10))
 
 	// The label is "Issuer:Account"
 	label := fmt.Sprintf("%s:%s", s.issuer, accountName)
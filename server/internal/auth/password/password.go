@@ -0,0 +1,81 @@
+// Package password hashes users' static passwords. Unlike recovery codes
+// they are chosen by people and have little entropy, so they are stored
+// as salted PBKDF2-HMAC-SHA256 (RFC 8018) with a high iteration count.
+package password
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Iterations is the PBKDF2 work factor of new hashes.
+	Iterations = 600000
+	saltLen    = 16
+	keyLen     = sha256.Size
+	scheme     = "pbkdf2-sha256"
+)
+
+// ErrEmpty is returned by Hash for an empty password.
+var ErrEmpty = errors.New("password is empty")
+
+// Hash returns the encoded hash of password with a fresh salt:
+// "pbkdf2-sha256$<iterations>$<salt>$<key>", base64 without padding.
+func Hash(password string) (string, error) {
+	if password == "" {
+		return "", ErrEmpty
+	}
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2([]byte(password), salt, Iterations)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("%s$%d$%s$%s", scheme, Iterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// Matches reports whether password hashes to encoded. Malformed hashes
+// match nothing.
+func Matches(password, encoded string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != scheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := enc.DecodeString(parts[3])
+	if err != nil || len(want) != keyLen {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2([]byte(password), salt, iterations), want) == 1
+}
+
+// pbkdf2 derives a single block, which is all a key of keyLen needs.
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		subtle.XORBytes(key, key, u)
+	}
+	return key
+}
@@ -0,0 +1,47 @@
+package password
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestPBKDF2Vectors(t *testing.T) {
+	// PBKDF2-HMAC-SHA256 test vectors for P="password", S="salt".
+	for iterations, want := range map[int]string{
+		1:    "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b",
+		2:    "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43",
+		4096: "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a",
+	} {
+		if got := hex.EncodeToString(pbkdf2([]byte("password"), []byte("salt"), iterations)); got != want {
+			t.Errorf("pbkdf2 with %d iterations = %s, want %s", iterations, got, want)
+		}
+	}
+}
+
+func TestHashMatches(t *testing.T) {
+	h, err := Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(h, "pbkdf2-sha256$600000$") {
+		t.Fatalf("Hash = %q", h)
+	}
+	if !Matches("correct horse", h) {
+		t.Fatal("password does not match its own hash")
+	}
+	if Matches("correct horsE", h) {
+		t.Fatal("wrong password matches")
+	}
+	if again, _ := Hash("correct horse"); again == h {
+		t.Fatal("two hashes of the same password share a salt")
+	}
+	if _, err := Hash(""); err != ErrEmpty {
+		t.Fatalf("Hash(\"\") error = %v, want ErrEmpty", err)
+	}
+	for _, bad := range []string{"", "plain", "pbkdf2-sha256$x$c2FsdA$a2V5", "bcrypt$1$c2FsdA$a2V5", "pbkdf2-sha256$1$c2FsdA$a2V5"} {
+		if Matches("plain", bad) {
+			t.Errorf("Matches against %q succeeded", bad)
+		}
+	}
+}
@@ -17,6 +17,9 @@ type InMemoryLimiter struct {
 	counters map[string]*bucket
 	rate     time.Duration // Time to refill one token
 	capacity int           // Max burst
+
+	stop      chan struct{} // closed by Close to end the janitor
+	closeOnce sync.Once
 }
 
 type bucket struct {
@@ -31,9 +34,53 @@ func NewInMemoryLimiter(rate time.Duration, capacity int) *InMemoryLimiter {
 		counters: make(map[string]*bucket),
 		rate:     rate,
 		capacity: capacity,
+		stop:     make(chan struct{}),
+	}
+}
+
+// StartJanitor forgets, every interval, the keys whose buckets have
+// refilled completely; such a key behaves exactly like one never seen.
+// Without it the limiter grows with every key it is asked about.
+// Close stops the janitor.
+func (l *InMemoryLimiter) StartJanitor(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				l.sweep(time.Now())
+			case <-l.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (l *InMemoryLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	full := time.Duration(l.capacity) * l.rate
+	for key, b := range l.counters {
+		if now.Sub(b.lastUpdate) >= full {
+			delete(l.counters, key)
+		}
 	}
 }
 
+// Len returns the number of keys currently tracked.
+func (l *InMemoryLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.counters)
+}
+
+// Close stops the janitor, if any. It is safe to call more than once.
+func (l *InMemoryLimiter) Close() error {
+	l.closeOnce.Do(func() { close(l.stop) })
+	return nil
+}
+
 // Allow checks if the action is allowed for the given key.
 func (l *InMemoryLimiter) Allow(key string) bool {
 	l.mu.Lock()
@@ -3,6 +3,7 @@ package recovery
 import (
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"math/big"
 )
@@ -63,6 +64,13 @@ func (s *Service) ValidateAndConsume(inputCode string, storedHashes []string) ([
 	return storedHashes, false
 }
 
+// Matches reports whether inputCode hashes to storedHash.
+// Callers that keep used codes around (soft-consume) use this instead of
+// ValidateAndConsume and mark the matching code themselves.
+func (s *Service) Matches(inputCode, storedHash string) bool {
+	return subtle.ConstantTimeCompare([]byte(hash(inputCode)), []byte(storedHash)) == 1
+}
+
 func hash(code string) string {
 	sum := sha256.Sum256([]byte(code))
 	return hex.EncodeToString(sum[:])
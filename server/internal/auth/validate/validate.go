@@ -0,0 +1,102 @@
+// Package validate checks a signed-in user's TOTP code. It is what
+// /validate does, shared with the other frontends (the forward-auth
+// gateway and the like) so every way in applies the same rate limit and
+// records the same usage metadata.
+package validate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-auth-totp/internal/auth/password"
+	"go-auth-totp/internal/auth/ratelimit"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+	"log/slog"
+	"time"
+)
+
+var (
+	ErrRateLimited = errors.New("rate limit exceeded")
+	// ErrNotEnabled is returned for a user who has not finished enrolling.
+	// Unknown users get storage.ErrUserNotFound.
+	ErrNotEnabled  = errors.New("totp not enabled")
+	ErrInvalidCode = errors.New("invalid code")
+	// ErrNoPassword is returned by ValidateWithPassword for a user who
+	// has no static password.
+	ErrNoPassword = errors.New("no static password set")
+	// ErrDecrypt is returned when the stored secret cannot be decrypted,
+	// e.g. because the tenant's key changed.
+	ErrDecrypt = errors.New("failed to decrypt secret")
+	// ErrVerify wraps a failure of the TOTP verifier itself.
+	ErrVerify = errors.New("verification error")
+)
+
+// LimiterKey scopes rate limiting to the tenant, so a user ID that exists
+// in two tenants does not share one budget.
+func LimiterKey(t *tenant.Tenant, userID string) string {
+	return t.ID + ":" + userID
+}
+
+// Service checks codes against a repository.
+type Service struct {
+	repo    storage.Repository
+	limiter ratelimit.Limiter
+}
+
+// NewService returns a Service reading users from repo.
+func NewService(repo storage.Repository, limiter ratelimit.Limiter) *Service {
+	return &Service{repo: repo, limiter: limiter}
+}
+
+// Validate checks code for userID of tenant t and records the attempt.
+// Besides the errors above it returns the repository's errors.
+func (s *Service) Validate(ctx context.Context, t *tenant.Tenant, userID, code string) error {
+	return s.validate(ctx, t, userID, nil, code)
+}
+
+// ValidateWithPassword is Validate for a user who must also know their
+// static password. A wrong password fails like a wrong code, with
+// ErrInvalidCode, and counts as one failed attempt.
+func (s *Service) ValidateWithPassword(ctx context.Context, t *tenant.Tenant, userID, staticPassword, code string) error {
+	return s.validate(ctx, t, userID, &staticPassword, code)
+}
+
+// validate checks code, and staticPassword unless it is nil.
+func (s *Service) validate(ctx context.Context, t *tenant.Tenant, userID string, staticPassword *string, code string) error {
+	ctx = storage.WithTenant(ctx, t.ID)
+	if !s.limiter.Allow(LimiterKey(t, userID)) {
+		return ErrRateLimited
+	}
+
+	user, err := s.repo.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !user.Enabled {
+		return ErrNotEnabled
+	}
+	if staticPassword != nil && user.StaticPasswordHash == "" {
+		return ErrNoPassword
+	}
+
+	secret, err := t.Crypto.Decrypt(user.EncryptedSecret)
+	if err != nil {
+		return ErrDecrypt
+	}
+	valid, err := t.Verifier.Verify(secret, code)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrVerify, err)
+	}
+	if staticPassword != nil && !password.Matches(*staticPassword, user.StaticPasswordHash) {
+		valid = false
+	}
+
+	if err := s.repo.RecordAttempt(ctx, userID, valid, time.Now()); err != nil {
+		slog.ErrorContext(ctx, "RecordAttempt failed", "user_id", userID, "error", err)
+	}
+	if !valid {
+		return ErrInvalidCode
+	}
+	return nil
+}
@@ -4,31 +4,331 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
-	"log"
+	"go-auth-totp/internal/storage"
+	"log/slog"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	AppName    string
-	MasterKey  []byte
-	DBPath     string
-	Port       string
-	WindowSize uint64
+	AppName   string
+	MasterKey []byte
+	// EphemeralKey is set when TOTP_MASTER_KEY was missing and MasterKey
+	// was generated for this process only.
+	EphemeralKey bool
+	DBPath       string
+	Port         string
+	WindowSize   uint64
+	// AutoMigrate applies pending schema migrations at startup.
+	// When false, the server refuses to start until `totpctl migrate` is run.
+	AutoMigrate bool
+
+	// SQLite connection tuning, see storage.SQLiteOptions.
+	SQLiteJournalMode string
+	SQLiteBusyTimeout time.Duration
+	SQLiteSynchronous string
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+
+	// Read-through user cache; a zero TTL disables it.
+	CacheTTL        time.Duration
+	CacheMaxEntries int
+
+	// TenantsFile lists the tenants of a shared deployment (see
+	// tenant.File). Empty means a single tenant built from the settings above.
+	TenantsFile string
+
+	// API authentication, see apikey.Options.
+	APIAuthRequired     bool
+	APIKeyRateLimit     int // requests per minute per key
+	APISignatureMaxSkew time.Duration
+
+	// Native HTTPS, see tlsutil.Options. Without TLSCertFile the server
+	// speaks plain HTTP.
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+	TLSClientAuth   string
+
+	// HTTP server limits. Zero timeouts mean none.
+	HTTPReadHeaderTimeout time.Duration
+	HTTPReadTimeout       time.Duration
+	HTTPWriteTimeout      time.Duration
+	HTTPIdleTimeout       time.Duration
+	HTTPMaxHeaderBytes    int
+	HTTPMaxBodyBytes      int64
+	// ShutdownTimeout bounds how long in-flight requests may run after
+	// SIGINT/SIGTERM before the server closes them.
+	ShutdownTimeout time.Duration
+
+	// MetricsEnabled serves Prometheus metrics on /metrics.
+	MetricsEnabled bool
+
+	// LogLevel is the minimum level logged.
+	LogLevel slog.Level
+
+	// Webhook delivery. A delivery that fails WebhookMaxAttempts times is
+	// dead-lettered; retries wait WebhookRetryBase, doubling each time.
+	WebhookMaxAttempts      int
+	WebhookRetryBase        time.Duration
+	WebhookPollInterval     time.Duration
+	WebhookTimeout          time.Duration
+	WebhookLowRecoveryCodes int
+
+	// Assertions returned by /validate and /recover. Disabled unless
+	// AssertionKeyFile names a PEM Ed25519 private key.
+	AssertionKeyFile string
+	AssertionIssuer  string
+	AssertionTTL     time.Duration
+	// AssertionAudiences are the audiences the default tenant's assertions
+	// may be requested for; other tenants list theirs in TENANTS_FILE.
+	// Empty refuses assertion requests.
+	AssertionAudiences []string
+
+	// DeviceTrustTTL is how long a device stays trusted after /validate
+	// issues it a token.
+	DeviceTrustTTL time.Duration
+
+	// Forward-auth gateway (cmd/gateway).
+	GatewayPort string
+	// GatewayPublicURL is where browsers reach the gateway's login page.
+	GatewayPublicURL string
+	// GatewaySessionKey signs session cookies. Nil means a random key per
+	// process, which signs everyone out on restart.
+	GatewaySessionKey   []byte
+	GatewaySessionTTL   time.Duration
+	GatewayCookieName   string
+	GatewayCookieDomain string
+	GatewayCookieSecure bool
+	// GatewayTenant is the tenant whose users may sign in; empty means the
+	// default tenant.
+	GatewayTenant string
+
+	// RadiusAddr is the UDP address of the RADIUS frontend, e.g. ":1812".
+	// Empty disables it.
+	RadiusAddr string
+	// RadiusClientsFile lists the RADIUS clients (see radius.ClientsFile).
+	RadiusClientsFile string
+
+	// GRPCAddr is the TCP address of the gRPC API, e.g. ":9090". Empty
+	// disables it.
+	GRPCAddr string
+
+	// HealthAddr is the TCP address of a plain-HTTP listener serving only
+	// /healthz and /readyz, for probes that cannot present a client
+	// certificate. Empty disables it.
+	HealthAddr string
 }
 
 func Load() (*Config, error) {
 	// Load .env file if it exists, ignore error if missing (e.g. prod env vars)
 	_ = godotenv.Load()
 	windowSize, _ := strconv.ParseUint(getEnv("WINDOW_SIZE", "1"), 10, 64)
+	autoMigrate, _ := strconv.ParseBool(getEnv("DB_AUTO_MIGRATE", "true"))
+
+	busyTimeout, err := time.ParseDuration(getEnv("SQLITE_BUSY_TIMEOUT", "5s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SQLITE_BUSY_TIMEOUT: %w", err)
+	}
+	connMaxLifetime, err := time.ParseDuration(getEnv("DB_CONN_MAX_LIFETIME", "0s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DB_CONN_MAX_LIFETIME: %w", err)
+	}
+	maxOpenConns, err := strconv.Atoi(getEnv("DB_MAX_OPEN_CONNS", "10"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DB_MAX_OPEN_CONNS: %w", err)
+	}
+	maxIdleConns, err := strconv.Atoi(getEnv("DB_MAX_IDLE_CONNS", "10"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DB_MAX_IDLE_CONNS: %w", err)
+	}
+	cacheTTL, err := time.ParseDuration(getEnv("CACHE_TTL", "0"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CACHE_TTL: %w", err)
+	}
+	cacheMaxEntries, err := strconv.Atoi(getEnv("CACHE_MAX_ENTRIES", "10000"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CACHE_MAX_ENTRIES: %w", err)
+	}
+	apiAuthRequired, err := strconv.ParseBool(getEnv("API_AUTH_REQUIRED", "true"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid API_AUTH_REQUIRED: %w", err)
+	}
+	apiKeyRateLimit, err := strconv.Atoi(getEnv("API_KEY_RATE_LIMIT", "600"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid API_KEY_RATE_LIMIT: %w", err)
+	}
+	apiSignatureMaxSkew, err := time.ParseDuration(getEnv("API_SIGNATURE_MAX_SKEW", "5m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid API_SIGNATURE_MAX_SKEW: %w", err)
+	}
+
+	readHeaderTimeout, err := time.ParseDuration(getEnv("HTTP_READ_HEADER_TIMEOUT", "5s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP_READ_HEADER_TIMEOUT: %w", err)
+	}
+	readTimeout, err := time.ParseDuration(getEnv("HTTP_READ_TIMEOUT", "15s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP_READ_TIMEOUT: %w", err)
+	}
+	writeTimeout, err := time.ParseDuration(getEnv("HTTP_WRITE_TIMEOUT", "15s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP_WRITE_TIMEOUT: %w", err)
+	}
+	idleTimeout, err := time.ParseDuration(getEnv("HTTP_IDLE_TIMEOUT", "60s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP_IDLE_TIMEOUT: %w", err)
+	}
+	maxHeaderBytes, err := strconv.Atoi(getEnv("HTTP_MAX_HEADER_BYTES", "65536"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP_MAX_HEADER_BYTES: %w", err)
+	}
+	maxBodyBytes, err := strconv.ParseInt(getEnv("HTTP_MAX_BODY_BYTES", "65536"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP_MAX_BODY_BYTES: %w", err)
+	}
+	shutdownTimeout, err := time.ParseDuration(getEnv("SHUTDOWN_TIMEOUT", "30s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SHUTDOWN_TIMEOUT: %w", err)
+	}
+
+	metricsEnabled, err := strconv.ParseBool(getEnv("METRICS_ENABLED", "true"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid METRICS_ENABLED: %w", err)
+	}
+
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info"))); err != nil {
+		return nil, fmt.Errorf("invalid LOG_LEVEL: %w", err)
+	}
+
+	webhookMaxAttempts, err := strconv.Atoi(getEnv("WEBHOOK_MAX_ATTEMPTS", "8"))
+	if err != nil || webhookMaxAttempts < 1 {
+		return nil, fmt.Errorf("invalid WEBHOOK_MAX_ATTEMPTS: must be a positive integer")
+	}
+	webhookRetryBase, err := time.ParseDuration(getEnv("WEBHOOK_RETRY_BASE", "30s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid WEBHOOK_RETRY_BASE: %w", err)
+	}
+	webhookPollInterval, err := time.ParseDuration(getEnv("WEBHOOK_POLL_INTERVAL", "5s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid WEBHOOK_POLL_INTERVAL: %w", err)
+	}
+	webhookTimeout, err := time.ParseDuration(getEnv("WEBHOOK_TIMEOUT", "10s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid WEBHOOK_TIMEOUT: %w", err)
+	}
+	webhookLowRecoveryCodes, err := strconv.Atoi(getEnv("WEBHOOK_LOW_RECOVERY_CODES", "3"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid WEBHOOK_LOW_RECOVERY_CODES: %w", err)
+	}
+
+	assertionTTL, err := time.ParseDuration(getEnv("ASSERTION_TTL", "5m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ASSERTION_TTL: %w", err)
+	}
+	var assertionAudiences []string
+	for _, aud := range strings.Split(os.Getenv("ASSERTION_AUDIENCES"), ",") {
+		if aud = strings.TrimSpace(aud); aud != "" {
+			assertionAudiences = append(assertionAudiences, aud)
+		}
+	}
+
+	deviceTrustTTL, err := time.ParseDuration(getEnv("DEVICE_TRUST_TTL", "720h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DEVICE_TRUST_TTL: %w", err)
+	}
+
+	gatewaySessionTTL, err := time.ParseDuration(getEnv("GATEWAY_SESSION_TTL", "12h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid GATEWAY_SESSION_TTL: %w", err)
+	}
+	gatewayCookieSecure, err := strconv.ParseBool(getEnv("GATEWAY_COOKIE_SECURE", "true"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid GATEWAY_COOKIE_SECURE: %w", err)
+	}
+	var gatewaySessionKey []byte
+	if v := os.Getenv("GATEWAY_SESSION_KEY"); v != "" {
+		if gatewaySessionKey, err = hex.DecodeString(v); err != nil {
+			return nil, fmt.Errorf("invalid GATEWAY_SESSION_KEY hex: %w", err)
+		}
+		if len(gatewaySessionKey) < 32 {
+			return nil, fmt.Errorf("GATEWAY_SESSION_KEY must be at least 32 bytes, got %d", len(gatewaySessionKey))
+		}
+	}
 
 	cfg := &Config{
-		AppName:    getEnv("TOTP_APP_NAME", "EnjoysAuthTOTP"),
-		DBPath:     getEnv("DB_PATH", "totp.db"),
-		Port:       getEnv("PORT", "8080"),
-		WindowSize: windowSize,
+		AppName:     getEnv("TOTP_APP_NAME", "EnjoysAuthTOTP"),
+		DBPath:      getEnv("DB_PATH", "totp.db"),
+		Port:        getEnv("PORT", "8080"),
+		WindowSize:  windowSize,
+		AutoMigrate: autoMigrate,
+
+		SQLiteJournalMode: getEnv("SQLITE_JOURNAL_MODE", "WAL"),
+		SQLiteBusyTimeout: busyTimeout,
+		SQLiteSynchronous: getEnv("SQLITE_SYNCHRONOUS", "NORMAL"),
+		DBMaxOpenConns:    maxOpenConns,
+		DBMaxIdleConns:    maxIdleConns,
+		DBConnMaxLifetime: connMaxLifetime,
+
+		CacheTTL:        cacheTTL,
+		CacheMaxEntries: cacheMaxEntries,
+
+		TenantsFile: os.Getenv("TENANTS_FILE"),
+
+		APIAuthRequired:     apiAuthRequired,
+		APIKeyRateLimit:     apiKeyRateLimit,
+		APISignatureMaxSkew: apiSignatureMaxSkew,
+
+		TLSCertFile:     os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:      os.Getenv("TLS_KEY_FILE"),
+		TLSClientCAFile: os.Getenv("TLS_CLIENT_CA_FILE"),
+		TLSClientAuth:   getEnv("TLS_CLIENT_AUTH", "require"),
+
+		HTTPReadHeaderTimeout: readHeaderTimeout,
+		HTTPReadTimeout:       readTimeout,
+		HTTPWriteTimeout:      writeTimeout,
+		HTTPIdleTimeout:       idleTimeout,
+		HTTPMaxHeaderBytes:    maxHeaderBytes,
+		HTTPMaxBodyBytes:      maxBodyBytes,
+		ShutdownTimeout:       shutdownTimeout,
+
+		MetricsEnabled: metricsEnabled,
+		LogLevel:       logLevel,
+
+		WebhookMaxAttempts:      webhookMaxAttempts,
+		WebhookRetryBase:        webhookRetryBase,
+		WebhookPollInterval:     webhookPollInterval,
+		WebhookTimeout:          webhookTimeout,
+		WebhookLowRecoveryCodes: webhookLowRecoveryCodes,
+
+		AssertionKeyFile:   os.Getenv("ASSERTION_KEY_FILE"),
+		AssertionIssuer:    getEnv("ASSERTION_ISSUER", getEnv("TOTP_APP_NAME", "EnjoysAuthTOTP")),
+		AssertionTTL:       assertionTTL,
+		AssertionAudiences: assertionAudiences,
+
+		DeviceTrustTTL: deviceTrustTTL,
+
+		GatewayPort:         getEnv("GATEWAY_PORT", "8090"),
+		GatewayPublicURL:    os.Getenv("GATEWAY_PUBLIC_URL"),
+		GatewaySessionKey:   gatewaySessionKey,
+		GatewaySessionTTL:   gatewaySessionTTL,
+		GatewayCookieName:   getEnv("GATEWAY_COOKIE_NAME", "totp_session"),
+		GatewayCookieDomain: os.Getenv("GATEWAY_COOKIE_DOMAIN"),
+		GatewayCookieSecure: gatewayCookieSecure,
+		GatewayTenant:       os.Getenv("GATEWAY_TENANT"),
+
+		RadiusAddr:        os.Getenv("RADIUS_ADDR"),
+		RadiusClientsFile: os.Getenv("RADIUS_CLIENTS_FILE"),
+
+		GRPCAddr: os.Getenv("GRPC_ADDR"),
+
+		HealthAddr: os.Getenv("HEALTH_ADDR"),
 	}
 
 	masterKeyHex := os.Getenv("TOTP_MASTER_KEY")
@@ -42,18 +342,31 @@ func Load() (*Config, error) {
 		}
 		cfg.MasterKey = key
 	} else {
-		log.Println("WARNING: TOTP_MASTER_KEY not set. Generating random key for this session (NOT PERSISTENT).")
+		slog.Warn("TOTP_MASTER_KEY not set; using a random key for this process only, secrets will not survive a restart")
 		key := make([]byte, 32)
 		if _, err := rand.Read(key); err != nil {
 			return nil, fmt.Errorf("failed to generate random key: %w", err)
 		}
-		log.Printf("Generated Master Key (Hex): %x", key)
 		cfg.MasterKey = key
+		cfg.EphemeralKey = true
 	}
 
 	return cfg, nil
 }
 
+// SQLiteOptions returns the database settings of the configuration.
+func (c *Config) SQLiteOptions() storage.SQLiteOptions {
+	return storage.SQLiteOptions{
+		AutoMigrate:     c.AutoMigrate,
+		JournalMode:     c.SQLiteJournalMode,
+		BusyTimeout:     c.SQLiteBusyTimeout,
+		Synchronous:     c.SQLiteSynchronous,
+		MaxOpenConns:    c.DBMaxOpenConns,
+		MaxIdleConns:    c.DBMaxIdleConns,
+		ConnMaxLifetime: c.DBConnMaxLifetime,
+	}
+}
+
 func getEnv(key, fallback string) string {
 	if value, exists := os.LookupEnv(key); exists {
 		return value
@@ -0,0 +1,23 @@
+package crypto
+
+// DecryptHook is called with every Decrypt error.
+type DecryptHook func(err error)
+
+// WithDecryptHook wraps cs so that failed decryptions are reported to
+// hook, e.g. to count them. Results are passed through unchanged.
+func WithDecryptHook(cs CryptoService, hook DecryptHook) CryptoService {
+	return &hookedCrypto{CryptoService: cs, hook: hook}
+}
+
+type hookedCrypto struct {
+	CryptoService
+	hook DecryptHook
+}
+
+func (c *hookedCrypto) Decrypt(ciphertext string) ([]byte, error) {
+	plain, err := c.CryptoService.Decrypt(ciphertext)
+	if err != nil {
+		c.hook(err)
+	}
+	return plain, err
+}
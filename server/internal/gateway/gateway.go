@@ -0,0 +1,334 @@
+// Package gateway puts TOTP in front of internal tools through a reverse
+// proxy's forward-auth hook: nginx auth_request, Traefik ForwardAuth or
+// Caddy forward_auth.
+//
+// The proxy asks GET /auth about every request. With a valid session
+// cookie the answer is 200 and names the user in Remote-User. Without one
+// it is 302 to the login page when the proxy passes the original URL in
+// X-Forwarded-Host and X-Forwarded-Uri (Traefik, Caddy), and 401
+// otherwise (nginx, which only accepts 2xx, 401 and 403 and redirects
+// itself with error_page). The login page checks the code through the
+// same validate.Service as /validate and sets the signed session cookie.
+package gateway
+
+import (
+	"crypto/rand"
+	"embed"
+	"errors"
+	"fmt"
+	"go-auth-totp/internal/audit"
+	"go-auth-totp/internal/auth/validate"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+	"go-auth-totp/pkg/timeutil"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Headers on a successful /auth answer, for the proxy to pass upstream.
+const (
+	HeaderUser          = "Remote-User"
+	HeaderForwardedUser = "X-Forwarded-User"
+)
+
+//go:embed login.html
+var templates embed.FS
+
+var loginPage = template.Must(template.ParseFS(templates, "login.html"))
+
+// Options configure a Gateway.
+type Options struct {
+	// PublicURL is where browsers reach the gateway, e.g.
+	// https://auth.example.com. Its host may always be redirected to.
+	PublicURL *url.URL
+	// SessionKey signs session cookies; at least 32 bytes. Nil generates
+	// a random key.
+	SessionKey []byte
+	SessionTTL time.Duration
+	CookieName string
+	// CookieDomain, e.g. "example.com", shares the session with the
+	// protected hosts below it; after login the gateway only redirects to
+	// those hosts. Empty keeps the cookie on the gateway's host.
+	CookieDomain string
+	CookieSecure bool
+	// AppName is shown on the login page.
+	AppName string
+	Clock   timeutil.Clock
+}
+
+// Gateway serves the forward-auth endpoint and the login page.
+type Gateway struct {
+	repo   storage.Repository
+	tenant *tenant.Tenant
+	codes  *validate.Service
+	audit  *audit.Recorder
+	opts   Options
+}
+
+// New returns a Gateway signing in users of t.
+func New(repo storage.Repository, t *tenant.Tenant, codes *validate.Service, rec *audit.Recorder, opts Options) (*Gateway, error) {
+	if opts.PublicURL == nil || opts.PublicURL.Host == "" {
+		return nil, errors.New("gateway public URL is required")
+	}
+	if opts.SessionKey == nil {
+		opts.SessionKey = make([]byte, 32)
+		if _, err := rand.Read(opts.SessionKey); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.SessionKey) < 32 {
+		return nil, fmt.Errorf("session key must be at least 32 bytes, got %d", len(opts.SessionKey))
+	}
+	if opts.SessionTTL <= 0 {
+		opts.SessionTTL = 12 * time.Hour
+	}
+	if opts.CookieName == "" {
+		opts.CookieName = "totp_session"
+	}
+	opts.CookieDomain = strings.TrimPrefix(strings.ToLower(opts.CookieDomain), ".")
+	if opts.Clock == nil {
+		opts.Clock = timeutil.RealClock{}
+	}
+	return &Gateway{repo: repo, tenant: t, codes: codes, audit: rec, opts: opts}, nil
+}
+
+// Handler returns the gateway's routes.
+func (g *Gateway) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", g.AuthHandler)
+	mux.HandleFunc("/login", g.LoginHandler)
+	mux.HandleFunc("/logout", g.LogoutHandler)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+// AuthHandler answers the proxy's forward-auth request.
+func (g *Gateway) AuthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if s, ok := g.session(r); ok {
+		w.Header().Set(HeaderUser, s.UserID)
+		w.Header().Set(HeaderForwardedUser, s.UserID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	original := forwardedURL(r)
+	method := r.Header.Get("X-Forwarded-Method")
+	if original != "" && (method == "" || method == http.MethodGet || method == http.MethodHead) {
+		http.Redirect(w, r, g.loginURL(original), http.StatusFound)
+		return
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// session returns the request's session if its cookie is valid and the
+// user still has 2FA enabled.
+func (g *Gateway) session(r *http.Request) (*session, bool) {
+	c, err := r.Cookie(g.opts.CookieName)
+	if err != nil {
+		return nil, false
+	}
+	s, err := decodeSession(g.opts.SessionKey, c.Value, g.opts.Clock.Now())
+	if err != nil || s.TenantID != g.tenant.ID {
+		return nil, false
+	}
+	user, err := g.repo.GetUser(storage.WithTenant(r.Context(), g.tenant.ID), s.UserID)
+	if err != nil {
+		if !errors.Is(err, storage.ErrUserNotFound) {
+			slog.ErrorContext(r.Context(), "Session check failed", "user_id", s.UserID, "error", err)
+		}
+		return nil, false
+	}
+	// Disabling 2FA signs the user out.
+	if !user.Enabled || user.EnabledAt.Unix() > s.AuthTime {
+		return nil, false
+	}
+	return s, true
+}
+
+type loginData struct {
+	AppName  string
+	Redirect string
+	UserID   string
+	Error    string
+	SignedIn bool
+}
+
+// LoginHandler shows the login form and checks submitted codes.
+func (g *Gateway) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		g.renderLogin(w, http.StatusOK, loginData{Redirect: r.URL.Query().Get("rd")})
+	case http.MethodPost:
+		// Browsers send Origin on form posts; one from another site is a
+		// login CSRF attempt.
+		if origin := r.Header.Get("Origin"); origin != "" && !g.sameOrigin(origin) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		g.login(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (g *Gateway) login(w http.ResponseWriter, r *http.Request) {
+	userID := strings.TrimSpace(r.PostFormValue("user"))
+	code := strings.TrimSpace(r.PostFormValue("code"))
+	data := loginData{Redirect: r.PostFormValue("rd"), UserID: userID}
+	if userID == "" || code == "" {
+		data.Error = "Enter your user name and code."
+		g.renderLogin(w, http.StatusBadRequest, data)
+		return
+	}
+
+	ctx := storage.WithTenant(r.Context(), g.tenant.ID)
+	outcome := audit.OutcomeError
+	defer func() {
+		g.audit.Record(r.WithContext(ctx), audit.Event{Type: audit.EventValidate, UserID: userID,
+			Credential: audit.CredentialTOTP, Outcome: outcome, Detail: "gateway"})
+	}()
+
+	err := g.codes.Validate(ctx, g.tenant, userID, code)
+	switch {
+	case err == nil:
+		outcome = audit.OutcomeSuccess
+	case errors.Is(err, validate.ErrRateLimited):
+		outcome = audit.OutcomeRateLimited
+		data.Error = "Too many attempts. Wait a minute and try again."
+		g.renderLogin(w, http.StatusTooManyRequests, data)
+		return
+	case errors.Is(err, validate.ErrInvalidCode), errors.Is(err, validate.ErrNotEnabled),
+		errors.Is(err, storage.ErrUserNotFound):
+		// Unknown users look like wrong codes.
+		outcome = audit.OutcomeInvalidCode
+		if !errors.Is(err, validate.ErrInvalidCode) {
+			outcome = audit.OutcomeNotEnabled
+		}
+		data.Error = "Invalid user name or code."
+		g.renderLogin(w, http.StatusUnauthorized, data)
+		return
+	default:
+		slog.ErrorContext(r.Context(), "Gateway login failed", "user_id", userID, "error", err)
+		data.Error = "Sign-in is unavailable right now."
+		g.renderLogin(w, http.StatusServiceUnavailable, data)
+		return
+	}
+
+	if err := g.setSession(w, userID); err != nil {
+		slog.ErrorContext(r.Context(), "Creating session failed", "user_id", userID, "error", err)
+		data.Error = "Sign-in is unavailable right now."
+		g.renderLogin(w, http.StatusInternalServerError, data)
+		return
+	}
+	slog.InfoContext(r.Context(), "Gateway sign-in", "user_id", userID, "tenant", g.tenant.ID)
+	if target, ok := g.safeRedirect(data.Redirect); ok {
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+	g.renderLogin(w, http.StatusOK, loginData{UserID: userID, SignedIn: true})
+}
+
+func (g *Gateway) setSession(w http.ResponseWriter, userID string) error {
+	now := g.opts.Clock.Now()
+	value, err := encodeSession(g.opts.SessionKey, session{
+		UserID:   userID,
+		TenantID: g.tenant.ID,
+		AuthTime: now.Unix(),
+		Expires:  now.Add(g.opts.SessionTTL).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, g.cookie(value, int(g.opts.SessionTTL/time.Second)))
+	return nil
+}
+
+func (g *Gateway) cookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     g.opts.CookieName,
+		Value:    value,
+		Path:     "/",
+		Domain:   g.opts.CookieDomain,
+		MaxAge:   maxAge,
+		Secure:   g.opts.CookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// LogoutHandler clears the session cookie.
+func (g *Gateway) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, g.cookie("", -1))
+	if target, ok := g.safeRedirect(r.URL.Query().Get("rd")); ok {
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+	g.renderLogin(w, http.StatusOK, loginData{})
+}
+
+func (g *Gateway) renderLogin(w http.ResponseWriter, status int, data loginData) {
+	data.AppName = g.opts.AppName
+	if _, ok := g.safeRedirect(data.Redirect); !ok {
+		data.Redirect = ""
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := loginPage.Execute(w, data); err != nil {
+		slog.Error("Rendering login page failed", "error", err)
+	}
+}
+
+func (g *Gateway) loginURL(original string) string {
+	u := *g.opts.PublicURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/login"
+	u.RawQuery = url.Values{"rd": {original}}.Encode()
+	return u.String()
+}
+
+// safeRedirect accepts only absolute http(s) URLs on the gateway's host or
+// under the cookie domain, so the login page is not an open redirect.
+func (g *Gateway) safeRedirect(target string) (string, bool) {
+	if target == "" {
+		return "", false
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.User != nil {
+		return "", false
+	}
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case host == strings.ToLower(g.opts.PublicURL.Hostname()):
+	case g.opts.CookieDomain != "" && (host == g.opts.CookieDomain || strings.HasSuffix(host, "."+g.opts.CookieDomain)):
+	default:
+		return "", false
+	}
+	return u.String(), true
+}
+
+func (g *Gateway) sameOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Scheme == g.opts.PublicURL.Scheme && strings.EqualFold(u.Host, g.opts.PublicURL.Host)
+}
+
+// forwardedURL rebuilds the URL the user asked the proxy for from the
+// headers Traefik and Caddy send, or returns "".
+func forwardedURL(r *http.Request) string {
+	host, uri := r.Header.Get("X-Forwarded-Host"), r.Header.Get("X-Forwarded-Uri")
+	if host == "" || uri == "" || !strings.HasPrefix(uri, "/") {
+		return ""
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto != "http" {
+		proto = "https"
+	}
+	return proto + "://" + host + uri
+}
@@ -0,0 +1,184 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"go-auth-totp/internal/auth/enroll"
+	"go-auth-totp/internal/auth/ratelimit"
+	"go-auth-totp/internal/auth/validate"
+	"go-auth-totp/internal/crypto"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+	"go-auth-totp/pkg/totp"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestGateway(t *testing.T) (*Gateway, storage.Repository, string) {
+	t.Helper()
+	cryptoSvc, err := crypto.NewAESGCMEncryption(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatalf("crypto: %v", err)
+	}
+	tn := &tenant.Tenant{ID: "default", Issuer: "Test", Crypto: cryptoSvc,
+		Enroll: enroll.NewService("Test", cryptoSvc), Verifier: totp.NewVerifier(nil)}
+	repo := storage.NewInMemoryRepository()
+
+	const secret = "JBSWY3DPEHPK3PXP"
+	raw, _ := base32.StdEncoding.DecodeString(secret)
+	encrypted, err := cryptoSvc.Encrypt(raw)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	ctx := storage.WithTenant(context.Background(), tn.ID)
+	if err := repo.SaveUser(ctx, &storage.User{ID: "alice", EncryptedSecret: encrypted, Enabled: true,
+		EnabledAt: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatalf("save user: %v", err)
+	}
+
+	public, _ := url.Parse("https://auth.example.com")
+	g, err := New(repo, tn, validate.NewService(repo, ratelimit.NewInMemoryLimiter(time.Millisecond, 100)), nil,
+		Options{PublicURL: public, CookieDomain: ".example.com", CookieSecure: true})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return g, repo, secret
+}
+
+func code(t *testing.T, secret string) string {
+	t.Helper()
+	c, err := totp.NewGenerator().GenerateCodeFromBase32(secret, uint64(time.Now().Unix()))
+	if err != nil {
+		t.Fatalf("generate code: %v", err)
+	}
+	return c
+}
+
+func postLogin(h http.Handler, form url.Values, origin string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestForwardAuth(t *testing.T) {
+	g, repo, secret := newTestGateway(t)
+	h := g.Handler()
+	auth := func(cookie *http.Cookie, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// nginx: no original URL, so 401 and the proxy redirects.
+	if rec := auth(nil, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("auth without session = %d, want 401", rec.Code)
+	}
+	// Traefik and Caddy: 302 to the login page.
+	rec := auth(nil, http.Header{"X-Forwarded-Host": {"wiki.example.com"}, "X-Forwarded-Uri": {"/page?id=1"},
+		"X-Forwarded-Proto": {"https"}, "X-Forwarded-Method": {"GET"}})
+	const original = "https://wiki.example.com/page?id=1"
+	if want := "https://auth.example.com/login?rd=" + url.QueryEscape(original); rec.Code != http.StatusFound || rec.Header().Get("Location") != want {
+		t.Fatalf("auth with forwarded URL = %d %q, want 302 %q", rec.Code, rec.Header().Get("Location"), want)
+	}
+	// Redirecting would turn a POST into a GET.
+	if rec := auth(nil, http.Header{"X-Forwarded-Host": {"wiki.example.com"}, "X-Forwarded-Uri": {"/"},
+		"X-Forwarded-Method": {"POST"}}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("auth for POST = %d, want 401", rec.Code)
+	}
+
+	if rec := postLogin(h, url.Values{"user": {"alice"}, "code": {"000000"}, "rd": {original}}, ""); rec.Code != http.StatusUnauthorized ||
+		len(rec.Result().Cookies()) != 0 || !strings.Contains(rec.Body.String(), "Invalid user name or code") {
+		t.Fatalf("login with wrong code = %d %s", rec.Code, rec.Body)
+	}
+	if rec := postLogin(h, url.Values{"user": {"mallory"}, "code": {"123456"}}, ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("login as unknown user = %d, want 401", rec.Code)
+	}
+	if rec := postLogin(h, url.Values{"user": {"alice"}, "code": {code(t, secret)}}, "https://evil.test"); rec.Code != http.StatusForbidden {
+		t.Fatalf("cross-site login = %d, want 403", rec.Code)
+	}
+
+	rec = postLogin(h, url.Values{"user": {"alice"}, "code": {code(t, secret)}, "rd": {original}}, "https://auth.example.com")
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != original {
+		t.Fatalf("login = %d %q, want 302 to %s", rec.Code, rec.Header().Get("Location"), original)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly || !cookies[0].Secure || cookies[0].Domain != "example.com" ||
+		cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Fatalf("session cookie = %+v", cookies)
+	}
+	cookie := cookies[0]
+
+	rec = auth(cookie, nil)
+	if rec.Code != http.StatusOK || rec.Header().Get(HeaderUser) != "alice" || rec.Header().Get(HeaderForwardedUser) != "alice" {
+		t.Fatalf("auth with session = %d %v", rec.Code, rec.Header())
+	}
+	tampered := *cookie
+	tampered.Value = strings.Replace(cookie.Value, ".", "x.", 1)
+	if rec := auth(&tampered, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("auth with tampered cookie = %d, want 401", rec.Code)
+	}
+
+	// Disabling 2FA ends the session.
+	ctx := storage.WithTenant(context.Background(), "default")
+	if err := repo.DisableUser(ctx, "alice"); err != nil {
+		t.Fatalf("disable: %v", err)
+	}
+	if rec := auth(cookie, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("auth after disable = %d, want 401", rec.Code)
+	}
+}
+
+func TestSafeRedirect(t *testing.T) {
+	g, _, _ := newTestGateway(t)
+	for target, want := range map[string]bool{
+		"https://wiki.example.com/x":       true,
+		"https://example.com/":             true,
+		"https://auth.example.com/login":   true,
+		"http://grafana.example.com:3000/": true,
+		"https://example.com.evil.test/":   false,
+		"https://evilexample.com/":         false,
+		"//wiki.example.com/":              false,
+		"/relative":                        false,
+		"javascript:alert(1)":              false,
+		"https://user@wiki.example.com/":   false,
+	} {
+		if _, ok := g.safeRedirect(target); ok != want {
+			t.Errorf("safeRedirect(%q) = %v, want %v", target, ok, want)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	now := time.Unix(1_700_000_000, 0)
+	value, err := encodeSession(key, session{UserID: "alice", TenantID: "default", AuthTime: now.Unix(), Expires: now.Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if s, err := decodeSession(key, value, now); err != nil || s.UserID != "alice" {
+		t.Fatalf("decode = %+v, %v", s, err)
+	}
+	if _, err := decodeSession(key, value, now.Add(time.Hour)); err == nil {
+		t.Error("expired session accepted")
+	}
+	if _, err := decodeSession(bytes.Repeat([]byte{2}, 32), value, now); err == nil {
+		t.Error("session signed with another key accepted")
+	}
+}
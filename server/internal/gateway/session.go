@@ -0,0 +1,65 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var errBadSession = errors.New("invalid session")
+
+var b64 = base64.RawURLEncoding
+
+// session is the content of the session cookie.
+type session struct {
+	UserID   string `json:"u"`
+	TenantID string `json:"t"`
+	// AuthTime and Expires are Unix seconds.
+	AuthTime int64 `json:"at"`
+	Expires  int64 `json:"exp"`
+}
+
+// encodeSession returns "<payload>.<mac>", both base64url, with the MAC
+// an HMAC-SHA256 of the payload under key.
+func encodeSession(key []byte, s session) (string, error) {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	p := b64.EncodeToString(payload)
+	return p + "." + b64.EncodeToString(sessionMAC(key, p)), nil
+}
+
+// decodeSession checks the MAC and expiry of a cookie value.
+func decodeSession(key []byte, value string, now time.Time) (*session, error) {
+	p, mac, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, errBadSession
+	}
+	got, err := b64.DecodeString(mac)
+	if err != nil || !hmac.Equal(got, sessionMAC(key, p)) {
+		return nil, errBadSession
+	}
+	payload, err := b64.DecodeString(p)
+	if err != nil {
+		return nil, errBadSession
+	}
+	var s session
+	if err := json.Unmarshal(payload, &s); err != nil || s.UserID == "" {
+		return nil, errBadSession
+	}
+	if now.Unix() >= s.Expires {
+		return nil, errBadSession
+	}
+	return &s, nil
+}
+
+func sessionMAC(key []byte, payload string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("totp-gateway-session\n" + payload))
+	return m.Sum(nil)
+}
@@ -0,0 +1,234 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"go-auth-totp/internal/auth/account"
+	"go-auth-totp/internal/auth/apikey"
+	"go-auth-totp/internal/auth/ratelimit"
+	"go-auth-totp/internal/auth/validate"
+	"go-auth-totp/internal/crypto"
+	"go-auth-totp/internal/metrics"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+	"go-auth-totp/pkg/assertion"
+	"go-auth-totp/pkg/totp"
+	"go-auth-totp/pkg/totpv1"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type testServer struct {
+	client  totpv1.TOTPServiceClient
+	repo    *storage.InMemoryRepository
+	tenant  *tenant.Tenant
+	metrics *metrics.Metrics
+}
+
+// newTestServer serves one default tenant over bufconn with API keys
+// required.
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	cs, err := crypto.NewAESGCMEncryption(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatalf("crypto: %v", err)
+	}
+	tn, err := tenant.New("default", "Test", totp.DefaultPolicy(), cs)
+	if err != nil {
+		t.Fatalf("tenant: %v", err)
+	}
+	tn.AssertionAudiences = []string{"billing"}
+	reg := tenant.NewRegistry("default")
+	if err := reg.Add(tn); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	repo := storage.NewInMemoryRepository()
+	limiter := ratelimit.NewInMemoryLimiter(time.Millisecond, 100)
+	m := metrics.New()
+	srv := NewServer(Options{
+		Auth:       apikey.NewAuthenticator(repo, reg, apikey.Options{Required: true}),
+		Tenants:    reg,
+		Accounts:   account.NewService(repo, limiter, account.Options{}),
+		Codes:      validate.NewService(repo, limiter),
+		Metrics:    m,
+		Assertions: assertion.NewSigner(key, assertion.SignerOptions{Issuer: "test"}),
+	})
+
+	lis := bufconn.Listen(1 << 20)
+	go srv.Serve(lis)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		srv.Stop()
+	})
+	return &testServer{client: totpv1.NewTOTPServiceClient(conn), repo: repo, tenant: tn, metrics: m}
+}
+
+// issueKey returns the token of a new key of the default tenant.
+func (s *testServer) issueKey(t *testing.T, opts apikey.IssueOptions) string {
+	t.Helper()
+	opts.Name = "test"
+	if opts.Scopes == nil {
+		opts.Scopes = []apikey.Scope{apikey.ScopeEnroll, apikey.ScopeValidate}
+	}
+	issued, err := apikey.Issue(context.Background(), s.repo, s.tenant, opts)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	return issued.Token
+}
+
+func withKey(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), MetadataAPIKey, token)
+}
+
+func currentCode(t *testing.T, secret string) string {
+	t.Helper()
+	code, err := totp.NewGenerator().GenerateCodeFromBase32(secret, uint64(time.Now().Unix()))
+	if err != nil {
+		t.Fatalf("generate code: %v", err)
+	}
+	return code
+}
+
+func wantCode(t *testing.T, what string, err error, want codes.Code) {
+	t.Helper()
+	if got := status.Code(err); got != want {
+		t.Errorf("%s: code = %v (%v), want %v", what, got, err, want)
+	}
+}
+
+func TestEnrollVerifyValidateRecover(t *testing.T) {
+	s := newTestServer(t)
+	ctx := withKey(s.issueKey(t, apikey.IssueOptions{}))
+
+	st, err := s.client.GetStatus(ctx, &totpv1.GetStatusRequest{UserId: "alice"})
+	if err != nil || st.Enrolled {
+		t.Fatalf("status before enroll = %v, %v", st, err)
+	}
+	enrolled, err := s.client.Enroll(ctx, &totpv1.EnrollRequest{UserId: "alice"})
+	if err != nil {
+		t.Fatalf("Enroll: %v", err)
+	}
+	if !strings.HasPrefix(enrolled.OtpauthUrl, "otpauth://totp/") || len(enrolled.RecoveryCodes) == 0 {
+		t.Fatalf("Enroll = %v", enrolled)
+	}
+	_, err = s.client.Validate(ctx, &totpv1.ValidateRequest{UserId: "alice", Code: "000000"})
+	wantCode(t, "validate before verify", err, codes.FailedPrecondition)
+
+	code := currentCode(t, enrolled.Secret)
+	if _, err := s.client.Verify(ctx, &totpv1.VerifyRequest{UserId: "alice", Code: code}); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	_, err = s.client.Verify(ctx, &totpv1.VerifyRequest{UserId: "alice", Code: code})
+	wantCode(t, "second verify", err, codes.AlreadyExists)
+
+	resp, err := s.client.Validate(ctx, &totpv1.ValidateRequest{UserId: "alice", Code: code, Audience: "billing"})
+	if err != nil || resp.Assertion.GetToken() == "" || !resp.Assertion.GetExpiresAt().AsTime().After(time.Now()) {
+		t.Fatalf("Validate = %v, %v, want an assertion", resp, err)
+	}
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	_, err = s.client.Validate(ctx, &totpv1.ValidateRequest{UserId: "alice", Code: wrong})
+	wantCode(t, "validate wrong code", err, codes.PermissionDenied)
+	_, err = s.client.Validate(ctx, &totpv1.ValidateRequest{UserId: "mallory", Code: code})
+	wantCode(t, "validate unknown user", err, codes.NotFound)
+	_, err = s.client.Validate(ctx, &totpv1.ValidateRequest{Code: code})
+	wantCode(t, "validate without user", err, codes.InvalidArgument)
+
+	rec, err := s.client.Recover(ctx, &totpv1.RecoverRequest{UserId: "alice", Code: enrolled.RecoveryCodes[0]})
+	if err != nil || int(rec.RemainingRecoveryCodes) != len(enrolled.RecoveryCodes)-1 {
+		t.Fatalf("Recover = %v, %v", rec, err)
+	}
+	_, err = s.client.Recover(ctx, &totpv1.RecoverRequest{UserId: "alice", Code: enrolled.RecoveryCodes[0]})
+	wantCode(t, "reused recovery code", err, codes.PermissionDenied)
+
+	st, err = s.client.GetStatus(ctx, &totpv1.GetStatusRequest{UserId: "alice"})
+	if err != nil || !st.Enabled || st.EnabledAt == nil || st.LastVerifiedAt == nil ||
+		int(st.RemainingRecoveryCodes) != len(enrolled.RecoveryCodes)-1 || st.FailedAttempts != 1 {
+		t.Fatalf("GetStatus = %v, %v", st, err)
+	}
+
+	// The metrics interceptor counts like the HTTP API.
+	rr := httptest.NewRecorder()
+	s.metrics.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rr.Body)
+	for _, want := range []string{
+		`totp_auth_attempts_total{operation="enroll",outcome="success"} 1`,
+		`totp_auth_attempts_total{operation="verify",outcome="error"} 1`,
+		`totp_auth_attempts_total{operation="validate",outcome="invalid_code"} 1`,
+		`totp_auth_attempts_total{operation="validate",outcome="not_enabled"} 2`,
+		`totp_auth_attempts_total{operation="recover",outcome="success"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	s := newTestServer(t)
+	validateOnly := s.issueKey(t, apikey.IssueOptions{Scopes: []apikey.Scope{apikey.ScopeValidate}})
+	signed := s.issueKey(t, apikey.IssueOptions{Signed: true})
+	req := &totpv1.ValidateRequest{UserId: "alice", Code: "123456"}
+
+	_, err := s.client.Validate(context.Background(), req)
+	wantCode(t, "no key", err, codes.Unauthenticated)
+	_, err = s.client.Validate(withKey("not-a-key"), req)
+	wantCode(t, "malformed key", err, codes.Unauthenticated)
+	_, err = s.client.Validate(withKey(signed), req)
+	wantCode(t, "key that must sign", err, codes.Unauthenticated)
+	if msg := status.Convert(err).Message(); msg != "Invalid request signature" {
+		t.Errorf("key that must sign: message = %q, want a fixed message", msg)
+	}
+	_, err = s.client.Enroll(withKey(validateOnly), &totpv1.EnrollRequest{UserId: "alice"})
+	wantCode(t, "missing enroll scope", err, codes.PermissionDenied)
+	_, err = s.client.Validate(withKey(validateOnly), req)
+	wantCode(t, "validate scope", err, codes.NotFound)
+
+	// The bearer form is accepted too, and the request ID comes back.
+	ctx := metadata.AppendToOutgoingContext(context.Background(),
+		"authorization", "Bearer "+validateOnly, MetadataRequestID, "req-12345")
+	var header metadata.MD
+	_, err = s.client.Validate(ctx, req, grpc.Header(&header))
+	wantCode(t, "bearer key", err, codes.NotFound)
+	if got := header.Get(MetadataRequestID); len(got) != 1 || got[0] != "req-12345" {
+		t.Errorf("request ID = %v, want req-12345", got)
+	}
+}
+
+func TestKeyRateLimit(t *testing.T) {
+	s := newTestServer(t)
+	ctx := withKey(s.issueKey(t, apikey.IssueOptions{RateLimit: 1}))
+	req := &totpv1.GetStatusRequest{UserId: "alice"}
+
+	if _, err := s.client.GetStatus(ctx, req); err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+	_, err := s.client.GetStatus(ctx, req)
+	wantCode(t, "second call", err, codes.ResourceExhausted)
+}
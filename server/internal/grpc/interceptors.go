@@ -0,0 +1,175 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"go-auth-totp/internal/auth/apikey"
+	"go-auth-totp/internal/logging"
+	"go-auth-totp/internal/metrics"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+	"go-auth-totp/pkg/totpv1"
+	"log/slog"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata keys. Like HTTP headers, gRPC metadata keys are lowercase.
+const (
+	MetadataAPIKey    = "x-api-key"
+	MetadataRequestID = "x-request-id"
+)
+
+// methodScopes is the scope each method needs, as on the HTTP routes.
+var methodScopes = map[string]apikey.Scope{
+	totpv1.TOTPService_Enroll_FullMethodName:    apikey.ScopeEnroll,
+	totpv1.TOTPService_Verify_FullMethodName:    apikey.ScopeEnroll,
+	totpv1.TOTPService_Validate_FullMethodName:  apikey.ScopeValidate,
+	totpv1.TOTPService_Recover_FullMethodName:   apikey.ScopeValidate,
+	totpv1.TOTPService_GetStatus_FullMethodName: apikey.ScopeValidate,
+}
+
+// methodOps is the metrics operation of each method that checks or
+// changes a credential.
+var methodOps = map[string]string{
+	totpv1.TOTPService_Enroll_FullMethodName:   metrics.OpEnroll,
+	totpv1.TOTPService_Verify_FullMethodName:   metrics.OpVerify,
+	totpv1.TOTPService_Validate_FullMethodName: metrics.OpValidate,
+	totpv1.TOTPService_Recover_FullMethodName:  metrics.OpRecover,
+}
+
+// logCalls gives every call an ID, reusing a well-formed x-request-id from
+// the caller, returns it in the response header and logs one line per
+// call when the handler is done.
+func (s *Service) logCalls(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	id := firstValue(ctx, MetadataRequestID)
+	if !logging.ValidRequestID(id) {
+		id = logging.NewRequestID()
+	}
+	ctx = logging.WithRequestID(ctx, id)
+	grpc.SetHeader(ctx, metadata.Pairs(MetadataRequestID, id))
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	slog.InfoContext(ctx, "Request", "method", info.FullMethod, "code", status.Code(err).String(),
+		"duration_ms", time.Since(start).Milliseconds())
+	return resp, err
+}
+
+// authenticate identifies the caller by the API key in its metadata,
+// checks the method's scope and picks the tenant: the key's, or the
+// default tenant for anonymous calls (keys optional). It is the gRPC
+// counterpart of the HTTP API's Authenticate, RequireScope and
+// ResolveTenant. Keys that must sign their requests cannot call this API.
+func (s *Service) authenticate(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	scope, ok := methodScopes[info.FullMethod]
+	if !ok {
+		return nil, status.Error(codes.PermissionDenied, "No scope grants this method")
+	}
+
+	if s.opts.Auth != nil {
+		p, err := s.opts.Auth.AuthenticateToken(ctx, presentedKey(ctx))
+		switch {
+		case err == nil:
+			ctx = apikey.NewContext(ctx, p)
+		case errors.Is(err, apikey.ErrMissingKey) && !s.opts.Auth.Required():
+		case errors.Is(err, apikey.ErrMissingKey):
+			s.rejectKey(ctx, err)
+			return nil, status.Error(codes.Unauthenticated, "API key required")
+		case errors.Is(err, apikey.ErrInvalidKey), errors.Is(err, apikey.ErrRevokedKey),
+			errors.Is(err, apikey.ErrInvalidSignature):
+			slog.WarnContext(ctx, "Rejected API call", "method", info.FullMethod, "error", err)
+			s.rejectKey(ctx, err)
+			return nil, status.Error(codes.Unauthenticated, apikey.ClientMessage(err))
+		default:
+			return nil, statusError(err)
+		}
+	}
+
+	var t *tenant.Tenant
+	if p, ok := apikey.FromContext(ctx); ok {
+		if !p.HasScope(scope) {
+			return nil, status.Error(codes.PermissionDenied, "API key lacks the "+string(scope)+" scope")
+		}
+		if t, ok = s.opts.Tenants.Get(p.TenantID); !ok {
+			return nil, status.Error(codes.PermissionDenied, "API key tenant is not configured")
+		}
+	} else if t, ok = s.opts.Tenants.Default(); !ok {
+		return nil, status.Error(codes.InvalidArgument, "Tenant required: use an API key")
+	}
+	return handler(tenant.NewContext(ctx, t), req)
+}
+
+// rejectKey counts and audits a rejected call, under the default tenant
+// unless the key names its own.
+func (s *Service) rejectKey(ctx context.Context, err error) {
+	s.opts.Metrics.RecordAPIKeyRejection(err)
+	ip, ua := peerInfo(ctx)
+	s.opts.Audit.RecordRemoteRejection(storage.WithTenant(ctx, storage.DefaultTenant), ip, ua, err)
+}
+
+// rateLimit applies the caller's per-key rate limit.
+func (s *Service) rateLimit(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if p, ok := apikey.FromContext(ctx); ok && !s.opts.Auth.Allow(p) {
+		s.rejectKey(ctx, &apikey.KeyError{KeyID: p.KeyID, TenantID: p.TenantID, Err: apikey.ErrRateLimited})
+		return nil, status.Error(codes.ResourceExhausted, "Rate limit exceeded")
+	}
+	return handler(ctx, req)
+}
+
+// countAttempt records the outcome of the methods in methodOps.
+func (s *Service) countAttempt(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	resp, err := handler(ctx, req)
+	if op, ok := methodOps[info.FullMethod]; ok {
+		s.opts.Metrics.RecordAttempt(op, outcomeForCode(status.Code(err)))
+	}
+	return resp, err
+}
+
+// outcomeForCode classifies a call by its status code, like
+// metrics.OutcomeForStatus does for HTTP.
+func outcomeForCode(c codes.Code) string {
+	switch c {
+	case codes.OK:
+		return metrics.OutcomeSuccess
+	case codes.PermissionDenied:
+		return metrics.OutcomeInvalidCode
+	case codes.ResourceExhausted:
+		return metrics.OutcomeRateLimited
+	case codes.FailedPrecondition, codes.NotFound:
+		return metrics.OutcomeNotEnabled
+	default:
+		return metrics.OutcomeError
+	}
+}
+
+// presentedKey returns the key in the x-api-key or authorization
+// ("Bearer <key>") metadata.
+func presentedKey(ctx context.Context) string {
+	if key := firstValue(ctx, MetadataAPIKey); key != "" {
+		return key
+	}
+	if key, ok := strings.CutPrefix(firstValue(ctx, "authorization"), "Bearer "); ok {
+		return strings.TrimSpace(key)
+	}
+	return ""
+}
+
+func firstValue(ctx context.Context, key string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// tenantOf returns the tenant picked by authenticate.
+func tenantOf(ctx context.Context) *tenant.Tenant {
+	t, _ := tenant.FromContext(ctx)
+	return t
+}
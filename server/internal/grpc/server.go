@@ -0,0 +1,300 @@
+// Package grpc serves totpv1.TOTPService, the gRPC counterpart of the
+// HTTP API's /enroll, /verify, /validate and /recover. It runs on its own
+// port but shares the repository, rate limiter, API keys, audit log,
+// webhooks and assertion signer with the HTTP API, and uses the same
+// account and validate services, so both APIs behave alike.
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-auth-totp/internal/audit"
+	"go-auth-totp/internal/auth/account"
+	"go-auth-totp/internal/auth/apikey"
+	"go-auth-totp/internal/auth/validate"
+	"go-auth-totp/internal/metrics"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+	"go-auth-totp/pkg/assertion"
+	"go-auth-totp/pkg/totpv1"
+	"log/slog"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Options configure the service.
+type Options struct {
+	// Auth authenticates callers (see authenticate); nil disables it.
+	Auth *apikey.Authenticator
+	// Tenants resolves the tenant of each call: the API key's, or the
+	// default tenant for anonymous calls.
+	Tenants  *tenant.Registry
+	Accounts *account.Service
+	Codes    *validate.Service
+	// Metrics counts attempts like the HTTP API; nil disables it.
+	Metrics *metrics.Metrics
+	// Audit records security events; nil disables it.
+	Audit *audit.Recorder
+	// Assertions signs the assertions Validate and Recover return on
+	// request; nil disables them.
+	Assertions *assertion.Signer
+}
+
+// Service implements totpv1.TOTPServiceServer.
+type Service struct {
+	totpv1.UnimplementedTOTPServiceServer
+	opts Options
+}
+
+// NewService returns the service; see NewServer for serving it.
+func NewService(opts Options) *Service {
+	return &Service{opts: opts}
+}
+
+// NewServer returns a gRPC server with the service registered behind the
+// logging, auth, rate limit and metrics interceptors, in that order.
+func NewServer(opts Options, serverOpts ...grpc.ServerOption) *grpc.Server {
+	s := NewService(opts)
+	serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(
+		s.logCalls, s.authenticate, s.rateLimit, s.countAttempt,
+	))
+	srv := grpc.NewServer(serverOpts...)
+	totpv1.RegisterTOTPServiceServer(srv, s)
+	return srv
+}
+
+func (s *Service) Enroll(ctx context.Context, req *totpv1.EnrollRequest) (*totpv1.EnrollResponse, error) {
+	if err := requireUser(req.GetUserId()); err != nil {
+		return nil, err
+	}
+	t := tenantOf(ctx)
+	slog.InfoContext(ctx, "Enrolling user", "user_id", req.GetUserId(), "tenant", t.ID)
+	resp, err := s.opts.Accounts.Enroll(ctx, t, req.GetUserId())
+	s.audit(ctx, audit.EventEnroll, req.GetUserId(), audit.CredentialTOTP, err)
+	if err != nil {
+		slog.ErrorContext(ctx, "Enrollment failed", "user_id", req.GetUserId(), "error", err)
+		return nil, statusError(err)
+	}
+	return &totpv1.EnrollResponse{
+		Secret:        resp.Secret,
+		OtpauthUrl:    resp.OTPAuthURL,
+		RecoveryCodes: resp.RecoveryCodes,
+	}, nil
+}
+
+func (s *Service) Verify(ctx context.Context, req *totpv1.VerifyRequest) (*totpv1.VerifyResponse, error) {
+	if err := requireUser(req.GetUserId()); err != nil {
+		return nil, err
+	}
+	err := s.opts.Accounts.Verify(ctx, tenantOf(ctx), req.GetUserId(), req.GetCode())
+	s.audit(ctx, audit.EventVerify, req.GetUserId(), audit.CredentialTOTP, err)
+	if err != nil {
+		slog.WarnContext(ctx, "Verify failed", "user_id", req.GetUserId(), "error", err)
+		return nil, statusError(err)
+	}
+	return &totpv1.VerifyResponse{}, nil
+}
+
+func (s *Service) Validate(ctx context.Context, req *totpv1.ValidateRequest) (*totpv1.ValidateResponse, error) {
+	if err := requireUser(req.GetUserId()); err != nil {
+		return nil, err
+	}
+	t := tenantOf(ctx)
+	if err := s.allowAudience(t, req.GetAudience()); err != nil {
+		return nil, err
+	}
+	err := s.opts.Codes.Validate(ctx, t, req.GetUserId(), req.GetCode())
+	s.audit(ctx, audit.EventValidate, req.GetUserId(), audit.CredentialTOTP, err)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	a, err := s.sign(ctx, assertion.Claims{
+		Subject:    req.GetUserId(),
+		Audience:   req.GetAudience(),
+		Tenant:     t.ID,
+		Method:     assertion.MethodTOTP,
+		Credential: audit.CredentialTOTP,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &totpv1.ValidateResponse{Assertion: a}, nil
+}
+
+func (s *Service) Recover(ctx context.Context, req *totpv1.RecoverRequest) (*totpv1.RecoverResponse, error) {
+	if err := requireUser(req.GetUserId()); err != nil {
+		return nil, err
+	}
+	t := tenantOf(ctx)
+	if err := s.allowAudience(t, req.GetAudience()); err != nil {
+		return nil, err
+	}
+	rec, err := s.opts.Accounts.Recover(ctx, t, req.GetUserId(), req.GetCode())
+	s.audit(ctx, audit.EventRecover, req.GetUserId(), audit.CredentialRecoveryCode, err)
+	if errors.Is(err, account.ErrInvalidCode) {
+		return nil, status.Error(codes.PermissionDenied, "Invalid recovery code")
+	}
+	if err != nil {
+		return nil, statusError(err)
+	}
+	a, err := s.sign(ctx, assertion.Claims{
+		Subject:    req.GetUserId(),
+		Audience:   req.GetAudience(),
+		Tenant:     t.ID,
+		Method:     assertion.MethodRecovery,
+		Credential: fmt.Sprintf("%s:%d", audit.CredentialRecoveryCode, rec.Index),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &totpv1.RecoverResponse{RemainingRecoveryCodes: int32(rec.Remaining), Assertion: a}, nil
+}
+
+func (s *Service) GetStatus(ctx context.Context, req *totpv1.GetStatusRequest) (*totpv1.GetStatusResponse, error) {
+	if err := requireUser(req.GetUserId()); err != nil {
+		return nil, err
+	}
+	user, err := s.opts.Accounts.Get(ctx, tenantOf(ctx), req.GetUserId())
+	if errors.Is(err, storage.ErrUserNotFound) {
+		return &totpv1.GetStatusResponse{}, nil
+	}
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &totpv1.GetStatusResponse{
+		Enrolled:               true,
+		Enabled:                user.Enabled,
+		EnabledAt:              timestamp(user.EnabledAt),
+		RemainingRecoveryCodes: int32(user.RemainingRecoveryCodes()),
+		LastVerifiedAt:         timestamp(user.LastVerifiedAt),
+		FailedAttempts:         int32(user.FailedAttempts),
+	}, nil
+}
+
+func requireUser(userID string) error {
+	if userID == "" {
+		return status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	return nil
+}
+
+// timestamp leaves zero times (events that have not happened) unset.
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+// allowAudience rejects assertion requests the server cannot honor: an
+// audience must be one of t's.
+func (s *Service) allowAudience(t *tenant.Tenant, audience string) error {
+	switch {
+	case audience == "":
+		return nil
+	case s.opts.Assertions == nil:
+		return status.Error(codes.InvalidArgument, "Assertions are not enabled")
+	case len(t.AssertionAudiences) == 0:
+		return status.Error(codes.InvalidArgument, "No assertion audiences are configured for this tenant")
+	case !t.AllowsAudience(audience):
+		return status.Error(codes.InvalidArgument, "Unknown audience")
+	}
+	return nil
+}
+
+// sign returns the assertion for c, or nil when c names no audience.
+func (s *Service) sign(ctx context.Context, c assertion.Claims) (*totpv1.Assertion, error) {
+	if c.Audience == "" {
+		return nil, nil
+	}
+	token, issued, err := s.opts.Assertions.Sign(c)
+	if err != nil {
+		slog.ErrorContext(ctx, "Signing assertion failed", "user_id", c.Subject, "error", err)
+		return nil, status.Error(codes.Internal, "Failed to sign assertion")
+	}
+	return &totpv1.Assertion{Token: token, ExpiresAt: timestamppb.New(issued.Expiry())}, nil
+}
+
+// audit records the outcome of a call about userID's credential.
+func (s *Service) audit(ctx context.Context, event, userID, credential string, err error) {
+	s.auditEvent(ctx, audit.Event{Type: event, UserID: userID, Credential: credential, Outcome: auditOutcome(err)})
+}
+
+func (s *Service) auditEvent(ctx context.Context, e audit.Event) {
+	ip, ua := peerInfo(ctx)
+	s.opts.Audit.RecordRemote(ctx, audit.Actor(ctx), ip, ua, e)
+}
+
+// peerInfo returns the caller's IP and user agent.
+func peerInfo(ctx context.Context) (ip, ua string) {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		ip = p.Addr.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("user-agent"); len(v) > 0 {
+			ua = v[0]
+		}
+	}
+	return ip, ua
+}
+
+// auditOutcome classifies an error of the account or validate services
+// for the audit log, like the HTTP API does.
+func auditOutcome(err error) string {
+	switch {
+	case err == nil:
+		return audit.OutcomeSuccess
+	case errors.Is(err, account.ErrRateLimited):
+		return audit.OutcomeRateLimited
+	case errors.Is(err, account.ErrInvalidCode):
+		return audit.OutcomeInvalidCode
+	case errors.Is(err, account.ErrNotEnabled), errors.Is(err, storage.ErrUserNotFound):
+		return audit.OutcomeNotEnabled
+	default:
+		return audit.OutcomeError
+	}
+}
+
+// statusError maps an error of the account or validate services, or of
+// the repository, onto a gRPC status.
+func statusError(err error) error {
+	switch {
+	case errors.Is(err, account.ErrRateLimited):
+		return status.Error(codes.ResourceExhausted, "Rate limit exceeded")
+	case errors.Is(err, account.ErrNotEnabled):
+		return status.Error(codes.FailedPrecondition, "TOTP not enabled")
+	case errors.Is(err, account.ErrAlreadyEnabled):
+		return status.Error(codes.AlreadyExists, "TOTP already enabled")
+	case errors.Is(err, account.ErrInvalidCode):
+		return status.Error(codes.PermissionDenied, "Invalid code")
+	case errors.Is(err, account.ErrEnroll):
+		return status.Error(codes.Internal, "Failed to generate secret")
+	case errors.Is(err, account.ErrDecrypt):
+		return status.Error(codes.Internal, "Failed to decrypt secret")
+	case errors.Is(err, account.ErrVerify):
+		return status.Error(codes.Internal, "Verification error")
+	case errors.Is(err, storage.ErrUserNotFound):
+		return status.Error(codes.NotFound, "User not found")
+	case errors.Is(err, storage.ErrConflict), errors.Is(err, storage.ErrVersionMismatch):
+		return status.Error(codes.Aborted, "User was modified concurrently, retry the request")
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, "Request canceled")
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, "Storage timed out")
+	case errors.Is(err, storage.ErrUnavailable):
+		return status.Error(codes.Unavailable, "Storage unavailable")
+	default:
+		return status.Error(codes.Internal, "Storage error")
+	}
+}
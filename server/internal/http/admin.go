@@ -0,0 +1,182 @@
+package http
+
+import (
+	"go-auth-totp/internal/audit"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/webhook"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// AdminUser is the admin view of a user. It never includes the secret or code hashes.
+type AdminUser struct {
+	ID             string     `json:"id"`
+	Enabled        bool       `json:"enabled"`
+	CreatedAt      time.Time  `json:"created_at"`
+	EnabledAt      *time.Time `json:"enabled_at,omitempty"`
+	LastVerifiedAt *time.Time `json:"last_verified_at,omitempty"`
+	LastFailedAt   *time.Time `json:"last_failed_at,omitempty"`
+	FailedAttempts int        `json:"failed_attempts"`
+	TotalFailures  int        `json:"total_failures"`
+
+	// Only populated for single-user responses.
+	RecoveryCodesRemaining *int                `json:"recovery_codes_remaining,omitempty"`
+	RecoveryCodes          []AdminRecoveryCode `json:"recovery_codes,omitempty"`
+}
+
+// AdminRecoveryCode identifies a recovery code by its position in the set
+// handed out at enrollment.
+type AdminRecoveryCode struct {
+	Index  int        `json:"index"`
+	UsedAt *time.Time `json:"used_at,omitempty"`
+}
+
+type ListUsersResponse struct {
+	Users      []AdminUser `json:"users"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+func toAdminUser(u *storage.User, withCodes bool) AdminUser {
+	au := AdminUser{
+		ID:             u.ID,
+		Enabled:        u.Enabled,
+		CreatedAt:      u.CreatedAt,
+		EnabledAt:      optionalTime(u.EnabledAt),
+		LastVerifiedAt: optionalTime(u.LastVerifiedAt),
+		LastFailedAt:   optionalTime(u.LastFailedAt),
+		FailedAttempts: u.FailedAttempts,
+		TotalFailures:  u.TotalFailures,
+	}
+	if withCodes {
+		n := u.RemainingRecoveryCodes()
+		au.RecoveryCodesRemaining = &n
+		for i, c := range u.RecoveryCodes {
+			au.RecoveryCodes = append(au.RecoveryCodes, AdminRecoveryCode{Index: i, UsedAt: optionalTime(c.UsedAt)})
+		}
+	}
+	return au
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// ListUsersHandler returns a page of users.
+// Query params: enabled, created_after, created_before, last_verified_after,
+// last_verified_before (RFC 3339), min_failed_attempts, cursor, limit.
+func (h *Handlers) ListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts := storage.ListUsersOptions{Cursor: q.Get("cursor")}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			h.ErrorJSON(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		opts.Limit = limit
+	}
+	if v := q.Get("enabled"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			h.ErrorJSON(w, http.StatusBadRequest, "Invalid enabled filter")
+			return
+		}
+		opts.Enabled = &enabled
+	}
+	if v := q.Get("min_failed_attempts"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			h.ErrorJSON(w, http.StatusBadRequest, "Invalid min_failed_attempts")
+			return
+		}
+		opts.MinFailedAttempts = n
+	}
+	timeParams := []struct {
+		name string
+		dst  *time.Time
+	}{
+		{"created_after", &opts.CreatedAfter},
+		{"created_before", &opts.CreatedBefore},
+		{"last_verified_after", &opts.LastVerifiedAfter},
+		{"last_verified_before", &opts.LastVerifiedBefore},
+	}
+	for _, p := range timeParams {
+		t, err := parseTimeParam(q.Get(p.name))
+		if err != nil {
+			h.ErrorJSON(w, http.StatusBadRequest, "Invalid "+p.name+", expected RFC 3339")
+			return
+		}
+		*p.dst = t
+	}
+
+	page, err := h.Repo.ListUsers(r.Context(), opts)
+	if err != nil {
+		h.StorageError(w, err)
+		return
+	}
+
+	resp := ListUsersResponse{Users: make([]AdminUser, 0, len(page.Users)), NextCursor: page.NextCursor}
+	for _, u := range page.Users {
+		resp.Users = append(resp.Users, toAdminUser(u, false))
+	}
+	h.EncodeJSON(w, http.StatusOK, resp)
+}
+
+// GetUserHandler returns a single user.
+func (h *Handlers) GetUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := h.Repo.GetUser(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		h.StorageError(w, err)
+		return
+	}
+	h.EncodeJSON(w, http.StatusOK, toAdminUser(user, true))
+}
+
+// DisableUserHandler turns 2FA off for a user.
+func (h *Handlers) DisableUserHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	ctx, err := h.Webhooks.WithEvents(r.Context(), webhook.Event{Type: webhook.EventTOTPDisabled, UserID: id})
+	if err != nil {
+		h.StorageError(w, err)
+		return
+	}
+	if err := h.Repo.DisableUser(ctx, id); err != nil {
+		h.StorageError(w, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Disabled 2FA", "user_id", id)
+	h.Audit.Record(r, audit.Event{Type: audit.EventUserDisabled, UserID: id, Outcome: audit.OutcomeSuccess})
+	h.EncodeJSON(w, http.StatusOK, StatusResponse{Status: "disabled"})
+}
+
+// DeleteUserHandler removes a user and its recovery codes.
+func (h *Handlers) DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	ctx, err := h.Webhooks.WithEvents(r.Context(), webhook.Event{Type: webhook.EventTOTPDisabled, UserID: id})
+	if err != nil {
+		h.StorageError(w, err)
+		return
+	}
+	if err := h.Repo.DeleteUser(ctx, id); err != nil {
+		h.StorageError(w, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Deleted user", "user_id", id)
+	h.Audit.Record(r, audit.Event{Type: audit.EventUserDeleted, UserID: id, Outcome: audit.OutcomeSuccess})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func parseTimeParam(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
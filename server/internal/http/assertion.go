@@ -0,0 +1,52 @@
+package http
+
+import (
+	"go-auth-totp/internal/tenant"
+	"go-auth-totp/pkg/assertion"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// allowAudience rejects an assertion request the server cannot honour,
+// before any code is checked or spent. An empty audience asks for none;
+// any other must be one of t's audiences.
+func (h *Handlers) allowAudience(w http.ResponseWriter, t *tenant.Tenant, audience string) bool {
+	switch {
+	case audience == "":
+		return true
+	case h.Assertions == nil:
+		h.ErrorJSON(w, http.StatusBadRequest, "Assertions are not enabled")
+		return false
+	case len(t.AssertionAudiences) == 0:
+		h.ErrorJSON(w, http.StatusBadRequest, "No assertion audiences are configured for this tenant")
+		return false
+	case !t.AllowsAudience(audience):
+		h.ErrorJSON(w, http.StatusBadRequest, "Unknown audience")
+		return false
+	}
+	return true
+}
+
+// assert fills f with a signed assertion when c names an audience. It
+// writes the error response and returns false if signing fails.
+func (h *Handlers) assert(w http.ResponseWriter, r *http.Request, f *AssertionFields, c assertion.Claims) bool {
+	if c.Audience == "" {
+		return true
+	}
+	token, issued, err := h.Assertions.Sign(c)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Signing assertion failed", "user_id", c.Subject, "error", err)
+		h.ErrorJSON(w, http.StatusInternalServerError, "Failed to sign assertion")
+		return false
+	}
+	f.Assertion = token
+	f.AssertionExpiresAt = issued.Expiry().UTC().Format(time.RFC3339)
+	return true
+}
+
+// JWKSHandler serves the public keys that verify assertions.
+func (h *Handlers) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	h.EncodeJSON(w, http.StatusOK, h.Assertions.JWKS())
+}
@@ -0,0 +1,102 @@
+package http
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"go-auth-totp/pkg/assertion"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAssertions(t *testing.T) {
+	h := newTestHandlers(t)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	h.Assertions = assertion.NewSigner(key, assertion.SignerOptions{Issuer: "Test"})
+	h.AssertionAudiences = []string{"billing"}
+	router := NewRouter(h)
+
+	rec := postJSON(t, h.EnrollHandler, `{"user_id":"alice"}`)
+	var enrolled EnrollResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &enrolled); err != nil {
+		t.Fatalf("decode enroll: %v", err)
+	}
+	code := currentCode(t, enrolled.Secret)
+	if rec := postJSON(t, h.VerifyHandler, `{"user_id":"alice","code":"`+code+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("verify = %d", rec.Code)
+	}
+
+	// Downstream services verify with the published keys only.
+	rec = serve(router, http.MethodGet, "/.well-known/jwks.json", "", "")
+	var jwks assertion.JWKS
+	if err := json.Unmarshal(rec.Body.Bytes(), &jwks); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("jwks = %d %s", rec.Code, rec.Body)
+	}
+	v := &assertion.Verifier{Keys: jwks, Issuer: "Test", Audience: "billing", Tenant: "default"}
+	assertionOf := func(rec *httptest.ResponseRecorder) *assertion.Claims {
+		t.Helper()
+		var resp map[string]string
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		noteSensitive(resp["assertion"])
+		if resp["assertion_expires_at"] == "" {
+			t.Fatalf("no assertion expiry in %v", resp)
+		}
+		c, err := v.Verify(context.Background(), resp["assertion"])
+		if err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+		return c
+	}
+
+	// Without an audience the answer stays as it was.
+	if rec := serve(router, http.MethodPost, "/validate", "", `{"user_id":"alice","code":"`+code+`"}`); rec.Body.String() != "{\"status\":\"valid\"}\n" {
+		t.Fatalf("validate without audience = %s", rec.Body)
+	}
+	rec = serve(router, http.MethodPost, "/validate", "", `{"user_id":"alice","code":"`+code+`","audience":"billing"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("validate = %d %s", rec.Code, rec.Body)
+	}
+	if c := assertionOf(rec); c.Subject != "alice" || c.Method != assertion.MethodTOTP || c.Credential != "totp" || c.Tenant != "default" {
+		t.Fatalf("validate claims = %+v", c)
+	}
+
+	rec = serve(router, http.MethodPost, "/recover", "", `{"user_id":"alice","code":"`+enrolled.RecoveryCodes[2]+`","audience":"billing"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("recover = %d %s", rec.Code, rec.Body)
+	}
+	if c := assertionOf(rec); c.Method != assertion.MethodRecovery || c.Credential != "recovery_code:2" {
+		t.Fatalf("recover claims = %+v", c)
+	}
+
+	// An audience the server does not serve is refused before the code is
+	// spent.
+	rec = serve(router, http.MethodPost, "/recover", "", `{"user_id":"alice","code":"`+enrolled.RecoveryCodes[3]+`","audience":"payroll"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("unknown audience = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if rec := serve(router, http.MethodPost, "/recover", "", `{"user_id":"alice","code":"`+enrolled.RecoveryCodes[3]+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("recovery code spent by refused request: %d", rec.Code)
+	}
+
+	// A tenant without audiences gets no assertions at all.
+	h.AssertionAudiences = nil
+	if rec := serve(router, http.MethodPost, "/validate", "", `{"user_id":"alice","code":"`+code+`","audience":"billing"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("no audiences configured = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	h.Assertions = nil
+	router = NewRouter(h)
+	if rec := serve(router, http.MethodPost, "/validate", "", `{"user_id":"alice","code":"`+code+`","audience":"billing"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("assertions disabled = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if rec := serve(router, http.MethodGet, "/.well-known/jwks.json", "", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("jwks with assertions disabled = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,68 @@
+package http
+
+import (
+	"go-auth-totp/internal/storage"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type ListAuditResponse struct {
+	Events []storage.AuditEvent `json:"events"`
+	// NextAfter is passed back as ?after= to fetch the next page.
+	NextAfter int64 `json:"next_after,omitempty"`
+}
+
+// ListAuditHandler returns a page of the tenant's audit events, oldest
+// first. Query params: user_id, type, since, until (RFC 3339), after, limit.
+func (h *Handlers) ListAuditHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := storage.AuditQuery{UserID: q.Get("user_id"), Type: q.Get("type")}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			h.ErrorJSON(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		query.Limit = limit
+	}
+	if v := q.Get("after"); v != "" {
+		after, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || after < 0 {
+			h.ErrorJSON(w, http.StatusBadRequest, "Invalid after")
+			return
+		}
+		query.AfterSeq = after
+	}
+	timeParams := []struct {
+		name string
+		dst  *time.Time
+	}{
+		{"since", &query.Since},
+		{"until", &query.Until},
+	}
+	for _, p := range timeParams {
+		t, err := parseTimeParam(q.Get(p.name))
+		if err != nil {
+			h.ErrorJSON(w, http.StatusBadRequest, "Invalid "+p.name+", expected RFC 3339")
+			return
+		}
+		*p.dst = t
+	}
+
+	events, err := h.Audit.List(r.Context(), query)
+	if err != nil {
+		h.StorageError(w, err)
+		return
+	}
+
+	resp := ListAuditResponse{Events: events}
+	if resp.Events == nil {
+		resp.Events = []storage.AuditEvent{}
+	}
+	if n := len(events); n > 0 && n == query.PageSize() {
+		resp.NextAfter = events[n-1].Seq
+	}
+	h.EncodeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,116 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"go-auth-totp/internal/audit"
+	"go-auth-totp/internal/auth/apikey"
+	"go-auth-totp/internal/auth/enroll"
+	"go-auth-totp/internal/auth/ratelimit"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/pkg/totp"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	_, h := newAuthRouter(t)
+	store := h.Repo.(storage.AuditStore)
+	h.Audit = audit.NewRecorder(store)
+	// Three validations per user, then the limiter kicks in.
+	h.Limiter = ratelimit.NewInMemoryLimiter(time.Hour, 3)
+	router := NewRouter(h)
+	key := issueKey(t, h, "acme", apikey.IssueOptions{})
+	globexKey := issueKey(t, h, "globex", apikey.IssueOptions{}).Token
+
+	rec := serve(router, http.MethodPost, "/enroll", key.Token, `{"user_id":"alice"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("enroll = %d %s", rec.Code, rec.Body)
+	}
+	var enrolled enroll.EnrollmentResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &enrolled); err != nil {
+		t.Fatalf("decode enroll: %v", err)
+	}
+	code, err := (&totp.Generator{Digits: 8, Period: 60}).GenerateCodeFromBase32(enrolled.Secret, uint64(time.Now().Unix()))
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	noteSensitive(code)
+	wrong := "00000000"
+	if code == wrong {
+		wrong = "11111111"
+	}
+
+	steps := []struct {
+		path, apiKey, code string
+		want               int
+	}{
+		{"/verify", key.Token, code, http.StatusOK},
+		{"/validate", key.Token, code, http.StatusOK},
+		{"/validate", key.Token, wrong, http.StatusUnauthorized},
+		{"/validate", key.Token, wrong, http.StatusTooManyRequests},
+		{"/t/acme/validate", "tk_000000000000_nope", code, http.StatusUnauthorized},
+		{"/t/acme/validate", "tk_000000000000_nope", code, http.StatusUnauthorized},
+	}
+	for _, s := range steps {
+		if rec := serve(router, http.MethodPost, s.path, s.apiKey, `{"user_id":"alice","code":"`+s.code+`"}`); rec.Code != s.want {
+			t.Fatalf("POST %s = %d, want %d (%s)", s.path, rec.Code, s.want, rec.Body)
+		}
+	}
+
+	rec = serve(router, http.MethodGet, "/admin/audit?user_id=alice&type=validate", key.Token, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/admin/audit = %d %s", rec.Code, rec.Body)
+	}
+	var page ListAuditResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+		t.Fatalf("decode audit: %v", err)
+	}
+	var outcomes []string
+	for _, e := range page.Events {
+		if e.TenantID != "acme" || e.Actor != "key:"+key.Key.ID || e.Credential != audit.CredentialTOTP || e.IP == "" || e.RequestID == "" {
+			t.Errorf("incomplete event: %+v", e)
+		}
+		outcomes = append(outcomes, e.Outcome)
+	}
+	want := []string{audit.OutcomeSuccess, audit.OutcomeInvalidCode, audit.OutcomeRateLimited}
+	if len(outcomes) != len(want) {
+		t.Fatalf("validate outcomes = %v, want %v", outcomes, want)
+	}
+	for i := range want {
+		if outcomes[i] != want[i] {
+			t.Fatalf("validate outcomes = %v, want %v", outcomes, want)
+		}
+	}
+
+	// The rejected key is recorded against the tenant in the path, once
+	// per window.
+	rec = serve(router, http.MethodGet, "/admin/audit?type=api_auth", key.Token, "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+		t.Fatalf("decode audit: %v", err)
+	}
+	if len(page.Events) != 1 || page.Events[0].Actor != audit.ActorAnonymous || page.Events[0].Outcome != audit.OutcomeDenied ||
+		page.Events[0].Detail != "invalid_key" {
+		t.Fatalf("api_auth events = %+v", page.Events)
+	}
+
+	if rec := serve(router, http.MethodGet, "/admin/audit?since=yesterday", key.Token, ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad since = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	// Other tenants see none of it.
+	if rec := serve(router, http.MethodGet, "/t/globex/admin/audit", globexKey, ""); rec.Code != http.StatusOK || rec.Body.String() != "{\"events\":[]}\n" {
+		t.Errorf("globex audit = %d %s", rec.Code, rec.Body)
+	}
+
+	all, err := store.ListAuditEvents(context.Background(), storage.AuditQuery{AllTenants: true, Limit: storage.MaxAuditLimit})
+	if err != nil {
+		t.Fatalf("ListAuditEvents: %v", err)
+	}
+	if len(all) != 6 {
+		t.Errorf("recorded %d events, want 6", len(all))
+	}
+	if err := storage.VerifyAuditChain(all); err != nil {
+		t.Fatalf("VerifyAuditChain: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package http
+
+import (
+	"errors"
+	"go-auth-totp/internal/auth/apikey"
+	"go-auth-totp/internal/storage"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Authenticate is middleware that identifies the caller by API key and
+// attaches the apikey.Principal to the request context. Without an
+// Authenticator, or when keys are optional and none was sent, the request
+// continues anonymously. Rejections are counted and audited (see
+// audit.Recorder.RecordRejection).
+func (h *Handlers) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.Auth == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p, err := h.Auth.Authenticate(r)
+		switch {
+		case err == nil:
+			next.ServeHTTP(w, r.WithContext(apikey.NewContext(r.Context(), p)))
+		case errors.Is(err, apikey.ErrMissingKey) && !h.Auth.Required():
+			next.ServeHTTP(w, r)
+		case errors.Is(err, apikey.ErrMissingKey):
+			h.rejectKey(r, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="totp"`)
+			h.ErrorJSON(w, http.StatusUnauthorized, "API key required")
+		case bodyTooLarge(err):
+			h.ErrorJSON(w, http.StatusRequestEntityTooLarge, "Request body too large")
+		case errors.Is(err, apikey.ErrRateLimited):
+			h.rejectKey(r, err)
+			h.ErrorJSON(w, http.StatusTooManyRequests, "Rate limit exceeded")
+		case errors.Is(err, apikey.ErrInvalidKey), errors.Is(err, apikey.ErrRevokedKey),
+			errors.Is(err, apikey.ErrInvalidSignature), errors.Is(err, apikey.ErrReplayedRequest):
+			slog.WarnContext(r.Context(), "Rejected API request", "path", r.URL.Path, "error", err)
+			h.rejectKey(r, err)
+			h.ErrorJSON(w, http.StatusUnauthorized, apikey.ClientMessage(err))
+		default:
+			h.StorageError(w, err)
+		}
+	})
+}
+
+// rejectKey counts and audits a rejected API request. Unless the key
+// names its tenant, the event goes to the tenant in the path if it exists,
+// and to the default tenant otherwise.
+func (h *Handlers) rejectKey(r *http.Request, err error) {
+	h.Metrics.RecordAPIKeyRejection(err)
+	tenantID := storage.DefaultTenant
+	if id := mux.Vars(r)["tenant"]; id != "" && h.Tenants != nil {
+		if _, ok := h.Tenants.Get(id); ok {
+			tenantID = id
+		}
+	}
+	h.Audit.RecordRejection(r.WithContext(storage.WithTenant(r.Context(), tenantID)), err)
+}
+
+// RequireScope lets the request through only if the caller's key has
+// scope. Anonymous requests (keys optional) are let through.
+func (h *Handlers) RequireScope(scope apikey.Scope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := apikey.FromContext(r.Context()); ok && !p.HasScope(scope) {
+			h.ErrorJSON(w, http.StatusForbidden, "API key lacks the "+string(scope)+" scope")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,224 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"go-auth-totp/internal/auth/apikey"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tlsutil"
+	"go-auth-totp/internal/tlsutil/tlstest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newAuthRouter serves the default tenant with API keys required.
+func newAuthRouter(t *testing.T) (http.Handler, *Handlers) {
+	t.Helper()
+	router, h := newTenantRouter(t)
+	h.Auth = apikey.NewAuthenticator(h.Repo.(storage.KeyStore), h.Tenants, apikey.Options{Required: true})
+	return router, h
+}
+
+func TestAuthenticationAndScopes(t *testing.T) {
+	router, h := newAuthRouter(t)
+	validateOnly := issueKey(t, h, "acme", apikey.IssueOptions{Scopes: []apikey.Scope{apikey.ScopeValidate}}).Token
+	revoked := issueKey(t, h, "acme", apikey.IssueOptions{})
+	if err := h.Repo.(storage.KeyStore).RevokeAPIKey(context.Background(), revoked.Key.ID, time.Now()); err != nil {
+		t.Fatalf("RevokeAPIKey: %v", err)
+	}
+	// Right ID, wrong secret.
+	forged := "tk_" + revoked.Key.ID + "_" + "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+
+	tests := []struct {
+		name, method, path, apiKey string
+		want                       int
+	}{
+		{"no key", http.MethodPost, "/t/acme/enroll", "", http.StatusUnauthorized},
+		{"malformed key", http.MethodPost, "/enroll", "not-a-key", http.StatusUnauthorized},
+		{"wrong secret", http.MethodPost, "/enroll", forged, http.StatusUnauthorized},
+		{"revoked key", http.MethodPost, "/enroll", revoked.Token, http.StatusUnauthorized},
+		{"missing enroll scope", http.MethodPost, "/enroll", validateOnly, http.StatusForbidden},
+		{"missing admin scope", http.MethodGet, "/admin/users", validateOnly, http.StatusForbidden},
+		{"validate scope", http.MethodPost, "/validate", validateOnly, http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		if rec := serve(router, tc.method, tc.path, tc.apiKey, `{"user_id":"alice","code":"123456"}`); rec.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d (%s)", tc.name, rec.Code, tc.want, rec.Body)
+		}
+	}
+
+	// Rejections carry a fixed message, never the key ID or other detail.
+	for _, token := range []string{forged, revoked.Token} {
+		rec := serve(router, http.MethodPost, "/enroll", token, `{"user_id":"alice"}`)
+		if body := strings.TrimSpace(rec.Body.String()); body != `{"error":"Invalid API key"}` {
+			t.Errorf("rejection body = %s, want a fixed message", body)
+		}
+	}
+
+	// The bearer form is accepted too.
+	req := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewBufferString(`{"user_id":"alice","code":"123456"}`))
+	req.Header.Set("Authorization", "Bearer "+validateOnly)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("bearer key: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestSignedRequests(t *testing.T) {
+	router, h := newAuthRouter(t)
+	issued := issueKey(t, h, "acme", apikey.IssueOptions{Signed: true})
+	body := `{"user_id":"alice","code":"123456"}`
+
+	newRequest := func(body string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewBufferString(body))
+		req.Header.Set(apikey.HeaderAPIKey, issued.Token)
+		return req
+	}
+	do := func(req *http.Request) int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := do(newRequest(body)); code != http.StatusUnauthorized {
+		t.Fatalf("unsigned request = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	signed := newRequest(body)
+	if err := apikey.SignRequest(signed, issued.SigningSecret, time.Now()); err != nil {
+		t.Fatalf("SignRequest: %v", err)
+	}
+	replay := newRequest(body)
+	replay.Header = signed.Header.Clone()
+	// The handler still sees the body after verification: unknown user, not a 400.
+	if code := do(signed); code != http.StatusNotFound {
+		t.Fatalf("signed request = %d, want %d", code, http.StatusNotFound)
+	}
+	if code := do(replay); code != http.StatusUnauthorized {
+		t.Fatalf("replayed request = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	tampered := newRequest(body)
+	if err := apikey.SignRequest(tampered, issued.SigningSecret, time.Now()); err != nil {
+		t.Fatalf("SignRequest: %v", err)
+	}
+	tampered.Body = newRequest(`{"user_id":"bob","code":"123456"}`).Body
+	if code := do(tampered); code != http.StatusUnauthorized {
+		t.Fatalf("tampered body = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	stale := newRequest(body)
+	if err := apikey.SignRequest(stale, issued.SigningSecret, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("SignRequest: %v", err)
+	}
+	if code := do(stale); code != http.StatusUnauthorized {
+		t.Fatalf("stale timestamp = %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestPerKeyRateLimit(t *testing.T) {
+	router, h := newAuthRouter(t)
+	limited := issueKey(t, h, "acme", apikey.IssueOptions{RateLimit: 2}).Token
+	other := issueKey(t, h, "acme", apikey.IssueOptions{RateLimit: 2}).Token
+
+	for i := 0; i < 2; i++ {
+		if rec := serve(router, http.MethodGet, "/admin/users", limited, ""); rec.Code != http.StatusOK {
+			t.Fatalf("request %d = %d", i, rec.Code)
+		}
+	}
+	if rec := serve(router, http.MethodGet, "/admin/users", limited, ""); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("third request = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if rec := serve(router, http.MethodGet, "/admin/users", other, ""); rec.Code != http.StatusOK {
+		t.Fatalf("other key = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	router, h := newAuthRouter(t)
+	serverCA := tlstest.NewCA(t, "server-ca")
+	clientCA := tlstest.NewCA(t, "client-ca")
+	server := serverCA.Server(t)
+	billing := clientCA.Client(t, pkix.Name{CommonName: "billing", Organization: []string{"Acme"}})
+	unbound := clientCA.Client(t, pkix.Name{CommonName: "stranger"})
+
+	issued := issueKey(t, h, "acme", apikey.IssueOptions{
+		Scopes:      []apikey.Scope{apikey.ScopeValidate},
+		CertSubject: apikey.CertSubject(billing.Cert),
+	})
+	validateOnly := issueKey(t, h, "acme", apikey.IssueOptions{Scopes: []apikey.Scope{apikey.ScopeValidate}}).Token
+
+	// verify_if_given lets requests without a certificate reach the API,
+	// which then needs a token.
+	reloader, err := tlsutil.NewReloader(tlsutil.Options{
+		CertFile:     server.CertFile,
+		KeyFile:      server.KeyFile,
+		ClientCAFile: clientCA.File,
+		ClientAuth:   "verify_if_given",
+	})
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(router)
+	srv.TLS = reloader.TLSConfig()
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	post := func(client *tls.Certificate, apiKey, path string) int {
+		t.Helper()
+		cfg := &tls.Config{RootCAs: serverCA.Pool()}
+		if client != nil {
+			cfg.Certificates = []tls.Certificate{*client}
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		req, err := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(`{"user_id":"alice","code":"123456"}`))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		if apiKey != "" {
+			req.Header.Set(apikey.HeaderAPIKey, apiKey)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	billingCert := billing.TLSCertificate(t)
+	unboundCert := unbound.TLSCertificate(t)
+	tests := []struct {
+		name   string
+		cert   *tls.Certificate
+		apiKey string
+		path   string
+		want   int
+	}{
+		{"bound certificate", &billingCert, "", "/validate", http.StatusNotFound},
+		{"bound certificate keeps its scopes", &billingCert, "", "/enroll", http.StatusForbidden},
+		{"bound certificate keeps its tenant", &billingCert, "", "/t/globex/validate", http.StatusForbidden},
+		{"unbound certificate", &unboundCert, "", "/validate", http.StatusUnauthorized},
+		{"token wins over certificate", &unboundCert, validateOnly, "/validate", http.StatusNotFound},
+		{"no certificate or token", nil, "", "/validate", http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		if code := post(tc.cert, tc.apiKey, tc.path); code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, code, tc.want)
+		}
+	}
+
+	// Revoking the key locks the certificate out as well.
+	if err := h.Repo.(storage.KeyStore).RevokeAPIKey(context.Background(), issued.Key.ID, time.Now()); err != nil {
+		t.Fatalf("RevokeAPIKey: %v", err)
+	}
+	if code := post(&billingCert, "", "/validate"); code != http.StatusUnauthorized {
+		t.Errorf("revoked certificate key: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+}
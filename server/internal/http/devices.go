@@ -0,0 +1,152 @@
+package http
+
+import (
+	"errors"
+	"go-auth-totp/internal/audit"
+	"go-auth-totp/internal/auth/device"
+	"go-auth-totp/internal/storage"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// TrustedDevice is the view of a trusted device. It never includes the
+// token.
+type TrustedDevice struct {
+	ID         string     `json:"id"`
+	Label      string     `json:"label"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+type ListDevicesResponse struct {
+	Devices []TrustedDevice `json:"devices"`
+}
+
+type CheckDeviceRequest struct {
+	UserID      string `json:"user_id"`
+	DeviceToken string `json:"device_token"`
+}
+
+type CheckDeviceResponse struct {
+	Status   string `json:"status"`
+	DeviceID string `json:"device_id"`
+}
+
+func toTrustedDevice(d *storage.TrustedDevice) TrustedDevice {
+	return TrustedDevice{
+		ID:         d.ID,
+		Label:      d.Label,
+		CreatedAt:  d.CreatedAt,
+		ExpiresAt:  d.ExpiresAt,
+		LastUsedAt: optionalTime(d.LastUsedAt),
+	}
+}
+
+// allowDeviceLabel rejects a request to trust a device the server cannot
+// honour, before any code is checked. An empty label asks for none.
+func (h *Handlers) allowDeviceLabel(w http.ResponseWriter, label string) bool {
+	switch {
+	case label == "":
+		return true
+	case h.Devices == nil:
+		h.ErrorJSON(w, http.StatusBadRequest, "Trusted devices are not enabled")
+		return false
+	case !device.ValidLabel(label):
+		h.ErrorJSON(w, http.StatusBadRequest, "Invalid device_label")
+		return false
+	}
+	return true
+}
+
+// trustDevice issues a device token for a user who just passed /validate
+// and adds it to resp.
+func (h *Handlers) trustDevice(w http.ResponseWriter, r *http.Request, userID, label string, resp *ValidateResponse) bool {
+	outcome := audit.OutcomeError
+	defer h.auditAttempt(r, audit.EventDeviceTrusted, userID, audit.CredentialDevice, &outcome)
+
+	issued, err := h.Devices.Trust(r.Context(), userID, label)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Trusting device failed", "user_id", userID, "error", err)
+		h.StorageError(w, err)
+		return false
+	}
+	outcome = audit.OutcomeSuccess
+	slog.InfoContext(r.Context(), "Trusted device", "user_id", userID, "device_id", issued.Device.ID)
+	resp.DeviceID = issued.Device.ID
+	resp.DeviceToken = issued.Token
+	resp.DeviceExpiresAt = issued.Device.ExpiresAt.UTC().Format(time.RFC3339)
+	return true
+}
+
+// CheckDeviceHandler tells the caller whether a device token lets the user
+// skip the TOTP prompt.
+func (h *Handlers) CheckDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	var req CheckDeviceRequest
+	if !h.decodeJSON(w, r, &req) {
+		return
+	}
+	outcome := audit.OutcomeError
+	defer h.auditAttempt(r, audit.EventDeviceCheck, req.UserID, audit.CredentialDevice, &outcome)
+
+	d, err := h.Devices.Check(r.Context(), req.UserID, req.DeviceToken)
+	switch {
+	case errors.Is(err, device.ErrUntrusted):
+		outcome = audit.OutcomeDenied
+		h.ErrorJSON(w, http.StatusUnauthorized, "Device not trusted")
+		return
+	case err != nil:
+		h.StorageError(w, err)
+		return
+	}
+	outcome = audit.OutcomeSuccess
+	h.EncodeJSON(w, http.StatusOK, CheckDeviceResponse{Status: "trusted", DeviceID: d.ID})
+}
+
+// ListDevicesHandler returns a user's trusted devices.
+func (h *Handlers) ListDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	devices, err := h.Devices.List(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		h.StorageError(w, err)
+		return
+	}
+	resp := ListDevicesResponse{Devices: make([]TrustedDevice, 0, len(devices))}
+	for _, d := range devices {
+		resp.Devices = append(resp.Devices, toTrustedDevice(d))
+	}
+	h.EncodeJSON(w, http.StatusOK, resp)
+}
+
+// RevokeDeviceHandler stops trusting one of a user's devices.
+func (h *Handlers) RevokeDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := h.Devices.Revoke(r.Context(), vars["id"], vars["device"]); err != nil {
+		if errors.Is(err, storage.ErrDeviceNotFound) {
+			h.ErrorJSON(w, http.StatusNotFound, "Device not found")
+			return
+		}
+		h.StorageError(w, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Revoked trusted device", "user_id", vars["id"], "device_id", vars["device"])
+	h.Audit.Record(r, audit.Event{Type: audit.EventDeviceRevoked, UserID: vars["id"], Credential: audit.CredentialDevice,
+		Outcome: audit.OutcomeSuccess, Detail: "device " + vars["device"]})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeDevicesHandler stops trusting all of a user's devices.
+func (h *Handlers) RevokeDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	n, err := h.Devices.RevokeAll(r.Context(), id)
+	if err != nil {
+		h.StorageError(w, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Revoked trusted devices", "user_id", id, "count", n)
+	h.Audit.Record(r, audit.Event{Type: audit.EventDeviceRevoked, UserID: id, Credential: audit.CredentialDevice,
+		Outcome: audit.OutcomeSuccess, Detail: "all devices"})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,104 @@
+package http
+
+import (
+	"encoding/json"
+	"go-auth-totp/internal/auth/device"
+	"go-auth-totp/internal/storage"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTrustedDevices(t *testing.T) {
+	h := newTestHandlers(t)
+	h.Devices = device.NewService(h.Repo.(storage.DeviceStore), 0, nil)
+	router := NewRouter(h)
+	secrets := map[string]string{"alice": enrollAndVerify(t, h, "alice"), "bob": enrollAndVerify(t, h, "bob")}
+
+	trust := func(userID, label string) map[string]string {
+		t.Helper()
+		rec := serve(router, http.MethodPost, "/validate", "",
+			`{"user_id":"`+userID+`","code":"`+currentCode(t, secrets[userID])+`","device_label":"`+label+`"}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("validate with device_label = %d %s", rec.Code, rec.Body)
+		}
+		var resp map[string]string
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if !strings.HasPrefix(resp["device_token"], "td_"+resp["device_id"]+"_") || resp["device_expires_at"] == "" {
+			t.Fatalf("validate response = %v", resp)
+		}
+		return resp
+	}
+	check := func(userID, token string) int {
+		t.Helper()
+		return serve(router, http.MethodPost, "/devices/check", "", `{"user_id":"`+userID+`","device_token":"`+token+`"}`).Code
+	}
+
+	laptop := trust("alice", "Work laptop")
+	if code := check("alice", laptop["device_token"]); code != http.StatusOK {
+		t.Fatalf("check = %d, want 200", code)
+	}
+	for name, tc := range map[string]struct{ user, token string }{
+		"other user":   {"bob", laptop["device_token"]},
+		"wrong secret": {"alice", "td_" + laptop["device_id"] + "_bm90LXRoZS1zZWNyZXQ"},
+		"malformed":    {"alice", "not-a-token"},
+	} {
+		if code := check(tc.user, tc.token); code != http.StatusUnauthorized {
+			t.Errorf("check %s = %d, want 401", name, code)
+		}
+	}
+
+	// A label is checked before the code.
+	if rec := serve(router, http.MethodPost, "/validate", "", `{"user_id":"alice","code":"000000","device_label":"`+strings.Repeat("x", 65)+`"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("overlong label = %d, want 400", rec.Code)
+	}
+
+	phone := trust("alice", "Phone")
+	rec := serve(router, http.MethodGet, "/admin/users/alice/devices", "", "")
+	var list ListDevicesResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("list = %d %s", rec.Code, rec.Body)
+	}
+	if len(list.Devices) != 2 || list.Devices[0].Label != "Work laptop" || list.Devices[0].LastUsedAt == nil ||
+		list.Devices[1].ID != phone["device_id"] || list.Devices[1].LastUsedAt != nil {
+		t.Fatalf("devices = %+v", list.Devices)
+	}
+
+	path := "/admin/users/alice/devices/" + phone["device_id"]
+	if rec := serve(router, http.MethodDelete, path, "", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke = %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(router, http.MethodDelete, path, "", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("second revoke = %d, want 404", rec.Code)
+	}
+	if rec := serve(router, http.MethodDelete, "/admin/users/bob/devices/"+laptop["device_id"], "", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("revoke through another user = %d, want 404", rec.Code)
+	}
+	if code := check("alice", phone["device_token"]); code != http.StatusUnauthorized {
+		t.Fatalf("check revoked device = %d, want 401", code)
+	}
+
+	// Rotating the secret by enrolling again ends the trust.
+	if rec := serve(router, http.MethodPost, "/enroll", "", `{"user_id":"alice"}`); rec.Code != http.StatusOK {
+		t.Fatalf("re-enroll = %d", rec.Code)
+	}
+	if code := check("alice", laptop["device_token"]); code != http.StatusUnauthorized {
+		t.Fatalf("check after rotation = %d, want 401", code)
+	}
+
+	// So does disabling 2FA.
+	desktop := trust("bob", "Desktop")
+	if rec := serve(router, http.MethodPost, "/admin/users/bob/disable", "", ""); rec.Code != http.StatusOK {
+		t.Fatalf("disable = %d", rec.Code)
+	}
+	if code := check("bob", desktop["device_token"]); code != http.StatusUnauthorized {
+		t.Fatalf("check after disable = %d, want 401", code)
+	}
+
+	h.Devices = nil
+	if rec := serve(NewRouter(h), http.MethodPost, "/validate", "", `{"user_id":"bob","code":"000000","device_label":"x"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("device_label while disabled = %d, want 400", rec.Code)
+	}
+}
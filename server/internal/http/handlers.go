@@ -1,35 +1,154 @@
 package http
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"go-auth-totp/internal/audit"
+	"go-auth-totp/internal/auth/account"
+	"go-auth-totp/internal/auth/apikey"
+	"go-auth-totp/internal/auth/device"
 	"go-auth-totp/internal/auth/enroll"
 	"go-auth-totp/internal/auth/ratelimit"
 	"go-auth-totp/internal/auth/recovery"
-	"go-auth-totp/internal/auth/totp"
+	"go-auth-totp/internal/auth/validate"
 	"go-auth-totp/internal/crypto"
+	"go-auth-totp/internal/metrics"
 	"go-auth-totp/internal/storage"
-	"log"
+	"go-auth-totp/internal/tenant"
+	"go-auth-totp/internal/webhook"
+	"go-auth-totp/pkg/assertion"
+	"go-auth-totp/pkg/totp"
+	"log/slog"
 	"net/http"
+	"sync"
+	"sync/atomic"
 )
 
 type Handlers struct {
-	Repo        storage.Repository
+	Repo storage.Repository
+	// Auth authenticates API callers (see Authenticate); nil disables it.
+	Auth *apikey.Authenticator
+	// Tenants resolves the tenant of each request (see ResolveTenant).
+	// When nil, Crypto, EnrollSvc and Verifier serve a single tenant.
+	Tenants     *tenant.Registry
 	Crypto      crypto.CryptoService
 	EnrollSvc   *enroll.Service
 	RecoverySvc *recovery.Service
 	Verifier    *totp.Verifier
 	Limiter     ratelimit.Limiter
+	// Accounts serves /enroll, /verify and /recover, and Codes serves
+	// /validate. When nil, each is built once, on first use, from Repo,
+	// Limiter, RecoverySvc, Webhooks and LowRecoveryCodes.
+	Accounts *account.Service
+	Codes    *validate.Service
+	// MaxBodyBytes caps request bodies (see LimitBody); 0 means no cap.
+	MaxBodyBytes int64
+	// Metrics records request metrics and serves /metrics; nil disables both.
+	Metrics *metrics.Metrics
+	// Audit records security events (see audit.Recorder); nil disables it.
+	Audit *audit.Recorder
+	// Webhooks queues events for webhook endpoints; nil disables them.
+	Webhooks *webhook.Notifier
+	// LowRecoveryCodes is the number of remaining recovery codes at or
+	// below which a recovery also sends recovery_codes.low.
+	LowRecoveryCodes int
+	// Assertions signs the assertions /validate and /recover return on
+	// request; nil disables them.
+	Assertions *assertion.Signer
+	// AssertionAudiences are the audiences of the default tenant when
+	// Tenants is nil, like Crypto and Verifier; tenants of a registry
+	// carry their own.
+	AssertionAudiences []string
+	// Devices trusts devices for /validate callers that ask for it and
+	// checks their tokens; nil disables trusted devices.
+	Devices *device.Service
+
+	draining atomic.Bool // set by SetDraining
+	wired    sync.Once   // builds Accounts and Codes, see wire
 }
 
+// The request and response bodies of the v1 API; openapi.json describes
+// the same shapes.
+
 type EnrollRequest struct {
 	UserID string `json:"user_id"`
 }
 
+type EnrollResponse struct {
+	// Secret is the base32 secret, for manual entry.
+	Secret string `json:"secret"`
+	// OTPAuthURL is the otpauth:// URL to show as a QR code.
+	OTPAuthURL string `json:"otpauth_url"`
+	// RecoveryCodes are shown to the user once; only their hashes are
+	// stored.
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
 type VerifyRequest struct {
 	UserID string `json:"user_id"`
 	Code   string `json:"code"`
 }
 
+type ValidateRequest struct {
+	UserID string `json:"user_id"`
+	Code   string `json:"code"`
+	// Audience asks for a signed assertion that service can verify.
+	Audience string `json:"audience,omitempty"`
+	// DeviceLabel asks to trust the device the user is on and return a
+	// device token for it.
+	DeviceLabel string `json:"device_label,omitempty"`
+}
+
+// AssertionFields carry the signed assertion a request asked for.
+type AssertionFields struct {
+	Assertion          string `json:"assertion,omitempty"`
+	AssertionExpiresAt string `json:"assertion_expires_at,omitempty"`
+}
+
+type ValidateResponse struct {
+	Status string `json:"status"`
+	AssertionFields
+	// The device fields are set when the request named a device_label.
+	DeviceID        string `json:"device_id,omitempty"`
+	DeviceToken     string `json:"device_token,omitempty"`
+	DeviceExpiresAt string `json:"device_expires_at,omitempty"`
+}
+
+type RecoverRequest struct {
+	UserID string `json:"user_id"`
+	Code   string `json:"code"`
+	// Audience asks for a signed assertion that service can verify.
+	Audience string `json:"audience,omitempty"`
+}
+
+type RecoverResponse struct {
+	Status string `json:"status"`
+	Msg    string `json:"msg"`
+	AssertionFields
+}
+
+// StatusResponse is the body of requests that only report a new state.
+type StatusResponse struct {
+	Status string `json:"status"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+	// Code tells apart errors that share a status, for clients such as
+	// pkg/stepup. Unlike Error, its values never change.
+	Code string `json:"code,omitempty"`
+}
+
+// Error codes (see ErrorResponse).
+const (
+	ErrCodeInvalidCode  = "invalid_code"
+	ErrCodeUserNotFound = "user_not_found"
+	ErrCodeNotEnabled   = "not_enabled"
+	ErrCodeRateLimited  = "rate_limited"
+)
+
 func (h *Handlers) EncodeJSON(w http.ResponseWriter, status int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -37,110 +156,186 @@ func (h *Handlers) EncodeJSON(w http.ResponseWriter, status int, v interface{})
 }
 
 func (h *Handlers) ErrorJSON(w http.ResponseWriter, status int, msg string) {
-	h.EncodeJSON(w, status, map[string]string{"error": msg})
+	h.EncodeJSON(w, status, ErrorResponse{Error: msg})
 }
 
-// EnrollHandler initiates the enrollment process.
-func (h *Handlers) EnrollHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		h.ErrorJSON(w, http.StatusMethodNotAllowed, "Method not allowed")
-		return
-	}
+// errorCodeJSON is ErrorJSON with an error code.
+func (h *Handlers) errorCodeJSON(w http.ResponseWriter, status int, code, msg string) {
+	h.EncodeJSON(w, status, ErrorResponse{Error: msg, Code: code})
+}
 
-	var req EnrollRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.ErrorJSON(w, http.StatusBadRequest, "Invalid request body")
-		return
+// statusClientClosedRequest is the non-standard status nginx uses for a
+// request whose client disconnected before the response was written.
+const statusClientClosedRequest = 499
+
+// StorageError maps a repository error onto the matching HTTP status.
+func (h *Handlers) StorageError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrUserNotFound):
+		h.errorCodeJSON(w, http.StatusNotFound, ErrCodeUserNotFound, "User not found")
+	case errors.Is(err, storage.ErrInvalidCursor):
+		h.ErrorJSON(w, http.StatusBadRequest, "Invalid cursor")
+	case errors.Is(err, storage.ErrConflict):
+		h.ErrorJSON(w, http.StatusConflict, "User already exists")
+	case errors.Is(err, storage.ErrVersionMismatch):
+		h.ErrorJSON(w, http.StatusConflict, "User was modified concurrently, retry the request")
+	case errors.Is(err, context.Canceled):
+		// The client went away; nobody reads this, but don't report a 503.
+		h.ErrorJSON(w, statusClientClosedRequest, "Request canceled")
+	case errors.Is(err, context.DeadlineExceeded):
+		h.ErrorJSON(w, http.StatusGatewayTimeout, "Storage timed out")
+	case errors.Is(err, storage.ErrUnavailable):
+		h.ErrorJSON(w, http.StatusServiceUnavailable, "Storage unavailable")
+	default:
+		h.ErrorJSON(w, http.StatusInternalServerError, "Storage error")
 	}
+}
 
-	// 1. Generate Secret & QR
-	log.Printf("Enrolling user: %s", req.UserID)
-	resp, err := h.EnrollSvc.Enroll(req.UserID)
-	if err != nil {
-		log.Printf("Enrollment failed for %s: %v", req.UserID, err)
+// wire builds the services the caller left unset.
+func (h *Handlers) wire() {
+	h.wired.Do(func() {
+		if h.Accounts == nil {
+			h.Accounts = account.NewService(h.Repo, h.Limiter, account.Options{
+				Recovery:         h.RecoverySvc,
+				Webhooks:         h.Webhooks,
+				LowRecoveryCodes: h.LowRecoveryCodes,
+			})
+		}
+		if h.Codes == nil {
+			h.Codes = validate.NewService(h.Repo, h.Limiter)
+		}
+	})
+}
+
+// accounts returns the service behind /enroll, /verify and /recover.
+func (h *Handlers) accounts() *account.Service {
+	h.wire()
+	return h.Accounts
+}
+
+// codes returns the service behind /validate.
+func (h *Handlers) codes() *validate.Service {
+	h.wire()
+	return h.Codes
+}
+
+// writeCodeError writes the response for an error of the validate or
+// account services.
+func (h *Handlers) writeCodeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, account.ErrRateLimited):
+		h.errorCodeJSON(w, http.StatusTooManyRequests, ErrCodeRateLimited, "Rate limit exceeded")
+	case errors.Is(err, account.ErrNotEnabled):
+		h.errorCodeJSON(w, http.StatusPreconditionFailed, ErrCodeNotEnabled, "TOTP not enabled")
+	case errors.Is(err, account.ErrAlreadyEnabled):
+		h.ErrorJSON(w, http.StatusConflict, "TOTP already enabled")
+	case errors.Is(err, account.ErrInvalidCode):
+		h.errorCodeJSON(w, http.StatusUnauthorized, ErrCodeInvalidCode, "Invalid code")
+	case errors.Is(err, account.ErrEnroll):
 		h.ErrorJSON(w, http.StatusInternalServerError, "Failed to generate secret")
-		return
+	case errors.Is(err, account.ErrDecrypt):
+		h.ErrorJSON(w, http.StatusInternalServerError, "Failed to decrypt secret")
+	case errors.Is(err, account.ErrVerify):
+		h.ErrorJSON(w, http.StatusInternalServerError, "Verification error")
+	default:
+		h.StorageError(w, err)
 	}
+}
 
-	// 2. Storage: Save user with DISABLED state
-	user := &storage.User{
-		ID:              req.UserID,
-		EncryptedSecret: resp.EncryptedBlob,
-		RecoveryCodes:   resp.HashedCodes,
-		Enabled:         false, // IMPORTANT: Not enabled until verified
+// auditOutcome classifies an error of the validate or account services
+// for the audit log.
+func auditOutcome(err error) string {
+	switch {
+	case err == nil:
+		return audit.OutcomeSuccess
+	case errors.Is(err, account.ErrRateLimited):
+		return audit.OutcomeRateLimited
+	case errors.Is(err, account.ErrInvalidCode):
+		return audit.OutcomeInvalidCode
+	case errors.Is(err, account.ErrNotEnabled), errors.Is(err, storage.ErrUserNotFound):
+		return audit.OutcomeNotEnabled
+	default:
+		return audit.OutcomeError
 	}
-	if err := h.Repo.SaveUser(user); err != nil {
-		log.Printf("SaveUser failed for %s: %v", req.UserID, err)
-		h.ErrorJSON(w, http.StatusInternalServerError, "Failed to save user")
-		return
-	}
-	log.Printf("User %s saved to DB", req.UserID)
+}
 
-	// 3. Return Secret & QR URL
-	// In production, might render the QR code as PNG data URI here.
-	h.EncodeJSON(w, http.StatusOK, resp)
+// auditAttempt records the outcome of a request about userID's credential
+// once the handler returns. Handlers update *outcome as they go; it starts
+// as an error so early returns are recorded as such.
+func (h *Handlers) auditAttempt(r *http.Request, event, userID, credential string, outcome *string) {
+	h.Audit.Record(r, audit.Event{Type: event, UserID: userID, Credential: credential, Outcome: *outcome})
 }
 
-// VerifyHandler confirms the first code and enables TOTP.
-func (h *Handlers) VerifyHandler(w http.ResponseWriter, r *http.Request) {
+// EnrollHandler initiates the enrollment process.
+func (h *Handlers) EnrollHandler(w http.ResponseWriter, r *http.Request) {
+	if resp, ok := h.enroll(w, r); ok {
+		h.EncodeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// enroll enrolls the requested user. It writes the error response and
+// returns false on failure.
+func (h *Handlers) enroll(w http.ResponseWriter, r *http.Request) (EnrollResponse, bool) {
 	if r.Method != http.MethodPost {
 		h.ErrorJSON(w, http.StatusMethodNotAllowed, "Method not allowed")
-		return
+		return EnrollResponse{}, false
 	}
 
-	var req VerifyRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.ErrorJSON(w, http.StatusBadRequest, "Invalid request body")
-		return
+	var req EnrollRequest
+	if !h.decodeJSON(w, r, &req) {
+		return EnrollResponse{}, false
 	}
-	log.Printf("Verifying user: %s with code: %s", req.UserID, req.Code)
+	outcome := audit.OutcomeError
+	defer h.auditAttempt(r, audit.EventEnroll, req.UserID, audit.CredentialTOTP, &outcome)
 
-	// Rate Limit
-	if !h.Limiter.Allow(req.UserID) {
-		h.ErrorJSON(w, http.StatusTooManyRequests, "Rate limit exceeded")
-		return
-	}
+	t := h.tenantFor(r)
 
-	// 1. Load User
-	user, err := h.Repo.GetUser(req.UserID)
+	// Generate the secret and QR URL and save the user DISABLED
+	// (re-enrollment replaces the secret).
+	slog.InfoContext(r.Context(), "Enrolling user", "user_id", req.UserID, "tenant", t.ID)
+	resp, err := h.accounts().Enroll(r.Context(), t, req.UserID)
 	if err != nil {
-		log.Printf("GetUser failed for %s: %v", req.UserID, err)
-		h.ErrorJSON(w, http.StatusNotFound, "User not found")
-		return
-	}
-
-	if user.Enabled {
-		h.ErrorJSON(w, http.StatusConflict, "TOTP already enabled")
-		return
+		slog.ErrorContext(r.Context(), "Enrollment failed", "user_id", req.UserID, "error", err)
+		h.writeCodeError(w, err)
+		return EnrollResponse{}, false
 	}
+	slog.InfoContext(r.Context(), "User saved", "user_id", req.UserID)
+	outcome = audit.OutcomeSuccess
 
-	// 2. Decrypt Secret
-	secretBytes, err := h.Crypto.Decrypt(user.EncryptedSecret)
-	if err != nil {
-		h.ErrorJSON(w, http.StatusInternalServerError, "Failed to decrypt secret")
-		return
-	}
+	// Return Secret & QR URL
+	// In production, might render the QR code as PNG data URI here.
+	return EnrollResponse{
+		Secret:        resp.Secret,
+		OTPAuthURL:    resp.OTPAuthURL,
+		RecoveryCodes: resp.RecoveryCodes,
+	}, true
+}
 
-	// 3. Verify Code
-	valid, err := h.Verifier.Verify(secretBytes, req.Code)
-	if err != nil {
-		h.ErrorJSON(w, http.StatusInternalServerError, "Verification error")
+// VerifyHandler confirms the first code and enables TOTP.
+func (h *Handlers) VerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.ErrorJSON(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
-	if !valid {
-		h.ErrorJSON(w, http.StatusUnauthorized, "Invalid code")
+	var req VerifyRequest
+	if !h.decodeJSON(w, r, &req) {
 		return
 	}
+	slog.InfoContext(r.Context(), "Verifying user", "user_id", req.UserID)
+	outcome := audit.OutcomeError
+	defer h.auditAttempt(r, audit.EventVerify, req.UserID, audit.CredentialTOTP, &outcome)
+	t := h.tenantFor(r)
 
-	// 4. Enable TOTP
-	user.Enabled = true
-	if err := h.Repo.SaveUser(user); err != nil {
-		h.ErrorJSON(w, http.StatusInternalServerError, "Failed to update user")
+	err := h.accounts().Verify(r.Context(), t, req.UserID, req.Code)
+	outcome = auditOutcome(err)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Verify failed", "user_id", req.UserID, "error", err)
+		h.writeCodeError(w, err)
 		return
 	}
 
-	h.EncodeJSON(w, http.StatusOK, map[string]string{"status": "enabled"})
+	h.EncodeJSON(w, http.StatusOK, StatusResponse{Status: "enabled"})
 }
 
 // ValidateHandler checks a code for an enrolled user (Login flow).
@@ -150,50 +345,38 @@ func (h *Handlers) ValidateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req VerifyRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.ErrorJSON(w, http.StatusBadRequest, "Invalid request body")
-		return
-	}
-
-	// Rate Limit
-	if !h.Limiter.Allow(req.UserID) {
-		h.ErrorJSON(w, http.StatusTooManyRequests, "Rate limit exceeded")
-		return
-	}
-
-	// 1. Load User
-	user, err := h.Repo.GetUser(req.UserID)
-	if err != nil {
-		h.ErrorJSON(w, http.StatusNotFound, "User not found")
+	var req ValidateRequest
+	if !h.decodeJSON(w, r, &req) {
 		return
 	}
-
-	if !user.Enabled {
-		h.ErrorJSON(w, http.StatusPreconditionFailed, "TOTP not enabled")
+	t := h.tenantFor(r)
+	if !h.allowAudience(w, t, req.Audience) || !h.allowDeviceLabel(w, req.DeviceLabel) {
 		return
 	}
+	outcome := audit.OutcomeError
+	defer h.auditAttempt(r, audit.EventValidate, req.UserID, audit.CredentialTOTP, &outcome)
 
-	// 2. Decrypt Secret
-	secretBytes, err := h.Crypto.Decrypt(user.EncryptedSecret)
+	err := h.codes().Validate(r.Context(), t, req.UserID, req.Code)
+	outcome = auditOutcome(err)
 	if err != nil {
-		h.ErrorJSON(w, http.StatusInternalServerError, "Failed to decrypt secret")
+		h.writeCodeError(w, err)
 		return
 	}
 
-	// 3. Verify Code
-	valid, err := h.Verifier.Verify(secretBytes, req.Code)
-	if err != nil {
-		h.ErrorJSON(w, http.StatusInternalServerError, "Verification error")
+	resp := ValidateResponse{Status: "valid"}
+	if req.DeviceLabel != "" && !h.trustDevice(w, r, req.UserID, req.DeviceLabel, &resp) {
 		return
 	}
-
-	if !valid {
-		h.ErrorJSON(w, http.StatusUnauthorized, "Invalid code")
+	if !h.assert(w, r, &resp.AssertionFields, assertion.Claims{
+		Subject:    req.UserID,
+		Audience:   req.Audience,
+		Tenant:     t.ID,
+		Method:     assertion.MethodTOTP,
+		Credential: audit.CredentialTOTP,
+	}) {
 		return
 	}
-
-	h.EncodeJSON(w, http.StatusOK, map[string]string{"status": "valid"})
+	h.EncodeJSON(w, http.StatusOK, resp)
 }
 
 // RecoverHandler allows login using a recovery code.
@@ -203,43 +386,37 @@ func (h *Handlers) RecoverHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req VerifyRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.ErrorJSON(w, http.StatusBadRequest, "Invalid request body")
+	var req RecoverRequest
+	if !h.decodeJSON(w, r, &req) {
 		return
 	}
-
-	// Rate Limit
-	if !h.Limiter.Allow(req.UserID) {
-		h.ErrorJSON(w, http.StatusTooManyRequests, "Rate limit exceeded")
+	t := h.tenantFor(r)
+	if !h.allowAudience(w, t, req.Audience) {
 		return
 	}
-
-	// 1. Load User
-	user, err := h.Repo.GetUser(req.UserID)
-	if err != nil {
-		h.ErrorJSON(w, http.StatusNotFound, "User not found")
+	outcome := audit.OutcomeError
+	defer h.auditAttempt(r, audit.EventRecover, req.UserID, audit.CredentialRecoveryCode, &outcome)
+
+	rec, err := h.accounts().Recover(r.Context(), t, req.UserID, req.Code)
+	outcome = auditOutcome(err)
+	switch {
+	case errors.Is(err, account.ErrInvalidCode):
+		h.errorCodeJSON(w, http.StatusUnauthorized, ErrCodeInvalidCode, "Invalid recovery code")
 		return
-	}
-
-	if !user.Enabled {
-		h.ErrorJSON(w, http.StatusPreconditionFailed, "TOTP not enabled")
-		return
-	}
-
-	// 2. Validate Recovery Code
-	remainingCodes, ok := h.RecoverySvc.ValidateAndConsume(req.Code, user.RecoveryCodes)
-	if !ok {
-		h.ErrorJSON(w, http.StatusUnauthorized, "Invalid recovery code")
+	case err != nil:
+		h.writeCodeError(w, err)
 		return
 	}
 
-	// 3. Update User (Remove used code)
-	user.RecoveryCodes = remainingCodes
-	if err := h.Repo.SaveUser(user); err != nil {
-		h.ErrorJSON(w, http.StatusInternalServerError, "Failed to update user")
+	resp := RecoverResponse{Status: "recovered", Msg: "Recovery code accepted"}
+	if !h.assert(w, r, &resp.AssertionFields, assertion.Claims{
+		Subject:    req.UserID,
+		Audience:   req.Audience,
+		Tenant:     t.ID,
+		Method:     assertion.MethodRecovery,
+		Credential: fmt.Sprintf("%s:%d", audit.CredentialRecoveryCode, rec.Index),
+	}) {
 		return
 	}
-
-	h.EncodeJSON(w, http.StatusOK, map[string]string{"status": "recovered", "msg": "Recovery code accepted"})
+	h.EncodeJSON(w, http.StatusOK, resp)
 }
@@ -0,0 +1,175 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-auth-totp/internal/auth/enroll"
+	"go-auth-totp/internal/auth/ratelimit"
+	"go-auth-totp/internal/auth/recovery"
+	"go-auth-totp/internal/crypto"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/pkg/totp"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStorageErrorStatus(t *testing.T) {
+	h := &Handlers{}
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{storage.ErrUserNotFound, http.StatusNotFound},
+		{fmt.Errorf("wrapped: %w", storage.ErrConflict), http.StatusConflict},
+		{storage.ErrVersionMismatch, http.StatusConflict},
+		{storage.ErrUnavailable, http.StatusServiceUnavailable},
+		{context.Canceled, statusClientClosedRequest},
+		{fmt.Errorf("%w: %w", storage.ErrUnavailable, context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{errors.New("disk on fire"), http.StatusInternalServerError},
+	}
+
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		h.StorageError(rec, tc.err)
+		if rec.Code != tc.want {
+			t.Errorf("StorageError(%v) = %d, want %d", tc.err, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestValidateHandlerCanceledRequest(t *testing.T) {
+	h := &Handlers{
+		Repo:     storage.NewInMemoryRepository(),
+		Verifier: totp.NewVerifier(nil),
+		Limiter:  ratelimit.NewInMemoryLimiter(time.Second, 10),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewBufferString(`{"user_id":"alice","code":"123456"}`)).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	h.ValidateHandler(rec, req)
+
+	// A client disconnect must not be reported as a storage outage.
+	if rec.Code != statusClientClosedRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, statusClientClosedRequest)
+	}
+}
+
+// newTestHandlers wires the handlers against an in-memory repository.
+func newTestHandlers(t testing.TB) *Handlers {
+	t.Helper()
+	cryptoSvc, err := crypto.NewAESGCMEncryption(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatalf("crypto: %v", err)
+	}
+	return &Handlers{
+		Repo:        storage.NewInMemoryRepository(),
+		Crypto:      cryptoSvc,
+		EnrollSvc:   enroll.NewService("Test", cryptoSvc),
+		RecoverySvc: recovery.NewService(),
+		Verifier:    totp.NewVerifier(nil),
+		Limiter:     ratelimit.NewInMemoryLimiter(time.Millisecond, 100),
+	}
+}
+
+func postJSON(t testing.TB, handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	noteRequest(body)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body)))
+	noteResponse(rec.Body.Bytes())
+	return rec
+}
+
+func currentCode(t testing.TB, secret string) string {
+	t.Helper()
+	code, err := totp.NewGenerator().GenerateCodeFromBase32(secret, uint64(time.Now().Unix()))
+	if err != nil {
+		t.Fatalf("generate code: %v", err)
+	}
+	noteSensitive(code)
+	return code
+}
+
+func TestEnrollVerifyValidateRecoverFlow(t *testing.T) {
+	h := newTestHandlers(t)
+	ctx := storage.WithTenant(context.Background(), storage.DefaultTenant)
+
+	rec := postJSON(t, h.EnrollHandler, `{"user_id":"alice"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("enroll = %d %s", rec.Code, rec.Body)
+	}
+	var enrolled EnrollResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &enrolled); err != nil {
+		t.Fatalf("decode enroll: %v", err)
+	}
+
+	if rec := postJSON(t, h.ValidateHandler, `{"user_id":"alice","code":"000000"}`); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("validate before verify = %d", rec.Code)
+	}
+
+	code := currentCode(t, enrolled.Secret)
+	if rec := postJSON(t, h.VerifyHandler, `{"user_id":"alice","code":"`+code+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("verify = %d %s", rec.Code, rec.Body)
+	}
+	if rec := postJSON(t, h.VerifyHandler, `{"user_id":"alice","code":"`+code+`"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("second verify = %d", rec.Code)
+	}
+
+	if rec := postJSON(t, h.ValidateHandler, `{"user_id":"alice","code":"`+code+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("validate = %d %s", rec.Code, rec.Body)
+	}
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	if rec := postJSON(t, h.ValidateHandler, `{"user_id":"alice","code":"`+wrong+`"}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("validate wrong code = %d", rec.Code)
+	}
+
+	recoveryCode := enrolled.RecoveryCodes[0]
+	if rec := postJSON(t, h.RecoverHandler, `{"user_id":"alice","code":"`+recoveryCode+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("recover = %d %s", rec.Code, rec.Body)
+	}
+	if rec := postJSON(t, h.RecoverHandler, `{"user_id":"alice","code":"`+recoveryCode+`"}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("reused recovery code = %d", rec.Code)
+	}
+
+	user, err := h.Repo.GetUser(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if user.EnabledAt.IsZero() || user.LastVerifiedAt.IsZero() || user.LastFailedAt.IsZero() {
+		t.Fatalf("usage metadata not recorded: %+v", user)
+	}
+	if user.TotalFailures != 2 || user.FailedAttempts != 1 {
+		t.Fatalf("failures = %d total / %d consecutive, want 2 / 1", user.TotalFailures, user.FailedAttempts)
+	}
+	if user.RemainingRecoveryCodes() != len(enrolled.RecoveryCodes)-1 || !user.RecoveryCodes[0].Used() {
+		t.Fatalf("recovery code not soft-consumed: %+v", user.RecoveryCodes)
+	}
+}
+
+// enrollAndVerify enrolls userID, enables TOTP and returns the base32 secret.
+func enrollAndVerify(t testing.TB, h *Handlers, userID string) string {
+	t.Helper()
+	rec := postJSON(t, h.EnrollHandler, `{"user_id":"`+userID+`"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("enroll %s = %d %s", userID, rec.Code, rec.Body)
+	}
+	var enrolled EnrollResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &enrolled); err != nil {
+		t.Fatalf("decode enroll: %v", err)
+	}
+	rec = postJSON(t, h.VerifyHandler, `{"user_id":"`+userID+`","code":"`+currentCode(t, enrolled.Secret)+`"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("verify %s = %d %s", userID, rec.Code, rec.Body)
+	}
+	return enrolled.Secret
+}
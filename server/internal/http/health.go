@@ -0,0 +1,91 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go-auth-totp/internal/crypto"
+	"go-auth-totp/internal/storage"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// readyTimeout bounds each readiness check.
+const readyTimeout = 2 * time.Second
+
+// HealthzHandler reports that the process is up. It checks nothing else,
+// so a slow database never gets the process restarted.
+func (h *Handlers) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	h.EncodeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ReadyzHandler reports whether requests can be served: the database
+// answers and every tenant's key can encrypt and decrypt. It fails once
+// shutdown has started (see SetDraining) so load balancers stop routing
+// here while in-flight requests finish.
+func (h *Handlers) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	if h.draining.Load() {
+		h.EncodeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	checks := map[string]string{"database": "ok", "crypto": "ok"}
+	status, code := "ok", http.StatusOK
+	if err := h.checkDatabase(ctx); err != nil {
+		slog.ErrorContext(ctx, "Readiness check failed", "check", "database", "error", err)
+		checks["database"], status, code = "failed", "unavailable", http.StatusServiceUnavailable
+	}
+	if err := h.checkCrypto(); err != nil {
+		slog.ErrorContext(ctx, "Readiness check failed", "check", "crypto", "error", err)
+		checks["crypto"], status, code = "failed", "unavailable", http.StatusServiceUnavailable
+	}
+	h.EncodeJSON(w, code, map[string]interface{}{"status": status, "checks": checks})
+}
+
+// SetDraining makes ReadyzHandler fail from now on.
+func (h *Handlers) SetDraining() {
+	h.draining.Store(true)
+}
+
+func (h *Handlers) checkDatabase(ctx context.Context) error {
+	if p, ok := h.Repo.(storage.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// checkCrypto round-trips a probe through every tenant's key.
+func (h *Handlers) checkCrypto() error {
+	if h.Tenants == nil {
+		return cryptoRoundTrip(h.Crypto)
+	}
+	for _, id := range h.Tenants.IDs() {
+		t, _ := h.Tenants.Get(id)
+		if err := cryptoRoundTrip(t.Crypto); err != nil {
+			return fmt.Errorf("tenant %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func cryptoRoundTrip(cs crypto.CryptoService) error {
+	if cs == nil {
+		return fmt.Errorf("no crypto service")
+	}
+	probe := []byte("readyz")
+	blob, err := cs.Encrypt(probe)
+	if err != nil {
+		return err
+	}
+	got, err := cs.Decrypt(blob)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, probe) {
+		return fmt.Errorf("decrypted probe does not match")
+	}
+	return nil
+}
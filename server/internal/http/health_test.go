@@ -0,0 +1,111 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"go-auth-totp/internal/storage"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type failingCrypto struct{}
+
+func (failingCrypto) Encrypt([]byte) (string, error) { return "", errors.New("kms down") }
+func (failingCrypto) Decrypt(string) ([]byte, error) { return nil, errors.New("kms down") }
+
+func readyStatus(t *testing.T, router http.Handler) (int, map[string]interface{}) {
+	t.Helper()
+	rec := serve(router, http.MethodGet, "/readyz", "", "")
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode /readyz: %v (%s)", err, rec.Body)
+	}
+	return rec.Code, body
+}
+
+func TestHealthEndpointsNeedNoAPIKey(t *testing.T) {
+	router, _ := newAuthRouter(t)
+	if rec := serve(router, http.MethodGet, "/healthz", "", ""); rec.Code != http.StatusOK {
+		t.Fatalf("/healthz = %d %s", rec.Code, rec.Body)
+	}
+	if code, body := readyStatus(t, router); code != http.StatusOK || body["status"] != "ok" {
+		t.Fatalf("/readyz = %d %v", code, body)
+	}
+	// Everything else still needs a key.
+	if rec := serve(router, http.MethodGet, "/admin/users", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("/admin/users = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestHealthRouterServesOnlyProbes(t *testing.T) {
+	_, h := newAuthRouter(t)
+	router := NewHealthRouter(h)
+	if rec := serve(router, http.MethodGet, "/healthz", "", ""); rec.Code != http.StatusOK {
+		t.Fatalf("/healthz = %d %s", rec.Code, rec.Body)
+	}
+	if code, _ := readyStatus(t, router); code != http.StatusOK {
+		t.Fatalf("/readyz = %d", code)
+	}
+	if rec := serve(router, http.MethodGet, "/admin/users", "", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("/admin/users = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestReadyzFailures(t *testing.T) {
+	t.Run("draining", func(t *testing.T) {
+		router, h := newTenantRouter(t)
+		h.SetDraining()
+		if code, body := readyStatus(t, router); code != http.StatusServiceUnavailable || body["status"] != "draining" {
+			t.Fatalf("/readyz = %d %v", code, body)
+		}
+		// Liveness is unaffected.
+		if rec := serve(router, http.MethodGet, "/healthz", "", ""); rec.Code != http.StatusOK {
+			t.Fatalf("/healthz = %d", rec.Code)
+		}
+	})
+
+	t.Run("database closed", func(t *testing.T) {
+		router, h := newTenantRouter(t)
+		repo, err := storage.NewSQLiteRepository(filepath.Join(t.TempDir(), "ready.db"), storage.DefaultSQLiteOptions())
+		if err != nil {
+			t.Fatalf("NewSQLiteRepository: %v", err)
+		}
+		h.Repo = repo
+		if code, _ := readyStatus(t, router); code != http.StatusOK {
+			t.Fatalf("/readyz with open database = %d", code)
+		}
+		repo.Close()
+		code, body := readyStatus(t, router)
+		checks, _ := body["checks"].(map[string]interface{})
+		if code != http.StatusServiceUnavailable || checks["database"] != "failed" || checks["crypto"] != "ok" {
+			t.Fatalf("/readyz with closed database = %d %v", code, body)
+		}
+	})
+
+	t.Run("crypto", func(t *testing.T) {
+		h := newTestHandlers(t)
+		h.Crypto = failingCrypto{}
+		code, body := readyStatus(t, NewRouter(h))
+		checks, _ := body["checks"].(map[string]interface{})
+		if code != http.StatusServiceUnavailable || checks["crypto"] != "failed" {
+			t.Fatalf("/readyz with failing crypto = %d %v", code, body)
+		}
+	})
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	_, h := newTenantRouter(t)
+	h.MaxBodyBytes = 64
+	router := NewRouter(h)
+
+	small := `{"user_id":"alice"}`
+	if rec := serve(router, http.MethodPost, "/t/acme/enroll", "", small); rec.Code != http.StatusOK {
+		t.Fatalf("small body = %d %s", rec.Code, rec.Body)
+	}
+	large := `{"user_id":"` + strings.Repeat("a", 100) + `"}`
+	if rec := serve(router, http.MethodPost, "/t/acme/enroll", "", large); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("large body = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
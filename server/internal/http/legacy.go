@@ -0,0 +1,45 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The unversioned routes (/enroll, /t/{tenant}/validate, ...) predate /v1.
+// They stay as aliases of the v1 routes until clients have moved, and
+// answer alike except for /enroll, which keeps its old body.
+
+// legacyEnrollResponse is the body of the unversioned /enroll: the v1
+// fields under the Go field names the handler used to encode.
+type legacyEnrollResponse struct {
+	Secret        string
+	OTPAuthURL    string
+	RecoveryCodes []string
+}
+
+// LegacyEnrollHandler serves the unversioned /enroll.
+func (h *Handlers) LegacyEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	if resp, ok := h.enroll(w, r); ok {
+		h.EncodeJSON(w, http.StatusOK, legacyEnrollResponse(resp))
+	}
+}
+
+// Deprecated marks the responses of an unversioned route as deprecated and
+// links the v1 route that replaces it.
+func Deprecated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successorPath(r.URL.EscapedPath())+`>; rel="successor-version"`)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// successorPath returns the v1 path of an unversioned one: "/validate"
+// becomes "/v1/validate" and "/t/acme/validate" "/t/acme/v1/validate".
+func successorPath(path string) string {
+	if rest, ok := strings.CutPrefix(path, "/t/"); ok {
+		tenant, rest, _ := strings.Cut(rest, "/")
+		return "/t/" + tenant + "/v1/" + rest
+	}
+	return "/v1" + path
+}
@@ -0,0 +1,40 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// LimitBody is middleware that caps request bodies at max bytes; reading
+// past the cap fails with *http.MaxBytesError. A max of 0 disables it.
+func LimitBody(max int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if max > 0 && r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, max)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func bodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// decodeJSON decodes the request body into v. On failure it writes the
+// error response (413 for bodies over the LimitBody cap) and returns false.
+func (h *Handlers) decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	switch {
+	case err == nil:
+		return true
+	case bodyTooLarge(err):
+		h.ErrorJSON(w, http.StatusRequestEntityTooLarge, "Request body too large")
+	default:
+		h.ErrorJSON(w, http.StatusBadRequest, "Invalid request body")
+	}
+	return false
+}
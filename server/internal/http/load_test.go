@@ -0,0 +1,79 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"go-auth-totp/internal/auth/ratelimit"
+	"go-auth-totp/internal/storage"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestParallelValidateSQLite hammers /validate against a file-backed SQLite
+// store. Every request reads the user and writes usage metadata, so without
+// WAL, a busy timeout and immediate transactions some requests fail with
+// "database is locked" (surfacing as 503).
+func TestParallelValidateSQLite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("load test")
+	}
+
+	repo, err := storage.NewSQLiteRepository(filepath.Join(t.TempDir(), "load.db"), storage.DefaultSQLiteOptions())
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository: %v", err)
+	}
+	defer repo.Close()
+
+	h := newTestHandlers(t)
+	h.Repo = repo
+	h.Limiter = ratelimit.NewInMemoryLimiter(time.Microsecond, 1_000_000)
+
+	const users = 10
+	secrets := make([]string, users)
+	for i := range secrets {
+		secrets[i] = enrollAndVerify(t, h, fmt.Sprintf("user-%d", i))
+	}
+
+	const workers, perWorker = 32, 25
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	statuses := map[int]int{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				u := (w + i) % users
+				code := currentCode(t, secrets[u])
+				if i%4 == 0 {
+					code = "not-a-code" // exercise the failure-counter write path too
+				}
+				rec := postJSON(t, h.ValidateHandler, fmt.Sprintf(`{"user_id":"user-%d","code":"%s"}`, u, code))
+				mu.Lock()
+				statuses[rec.Code]++
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for status, n := range statuses {
+		if status >= 500 {
+			t.Errorf("%d requests failed with %d", n, status)
+		}
+	}
+	if statuses[http.StatusOK] == 0 {
+		t.Fatalf("no successful validations: %v", statuses)
+	}
+
+	user, err := repo.GetUser(storage.WithTenant(context.Background(), storage.DefaultTenant), "user-0")
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if user.LastVerifiedAt.IsZero() || user.TotalFailures == 0 {
+		t.Fatalf("usage metadata not written under load: %+v", user)
+	}
+}
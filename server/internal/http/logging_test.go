@@ -0,0 +1,107 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go-auth-totp/internal/logging"
+	"log/slog"
+	"os"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+// The whole package runs with its logs captured. Test helpers note every
+// code, secret, recovery code and key they see; TestMain fails the run if
+// any of them shows up in the log output.
+var (
+	logMu     sync.Mutex
+	logOutput bytes.Buffer
+	sensitive = map[string]bool{}
+)
+
+type lockedWriter struct{}
+
+func (lockedWriter) Write(p []byte) (int, error) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	return logOutput.Write(p)
+}
+
+// noteSensitive records values that must never be logged.
+func noteSensitive(values ...string) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	for _, v := range values {
+		if len(v) >= 6 {
+			sensitive[v] = true
+		}
+	}
+}
+
+// noteRequest records the code or device token in a JSON request body.
+func noteRequest(body string) {
+	var req struct {
+		Code        string `json:"code"`
+		DeviceToken string `json:"device_token"`
+	}
+	if json.Unmarshal([]byte(body), &req) == nil {
+		noteSensitive(req.Code, req.DeviceToken)
+	}
+}
+
+// noteResponse records the secret, otpauth URL and recovery codes of an
+// enrollment response, v1 or legacy, and any signed assertion or device
+// token.
+func noteResponse(body []byte) {
+	var resp struct {
+		EnrollResponse
+		Assertion   string `json:"assertion"`
+		DeviceToken string `json:"device_token"`
+	}
+	if json.Unmarshal(body, &resp) == nil {
+		noteSensitive(resp.Secret, resp.OTPAuthURL, resp.Assertion, resp.DeviceToken)
+		noteSensitive(resp.RecoveryCodes...)
+	}
+	var legacy legacyEnrollResponse
+	if json.Unmarshal(body, &legacy) == nil {
+		noteSensitive(legacy.Secret, legacy.OTPAuthURL)
+		noteSensitive(legacy.RecoveryCodes...)
+	}
+}
+
+// leaks returns the noted values found in out. Values must stand alone, so
+// a six-digit code does not match inside a timestamp's nanoseconds.
+func leaks(out string) []string {
+	logMu.Lock()
+	defer logMu.Unlock()
+	var found []string
+	for v := range sensitive {
+		if regexp.MustCompile(`(^|\W)` + regexp.QuoteMeta(v) + `($|\W)`).MatchString(out) {
+			found = append(found, v)
+		}
+	}
+	return found
+}
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(logging.New(lockedWriter{}, slog.LevelDebug))
+	code := m.Run()
+
+	logMu.Lock()
+	out, noted := logOutput.String(), len(sensitive)
+	logMu.Unlock()
+	if found := leaks(out); len(found) > 0 {
+		fmt.Fprintf(os.Stderr, "FAIL: %d sensitive values appear in the logs: %q\n", len(found), found)
+		code = 1
+	}
+	if code == 0 && (noted == 0 || out == "") {
+		fmt.Fprintln(os.Stderr, "FAIL: log scan saw no sensitive values or no log output")
+		code = 1
+	}
+	if code != 0 && testing.Verbose() {
+		os.Stderr.WriteString(out)
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,43 @@
+package http
+
+import (
+	"go-auth-totp/internal/metrics"
+	"net/http"
+	"time"
+)
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// InstrumentRoutes is middleware that records handler latency by route
+// template, so path parameters such as user IDs never become labels.
+func (h *Handlers) InstrumentRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		h.Metrics.ObserveHTTP(route, r.Method, rec.status, time.Since(start))
+	})
+}
+
+// countAttempt counts each call of next as operation, with the outcome
+// taken from the status it responds with (see metrics.OutcomeForStatus).
+func (h *Handlers) countAttempt(operation string, next http.HandlerFunc) http.HandlerFunc {
+	if h.Metrics == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		h.Metrics.RecordAttempt(operation, metrics.OutcomeForStatus(rec.status))
+	}
+}
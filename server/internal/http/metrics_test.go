@@ -0,0 +1,86 @@
+package http
+
+import (
+	"errors"
+	"go-auth-totp/internal/auth/apikey"
+	"go-auth-totp/internal/crypto"
+	"go-auth-totp/internal/metrics"
+	"go-auth-totp/internal/storage"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	h := newTestHandlers(t)
+	h.Metrics = metrics.New()
+	keys := h.Repo.(storage.KeyStore)
+	h.Repo = storage.NewObservedRepository(h.Repo, h.Metrics.ObserveRepository)
+	h.Crypto = crypto.WithDecryptHook(h.Crypto, h.Metrics.DecryptFailed)
+	router := NewRouter(h)
+
+	serveOK := func(path, body string, want int) {
+		t.Helper()
+		if rec := serve(router, http.MethodPost, path, "", body); rec.Code != want {
+			t.Fatalf("POST %s = %d, want %d (%s)", path, rec.Code, want, rec.Body)
+		}
+	}
+	secret := enrollAndVerify(t, h, "alice")
+	serveOK("/validate", `{"user_id":"alice","code":"`+currentCode(t, secret)+`"}`, http.StatusOK)
+	serveOK("/validate", `{"user_id":"bob","code":"123456"}`, http.StatusNotFound)
+	wrong := "000000"
+	if wrong == currentCode(t, secret) {
+		wrong = "111111"
+	}
+	serveOK("/t/acme/validate", `{"user_id":"alice","code":"`+wrong+`"}`, http.StatusUnauthorized)
+	h.Auth = apikey.NewAuthenticator(keys, h.Tenants, apikey.Options{})
+	serveKey := func(key string, want int) {
+		t.Helper()
+		if rec := serve(router, http.MethodPost, "/validate", key, `{"user_id":"alice","code":"123456"}`); rec.Code != want {
+			t.Fatalf("POST /validate with %q = %d, want %d (%s)", key, rec.Code, want, rec.Body)
+		}
+	}
+	serveKey("tk_000000000000_nope", http.StatusUnauthorized)
+	serveKey("garbage", http.StatusUnauthorized)
+	if _, err := h.Crypto.Decrypt("not base64!"); err == nil {
+		t.Fatal("Decrypt of garbage succeeded")
+	}
+
+	rec := serve(router, http.MethodGet, "/metrics", "", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/metrics = %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`totp_auth_attempts_total{operation="validate",outcome="success"} 1`,
+		`totp_auth_attempts_total{operation="validate",outcome="not_enabled"} 1`,
+		`totp_auth_attempts_total{operation="validate",outcome="invalid_code"} 1`,
+		`totp_auth_attempts_total{operation="recover",outcome="success"} 0`,
+		`totp_http_request_duration_seconds_count{code="200",method="POST",route="/validate"} 1`,
+		`totp_http_request_duration_seconds_count{code="401",method="POST",route="/t/{tenant}/validate"} 1`,
+		`totp_repository_duration_seconds_count{operation="get_user",result="not_found"}`,
+		`totp_decrypt_failures_total 1`,
+		`totp_api_key_rejections_total{reason="invalid_key"} 2`,
+		`totp_api_key_rejections_total{reason="rate_limited"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics lacks %s", want)
+		}
+	}
+	// No label carries user IDs or tenants.
+	if strings.Contains(body, "alice") || strings.Contains(body, `"acme"`) {
+		t.Errorf("/metrics leaks request values:\n%s", body)
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	h := newTestHandlers(t)
+	if rec := serve(NewRouter(h), http.MethodGet, "/metrics", "", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("/metrics without Metrics = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	// A nil *Metrics is safe to call.
+	var m *metrics.Metrics
+	m.RecordAttempt(metrics.OpValidate, metrics.OutcomeError)
+	m.DecryptFailed(errors.New("boom"))
+	m.RecordAPIKeyRejection(apikey.ErrMissingKey)
+}
@@ -0,0 +1,19 @@
+package http
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec is the OpenAPI 3 document of the v1 API. TestOpenAPIContract
+// keeps it in step with the router and the handlers.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// OpenAPIHandler serves the OpenAPI document of the v1 API.
+func (h *Handlers) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(openAPISpec)
+}
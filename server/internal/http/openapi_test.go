@@ -0,0 +1,259 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"go-auth-totp/internal/audit"
+	"go-auth-totp/internal/auth/device"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/webhook"
+	"go-auth-totp/pkg/assertion"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/gorilla/mux"
+)
+
+func loadSpec(t *testing.T) *openapi3.T {
+	t.Helper()
+	doc, err := openapi3.NewLoader().LoadFromData(openAPISpec)
+	if err != nil {
+		t.Fatalf("load openapi.json: %v", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		t.Fatalf("openapi.json is invalid: %v", err)
+	}
+	return doc
+}
+
+// newContractHandlers enables every optional feature so every route of
+// the spec is served.
+func newContractHandlers(t *testing.T) *Handlers {
+	t.Helper()
+	h := newTestHandlers(t)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	h.Assertions = assertion.NewSigner(key, assertion.SignerOptions{Issuer: "Test"})
+	h.AssertionAudiences = []string{"billing"}
+	h.Devices = device.NewService(h.Repo.(storage.DeviceStore), 0, nil)
+	h.Audit = audit.NewRecorder(h.Repo.(storage.AuditStore))
+	h.Webhooks = webhook.NewNotifier(h.Repo.(storage.WebhookStore))
+	return h
+}
+
+// contract serves requests and fails the test when a request or its
+// response does not match the spec.
+type contract struct {
+	t      *testing.T
+	router http.Handler
+	spec   routers.Router
+}
+
+func (c *contract) serve(method, path, body string, want int) *httptest.ResponseRecorder {
+	c.t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	route, params, err := c.spec.FindRoute(req)
+	if err != nil {
+		c.t.Fatalf("%s %s is not in the spec: %v", method, path, err)
+	}
+	in := &openapi3filter.RequestValidationInput{
+		Request:    req,
+		PathParams: params,
+		Route:      route,
+		Options:    &openapi3filter.Options{AuthenticationFunc: openapi3filter.NoopAuthenticationFunc},
+	}
+	if err := openapi3filter.ValidateRequest(context.Background(), in); err != nil {
+		c.t.Fatalf("%s %s: request does not match the spec: %v", method, path, err)
+	}
+
+	rec := serve(c.router, method, path, "", body)
+	if rec.Code != want {
+		c.t.Fatalf("%s %s = %d %s, want %d", method, path, rec.Code, rec.Body, want)
+	}
+	out := &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: in,
+		Status:                 rec.Code,
+		Header:                 rec.Header(),
+		Body:                   io.NopCloser(bytes.NewReader(rec.Body.Bytes())),
+	}
+	if err := openapi3filter.ValidateResponse(context.Background(), out); err != nil {
+		c.t.Errorf("%s %s: response does not match the spec: %v", method, path, err)
+	}
+	if rec.Header().Get("Deprecation") != "" {
+		c.t.Errorf("%s %s is marked deprecated", method, path)
+	}
+	return rec
+}
+
+func TestOpenAPIContract(t *testing.T) {
+	doc := loadSpec(t)
+	spec, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		t.Fatalf("spec router: %v", err)
+	}
+	h := newContractHandlers(t)
+	c := &contract{t: t, router: NewRouter(h), spec: spec}
+
+	rec := c.serve(http.MethodPost, "/v1/enroll", `{"user_id":"alice"}`, http.StatusOK)
+	var enrolled EnrollResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &enrolled); err != nil {
+		t.Fatalf("decode enroll: %v", err)
+	}
+	code := currentCode(t, enrolled.Secret)
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	c.serve(http.MethodPost, "/v1/verify", `{"user_id":"alice","code":"`+code+`"}`, http.StatusOK)
+	c.serve(http.MethodPost, "/v1/verify", `{"user_id":"alice","code":"`+code+`"}`, http.StatusConflict)
+	c.serve(http.MethodPost, "/v1/validate", `{"user_id":"alice","code":"`+wrong+`"}`, http.StatusUnauthorized)
+	c.serve(http.MethodPost, "/v1/validate", `{"user_id":"bob","code":"`+code+`"}`, http.StatusNotFound)
+	rec = c.serve(http.MethodPost, "/v1/validate",
+		`{"user_id":"alice","code":"`+code+`","audience":"billing","device_label":"Laptop"}`, http.StatusOK)
+	var validated ValidateResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &validated); err != nil || validated.Assertion == "" || validated.DeviceToken == "" {
+		t.Fatalf("validate = %s", rec.Body)
+	}
+	noteSensitive(validated.Assertion)
+	c.serve(http.MethodPost, "/v1/devices/check",
+		`{"user_id":"alice","device_token":"`+validated.DeviceToken+`"}`, http.StatusOK)
+	c.serve(http.MethodPost, "/v1/recover",
+		`{"user_id":"alice","code":"`+enrolled.RecoveryCodes[0]+`","audience":"billing"}`, http.StatusOK)
+
+	c.serve(http.MethodGet, "/v1/admin/users?enabled=true&limit=10", "", http.StatusOK)
+	c.serve(http.MethodGet, "/v1/admin/users/alice", "", http.StatusOK)
+	c.serve(http.MethodGet, "/v1/admin/users/bob", "", http.StatusNotFound)
+	c.serve(http.MethodGet, "/v1/admin/users/alice/devices", "", http.StatusOK)
+	c.serve(http.MethodDelete, "/v1/admin/users/alice/devices/"+validated.DeviceID, "", http.StatusNoContent)
+	c.serve(http.MethodDelete, "/v1/admin/users/alice/devices", "", http.StatusNoContent)
+	c.serve(http.MethodGet, "/v1/admin/audit?user_id=alice", "", http.StatusOK)
+	c.serve(http.MethodGet, "/v1/admin/webhooks/dead-letters", "", http.StatusOK)
+	c.serve(http.MethodPost, "/v1/admin/webhooks/dead-letters/1/retry", "", http.StatusNotFound)
+	c.serve(http.MethodPost, "/v1/admin/users/alice/disable", "", http.StatusOK)
+	c.serve(http.MethodDelete, "/v1/admin/users/alice", "", http.StatusNoContent)
+
+	// The tenant server of the spec.
+	router, _ := newTenantRouter(t)
+	c = &contract{t: t, router: router, spec: spec}
+	c.serve(http.MethodPost, "/t/acme/v1/enroll", `{"user_id":"alice"}`, http.StatusOK)
+	c.serve(http.MethodPost, "/t/nope/v1/enroll", `{"user_id":"alice"}`, http.StatusNotFound)
+}
+
+// TestOpenAPIRoutes checks that the spec lists every v1 route, and only
+// those, under both of its servers.
+func TestOpenAPIRoutes(t *testing.T) {
+	doc := loadSpec(t)
+	var documented []string
+	for path, item := range doc.Paths.Map() {
+		for method := range item.Operations() {
+			documented = append(documented, method+" "+path)
+		}
+	}
+	slices.Sort(documented)
+
+	served := map[string][]string{}
+	err := NewRouter(newContractHandlers(t)).Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, prefix := range []string{"/v1", "/t/{tenant}/v1"} {
+			if path, ok := strings.CutPrefix(tpl, prefix+"/"); ok {
+				for _, m := range methods {
+					served[prefix] = append(served[prefix], m+" /"+path)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	for prefix, routes := range served {
+		slices.Sort(routes)
+		if !slices.Equal(routes, documented) {
+			t.Errorf("routes under %s:\n%s\nspec:\n%s", prefix, strings.Join(routes, "\n"), strings.Join(documented, "\n"))
+		}
+	}
+	if len(served) != 2 {
+		t.Errorf("served prefixes = %v", served)
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	router, _ := newAuthRouter(t)
+	rec := serve(router, http.MethodGet, "/openapi.json", "", "")
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), openAPISpec) {
+		t.Fatalf("openapi.json = %d %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+}
+
+func TestDeprecatedRoutes(t *testing.T) {
+	router, _ := newTenantRouter(t)
+
+	rec := serve(router, http.MethodPost, "/t/acme/enroll", "", `{"user_id":"alice"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("legacy enroll = %d %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Deprecation"); got != "true" {
+		t.Errorf("Deprecation = %q", got)
+	}
+	if got := rec.Header().Get("Link"); got != `</t/acme/v1/enroll>; rel="successor-version"` {
+		t.Errorf("Link = %q", got)
+	}
+	// The old body keeps its Go field names but no longer leaks the
+	// encrypted secret or the code hashes.
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	keys := make([]string, 0, len(body))
+	for k := range body {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	if want := []string{"OTPAuthURL", "RecoveryCodes", "Secret"}; !slices.Equal(keys, want) {
+		t.Errorf("legacy enroll fields = %v, want %v", keys, want)
+	}
+
+	rec = serve(router, http.MethodPost, "/t/acme/validate", "", `{"user_id":"bob","code":"00000000"}`)
+	if rec.Code != http.StatusNotFound || rec.Header().Get("Link") != `</t/acme/v1/validate>; rel="successor-version"` {
+		t.Errorf("legacy validate = %d, Link %q", rec.Code, rec.Header().Get("Link"))
+	}
+}
+
+func TestSuccessorPath(t *testing.T) {
+	for path, want := range map[string]string{
+		"/enroll":                   "/v1/enroll",
+		"/admin/users/alice":        "/v1/admin/users/alice",
+		"/t/acme/validate":          "/t/acme/v1/validate",
+		"/t/acme/admin/users/a%2Fb": "/t/acme/v1/admin/users/a%2Fb",
+	} {
+		if got := successorPath(path); got != want {
+			t.Errorf("successorPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package http
+
+import (
+	"go-auth-totp/internal/logging"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// HeaderRequestID carries the request ID in both directions.
+const HeaderRequestID = "X-Request-ID"
+
+// LogRequests is middleware that gives every request an ID, reusing a
+// well-formed X-Request-ID from the caller, echoes it in the response and
+// attaches it to the context so every log line of the request carries it.
+// It logs one line per request when the handler is done.
+func (h *Handlers) LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(HeaderRequestID)
+		if !logging.ValidRequestID(id) {
+			id = logging.NewRequestID()
+		}
+		w.Header().Set(HeaderRequestID, id)
+		ctx := logging.WithRequestID(r.Context(), id)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		route := routeTemplate(r)
+		level := slog.LevelInfo
+		if quietRoutes[route] {
+			level = slog.LevelDebug
+		}
+		slog.Log(ctx, level, "Request", "method", r.Method, "route", route,
+			"status", rec.status, "duration_ms", time.Since(start).Milliseconds())
+	})
+}
+
+// quietRoutes are polled by infrastructure and only logged at debug level.
+var quietRoutes = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true, "/.well-known/jwks.json": true}
+
+// routeTemplate returns the template of the matched route, such as
+// "/admin/users/{id}", so path parameters stay out of labels and logs.
+func routeTemplate(r *http.Request) string {
+	if cur := mux.CurrentRoute(r); cur != nil {
+		if tpl, err := cur.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,89 @@
+package http
+
+import (
+	"go-auth-totp/internal/auth/apikey"
+	"go-auth-totp/internal/metrics"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// NewRouter registers every endpoint of the v1 API twice: under /v1/,
+// where the tenant comes from the API key or the default tenant, and under
+// /t/{tenant}/v1/. The unversioned paths of earlier releases remain as
+// deprecated aliases (see Deprecated). Requests are authenticated before
+// the tenant is resolved. The health, metrics, JWKS and OpenAPI endpoints
+// need no API key and belong to no tenant.
+func NewRouter(h *Handlers) *mux.Router {
+	r := mux.NewRouter()
+	r.Use(h.LogRequests)
+	r.HandleFunc("/healthz", h.HealthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", h.ReadyzHandler).Methods("GET")
+	r.HandleFunc("/openapi.json", h.OpenAPIHandler).Methods("GET")
+	if h.Assertions != nil {
+		r.HandleFunc("/.well-known/jwks.json", h.JWKSHandler).Methods("GET")
+	}
+	if h.Metrics != nil {
+		r.Handle("/metrics", h.Metrics.Handler()).Methods("GET")
+		r.Use(h.InstrumentRoutes)
+	}
+
+	api := r.NewRoute().Subrouter()
+	api.Use(LimitBody(h.MaxBodyBytes), h.Authenticate, h.ResolveTenant)
+	registerRoutes(api.PathPrefix("/t/{tenant}/v1").Subrouter(), h, false)
+	registerRoutes(api.PathPrefix("/v1").Subrouter(), h, false)
+
+	legacy := api.NewRoute().Subrouter()
+	legacy.Use(Deprecated)
+	registerRoutes(legacy.PathPrefix("/t/{tenant}").Subrouter(), h, true)
+	registerRoutes(legacy, h, true)
+	return r
+}
+
+// NewHealthRouter serves only /healthz and /readyz. cmd/api mounts it on
+// HEALTH_ADDR so probes work when the main listener requires client
+// certificates.
+func NewHealthRouter(h *Handlers) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/healthz", h.HealthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", h.ReadyzHandler).Methods("GET")
+	return r
+}
+
+// registerRoutes registers the API on r; legacy selects the bodies of the
+// unversioned routes where they differ.
+func registerRoutes(r *mux.Router, h *Handlers, legacy bool) {
+	enroll := func(f http.HandlerFunc) http.HandlerFunc { return h.RequireScope(apikey.ScopeEnroll, f) }
+	validate := func(f http.HandlerFunc) http.HandlerFunc { return h.RequireScope(apikey.ScopeValidate, f) }
+	admin := func(f http.HandlerFunc) http.HandlerFunc { return h.RequireScope(apikey.ScopeAdmin, f) }
+
+	enrollHandler := h.EnrollHandler
+	if legacy {
+		enrollHandler = h.LegacyEnrollHandler
+	}
+	r.HandleFunc("/enroll", enroll(h.countAttempt(metrics.OpEnroll, enrollHandler))).Methods("POST")
+	r.HandleFunc("/verify", enroll(h.countAttempt(metrics.OpVerify, h.VerifyHandler))).Methods("POST")
+	r.HandleFunc("/validate", validate(h.countAttempt(metrics.OpValidate, h.ValidateHandler))).Methods("POST")
+	r.HandleFunc("/recover", validate(h.countAttempt(metrics.OpRecover, h.RecoverHandler))).Methods("POST")
+	if h.Devices != nil {
+		r.HandleFunc("/devices/check", validate(h.countAttempt(metrics.OpDeviceCheck, h.CheckDeviceHandler))).Methods("POST")
+	}
+
+	a := r.PathPrefix("/admin").Subrouter()
+	a.HandleFunc("/users", admin(h.ListUsersHandler)).Methods("GET")
+	a.HandleFunc("/users/{id}", admin(h.GetUserHandler)).Methods("GET")
+	a.HandleFunc("/users/{id}", admin(h.DeleteUserHandler)).Methods("DELETE")
+	a.HandleFunc("/users/{id}/disable", admin(h.DisableUserHandler)).Methods("POST")
+	if h.Devices != nil {
+		a.HandleFunc("/users/{id}/devices", admin(h.ListDevicesHandler)).Methods("GET")
+		a.HandleFunc("/users/{id}/devices", admin(h.RevokeDevicesHandler)).Methods("DELETE")
+		a.HandleFunc("/users/{id}/devices/{device}", admin(h.RevokeDeviceHandler)).Methods("DELETE")
+	}
+	if h.Audit != nil {
+		a.HandleFunc("/audit", admin(h.ListAuditHandler)).Methods("GET")
+	}
+	if h.Webhooks != nil {
+		a.HandleFunc("/webhooks/dead-letters", admin(h.ListDeadLettersHandler)).Methods("GET")
+		a.HandleFunc("/webhooks/dead-letters/{id}/retry", admin(h.RetryDeadLetterHandler)).Methods("POST")
+	}
+}
@@ -0,0 +1,63 @@
+package http
+
+import (
+	"go-auth-totp/internal/auth/apikey"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// ResolveTenant is middleware that picks the tenant for a request: the
+// tenant of the caller's API key, else the {tenant} path variable (routes
+// under /t/{tenant}/), else the registry's default tenant. A path tenant
+// must match the key's tenant. Without a registry every request uses the
+// handlers' own services and is scoped to the default storage tenant.
+func (h *Handlers) ResolveTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.Tenants == nil {
+			next.ServeHTTP(w, r.WithContext(storage.WithTenant(r.Context(), storage.DefaultTenant)))
+			return
+		}
+
+		var t *tenant.Tenant
+		pathID, hasPath := mux.Vars(r)["tenant"]
+		if p, ok := apikey.FromContext(r.Context()); ok {
+			if hasPath && pathID != p.TenantID {
+				h.ErrorJSON(w, http.StatusForbidden, "API key does not belong to this tenant")
+				return
+			}
+			if t, ok = h.Tenants.Get(p.TenantID); !ok {
+				h.ErrorJSON(w, http.StatusForbidden, "API key tenant is not configured")
+				return
+			}
+		} else if hasPath {
+			if t, ok = h.Tenants.Get(pathID); !ok {
+				h.ErrorJSON(w, http.StatusNotFound, "Unknown tenant")
+				return
+			}
+		} else if t, ok = h.Tenants.Default(); !ok {
+			h.ErrorJSON(w, http.StatusBadRequest, "Tenant required: use /t/{tenant}/ or an API key")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(tenant.NewContext(r.Context(), t)))
+	})
+}
+
+// tenantFor returns the tenant resolved by ResolveTenant. Handlers mounted
+// without the middleware fall back to their own services, scoped to the
+// default storage tenant.
+func (h *Handlers) tenantFor(r *http.Request) *tenant.Tenant {
+	if t, ok := tenant.FromContext(r.Context()); ok {
+		return t
+	}
+	return &tenant.Tenant{
+		ID:                 storage.DefaultTenant,
+		Crypto:             h.Crypto,
+		Enroll:             h.EnrollSvc,
+		Verifier:           h.Verifier,
+		AssertionAudiences: h.AssertionAudiences,
+	}
+}
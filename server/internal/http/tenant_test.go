@@ -0,0 +1,183 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"go-auth-totp/internal/auth/apikey"
+	"go-auth-totp/internal/auth/enroll"
+	"go-auth-totp/internal/auth/ratelimit"
+	"go-auth-totp/internal/auth/recovery"
+	"go-auth-totp/internal/crypto"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+	"go-auth-totp/pkg/totp"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newTenantRouter serves two tenants with different keys and policies.
+// API keys are optional and there is no default tenant.
+func newTenantRouter(t *testing.T) (http.Handler, *Handlers) {
+	t.Helper()
+	reg := tenant.NewRegistry("")
+	add := func(id, issuer string, policy totp.Policy, keyByte byte) {
+		cs, err := crypto.NewAESGCMEncryption(bytes.Repeat([]byte{keyByte}, 32))
+		if err != nil {
+			t.Fatalf("crypto: %v", err)
+		}
+		tn, err := tenant.New(id, issuer, policy, cs)
+		if err != nil {
+			t.Fatalf("tenant.New(%s): %v", id, err)
+		}
+		if err := reg.Add(tn); err != nil {
+			t.Fatalf("Add(%s): %v", id, err)
+		}
+	}
+	add("acme", "Acme", totp.Policy{Digits: 8, Period: 60, Window: 1}, 1)
+	add("globex", "Globex", totp.DefaultPolicy(), 2)
+
+	repo := storage.NewInMemoryRepository()
+	h := &Handlers{
+		Repo:        repo,
+		Auth:        apikey.NewAuthenticator(repo, reg, apikey.Options{}),
+		Tenants:     reg,
+		RecoverySvc: recovery.NewService(),
+		Limiter:     ratelimit.NewInMemoryLimiter(time.Millisecond, 100),
+	}
+	return NewRouter(h), h
+}
+
+func serve(router http.Handler, method, path, apiKey, body string) *httptest.ResponseRecorder {
+	noteRequest(body)
+	noteSensitive(apiKey)
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	if apiKey != "" {
+		req.Header.Set(apikey.HeaderAPIKey, apiKey)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	noteResponse(rec.Body.Bytes())
+	return rec
+}
+
+// issueKey creates an API key for tenantID and returns its token.
+func issueKey(t *testing.T, h *Handlers, tenantID string, opts apikey.IssueOptions) *apikey.Issued {
+	t.Helper()
+	tn, ok := h.Tenants.Get(tenantID)
+	if !ok {
+		t.Fatalf("unknown tenant %s", tenantID)
+	}
+	if opts.Name == "" {
+		opts.Name = "test"
+	}
+	if opts.Scopes == nil {
+		opts.Scopes = []apikey.Scope{apikey.ScopeEnroll, apikey.ScopeValidate, apikey.ScopeAdmin}
+	}
+	issued, err := apikey.Issue(context.Background(), h.Repo.(storage.KeyStore), tn, opts)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	noteSensitive(issued.Token, hex.EncodeToString(issued.SigningSecret))
+	return issued
+}
+
+func TestTenantsAreIsolated(t *testing.T) {
+	router, h := newTenantRouter(t)
+	acmeKey := issueKey(t, h, "acme", apikey.IssueOptions{}).Token
+
+	enrollIn := func(path, apiKey string) enroll.EnrollmentResponse {
+		t.Helper()
+		rec := serve(router, http.MethodPost, path, apiKey, `{"user_id":"alice"}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("enroll via %s = %d %s", path, rec.Code, rec.Body)
+		}
+		var resp enroll.EnrollmentResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode enroll: %v", err)
+		}
+		return resp
+	}
+	// The same user ID enrolls independently in both tenants.
+	acme := enrollIn("/enroll", acmeKey)
+	globex := enrollIn("/t/globex/enroll", "")
+
+	// Each tenant's issuer and policy end up in the otpauth URL.
+	for _, tc := range []struct {
+		resp           enroll.EnrollmentResponse
+		issuer, digits string
+		period         string
+	}{
+		{acme, "Acme", "8", "60"},
+		{globex, "Globex", "6", "30"},
+	} {
+		u, err := url.Parse(tc.resp.OTPAuthURL)
+		if err != nil {
+			t.Fatalf("parse %s: %v", tc.resp.OTPAuthURL, err)
+		}
+		q := u.Query()
+		if q.Get("issuer") != tc.issuer || q.Get("digits") != tc.digits || q.Get("period") != tc.period {
+			t.Fatalf("otpauth URL = %s, want issuer=%s digits=%s period=%s", tc.resp.OTPAuthURL, tc.issuer, tc.digits, tc.period)
+		}
+	}
+
+	// acme codes follow acme's policy; the path and API key routes agree.
+	acmeCode, err := (&totp.Generator{Digits: 8, Period: 60}).GenerateCodeFromBase32(acme.Secret, uint64(time.Now().Unix()))
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if rec := serve(router, http.MethodPost, "/t/acme/verify", acmeKey, `{"user_id":"alice","code":"`+acmeCode+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("acme verify = %d %s", rec.Code, rec.Body)
+	}
+	// Enabling alice in acme leaves globex's alice pending.
+	if rec := serve(router, http.MethodPost, "/t/globex/validate", "", `{"user_id":"alice","code":"000000"}`); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("globex validate = %d, want %d", rec.Code, http.StatusPreconditionFailed)
+	}
+
+	// Secrets are encrypted with the owning tenant's key only.
+	acmeTenant, _ := h.Tenants.Get("acme")
+	globexTenant, _ := h.Tenants.Get("globex")
+	stored, err := h.Repo.GetUser(storage.WithTenant(context.Background(), "acme"), "alice")
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if _, err := acmeTenant.Crypto.Decrypt(stored.EncryptedSecret); err != nil {
+		t.Fatalf("acme secret does not decrypt with acme key: %v", err)
+	}
+	if _, err := globexTenant.Crypto.Decrypt(stored.EncryptedSecret); err == nil {
+		t.Fatal("acme secret decrypts with globex key")
+	}
+
+	// Admin endpoints only see their own tenant.
+	if rec := serve(router, http.MethodDelete, "/t/globex/admin/users/alice", "", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("globex delete = %d", rec.Code)
+	}
+	if rec := serve(router, http.MethodGet, "/admin/users/alice", acmeKey, ""); rec.Code != http.StatusOK {
+		t.Fatalf("acme get after globex delete = %d", rec.Code)
+	}
+}
+
+func TestResolveTenantErrors(t *testing.T) {
+	router, h := newTenantRouter(t)
+	acmeKey := issueKey(t, h, "acme", apikey.IssueOptions{}).Token
+	body := `{"user_id":"alice"}`
+
+	tests := []struct {
+		name, path, apiKey string
+		want               int
+	}{
+		{"unknown path tenant", "/t/initech/enroll", "", http.StatusNotFound},
+		{"unknown API key", "/enroll", "tk_000000000000_nope", http.StatusUnauthorized},
+		{"API key of another tenant", "/t/globex/enroll", acmeKey, http.StatusForbidden},
+		{"no tenant and no default", "/enroll", "", http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		if rec := serve(router, http.MethodPost, tc.path, tc.apiKey, body); rec.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, rec.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"go-auth-totp/internal/storage"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DeadLetter is the admin view of a webhook delivery that ran out of
+// attempts.
+type DeadLetter struct {
+	ID            int64           `json:"id"`
+	EndpointID    string          `json:"endpoint_id"`
+	EventID       string          `json:"event_id"`
+	EventType     string          `json:"event_type"`
+	Attempts      int             `json:"attempts"`
+	LastStatus    int             `json:"last_status,omitempty"`
+	LastError     string          `json:"last_error"`
+	LastAttemptAt time.Time       `json:"last_attempt_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+type ListDeadLettersResponse struct {
+	DeadLetters []DeadLetter `json:"dead_letters"`
+	NextAfter   int64        `json:"next_after,omitempty"`
+}
+
+// ListDeadLettersHandler returns a page of the tenant's dead-lettered
+// webhook deliveries. Query params: after, limit.
+func (h *Handlers) ListDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := storage.DefaultListLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			h.ErrorJSON(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = min(max(n, 1), storage.MaxListLimit)
+	}
+	var after int64
+	if v := q.Get("after"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			h.ErrorJSON(w, http.StatusBadRequest, "Invalid after")
+			return
+		}
+		after = n
+	}
+
+	dead, err := h.Webhooks.DeadLetters(r.Context(), after, limit)
+	if err != nil {
+		h.StorageError(w, err)
+		return
+	}
+
+	resp := ListDeadLettersResponse{DeadLetters: make([]DeadLetter, 0, len(dead))}
+	for _, d := range dead {
+		resp.DeadLetters = append(resp.DeadLetters, DeadLetter{
+			ID:            d.ID,
+			EndpointID:    d.EndpointID,
+			EventID:       d.EventID,
+			EventType:     d.EventType,
+			Attempts:      d.Attempts,
+			LastStatus:    d.LastStatus,
+			LastError:     d.LastError,
+			LastAttemptAt: d.NextAttemptAt,
+			CreatedAt:     d.CreatedAt,
+			Payload:       d.Payload,
+		})
+	}
+	if len(dead) == limit {
+		resp.NextAfter = dead[len(dead)-1].ID
+	}
+	h.EncodeJSON(w, http.StatusOK, resp)
+}
+
+// RetryDeadLetterHandler queues a dead-lettered delivery again.
+func (h *Handlers) RetryDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		h.ErrorJSON(w, http.StatusNotFound, "Dead letter not found")
+		return
+	}
+	if err := h.Webhooks.Retry(r.Context(), id); err != nil {
+		if errors.Is(err, storage.ErrWebhookNotFound) {
+			h.ErrorJSON(w, http.StatusNotFound, "Dead letter not found")
+			return
+		}
+		h.StorageError(w, err)
+		return
+	}
+	h.EncodeJSON(w, http.StatusAccepted, StatusResponse{Status: "queued"})
+}
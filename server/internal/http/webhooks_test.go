@@ -0,0 +1,144 @@
+package http
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"go-auth-totp/internal/auth/enroll"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/webhook"
+	"go-auth-totp/pkg/totp"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookEvents(t *testing.T) {
+	_, h := newTenantRouter(t)
+	store := h.Repo.(storage.WebhookStore)
+	h.Webhooks = webhook.NewNotifier(store)
+	h.LowRecoveryCodes = 100 // every recovery leaves "few" codes
+	router := NewRouter(h)
+	acme, _ := h.Tenants.Get("acme")
+
+	var mu sync.Mutex
+	var got []webhook.Payload
+	var failing bool
+	rcv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var p webhook.Payload
+		json.Unmarshal(body, &p)
+		got = append(got, p)
+	}))
+	defer rcv.Close()
+	received := func() []webhook.Payload {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]webhook.Payload(nil), got...)
+	}
+	setFailing := func(v bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		failing = v
+	}
+	reg, err := webhook.Register(context.Background(), store, acme, rcv.URL, []string{"*"})
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	noteSensitive(hex.EncodeToString(reg.Secret))
+
+	rec := serve(router, http.MethodPost, "/t/acme/enroll", "", `{"user_id":"alice"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("enroll = %d %s", rec.Code, rec.Body)
+	}
+	var enrolled enroll.EnrollmentResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &enrolled); err != nil {
+		t.Fatalf("decode enroll: %v", err)
+	}
+	code, err := (&totp.Generator{Digits: 8, Period: 60}).GenerateCodeFromBase32(enrolled.Secret, uint64(time.Now().Unix()))
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	noteSensitive(code)
+	steps := []struct{ path, body string }{
+		{"/t/acme/verify", `{"user_id":"alice","code":"` + code + `"}`},
+		{"/t/acme/recover", `{"user_id":"alice","code":"` + enrolled.RecoveryCodes[0] + `"}`},
+		{"/t/acme/enroll", `{"user_id":"alice"}`}, // re-enrolling turns 2FA off
+		{"/t/acme/admin/users/alice/disable", ""},
+	}
+	for _, s := range steps {
+		if rec := serve(router, http.MethodPost, s.path, "", s.body); rec.Code != http.StatusOK {
+			t.Fatalf("POST %s = %d %s", s.path, rec.Code, rec.Body)
+		}
+	}
+
+	d := webhook.NewDispatcher(store, h.Tenants, webhook.Options{MaxAttempts: 1})
+	if _, err := d.DeliverDue(context.Background()); err != nil {
+		t.Fatalf("DeliverDue: %v", err)
+	}
+	events := received()
+	want := []string{webhook.EventTOTPEnabled, webhook.EventRecoveryCodeUsed, webhook.EventRecoveryCodesLow,
+		webhook.EventTOTPDisabled, webhook.EventTOTPDisabled}
+	if len(events) != len(want) {
+		t.Fatalf("received %d events, want %v: %+v", len(events), want, events)
+	}
+	for i, p := range events {
+		if p.Type != want[i] || p.UserID != "alice" || p.TenantID != "acme" {
+			t.Errorf("event %d = %+v, want %s", i, p, want[i])
+		}
+	}
+	remaining := float64(len(enrolled.RecoveryCodes) - 1)
+	if events[1].Data["remaining"] != remaining || events[2].Data["remaining"] != remaining {
+		t.Errorf("remaining = %v / %v, want %v", events[1].Data["remaining"], events[2].Data["remaining"], remaining)
+	}
+
+	// A delivery that fails its only attempt shows up as a dead letter and
+	// can be retried.
+	// Deleting a user sends totp.disabled; a failed delete sends nothing.
+	setFailing(true)
+	if rec := serve(router, http.MethodDelete, "/t/acme/admin/users/bob", "", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("delete unknown user = %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(router, http.MethodDelete, "/t/acme/admin/users/alice", "", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete = %d %s", rec.Code, rec.Body)
+	}
+	if _, err := d.DeliverDue(context.Background()); err != nil {
+		t.Fatalf("DeliverDue: %v", err)
+	}
+	rec = serve(router, http.MethodGet, "/t/acme/admin/webhooks/dead-letters", "", "")
+	var page ListDeadLettersResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("dead letters = %d %s", rec.Code, rec.Body)
+	}
+	if len(page.DeadLetters) != 1 || page.DeadLetters[0].LastStatus != http.StatusBadGateway || page.DeadLetters[0].EventType != webhook.EventTOTPDisabled {
+		t.Fatalf("dead letters = %+v", page.DeadLetters)
+	}
+	if rec := serve(router, http.MethodGet, "/t/globex/admin/webhooks/dead-letters", "", ""); rec.Body.String() != "{\"dead_letters\":[]}\n" {
+		t.Errorf("globex dead letters = %s", rec.Body)
+	}
+
+	id := strconv.FormatInt(page.DeadLetters[0].ID, 10)
+	if rec := serve(router, http.MethodPost, "/t/globex/admin/webhooks/dead-letters/"+id+"/retry", "", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("retry from globex = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := serve(router, http.MethodPost, "/t/acme/admin/webhooks/dead-letters/"+id+"/retry", "", ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("retry = %d %s", rec.Code, rec.Body)
+	}
+	setFailing(false)
+	if _, err := d.DeliverDue(context.Background()); err != nil {
+		t.Fatalf("DeliverDue: %v", err)
+	}
+	if events := received(); len(events) != len(want)+1 {
+		t.Fatalf("retried event not delivered: %+v", events)
+	}
+}
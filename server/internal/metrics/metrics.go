@@ -0,0 +1,193 @@
+// Package metrics exposes Prometheus metrics for authentication outcomes,
+// HTTP and repository latency, rate limiter size and decrypt failures.
+//
+// Labels are drawn from small fixed sets (operations, outcomes, route
+// templates); user IDs, API keys and tenants never become label values.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"go-auth-totp/internal/auth/apikey"
+	"go-auth-totp/internal/storage"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Authentication operations.
+const (
+	OpEnroll   = "enroll"
+	OpVerify   = "verify"
+	OpValidate = "validate"
+	OpRecover  = "recover"
+	// OpDeviceCheck is a trusted device token standing in for a code.
+	OpDeviceCheck = "device_check"
+	// OpRadius is an Access-Request to the RADIUS frontend.
+	OpRadius = "radius"
+)
+
+// Outcomes of an authentication operation.
+const (
+	OutcomeSuccess     = "success"
+	OutcomeInvalidCode = "invalid_code"
+	OutcomeRateLimited = "rate_limited"
+	// OutcomeNotEnabled covers unknown users as well as users whose TOTP
+	// is not (yet) enabled.
+	OutcomeNotEnabled = "not_enabled"
+	OutcomeError      = "error"
+)
+
+// OutcomeForStatus classifies an operation by the HTTP status its handler
+// responded with.
+func OutcomeForStatus(status int) string {
+	switch status {
+	case http.StatusOK:
+		return OutcomeSuccess
+	case http.StatusUnauthorized:
+		return OutcomeInvalidCode
+	case http.StatusTooManyRequests:
+		return OutcomeRateLimited
+	case http.StatusPreconditionFailed, http.StatusNotFound:
+		return OutcomeNotEnabled
+	default:
+		return OutcomeError
+	}
+}
+
+// Metrics owns a registry with every collector of this service. A nil
+// *Metrics records nothing, so callers need no checks.
+type Metrics struct {
+	registry        *prometheus.Registry
+	attempts        *prometheus.CounterVec
+	keyRejections   *prometheus.CounterVec
+	httpDuration    *prometheus.HistogramVec
+	repoDuration    *prometheus.HistogramVec
+	decryptFailures prometheus.Counter
+}
+
+// New creates the collectors, along with the standard Go runtime and
+// process collectors, in a fresh registry.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		attempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "totp_auth_attempts_total",
+			Help: "Enroll, verify, validate and recover requests by outcome.",
+		}, []string{"operation", "outcome"}),
+		keyRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "totp_api_key_rejections_total",
+			Help: "Requests rejected by API key authentication or the per-key rate limit, by reason.",
+		}, []string{"reason"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "totp_http_request_duration_seconds",
+			Help:    "Handler latency by route template, method and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+		repoDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "totp_repository_duration_seconds",
+			Help:    "Repository call latency by operation and result.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"operation", "result"}),
+		decryptFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "totp_decrypt_failures_total",
+			Help: "Secrets that failed to decrypt, e.g. after a key mix-up.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.attempts, m.keyRejections, m.httpDuration, m.repoDuration, m.decryptFailures,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	// Pre-create the outcome series so rates start from zero.
+	for _, op := range []string{OpEnroll, OpVerify, OpValidate, OpRecover, OpDeviceCheck, OpRadius} {
+		for _, outcome := range []string{OutcomeSuccess, OutcomeInvalidCode, OutcomeRateLimited, OutcomeNotEnabled, OutcomeError} {
+			m.attempts.WithLabelValues(op, outcome)
+		}
+	}
+	for _, reason := range apikey.RejectReasons {
+		m.keyRejections.WithLabelValues(reason)
+	}
+	return m
+}
+
+// Handler serves the registry in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// RecordAttempt counts one operation with its outcome.
+func (m *Metrics) RecordAttempt(operation, outcome string) {
+	if m == nil {
+		return
+	}
+	m.attempts.WithLabelValues(operation, outcome).Inc()
+}
+
+// RecordAPIKeyRejection counts a request rejected with err, an error of
+// apikey.Authenticator.
+func (m *Metrics) RecordAPIKeyRejection(err error) {
+	if m == nil {
+		return
+	}
+	m.keyRejections.WithLabelValues(apikey.RejectReason(err)).Inc()
+}
+
+// ObserveHTTP records the latency of a request matched by route, a
+// template such as "/t/{tenant}/validate".
+func (m *Metrics) ObserveHTTP(route, method string, status int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.httpDuration.WithLabelValues(route, method, strconv.Itoa(status)).Observe(d.Seconds())
+}
+
+// ObserveRepository is a storage.ObserveFunc.
+func (m *Metrics) ObserveRepository(operation string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.repoDuration.WithLabelValues(operation, repositoryResult(err)).Observe(d.Seconds())
+}
+
+func repositoryResult(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, storage.ErrUserNotFound):
+		return "not_found"
+	case errors.Is(err, storage.ErrConflict), errors.Is(err, storage.ErrVersionMismatch):
+		return "conflict"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, storage.ErrUnavailable):
+		return "unavailable"
+	default:
+		return "error"
+	}
+}
+
+// DecryptFailed counts a failed decryption; it is a crypto.DecryptHook.
+func (m *Metrics) DecryptFailed(error) {
+	if m == nil {
+		return
+	}
+	m.decryptFailures.Inc()
+}
+
+// WatchLimiter exports the number of buckets held by a rate limiter,
+// which grows with the number of distinct keys it has seen.
+func (m *Metrics) WatchLimiter(name string, buckets func() int) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "totp_ratelimit_buckets",
+		Help:        "Buckets currently held by the rate limiter.",
+		ConstLabels: prometheus.Labels{"limiter": name},
+	}, func() float64 { return float64(buckets()) }))
+}
@@ -0,0 +1,64 @@
+package pamexec
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cache records the time of each user's last successful login, one file
+// per user in a root-only directory. File names are hashes, so the
+// directory does not list who logs in.
+type Cache struct {
+	dir string
+	ttl time.Duration
+}
+
+// NewCache returns a cache in dir, creating it if needed.
+func NewCache(dir string, ttl time.Duration) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create cache dir: %w", err)
+	}
+	return &Cache{dir: dir, ttl: ttl}, nil
+}
+
+func (c *Cache) path(user string) string {
+	sum := sha256.Sum256([]byte(user))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:16]))
+}
+
+// Remember records a successful login of user at now.
+func (c *Cache) Remember(user string, now time.Time) error {
+	f, err := os.CreateTemp(c.dir, ".login-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(strconv.FormatInt(now.Unix(), 10) + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path(user))
+}
+
+// Recent reports whether user logged in successfully within the TTL.
+func (c *Cache) Recent(user string, now time.Time) bool {
+	b, err := os.ReadFile(c.path(user))
+	if err != nil {
+		return false
+	}
+	sec, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return false
+	}
+	at := time.Unix(sec, 0)
+	return !at.After(now) && now.Sub(at) < c.ttl
+}
@@ -0,0 +1,147 @@
+// Package pamexec decides PAM logins for cmd/pam-totp, a helper run by
+// pam_exec(8). The code is checked by the TOTP server's API or, on the
+// server's own host, against the database; what happens when neither can
+// answer is the configured fail policy, softened by an optional cache of
+// recent successful logins for hosts that go offline.
+package pamexec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"go-auth-totp/internal/auth/validate"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+	"go-auth-totp/pkg/assertion"
+	"go-auth-totp/pkg/stepup"
+	"go-auth-totp/pkg/timeutil"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// maxCodeLen bounds what is read from pam_exec; codes are 6 to 8 digits.
+const maxCodeLen = 64
+
+// Decision is the outcome of an authentication.
+type Decision struct {
+	Allow bool
+	// Reason is logged, never shown to the user.
+	Reason string
+}
+
+// Reasons.
+const (
+	ReasonValid         = "valid"
+	ReasonInvalidCode   = "invalid_code"
+	ReasonRateLimited   = "rate_limited"
+	ReasonNotEnrolled   = "not_enrolled"
+	ReasonMisconfigured = "misconfigured"
+	ReasonUnavailable   = "unavailable"
+	ReasonOfflineGrace  = "offline_grace"
+	ReasonFailOpen      = "fail_open"
+)
+
+// Options configure Authenticate.
+type Options struct {
+	Codes stepup.CodeChecker
+	// FailOpen allows logins the server cannot answer for. The default
+	// denies them.
+	FailOpen bool
+	// NullOK allows users who have not enrolled, like pam_unix's nullok.
+	NullOK bool
+	// Cache, when set, remembers successful logins; a user who logged in
+	// within its TTL is let in while the server cannot be reached.
+	Cache *Cache
+	Clock timeutil.Clock
+}
+
+// Authenticate checks code for user and applies the fail policy.
+func Authenticate(ctx context.Context, opts Options, user, code string) Decision {
+	clock := opts.Clock
+	if clock == nil {
+		clock = timeutil.RealClock{}
+	}
+	_, err := opts.Codes.CheckCode(ctx, user, code)
+	switch {
+	case err == nil:
+		if opts.Cache != nil {
+			if err := opts.Cache.Remember(user, clock.Now()); err != nil {
+				slog.Warn("Caching login failed", "user", user, "error", err)
+			}
+		}
+		return Decision{Allow: true, Reason: ReasonValid}
+	case errors.Is(err, stepup.ErrInvalidCode):
+		return Decision{Reason: ReasonInvalidCode}
+	case errors.Is(err, stepup.ErrRateLimited):
+		return Decision{Reason: ReasonRateLimited}
+	case errors.Is(err, stepup.ErrNotEnrolled):
+		return Decision{Allow: opts.NullOK, Reason: ReasonNotEnrolled}
+	case errors.Is(err, stepup.ErrMisconfigured):
+		// The server answered, so neither the fail policy nor the
+		// offline cache applies.
+		slog.Error("TOTP check misconfigured", "user", user, "error", err)
+		return Decision{Reason: ReasonMisconfigured}
+	}
+
+	// The server did not answer: offline, or failing itself.
+	slog.Warn("TOTP server unavailable", "user", user, "error", err)
+	if opts.Cache != nil && opts.Cache.Recent(user, clock.Now()) {
+		return Decision{Allow: true, Reason: ReasonOfflineGrace}
+	}
+	if opts.FailOpen {
+		return Decision{Allow: true, Reason: ReasonFailOpen}
+	}
+	return Decision{Reason: ReasonUnavailable}
+}
+
+// ReadCode reads the code pam_exec writes to stdin with expose_authtok: the
+// token followed by a NUL byte. A trailing newline, as typed into a
+// terminal, is dropped too.
+func ReadCode(r io.Reader) (string, error) {
+	b, err := io.ReadAll(io.LimitReader(bufio.NewReader(r), maxCodeLen+1))
+	if err != nil {
+		return "", err
+	}
+	if len(b) > maxCodeLen {
+		return "", errors.New("code is too long")
+	}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	code := strings.TrimRight(string(b), "\r\n")
+	if code == "" {
+		return "", errors.New("no code on stdin; is pam_exec run with expose_authtok?")
+	}
+	return code, nil
+}
+
+// Local checks codes against the database through validate.Service, for
+// the host that runs the server. Its rate limiter lives only as long as
+// the process, so pair it with pam_faillock.
+type Local struct {
+	Codes  *validate.Service
+	Tenant *tenant.Tenant
+	// Clock should be the one of Options; nil means the real clock.
+	Clock timeutil.Clock
+}
+
+func (l *Local) CheckCode(ctx context.Context, userID, code string) (*stepup.Proof, error) {
+	clock := l.Clock
+	if clock == nil {
+		clock = timeutil.RealClock{}
+	}
+	err := l.Codes.Validate(ctx, l.Tenant, userID, code)
+	switch {
+	case err == nil:
+		return &stepup.Proof{UserID: userID, Method: assertion.MethodTOTP, AuthTime: clock.Now()}, nil
+	case errors.Is(err, validate.ErrInvalidCode):
+		return nil, stepup.ErrInvalidCode
+	case errors.Is(err, validate.ErrRateLimited):
+		return nil, stepup.ErrRateLimited
+	case errors.Is(err, validate.ErrNotEnabled), errors.Is(err, storage.ErrUserNotFound):
+		return nil, stepup.ErrNotEnrolled
+	}
+	return nil, err
+}
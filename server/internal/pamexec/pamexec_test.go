@@ -0,0 +1,114 @@
+package pamexec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-auth-totp/pkg/stepup"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fixedClock struct{ t time.Time }
+
+func (c *fixedClock) Now() time.Time { return c.t }
+
+// fakeCodes accepts "123456" and fails with err otherwise.
+type fakeCodes struct{ err error }
+
+func (f *fakeCodes) CheckCode(_ context.Context, userID, code string) (*stepup.Proof, error) {
+	if code == "123456" && f.err == nil {
+		return &stepup.Proof{UserID: userID}, nil
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return nil, stepup.ErrInvalidCode
+}
+
+func TestAuthenticate(t *testing.T) {
+	offline := errors.New("validate: dial tcp: connection refused")
+	misconfigured := fmt.Errorf("%w: validate: 404 Not Found: Unknown tenant", stepup.ErrMisconfigured)
+	for name, tc := range map[string]struct {
+		err      error
+		code     string
+		failOpen bool
+		nullOK   bool
+		want     Decision
+	}{
+		"valid":                {code: "123456", want: Decision{true, ReasonValid}},
+		"invalid":              {code: "000000", want: Decision{false, ReasonInvalidCode}},
+		"invalid, fail open":   {code: "000000", failOpen: true, want: Decision{false, ReasonInvalidCode}},
+		"rate limited":         {err: stepup.ErrRateLimited, failOpen: true, want: Decision{false, ReasonRateLimited}},
+		"not enrolled":         {err: stepup.ErrNotEnrolled, want: Decision{false, ReasonNotEnrolled}},
+		"not enrolled, nullok": {err: stepup.ErrNotEnrolled, nullOK: true, want: Decision{true, ReasonNotEnrolled}},
+		"offline, fail closed": {err: offline, want: Decision{false, ReasonUnavailable}},
+		"offline, fail open":   {err: offline, failOpen: true, want: Decision{true, ReasonFailOpen}},
+		"misconfigured, fail open, nullok": {err: misconfigured, failOpen: true, nullOK: true,
+			want: Decision{false, ReasonMisconfigured}},
+	} {
+		opts := Options{Codes: &fakeCodes{err: tc.err}, FailOpen: tc.failOpen, NullOK: tc.nullOK}
+		if got := Authenticate(context.Background(), opts, "alice", tc.code); got != tc.want {
+			t.Errorf("%s: Authenticate = %+v, want %+v", name, got, tc.want)
+		}
+	}
+}
+
+func TestOfflineGrace(t *testing.T) {
+	cache, err := NewCache(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	clock := &fixedClock{t: time.Unix(1_700_000_000, 0)}
+	codes := &fakeCodes{}
+	opts := Options{Codes: codes, Cache: cache, Clock: clock}
+
+	if d := Authenticate(context.Background(), opts, "alice", "123456"); !d.Allow {
+		t.Fatalf("online login = %+v", d)
+	}
+
+	codes.err = errors.New("validate: 503 Service Unavailable: Storage unavailable")
+	clock.t = clock.t.Add(30 * time.Minute)
+	if d := Authenticate(context.Background(), opts, "alice", "000000"); d != (Decision{true, ReasonOfflineGrace}) {
+		t.Fatalf("offline within grace = %+v", d)
+	}
+	if d := Authenticate(context.Background(), opts, "bob", "000000"); d.Allow {
+		t.Fatalf("offline login of a user never seen = %+v", d)
+	}
+	clock.t = clock.t.Add(time.Hour)
+	if d := Authenticate(context.Background(), opts, "alice", "000000"); d.Allow {
+		t.Fatalf("offline after grace = %+v", d)
+	}
+
+	// Nor does it cover a server that answers but rejects the helper.
+	codes.err = fmt.Errorf("%w: validate: 401 Unauthorized: Invalid API key", stepup.ErrMisconfigured)
+	clock.t = time.Unix(1_700_000_000, 0)
+	if d := Authenticate(context.Background(), opts, "alice", "000000"); d != (Decision{false, ReasonMisconfigured}) {
+		t.Fatalf("misconfigured with a cached login = %+v", d)
+	}
+
+	// The grace only covers an unreachable server, never a wrong code.
+	codes.err = nil
+	clock.t = time.Unix(1_700_000_000, 0)
+	if d := Authenticate(context.Background(), opts, "alice", "000000"); d.Allow {
+		t.Fatalf("wrong code with a cached login = %+v", d)
+	}
+}
+
+func TestReadCode(t *testing.T) {
+	for in, want := range map[string]string{
+		"123456\x00": "123456", // pam_exec expose_authtok
+		"123456\n":   "123456",
+		"123456":     "123456",
+	} {
+		if got, err := ReadCode(strings.NewReader(in)); err != nil || got != want {
+			t.Errorf("ReadCode(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "\x00", "\n", strings.Repeat("1", 100)} {
+		if _, err := ReadCode(strings.NewReader(in)); err == nil {
+			t.Errorf("ReadCode(%q) succeeded", in)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package radius
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-auth-totp/internal/tenant"
+	"net"
+	"os"
+	"strings"
+)
+
+// ClientsFile is the format of RADIUS_CLIENTS_FILE.
+//
+//	{
+//	  "clients": [
+//	    {"name": "vpn", "address": "10.0.8.0/24", "secret_env": "VPN_RADIUS_SECRET",
+//	     "tenant": "acme", "static_password": true}
+//	  ]
+//	}
+//
+// Like tenant master keys, secrets are never stored in the file itself:
+// secret_env names the environment variable holding the shared secret.
+// address is an IP or a CIDR range. tenant defaults to the default tenant.
+// static_password makes users send their static password followed by the
+// code.
+type ClientsFile struct {
+	Clients []FileClient `json:"clients"`
+}
+
+// FileClient is one client entry of ClientsFile.
+type FileClient struct {
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+	SecretEnv string `json:"secret_env"`
+	Tenant    string `json:"tenant"`
+	// StaticPassword expects User-Password to be the user's own static
+	// password followed by the code. Users without one are rejected.
+	StaticPassword bool `json:"static_password"`
+	// RequireMessageAuthenticator drops requests without a valid
+	// Message-Authenticator (RFC 3579), which protects against forged
+	// responses (BlastRADIUS) once every client sends one.
+	RequireMessageAuthenticator bool `json:"require_message_authenticator"`
+}
+
+// Client is a network access server allowed to send requests.
+type Client struct {
+	Name                        string
+	Network                     *net.IPNet
+	Secret                      []byte
+	Tenant                      *tenant.Tenant
+	StaticPassword              bool
+	RequireMessageAuthenticator bool
+}
+
+// LoadClients reads and resolves the clients file at path.
+func LoadClients(path string, tenants *tenant.Registry) ([]Client, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read radius clients file: %w", err)
+	}
+	var f ClientsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parse radius clients file: %w", err)
+	}
+	return FromFile(&f, tenants)
+}
+
+// FromFile resolves the secrets and tenants of a parsed clients file.
+func FromFile(f *ClientsFile, tenants *tenant.Registry) ([]Client, error) {
+	if len(f.Clients) == 0 {
+		return nil, fmt.Errorf("radius clients file lists no clients")
+	}
+	clients := make([]Client, 0, len(f.Clients))
+	for _, fc := range f.Clients {
+		network, err := parseNetwork(fc.Address)
+		if err != nil {
+			return nil, fmt.Errorf("radius client %s: %w", fc.Name, err)
+		}
+		if fc.SecretEnv == "" {
+			return nil, fmt.Errorf("radius client %s: secret_env is required", fc.Name)
+		}
+		secret := os.Getenv(fc.SecretEnv)
+		if secret == "" {
+			return nil, fmt.Errorf("radius client %s: %s is not set", fc.Name, fc.SecretEnv)
+		}
+
+		t, ok := tenants.Default()
+		if fc.Tenant != "" {
+			t, ok = tenants.Get(fc.Tenant)
+		}
+		if !ok {
+			return nil, fmt.Errorf("radius client %s: tenant %q is not defined", fc.Name, fc.Tenant)
+		}
+
+		clients = append(clients, Client{Name: fc.Name, Network: network, Secret: []byte(secret), Tenant: t,
+			StaticPassword: fc.StaticPassword, RequireMessageAuthenticator: fc.RequireMessageAuthenticator})
+	}
+	return clients, nil
+}
+
+func parseNetwork(address string) (*net.IPNet, error) {
+	if strings.Contains(address, "/") {
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address: %w", err)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", address)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
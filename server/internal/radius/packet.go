@@ -0,0 +1,233 @@
+package radius
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Packet codes (RFC 2865 section 3).
+const (
+	CodeAccessRequest   byte = 1
+	CodeAccessAccept    byte = 2
+	CodeAccessReject    byte = 3
+	CodeAccessChallenge byte = 11
+)
+
+// Attribute types used here.
+const (
+	AttrUserName             byte = 1
+	AttrUserPassword         byte = 2
+	AttrReplyMessage         byte = 18
+	AttrMessageAuthenticator byte = 80 // RFC 3579
+)
+
+const (
+	headerLen = 20
+	// MaxPacketLen is the largest packet RFC 2865 allows.
+	MaxPacketLen = 4096
+	// maxPasswordLen is the largest User-Password before hiding.
+	maxPasswordLen = 128
+)
+
+var errMalformed = errors.New("malformed packet")
+
+// Attribute is one type-length-value attribute.
+type Attribute struct {
+	Type  byte
+	Value []byte
+}
+
+// Packet is a decoded RADIUS packet.
+type Packet struct {
+	Code          byte
+	Identifier    byte
+	Authenticator [16]byte
+	Attributes    []Attribute
+}
+
+// Parse decodes b, checking that its lengths are consistent.
+func Parse(b []byte) (*Packet, error) {
+	if len(b) < headerLen {
+		return nil, errMalformed
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < headerLen || length > MaxPacketLen || length > len(b) {
+		return nil, errMalformed
+	}
+	// Octets past Length are padding and ignored.
+	b = b[:length]
+	p := &Packet{Code: b[0], Identifier: b[1]}
+	copy(p.Authenticator[:], b[4:headerLen])
+	for rest := b[headerLen:]; len(rest) > 0; {
+		if len(rest) < 2 || rest[1] < 2 || int(rest[1]) > len(rest) {
+			return nil, errMalformed
+		}
+		p.Attributes = append(p.Attributes, Attribute{Type: rest[0], Value: rest[2:rest[1]]})
+		rest = rest[rest[1]:]
+	}
+	return p, nil
+}
+
+// Encode returns the wire form of p as is; see Response for signing.
+func (p *Packet) Encode() ([]byte, error) {
+	b := make([]byte, headerLen, MaxPacketLen)
+	b[0], b[1] = p.Code, p.Identifier
+	copy(b[4:headerLen], p.Authenticator[:])
+	for _, a := range p.Attributes {
+		if len(a.Value) > 253 {
+			return nil, fmt.Errorf("attribute %d is too long", a.Type)
+		}
+		b = append(b, a.Type, byte(len(a.Value)+2))
+		b = append(b, a.Value...)
+	}
+	if len(b) > MaxPacketLen {
+		return nil, errors.New("packet is too long")
+	}
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	return b, nil
+}
+
+// Get returns the value of the first attribute of type t.
+func (p *Packet) Get(t byte) ([]byte, bool) {
+	for _, a := range p.Attributes {
+		if a.Type == t {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Add appends an attribute.
+func (p *Packet) Add(t byte, value []byte) {
+	p.Attributes = append(p.Attributes, Attribute{Type: t, Value: value})
+}
+
+// HidePassword hides a User-Password as in RFC 2865 section 5.2, using the
+// shared secret and the request authenticator.
+func HidePassword(password, secret []byte, authenticator [16]byte) ([]byte, error) {
+	if len(password) > maxPasswordLen {
+		return nil, errors.New("password is too long")
+	}
+	n := (len(password) + 15) / 16 * 16
+	if n == 0 {
+		n = 16
+	}
+	out := make([]byte, n)
+	copy(out, password)
+	prev := authenticator[:]
+	for i := 0; i < n; i += 16 {
+		h := md5.Sum(append(append([]byte{}, secret...), prev...))
+		for j := 0; j < 16; j++ {
+			out[i+j] ^= h[j]
+		}
+		prev = out[i : i+16]
+	}
+	return out, nil
+}
+
+// RevealPassword undoes HidePassword and strips the padding.
+func RevealPassword(hidden, secret []byte, authenticator [16]byte) ([]byte, error) {
+	if len(hidden) == 0 || len(hidden)%16 != 0 || len(hidden) > maxPasswordLen {
+		return nil, errMalformed
+	}
+	out := make([]byte, len(hidden))
+	prev := authenticator[:]
+	for i := 0; i < len(hidden); i += 16 {
+		h := md5.Sum(append(append([]byte{}, secret...), prev...))
+		for j := 0; j < 16; j++ {
+			out[i+j] = hidden[i+j] ^ h[j]
+		}
+		prev = hidden[i : i+16]
+	}
+	return bytes.TrimRight(out, "\x00"), nil
+}
+
+// messageAuthenticator is the RFC 3579 HMAC-MD5 over the packet b with
+// its Message-Authenticator value zeroed and, for responses, the request
+// authenticator in place.
+func messageAuthenticator(b, secret []byte) []byte {
+	m := hmac.New(md5.New, secret)
+	m.Write(b)
+	return m.Sum(nil)
+}
+
+// offsetOf returns the offset of the value of the first attribute of type
+// t in the encoded packet b.
+func offsetOf(b []byte, t byte) (int, bool) {
+	for i := headerLen; i+2 <= len(b); i += int(b[i+1]) {
+		if b[i+1] < 2 {
+			return 0, false
+		}
+		if b[i] == t {
+			return i + 2, true
+		}
+	}
+	return 0, false
+}
+
+// VerifyMessageAuthenticator checks the Message-Authenticator of the
+// encoded request b. present is false when the request has none.
+func VerifyMessageAuthenticator(b, secret []byte) (present, valid bool) {
+	off, ok := offsetOf(b, AttrMessageAuthenticator)
+	if !ok {
+		return false, false
+	}
+	if off+16 > len(b) || b[off-1] != 18 {
+		return true, false
+	}
+	got := append([]byte{}, b[off:off+16]...)
+	zeroed := append([]byte{}, b...)
+	copy(zeroed[off:off+16], make([]byte, 16))
+	return true, hmac.Equal(got, messageAuthenticator(zeroed, secret))
+}
+
+// SignRequest encodes an Access-Request carrying a Message-Authenticator.
+// Clients use it; the server only verifies.
+func SignRequest(p *Packet, secret []byte) ([]byte, error) {
+	p.Add(AttrMessageAuthenticator, make([]byte, 16))
+	b, err := p.Encode()
+	if err != nil {
+		return nil, err
+	}
+	off, _ := offsetOf(b, AttrMessageAuthenticator)
+	copy(b[off:], messageAuthenticator(b, secret))
+	return b, nil
+}
+
+// Response encodes a reply to request: it adds a Message-Authenticator
+// and sets the Response Authenticator (RFC 2865 section 3).
+func Response(code byte, request *Packet, attrs []Attribute, secret []byte) ([]byte, error) {
+	p := &Packet{Code: code, Identifier: request.Identifier, Authenticator: request.Authenticator}
+	p.Attributes = append(p.Attributes, attrs...)
+	p.Add(AttrMessageAuthenticator, make([]byte, 16))
+	b, err := p.Encode()
+	if err != nil {
+		return nil, err
+	}
+	off, _ := offsetOf(b, AttrMessageAuthenticator)
+	copy(b[off:], messageAuthenticator(b, secret))
+
+	h := md5.New()
+	h.Write(b)
+	h.Write(secret)
+	copy(b[4:headerLen], h.Sum(nil))
+	return b, nil
+}
+
+// VerifyResponse checks the Response Authenticator of the encoded reply b
+// to a request with the given authenticator.
+func VerifyResponse(b, secret []byte, requestAuthenticator [16]byte) bool {
+	if len(b) < headerLen {
+		return false
+	}
+	c := append([]byte{}, b...)
+	copy(c[4:headerLen], requestAuthenticator[:])
+	h := md5.New()
+	h.Write(c)
+	h.Write(secret)
+	return hmac.Equal(h.Sum(nil), b[4:headerLen])
+}
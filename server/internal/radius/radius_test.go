@@ -0,0 +1,361 @@
+package radius
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"go-auth-totp/internal/auth/password"
+	"go-auth-totp/internal/auth/ratelimit"
+	"go-auth-totp/internal/auth/validate"
+	"go-auth-totp/internal/crypto"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+	"go-auth-totp/pkg/totp"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// The Access-Request and Access-Accept of RFC 2865 section 7.1: user
+// "nemo", password "arctangent", secret "xyzzy5461".
+const (
+	rfcRequest = "010000380f403f9473978057bd83d5cb98f4227a01066e656d6f02120dbe708d93d413ce3196e43f782a0aee0406c0a80110050600000003"
+	rfcAccept  = "0200002686fe220e7624ba2a1005f6bf9b55e0b20606000000010f06000000000e06c0a80103"
+)
+
+func TestRFC2865Example(t *testing.T) {
+	secret := []byte("xyzzy5461")
+	req, _ := hex.DecodeString(rfcRequest)
+	p, err := Parse(req)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if name, _ := p.Get(AttrUserName); string(name) != "nemo" {
+		t.Fatalf("User-Name = %q", name)
+	}
+	hidden, _ := p.Get(AttrUserPassword)
+	password, err := RevealPassword(hidden, secret, p.Authenticator)
+	if err != nil || string(password) != "arctangent" {
+		t.Fatalf("RevealPassword = %q, %v", password, err)
+	}
+	if again, _ := HidePassword(password, secret, p.Authenticator); !bytes.Equal(again, hidden) {
+		t.Fatalf("HidePassword = %x, want %x", again, hidden)
+	}
+	if encoded, _ := p.Encode(); !bytes.Equal(encoded, req) {
+		t.Fatalf("Encode = %x, want %x", encoded, req)
+	}
+
+	accept, _ := hex.DecodeString(rfcAccept)
+	if !VerifyResponse(accept, secret, p.Authenticator) {
+		t.Error("RFC Access-Accept does not verify")
+	}
+	if VerifyResponse(accept, []byte("wrong"), p.Authenticator) {
+		t.Error("Access-Accept verifies with the wrong secret")
+	}
+
+	for _, bad := range []string{"", "01000014", "0100001500000000000000000000000000000000", rfcRequest[:len(rfcRequest)-4]} {
+		b, _ := hex.DecodeString(bad)
+		if _, err := Parse(b); err == nil {
+			t.Errorf("Parse(%s) succeeded", bad)
+		}
+	}
+}
+
+const (
+	testSecret   = "JBSWY3DPEHPK3PXP"
+	testPassword = "hunter2"
+)
+
+// newTestServer serves client from 127.0.0.1 and returns its address.
+// Its users are alice, whose static password is testPassword, and bob,
+// who has none; both have testSecret.
+func newTestServer(t *testing.T, client Client, limiter ratelimit.Limiter) string {
+	t.Helper()
+	cryptoSvc, err := crypto.NewAESGCMEncryption(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatalf("crypto: %v", err)
+	}
+	tn, err := tenant.New("default", "Test", totp.DefaultPolicy(), cryptoSvc)
+	if err != nil {
+		t.Fatalf("tenant: %v", err)
+	}
+	repo := storage.NewInMemoryRepository()
+	raw, _ := base32.StdEncoding.DecodeString(testSecret)
+	encrypted, err := cryptoSvc.Encrypt(raw)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	passwordHash, err := password.Hash(testPassword)
+	if err != nil {
+		t.Fatalf("hash password: %v", err)
+	}
+	for _, u := range []*storage.User{
+		{ID: "alice", EncryptedSecret: encrypted, Enabled: true, StaticPasswordHash: passwordHash},
+		{ID: "bob", EncryptedSecret: encrypted, Enabled: true},
+	} {
+		if err := repo.SaveUser(storage.WithTenant(context.Background(), tn.ID), u); err != nil {
+			t.Fatalf("save user: %v", err)
+		}
+	}
+
+	client.Tenant = tn
+	client.Network = &net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}
+	if limiter == nil {
+		limiter = ratelimit.NewInMemoryLimiter(time.Millisecond, 100)
+	}
+	srv := NewServer([]Client{client}, validate.NewService(repo, limiter), nil, nil)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(conn) }()
+	t.Cleanup(func() {
+		conn.Close()
+		if err := <-done; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	})
+	return conn.LocalAddr().String()
+}
+
+// testClient is a minimal RADIUS client.
+type testClient struct {
+	addr   string
+	secret []byte
+	// noMessageAuthenticator sends requests the way older NASes do.
+	noMessageAuthenticator bool
+}
+
+var errNoResponse = errors.New("no response")
+
+// exchange sends an Access-Request and returns the verified response.
+func (c testClient) exchange(t *testing.T, user, password string) (*Packet, error) {
+	t.Helper()
+	p, req := c.request(t, user, password)
+	return c.roundTrip(t, p, req)
+}
+
+// request returns an Access-Request and its encoding.
+func (c testClient) request(t *testing.T, user, password string) (*Packet, []byte) {
+	t.Helper()
+	p := &Packet{Code: CodeAccessRequest, Identifier: 42}
+	if _, err := rand.Read(p.Authenticator[:]); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	hidden, err := HidePassword([]byte(password), c.secret, p.Authenticator)
+	if err != nil {
+		t.Fatalf("HidePassword: %v", err)
+	}
+	p.Add(AttrUserName, []byte(user))
+	p.Add(AttrUserPassword, hidden)
+	var req []byte
+	if c.noMessageAuthenticator {
+		req, err = p.Encode()
+	} else {
+		req, err = SignRequest(p, c.secret)
+	}
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	return p, req
+}
+
+// roundTrip sends req and returns the verified response to p.
+func (c testClient) roundTrip(t *testing.T, p *Packet, req []byte) (*Packet, error) {
+	t.Helper()
+	conn, err := net.Dial("udp", c.addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	buf := make([]byte, MaxPacketLen)
+	n, err := conn.Read(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, errNoResponse
+	}
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !VerifyResponse(buf[:n], c.secret, p.Authenticator) {
+		t.Fatal("response authenticator does not verify")
+	}
+	if present, valid := VerifyMessageAuthenticator(respForMA(buf[:n], p.Authenticator), c.secret); !present || !valid {
+		t.Fatal("response Message-Authenticator does not verify")
+	}
+	resp, err := Parse(buf[:n])
+	if err != nil {
+		t.Fatalf("parse response: %v", err)
+	}
+	if resp.Identifier != p.Identifier {
+		t.Fatalf("response identifier = %d, want %d", resp.Identifier, p.Identifier)
+	}
+	return resp, nil
+}
+
+// respForMA puts the request authenticator back into a response, which is
+// how its Message-Authenticator is computed.
+func respForMA(b []byte, requestAuthenticator [16]byte) []byte {
+	c := append([]byte{}, b...)
+	copy(c[4:headerLen], requestAuthenticator[:])
+	return c
+}
+
+func currentCode(t *testing.T) string {
+	t.Helper()
+	code, err := totp.NewGenerator().GenerateCodeFromBase32(testSecret, uint64(time.Now().Unix()))
+	if err != nil {
+		t.Fatalf("generate code: %v", err)
+	}
+	return code
+}
+
+func TestServer(t *testing.T) {
+	secret := []byte("s3cret-shared")
+	addr := newTestServer(t, Client{Name: "vpn", Secret: secret}, nil)
+	client := testClient{addr: addr, secret: secret}
+
+	for name, tc := range map[string]struct {
+		user, password string
+		want           byte
+	}{
+		"valid code":     {"alice", currentCode(t), CodeAccessAccept},
+		"wrong code":     {"alice", "000000", CodeAccessReject},
+		"unknown user":   {"mallory", currentCode(t), CodeAccessReject},
+		"empty password": {"alice", "", CodeAccessReject},
+	} {
+		resp, err := client.exchange(t, tc.user, tc.password)
+		if err != nil || resp.Code != tc.want {
+			t.Errorf("%s: response = %+v, %v, want code %d", name, resp, err, tc.want)
+		}
+	}
+
+	// Requests signed with another secret are dropped, not rejected.
+	if _, err := (testClient{addr: addr, secret: []byte("guess")}).exchange(t, "alice", currentCode(t)); !errors.Is(err, errNoResponse) {
+		t.Errorf("wrong secret: err = %v, want no response", err)
+	}
+}
+
+func TestStaticPassword(t *testing.T) {
+	secret := []byte("s3cret-shared")
+	addr := newTestServer(t, Client{Name: "vpn", Secret: secret, StaticPassword: true}, nil)
+	client := testClient{addr: addr, secret: secret}
+
+	for name, tc := range map[string]struct {
+		user, password string
+		want           byte
+	}{
+		"password and code": {"alice", testPassword + currentCode(t), CodeAccessAccept},
+		"code alone":        {"alice", currentCode(t), CodeAccessReject},
+		"wrong password":    {"alice", "hunter3" + currentCode(t), CodeAccessReject},
+		"wrong code":        {"alice", testPassword + "000000", CodeAccessReject},
+		"no password set":   {"bob", testPassword + currentCode(t), CodeAccessReject},
+	} {
+		resp, err := client.exchange(t, tc.user, tc.password)
+		if err != nil || resp.Code != tc.want {
+			t.Errorf("%s: response = %+v, %v, want code %d", name, resp, err, tc.want)
+		}
+	}
+}
+
+func TestRequireMessageAuthenticator(t *testing.T) {
+	secret := []byte("s3cret-shared")
+	addr := newTestServer(t, Client{Name: "vpn", Secret: secret, RequireMessageAuthenticator: true}, nil)
+	client := testClient{addr: addr, secret: secret}
+
+	if resp, err := client.exchange(t, "alice", currentCode(t)); err != nil || resp.Code != CodeAccessAccept {
+		t.Fatalf("signed request = %+v, %v, want accept", resp, err)
+	}
+	client.noMessageAuthenticator = true
+	if _, err := client.exchange(t, "alice", currentCode(t)); !errors.Is(err, errNoResponse) {
+		t.Errorf("without Message-Authenticator: err = %v, want no response", err)
+	}
+}
+
+func TestRetransmission(t *testing.T) {
+	secret := []byte("s3cret-shared")
+	addr := newTestServer(t, Client{Name: "vpn", Secret: secret}, ratelimit.NewInMemoryLimiter(time.Hour, 1))
+	client := testClient{addr: addr, secret: secret}
+
+	p, req := client.request(t, "alice", "000000")
+	first, err := client.roundTrip(t, p, req)
+	if err != nil || first.Code != CodeAccessReject {
+		t.Fatalf("first copy = %+v, %v, want reject", first, err)
+	}
+	// The retransmission gets the same answer instead of hitting the
+	// rate limit.
+	again, err := client.roundTrip(t, p, req)
+	if err != nil || again.Code != CodeAccessReject {
+		t.Fatalf("retransmission = %+v, %v, want reject", again, err)
+	}
+	if msg, _ := again.Get(AttrReplyMessage); len(msg) != 0 {
+		t.Errorf("retransmission was checked again: %q", msg)
+	}
+	// A new request is another attempt.
+	resp, err := client.exchange(t, "alice", "000000")
+	if err != nil || resp.Code != CodeAccessReject {
+		t.Fatalf("new request = %+v, %v, want reject", resp, err)
+	}
+	if msg, _ := resp.Get(AttrReplyMessage); len(msg) == 0 {
+		t.Error("new request was not rate limited")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	secret := []byte("s3cret-shared")
+	addr := newTestServer(t, Client{Name: "vpn", Secret: secret}, ratelimit.NewInMemoryLimiter(time.Hour, 1))
+	client := testClient{addr: addr, secret: secret, noMessageAuthenticator: true}
+
+	if resp, err := client.exchange(t, "alice", "000000"); err != nil || resp.Code != CodeAccessReject {
+		t.Fatalf("first attempt = %+v, %v", resp, err)
+	}
+	resp, err := client.exchange(t, "alice", currentCode(t))
+	if err != nil || resp.Code != CodeAccessReject {
+		t.Fatalf("rate-limited attempt = %+v, %v, want reject", resp, err)
+	}
+	if msg, _ := resp.Get(AttrReplyMessage); len(msg) == 0 {
+		t.Error("rate-limited reject has no Reply-Message")
+	}
+}
+
+func TestFromFile(t *testing.T) {
+	cryptoSvc, _ := crypto.NewAESGCMEncryption(bytes.Repeat([]byte{7}, 32))
+	tn, _ := tenant.New("default", "Test", totp.DefaultPolicy(), cryptoSvc)
+	reg := tenant.NewRegistry("default")
+	if err := reg.Add(tn); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	t.Setenv("VPN_SECRET", "s3cret")
+
+	clients, err := FromFile(&ClientsFile{Clients: []FileClient{
+		{Name: "vpn", Address: "10.0.8.0/24", SecretEnv: "VPN_SECRET"},
+		{Name: "switch", Address: "192.0.2.7", SecretEnv: "VPN_SECRET", StaticPassword: true},
+	}}, reg)
+	if err != nil {
+		t.Fatalf("FromFile: %v", err)
+	}
+	if clients[0].Tenant != tn || !clients[0].Network.Contains(net.ParseIP("10.0.8.9")) ||
+		!clients[1].Network.Contains(net.ParseIP("192.0.2.7")) || clients[1].Network.Contains(net.ParseIP("192.0.2.8")) ||
+		clients[0].StaticPassword || !clients[1].StaticPassword {
+		t.Fatalf("clients = %+v", clients)
+	}
+
+	for name, fc := range map[string]FileClient{
+		"missing secret": {Name: "a", Address: "10.0.0.1", SecretEnv: "UNSET_RADIUS_SECRET"},
+		"bad address":    {Name: "a", Address: "10.0.0", SecretEnv: "VPN_SECRET"},
+		"unknown tenant": {Name: "a", Address: "10.0.0.1", SecretEnv: "VPN_SECRET", Tenant: "acme"},
+	} {
+		if _, err := FromFile(&ClientsFile{Clients: []FileClient{fc}}, reg); err == nil {
+			t.Errorf("%s: FromFile succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Package radius is a RADIUS (RFC 2865) frontend for VPNs and network
+// gear that cannot call the HTTP API. It answers Access-Request packets
+// whose User-Password is the user's TOTP code, or for clients configured
+// so the user's static password followed by the code, with Access-Accept
+// or Access-Reject.
+// Codes are checked by validate.Service, so RADIUS shares the rate limit,
+// usage metadata and audit trail of /validate.
+package radius
+
+import (
+	"context"
+	"errors"
+	"go-auth-totp/internal/audit"
+	"go-auth-totp/internal/auth/validate"
+	"go-auth-totp/internal/metrics"
+	"go-auth-totp/internal/storage"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// dupTTL is how long the answer to a request is kept for retransmissions
+// of it (RFC 5080 section 2.2.2).
+const dupTTL = 5 * time.Second
+
+// dupKey identifies a request among its retransmissions.
+type dupKey struct {
+	client        string
+	identifier    byte
+	authenticator [16]byte
+}
+
+// dupEntry is the answer to a request, nil while it is being computed.
+type dupEntry struct {
+	resp    []byte
+	expires time.Time
+}
+
+// Server answers Access-Requests from its clients.
+type Server struct {
+	clients []Client
+	codes   *validate.Service
+	audit   *audit.Recorder
+	metrics *metrics.Metrics
+
+	mu    sync.Mutex
+	seen  map[dupKey]*dupEntry
+	swept time.Time
+}
+
+// NewServer returns a Server for clients. rec and m may be nil.
+func NewServer(clients []Client, codes *validate.Service, rec *audit.Recorder, m *metrics.Metrics) *Server {
+	return &Server{clients: clients, codes: codes, audit: rec, metrics: m, seen: make(map[dupKey]*dupEntry)}
+}
+
+// Serve answers requests arriving on conn until conn is closed, then
+// waits for requests in flight.
+func (s *Server) Serve(conn net.PacketConn) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	buf := make([]byte, MaxPacketLen)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		b := append([]byte(nil), buf[:n]...)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handle(conn, addr, b)
+		}()
+	}
+}
+
+// handle answers one packet. Packets that cannot be answered safely are
+// dropped silently, as RFC 2865 requires. A retransmitted request gets
+// the answer of its first copy instead of spending another attempt.
+func (s *Server) handle(conn net.PacketConn, addr net.Addr, b []byte) {
+	c, ok := s.client(addr)
+	if !ok {
+		slog.Warn("RADIUS request from unknown client dropped", "addr", addr.String())
+		return
+	}
+	p, err := Parse(b)
+	if err != nil || p.Code != CodeAccessRequest {
+		slog.Debug("RADIUS packet dropped", "client", c.Name, "error", err)
+		return
+	}
+	switch present, valid := VerifyMessageAuthenticator(b, c.Secret); {
+	case present && !valid:
+		slog.Warn("RADIUS request with a bad Message-Authenticator dropped", "client", c.Name)
+		return
+	case !present && c.RequireMessageAuthenticator:
+		slog.Warn("RADIUS request without Message-Authenticator dropped", "client", c.Name)
+		return
+	}
+
+	key := dupKey{client: c.Name, identifier: p.Identifier, authenticator: p.Authenticator}
+	cached, isNew := s.begin(key)
+	if !isNew {
+		// Without an answer yet, the first copy is still being checked.
+		if cached != nil {
+			s.send(conn, addr, c, cached)
+		}
+		return
+	}
+	var resp []byte
+	defer func() { s.finish(key, resp) }()
+
+	code, reply := s.authenticate(context.Background(), c, p)
+	resp, err = Response(code, p, reply, c.Secret)
+	if err != nil {
+		slog.Error("Encoding RADIUS response failed", "client", c.Name, "error", err)
+		return
+	}
+	s.send(conn, addr, c, resp)
+}
+
+func (s *Server) send(conn net.PacketConn, addr net.Addr, c *Client, resp []byte) {
+	if _, err := conn.WriteTo(resp, addr); err != nil {
+		slog.Warn("Sending RADIUS response failed", "client", c.Name, "error", err)
+	}
+}
+
+// begin reports whether the request k is new. For a retransmission it
+// returns the answer of the first copy, or nil while that is pending.
+func (s *Server) begin(k dupKey) (resp []byte, isNew bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.swept) > dupTTL {
+		for k, e := range s.seen {
+			if e.resp != nil && now.After(e.expires) {
+				delete(s.seen, k)
+			}
+		}
+		s.swept = now
+	}
+	if e, ok := s.seen[k]; ok && (e.resp == nil || now.Before(e.expires)) {
+		return e.resp, false
+	}
+	s.seen[k] = &dupEntry{}
+	return nil, true
+}
+
+// finish records the answer to k, or forgets k if there is none.
+func (s *Server) finish(k dupKey, resp []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if resp == nil {
+		delete(s.seen, k)
+		return
+	}
+	s.seen[k] = &dupEntry{resp: resp, expires: time.Now().Add(dupTTL)}
+}
+
+// client returns the first client whose network contains addr.
+func (s *Server) client(addr net.Addr) (*Client, bool) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil, false
+	}
+	for i := range s.clients {
+		if s.clients[i].Network.Contains(ua.IP) {
+			return &s.clients[i], true
+		}
+	}
+	return nil, false
+}
+
+// authenticate checks the request's credentials and returns the response
+// code with its attributes.
+func (s *Server) authenticate(ctx context.Context, c *Client, p *Packet) (byte, []Attribute) {
+	name, hasName := p.Get(AttrUserName)
+	hidden, hasPassword := p.Get(AttrUserPassword)
+	if !hasName || !hasPassword || len(name) == 0 {
+		// CHAP and EAP cannot carry a TOTP code we could check.
+		return CodeAccessReject, nil
+	}
+	userID := string(name)
+	ctx = storage.WithTenant(ctx, c.Tenant.ID)
+
+	outcome := audit.OutcomeError
+	defer func() {
+		s.metrics.RecordAttempt(metrics.OpRadius, outcome)
+		s.audit.RecordActor(ctx, "radius:"+c.Name, audit.Event{Type: audit.EventValidate, UserID: userID,
+			Credential: audit.CredentialTOTP, Outcome: outcome, Detail: "radius"})
+	}()
+
+	password, err := RevealPassword(hidden, c.Secret, p.Authenticator)
+	if err != nil {
+		outcome = audit.OutcomeInvalidCode
+		return CodeAccessReject, nil
+	}
+	if c.StaticPassword {
+		err = s.validateWithPassword(ctx, c, userID, string(password))
+	} else {
+		err = s.codes.Validate(ctx, c.Tenant, userID, string(password))
+	}
+	switch {
+	case err == nil:
+		outcome = audit.OutcomeSuccess
+		return CodeAccessAccept, nil
+	case errors.Is(err, validate.ErrRateLimited):
+		outcome = audit.OutcomeRateLimited
+		return CodeAccessReject, []Attribute{{Type: AttrReplyMessage, Value: []byte("Too many attempts, try again later")}}
+	case errors.Is(err, validate.ErrInvalidCode):
+		outcome = audit.OutcomeInvalidCode
+	case errors.Is(err, validate.ErrNotEnabled), errors.Is(err, validate.ErrNoPassword),
+		errors.Is(err, storage.ErrUserNotFound):
+		outcome = audit.OutcomeNotEnabled
+	default:
+		slog.Error("RADIUS validation failed", "client", c.Name, "user_id", userID, "error", err)
+	}
+	return CodeAccessReject, nil
+}
+
+// validateWithPassword splits password into the static password and the
+// code, which is the last Digits characters.
+func (s *Server) validateWithPassword(ctx context.Context, c *Client, userID, password string) error {
+	n := len(password) - c.Tenant.Policy.Digits
+	if n <= 0 {
+		return validate.ErrInvalidCode
+	}
+	return s.codes.ValidateWithPassword(ctx, c.Tenant, userID, password[:n], password[n:])
+}
@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// APIKey is a credential for the HTTP API. Only a hash of the key's secret
+// part is stored; the plaintext is shown once when the key is created.
+type APIKey struct {
+	ID         string // public part of the key, safe to log
+	TenantID   string
+	Name       string
+	SecretHash string
+	Scopes     []string
+	// RateLimit is the allowed requests per minute; zero means the server default.
+	RateLimit int
+	// SigningSecret is the HMAC secret encrypted with the tenant's key.
+	// When set, every request made with the key must be signed.
+	SigningSecret string
+	// CertSubject is the subject DN (x509 pkix.Name.String form, e.g.
+	// "CN=billing,O=Acme") of a client certificate that authenticates as
+	// this key under mutual TLS. Empty when the key is token-only.
+	CertSubject string
+	CreatedAt   time.Time
+	RevokedAt   time.Time // zero while the key is active
+}
+
+// Revoked reports whether the key has been revoked.
+func (k *APIKey) Revoked() bool {
+	return !k.RevokedAt.IsZero()
+}
+
+// KeyStore persists API keys. Keys are not scoped by the context's tenant:
+// a key is looked up before the tenant is known, and determines it.
+type KeyStore interface {
+	// CreateAPIKey stores a new key, failing with ErrConflict if the ID is
+	// taken or an active key is bound to the same certificate subject.
+	CreateAPIKey(ctx context.Context, key *APIKey) error
+	GetAPIKey(ctx context.Context, id string) (*APIKey, error)
+	// GetAPIKeyByCertSubject returns the active key bound to a client
+	// certificate subject, or the latest revoked one if none is active.
+	GetAPIKeyByCertSubject(ctx context.Context, subject string) (*APIKey, error)
+	// ListAPIKeys returns the keys of one tenant, or of all tenants when
+	// tenantID is empty, ordered by tenant and creation time.
+	ListAPIKeys(ctx context.Context, tenantID string) ([]*APIKey, error)
+	// RevokeAPIKey marks a key revoked. Revoking twice keeps the first time.
+	RevokeAPIKey(ctx context.Context, id string, at time.Time) error
+}
+
+func cloneAPIKey(k *APIKey) *APIKey {
+	keyCopy := *k
+	keyCopy.Scopes = append([]string(nil), k.Scopes...)
+	return &keyCopy
+}
+
+func (r *InMemoryRepository) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	if err := ctx.Err(); err != nil {
+		return contextError(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.apiKeys[key.ID]; ok {
+		return ErrConflict
+	}
+	if key.CertSubject != "" {
+		for _, k := range r.apiKeys {
+			if k.CertSubject == key.CertSubject && !k.Revoked() {
+				return ErrConflict
+			}
+		}
+	}
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now().UTC()
+	}
+	r.apiKeys[key.ID] = cloneAPIKey(key)
+	return nil
+}
+
+func (r *InMemoryRepository) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(err)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	k, ok := r.apiKeys[id]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return cloneAPIKey(k), nil
+}
+
+func (r *InMemoryRepository) GetAPIKeyByCertSubject(ctx context.Context, subject string) (*APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(err)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var found *APIKey
+	for _, k := range r.apiKeys {
+		if subject == "" || k.CertSubject != subject {
+			continue
+		}
+		if found == nil || found.Revoked() && (!k.Revoked() || k.CreatedAt.After(found.CreatedAt)) {
+			found = k
+		}
+	}
+	if found == nil {
+		return nil, ErrKeyNotFound
+	}
+	return cloneAPIKey(found), nil
+}
+
+func (r *InMemoryRepository) ListAPIKeys(ctx context.Context, tenantID string) ([]*APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(err)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var keys []*APIKey
+	for _, k := range r.apiKeys {
+		if tenantID == "" || k.TenantID == tenantID {
+			keys = append(keys, cloneAPIKey(k))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].TenantID != keys[j].TenantID {
+			return keys[i].TenantID < keys[j].TenantID
+		}
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+func (r *InMemoryRepository) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return contextError(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k, ok := r.apiKeys[id]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	if !k.Revoked() {
+		keyCopy := cloneAPIKey(k)
+		keyCopy.RevokedAt = at.UTC()
+		r.apiKeys[id] = keyCopy
+	}
+	return nil
+}
+
+const apiKeyColumns = `id, tenant_id, name, secret_hash, scopes, rate_limit, signing_secret, cert_subject,
+	created_at, revoked_at`
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	var k APIKey
+	var scopes string
+	var signingSecret, certSubject sql.NullString
+	var revokedAt sql.NullTime
+	err := row.Scan(&k.ID, &k.TenantID, &k.Name, &k.SecretHash, &scopes, &k.RateLimit,
+		&signingSecret, &certSubject, &k.CreatedAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	if scopes != "" {
+		k.Scopes = strings.Split(scopes, ",")
+	}
+	k.SigningSecret = signingSecret.String
+	k.CertSubject = certSubject.String
+	k.RevokedAt = revokedAt.Time
+	return &k, nil
+}
+
+func (r *SQLiteRepository) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	createdAt := key.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now().UTC()
+	}
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO api_keys (`+apiKeyColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, key.ID, key.TenantID, key.Name, key.SecretHash, strings.Join(key.Scopes, ","), key.RateLimit,
+		nullString(key.SigningSecret), nullString(key.CertSubject), createdAt, nullTime(key.RevokedAt))
+	if err != nil {
+		return r.translateError(err)
+	}
+	key.CreatedAt = createdAt
+	return nil
+}
+
+func (r *SQLiteRepository) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	k, err := scanAPIKey(r.db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrKeyNotFound
+	}
+	return k, r.translateError(err)
+}
+
+func (r *SQLiteRepository) GetAPIKeyByCertSubject(ctx context.Context, subject string) (*APIKey, error) {
+	k, err := scanAPIKey(r.db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+
+		" FROM api_keys WHERE cert_subject = ? ORDER BY revoked_at IS NOT NULL, created_at DESC LIMIT 1", subject))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrKeyNotFound
+	}
+	return k, r.translateError(err)
+}
+
+// nullString stores the empty string as NULL.
+func nullString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func (r *SQLiteRepository) ListAPIKeys(ctx context.Context, tenantID string) ([]*APIKey, error) {
+	keys, err := r.listAPIKeys(ctx, tenantID)
+	return keys, r.translateError(err)
+}
+
+func (r *SQLiteRepository) listAPIKeys(ctx context.Context, tenantID string) ([]*APIKey, error) {
+	query := "SELECT " + apiKeyColumns + " FROM api_keys"
+	var args []any
+	if tenantID != "" {
+		query += " WHERE tenant_id = ?"
+		args = append(args, tenantID)
+	}
+	query += " ORDER BY tenant_id, created_at, id"
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (r *SQLiteRepository) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	res, err := r.db.ExecContext(ctx,
+		"UPDATE api_keys SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ?", at.UTC(), id)
+	if err != nil {
+		return r.translateError(err)
+	}
+	if err := rowsOrNotFound(res); err != nil {
+		return ErrKeyNotFound
+	}
+	return nil
+}
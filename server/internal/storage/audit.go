@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// GenesisHash is the PrevHash of the first audit event.
+var GenesisHash = strings.Repeat("0", 64)
+
+const (
+	// DefaultAuditLimit is the page size used when AuditQuery.Limit is zero.
+	DefaultAuditLimit = 100
+	// MaxAuditLimit caps the page size a caller may request.
+	MaxAuditLimit = 1000
+)
+
+// ErrAuditChainBroken is returned by VerifyAuditChain when an event was
+// altered, removed or reordered.
+var ErrAuditChainBroken = errors.New("audit chain broken")
+
+// AuditEvent is one security-relevant event. Seq, TenantID, PrevHash and
+// Hash are assigned by AppendAuditEvent.
+type AuditEvent struct {
+	Seq      int64     `json:"seq"`
+	TenantID string    `json:"tenant_id"`
+	Time     time.Time `json:"time"`
+	// Type names the event, e.g. "validate" or "api_key_revoked".
+	Type string `json:"type"`
+	// Actor is who caused the event: an API key ("key:<id>"), "anonymous"
+	// or an operator tool.
+	Actor      string `json:"actor"`
+	UserID     string `json:"user_id,omitempty"`
+	Credential string `json:"credential,omitempty"`
+	Outcome    string `json:"outcome"`
+	Detail     string `json:"detail,omitempty"`
+	IP         string `json:"ip,omitempty"`
+	UserAgent  string `json:"user_agent,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+	PrevHash   string `json:"prev_hash"`
+	Hash       string `json:"hash"`
+}
+
+// ComputeHash returns the hex SHA-256 of PrevHash and every other field
+// except Hash, so changing any of them breaks the chain.
+func (e *AuditEvent) ComputeHash() string {
+	body := *e
+	body.Hash = ""
+	body.Time = e.Time.UTC()
+	data, err := json.Marshal(body)
+	if err != nil {
+		// Only strings, integers and a time: cannot fail.
+		panic(err)
+	}
+	sum := sha256.Sum256(append([]byte(e.PrevHash+"\n"), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyAuditChain checks that every event hashes correctly and links to
+// the event before it. events must be a contiguous run in Seq order; a run
+// that starts at Seq 1 must start from GenesisHash.
+func VerifyAuditChain(events []AuditEvent) error {
+	for i := range events {
+		e := &events[i]
+		if e.Hash != e.ComputeHash() {
+			return fmt.Errorf("%w: event %d does not match its hash", ErrAuditChainBroken, e.Seq)
+		}
+		switch {
+		case i == 0 && e.Seq == 1 && e.PrevHash != GenesisHash:
+			return fmt.Errorf("%w: event 1 does not start from the genesis hash", ErrAuditChainBroken)
+		case i > 0 && e.Seq != events[i-1].Seq+1:
+			return fmt.Errorf("%w: event %d follows event %d", ErrAuditChainBroken, e.Seq, events[i-1].Seq)
+		case i > 0 && e.PrevHash != events[i-1].Hash:
+			return fmt.Errorf("%w: event %d does not link to event %d", ErrAuditChainBroken, e.Seq, events[i-1].Seq)
+		}
+	}
+	return nil
+}
+
+// AuditQuery filters ListAuditEvents. Zero fields do not filter.
+type AuditQuery struct {
+	UserID string
+	Type   string
+	Since  time.Time // inclusive
+	Until  time.Time // exclusive
+	// AfterSeq returns events after this sequence number, for paging.
+	AfterSeq int64
+	Limit    int
+	// AllTenants ignores the context's tenant, e.g. to export or verify the
+	// whole chain.
+	AllTenants bool
+}
+
+// PageSize is the number of events ListAuditEvents returns at most.
+func (q AuditQuery) PageSize() int {
+	switch {
+	case q.Limit <= 0:
+		return DefaultAuditLimit
+	case q.Limit > MaxAuditLimit:
+		return MaxAuditLimit
+	}
+	return q.Limit
+}
+
+// scope returns the tenant the query is limited to. AllTenants queries
+// need none; every other query requires a scoped context.
+func (q AuditQuery) scope(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", contextError(err)
+	}
+	if q.AllTenants {
+		return "", nil
+	}
+	return TenantFromContext(ctx)
+}
+
+func (q AuditQuery) matches(tenantID string, e *AuditEvent) bool {
+	return (q.AllTenants || e.TenantID == tenantID) &&
+		e.Seq > q.AfterSeq &&
+		(q.UserID == "" || e.UserID == q.UserID) &&
+		(q.Type == "" || e.Type == q.Type) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until))
+}
+
+// AuditStore keeps the audit log. There is deliberately no way to change
+// or delete an event.
+type AuditStore interface {
+	// AppendAuditEvent stores e under the context's tenant, assigning Seq,
+	// TenantID, PrevHash and Hash. Appends are serialized so the chain
+	// has no forks.
+	AppendAuditEvent(ctx context.Context, e *AuditEvent) error
+	// ListAuditEvents returns matching events in Seq order.
+	ListAuditEvents(ctx context.Context, q AuditQuery) ([]AuditEvent, error)
+}
+
+// seal fills in the chain fields of e, an event of tenantID following an
+// event with sequence number lastSeq and hash lastHash.
+func (e *AuditEvent) seal(tenantID string, lastSeq int64, lastHash string) {
+	e.Seq = lastSeq + 1
+	e.TenantID = tenantID
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	e.PrevHash = lastHash
+	e.Hash = e.ComputeHash()
+}
+
+func (r *InMemoryRepository) AppendAuditEvent(ctx context.Context, e *AuditEvent) error {
+	tenantID, err := scope(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lastSeq, lastHash := int64(0), GenesisHash
+	if n := len(r.audit); n > 0 {
+		lastSeq, lastHash = r.audit[n-1].Seq, r.audit[n-1].Hash
+	}
+	e.seal(tenantID, lastSeq, lastHash)
+	r.audit = append(r.audit, *e)
+	return nil
+}
+
+func (r *InMemoryRepository) ListAuditEvents(ctx context.Context, q AuditQuery) ([]AuditEvent, error) {
+	tenantID, err := q.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	limit := q.PageSize()
+	var events []AuditEvent
+	for i := range r.audit {
+		if q.matches(tenantID, &r.audit[i]) {
+			events = append(events, r.audit[i])
+			if len(events) == limit {
+				break
+			}
+		}
+	}
+	return events, nil
+}
+
+// auditColumns is the column list read by scanAuditEvent.
+const auditColumns = `seq, tenant_id, at, type, actor, user_id, credential, outcome, detail,
+	ip, user_agent, request_id, prev_hash, hash`
+
+func scanAuditEvent(row rowScanner) (AuditEvent, error) {
+	var e AuditEvent
+	err := row.Scan(&e.Seq, &e.TenantID, &e.Time, &e.Type, &e.Actor, &e.UserID, &e.Credential, &e.Outcome,
+		&e.Detail, &e.IP, &e.UserAgent, &e.RequestID, &e.PrevHash, &e.Hash)
+	e.Time = e.Time.UTC()
+	return e, err
+}
+
+func (r *SQLiteRepository) AppendAuditEvent(ctx context.Context, e *AuditEvent) error {
+	return r.translateError(r.appendAuditEvent(ctx, e))
+}
+
+func (r *SQLiteRepository) appendAuditEvent(ctx context.Context, e *AuditEvent) error {
+	tenantID, err := TenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	// Transactions take the write lock up front, so reading the tail and
+	// inserting after it cannot interleave with another append.
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	lastSeq, lastHash := int64(0), GenesisHash
+	err = tx.QueryRowContext(ctx, "SELECT seq, hash FROM audit_log ORDER BY seq DESC LIMIT 1").Scan(&lastSeq, &lastHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	sealed := *e
+	sealed.seal(tenantID, lastSeq, lastHash)
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO audit_log (`+auditColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, sealed.Seq, sealed.TenantID, sealed.Time, sealed.Type, sealed.Actor, sealed.UserID, sealed.Credential,
+		sealed.Outcome, sealed.Detail, sealed.IP, sealed.UserAgent, sealed.RequestID, sealed.PrevHash, sealed.Hash)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	*e = sealed
+	return nil
+}
+
+func (r *SQLiteRepository) ListAuditEvents(ctx context.Context, q AuditQuery) ([]AuditEvent, error) {
+	events, err := r.listAuditEvents(ctx, q)
+	return events, r.translateError(err)
+}
+
+func (r *SQLiteRepository) listAuditEvents(ctx context.Context, q AuditQuery) ([]AuditEvent, error) {
+	tenantID, err := q.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	where := []string{"seq > ?"}
+	args := []any{q.AfterSeq}
+	if !q.AllTenants {
+		where = append(where, "tenant_id = ?")
+		args = append(args, tenantID)
+	}
+	if q.UserID != "" {
+		where = append(where, "user_id = ?")
+		args = append(args, q.UserID)
+	}
+	if q.Type != "" {
+		where = append(where, "type = ?")
+		args = append(args, q.Type)
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "at >= ?")
+		args = append(args, q.Since.UTC())
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "at < ?")
+		args = append(args, q.Until.UTC())
+	}
+	args = append(args, q.PageSize())
+
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT "+auditColumns+" FROM audit_log WHERE "+strings.Join(where, " AND ")+" ORDER BY seq LIMIT ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		e, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
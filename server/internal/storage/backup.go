@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// backupPagesPerStep is how many pages are copied while holding the read
+// lock; between steps writers can make progress.
+const backupPagesPerStep = 256
+
+// Backup writes a consistent copy of the live database to destPath using
+// SQLite's online backup API. It is safe to run while the server is
+// serving requests. destPath must not exist.
+func (r *SQLiteRepository) Backup(ctx context.Context, destPath string) error {
+	return r.translateError(BackupSQLite(ctx, r.db, destPath))
+}
+
+// BackupSQLite is Backup for a pool opened with OpenSQLite. Backup tools
+// use it so that taking a copy never migrates the live database.
+func BackupSQLite(ctx context.Context, db *sql.DB, destPath string) error {
+	if _, err := os.Stat(destPath); err == nil {
+		return fmt.Errorf("backup destination %s already exists", destPath)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	destDB, err := sql.Open("sqlite3", destPath)
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	srcConn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	err = destConn.Raw(func(destRaw any) error {
+		return srcConn.Raw(func(srcRaw any) error {
+			dest, ok := destRaw.(*sqlite3.SQLiteConn)
+			src, ok2 := srcRaw.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return errors.New("backup requires go-sqlite3 connections")
+			}
+			return copyDatabase(ctx, dest, src)
+		})
+	})
+	if err != nil {
+		os.Remove(destPath)
+		return err
+	}
+	return nil
+}
+
+func copyDatabase(ctx context.Context, dest, src *sqlite3.SQLiteConn) error {
+	bk, err := dest.Backup("main", src, "main")
+	if err != nil {
+		return err
+	}
+
+	for {
+		// Step treats SQLITE_BUSY/LOCKED as "try again", so only real errors surface.
+		done, err := bk.Step(backupPagesPerStep)
+		if err != nil {
+			bk.Close()
+			return err
+		}
+		if done {
+			return bk.Finish()
+		}
+		select {
+		case <-ctx.Done():
+			bk.Close()
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
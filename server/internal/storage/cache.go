@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"go-auth-totp/pkg/timeutil"
+	"sync"
+	"time"
+)
+
+// CacheOptions configures CachedRepository.
+type CacheOptions struct {
+	// TTL bounds how long an entry is served without going to the backend.
+	// It is also the worst-case staleness for writes made by other
+	// processes (e.g. totpctl disable, pam-totp -db, cmd/gateway), which
+	// cannot invalidate this cache: a user disabled there keeps validating
+	// here until the entry expires. Only enable the cache when this process
+	// is the sole writer of the database.
+	TTL time.Duration
+	// MaxEntries bounds the cache size; the least recently used entry is evicted.
+	MaxEntries int
+	// Clock defaults to the real clock.
+	Clock timeutil.Clock
+}
+
+// CacheStats is a snapshot of cache counters.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Size      int
+}
+
+// CachedRepository is a read-through cache in front of another Repository.
+// It caches GetUser results as stored (secrets stay encrypted) and drops an
+// entry whenever this process writes the user. Usage metadata written by
+// RecordAttempt is applied to the cached copy instead, so hot /validate
+// traffic keeps hitting the cache.
+type CachedRepository struct {
+	next  Repository
+	ttl   time.Duration
+	max   int
+	clock timeutil.Clock
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front = most recently used
+	// epoch increments on every invalidation. A miss only populates the
+	// cache if no invalidation happened while it was loading, so a slow read
+	// cannot reinstate a record that a concurrent write just replaced.
+	epoch uint64
+	stats CacheStats
+}
+
+type cacheEntry struct {
+	key       string
+	user      *User
+	expiresAt time.Time
+}
+
+// NewCachedRepository wraps next with a cache.
+func NewCachedRepository(next Repository, opts CacheOptions) *CachedRepository {
+	if opts.Clock == nil {
+		opts.Clock = timeutil.RealClock{}
+	}
+	return &CachedRepository{
+		next:    next,
+		ttl:     opts.TTL,
+		max:     opts.MaxEntries,
+		clock:   opts.Clock,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Ping checks the wrapped repository if it is a Pinger.
+func (c *CachedRepository) Ping(ctx context.Context) error {
+	if p, ok := c.next.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// Stats returns the current hit/miss counters.
+func (c *CachedRepository) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Size = c.lru.Len()
+	return s
+}
+
+// cacheKey scopes id to ctx's tenant.
+func cacheKey(ctx context.Context, id string) (string, error) {
+	tenantID, err := TenantFromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	return tenantID + "\x00" + id, nil
+}
+
+func (c *CachedRepository) GetUser(ctx context.Context, id string) (*User, error) {
+	key, err := cacheKey(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		if c.clock.Now().Before(e.expiresAt) {
+			c.lru.MoveToFront(el)
+			c.stats.Hits++
+			u := cloneUser(e.user)
+			c.mu.Unlock()
+			return u, nil
+		}
+		c.removeLocked(el)
+	}
+	c.stats.Misses++
+	epoch := c.epoch
+	c.mu.Unlock()
+
+	u, err := c.next.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.epoch == epoch {
+		c.storeLocked(key, cloneUser(u))
+	}
+	c.mu.Unlock()
+	return u, nil
+}
+
+func (c *CachedRepository) SaveUser(ctx context.Context, user *User) error {
+	// Invalidate even on failure: a version mismatch means our copy is stale.
+	key, err := cacheKey(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	defer c.invalidate(key)
+	return c.next.SaveUser(ctx, user)
+}
+
+func (c *CachedRepository) DeleteUser(ctx context.Context, id string) error {
+	key, err := cacheKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer c.invalidate(key)
+	return c.next.DeleteUser(ctx, id)
+}
+
+func (c *CachedRepository) DisableUser(ctx context.Context, id string) error {
+	key, err := cacheKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer c.invalidate(key)
+	return c.next.DisableUser(ctx, id)
+}
+
+func (c *CachedRepository) ListUsers(ctx context.Context, opts ListUsersOptions) (*UserPage, error) {
+	return c.next.ListUsers(ctx, opts)
+}
+
+func (c *CachedRepository) RecordAttempt(ctx context.Context, id string, success bool, at time.Time) error {
+	key, err := cacheKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := c.next.RecordAttempt(ctx, id, success, at); err != nil {
+		c.invalidate(key)
+		return err
+	}
+
+	// Mirror the backend's update on the cached copy. RecordAttempt does not
+	// change Version, so the entry stays valid for SaveUser. The epoch still
+	// moves: a miss that read the row before this update must not cache it.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	if el, ok := c.entries[key]; ok {
+		u := el.Value.(*cacheEntry).user
+		if success {
+			u.LastVerifiedAt = at.UTC()
+			u.FailedAttempts = 0
+		} else {
+			u.LastFailedAt = at.UTC()
+			u.FailedAttempts++
+			u.TotalFailures++
+		}
+	}
+	return nil
+}
+
+func (c *CachedRepository) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	if el, ok := c.entries[key]; ok {
+		c.removeLocked(el)
+	}
+}
+
+func (c *CachedRepository) storeLocked(key string, u *User) {
+	if c.max <= 0 || c.ttl <= 0 {
+		return
+	}
+	entry := &cacheEntry{key: key, user: u, expiresAt: c.clock.Now().Add(c.ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.max {
+		c.removeLocked(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *CachedRepository) removeLocked(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testContext is scoped to the default tenant, as every request is.
+func testContext() context.Context {
+	return WithTenant(context.Background(), DefaultTenant)
+}
+
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+// countingRepository counts backend reads.
+type countingRepository struct {
+	Repository
+	gets int
+}
+
+func (r *countingRepository) GetUser(ctx context.Context, id string) (*User, error) {
+	r.gets++
+	return r.Repository.GetUser(ctx, id)
+}
+
+func newTestCache(t *testing.T, max int) (*CachedRepository, *countingRepository, *fakeClock) {
+	t.Helper()
+	backend := &countingRepository{Repository: NewInMemoryRepository()}
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	cache := NewCachedRepository(backend, CacheOptions{TTL: time.Minute, MaxEntries: max, Clock: clock})
+	for _, id := range []string{"a", "b", "c"} {
+		if err := cache.SaveUser(testContext(), &User{ID: id, EncryptedSecret: "s"}); err != nil {
+			t.Fatalf("SaveUser: %v", err)
+		}
+	}
+	return cache, backend, clock
+}
+
+func TestCacheHitsAndExpiry(t *testing.T) {
+	cache, backend, clock := newTestCache(t, 10)
+	ctx := testContext()
+
+	for i := 0; i < 3; i++ {
+		if _, err := cache.GetUser(ctx, "a"); err != nil {
+			t.Fatalf("GetUser: %v", err)
+		}
+	}
+	if backend.gets != 1 {
+		t.Fatalf("backend reads = %d, want 1", backend.gets)
+	}
+	if s := cache.Stats(); s.Hits != 2 || s.Misses != 1 || s.Size != 1 {
+		t.Fatalf("stats = %+v", s)
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	cache.GetUser(ctx, "a")
+	if backend.gets != 2 {
+		t.Fatalf("expired entry served from cache (backend reads = %d)", backend.gets)
+	}
+
+	if _, err := cache.GetUser(ctx, "missing"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("GetUser missing err = %v", err)
+	}
+}
+
+func TestCacheInvalidatesOnWrite(t *testing.T) {
+	cache, backend, _ := newTestCache(t, 10)
+	ctx := testContext()
+
+	u, _ := cache.GetUser(ctx, "a")
+	u.Enabled = true
+	if err := cache.SaveUser(ctx, u); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+	if got, _ := cache.GetUser(ctx, "a"); !got.Enabled || got.Version != 2 {
+		t.Fatalf("stale read after SaveUser: %+v", got)
+	}
+
+	if err := cache.DisableUser(ctx, "a"); err != nil {
+		t.Fatalf("DisableUser: %v", err)
+	}
+	if got, _ := cache.GetUser(ctx, "a"); got.Enabled {
+		t.Fatal("stale read after DisableUser")
+	}
+
+	if err := cache.DeleteUser(ctx, "a"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if _, err := cache.GetUser(ctx, "a"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("read after DeleteUser err = %v", err)
+	}
+
+	// RecordAttempt updates the cached copy without a backend read.
+	cache.GetUser(ctx, "b")
+	reads := backend.gets
+	if err := cache.RecordAttempt(ctx, "b", false, time.Now()); err != nil {
+		t.Fatalf("RecordAttempt: %v", err)
+	}
+	got, _ := cache.GetUser(ctx, "b")
+	if got.TotalFailures != 1 || backend.gets != reads {
+		t.Fatalf("after RecordAttempt: failures=%d backend reads=%d (was %d)", got.TotalFailures, backend.gets, reads)
+	}
+}
+
+// racingRepository runs beforeReturn once, after GetUser has read the
+// backend and before the result reaches the cache.
+type racingRepository struct {
+	Repository
+	beforeReturn func()
+}
+
+func (r *racingRepository) GetUser(ctx context.Context, id string) (*User, error) {
+	u, err := r.Repository.GetUser(ctx, id)
+	if f := r.beforeReturn; f != nil {
+		r.beforeReturn = nil
+		f()
+	}
+	return u, err
+}
+
+func TestCacheMissDoesNotReinstateStaleMetadata(t *testing.T) {
+	backend := &racingRepository{Repository: NewInMemoryRepository()}
+	cache := NewCachedRepository(backend, CacheOptions{TTL: time.Minute, MaxEntries: 10})
+	ctx := testContext()
+	if err := cache.SaveUser(ctx, &User{ID: "a", EncryptedSecret: "s"}); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+
+	// A failed attempt lands between the miss's read and its cache fill.
+	backend.beforeReturn = func() {
+		if err := cache.RecordAttempt(ctx, "a", false, time.Now()); err != nil {
+			t.Fatalf("RecordAttempt: %v", err)
+		}
+	}
+	cache.GetUser(ctx, "a")
+
+	if got, _ := cache.GetUser(ctx, "a"); got.FailedAttempts != 1 {
+		t.Fatalf("FailedAttempts = %d after a concurrent RecordAttempt, want 1", got.FailedAttempts)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache, backend, _ := newTestCache(t, 2)
+	ctx := testContext()
+
+	cache.GetUser(ctx, "a")
+	cache.GetUser(ctx, "b")
+	cache.GetUser(ctx, "a") // a is now most recent
+	cache.GetUser(ctx, "c") // evicts b
+
+	if s := cache.Stats(); s.Size != 2 || s.Evictions != 1 {
+		t.Fatalf("stats = %+v", s)
+	}
+	reads := backend.gets
+	cache.GetUser(ctx, "a")
+	if backend.gets != reads {
+		t.Fatal("a was evicted, want b evicted")
+	}
+	cache.GetUser(ctx, "b")
+	if backend.gets != reads+1 {
+		t.Fatal("b was still cached")
+	}
+}
@@ -0,0 +1,99 @@
+package storage_test
+
+import (
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/storage/storagetest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInMemoryRepositoryConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Repository {
+		return storage.NewInMemoryRepository()
+	})
+}
+
+func TestSQLiteRepositoryConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Repository {
+		repo, err := storage.NewSQLiteRepository(filepath.Join(t.TempDir(), "test.db"), storage.DefaultSQLiteOptions())
+		if err != nil {
+			t.Fatalf("NewSQLiteRepository: %v", err)
+		}
+		return repo
+	})
+}
+
+func TestCachedRepositoryConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Repository {
+		backend, err := storage.NewSQLiteRepository(filepath.Join(t.TempDir(), "test.db"), storage.DefaultSQLiteOptions())
+		if err != nil {
+			t.Fatalf("NewSQLiteRepository: %v", err)
+		}
+		return storage.NewCachedRepository(backend, storage.CacheOptions{TTL: time.Minute, MaxEntries: 100})
+	})
+}
+
+func TestInMemoryKeyStoreConformance(t *testing.T) {
+	storagetest.RunKeyStore(t, func(t *testing.T) storage.KeyStore {
+		return storage.NewInMemoryRepository()
+	})
+}
+
+func TestSQLiteKeyStoreConformance(t *testing.T) {
+	storagetest.RunKeyStore(t, func(t *testing.T) storage.KeyStore {
+		repo, err := storage.NewSQLiteRepository(filepath.Join(t.TempDir(), "test.db"), storage.DefaultSQLiteOptions())
+		if err != nil {
+			t.Fatalf("NewSQLiteRepository: %v", err)
+		}
+		return repo
+	})
+}
+
+func TestInMemoryAuditStoreConformance(t *testing.T) {
+	storagetest.RunAuditStore(t, func(t *testing.T) storage.AuditStore {
+		return storage.NewInMemoryRepository()
+	})
+}
+
+func TestSQLiteAuditStoreConformance(t *testing.T) {
+	storagetest.RunAuditStore(t, func(t *testing.T) storage.AuditStore {
+		repo, err := storage.NewSQLiteRepository(filepath.Join(t.TempDir(), "test.db"), storage.DefaultSQLiteOptions())
+		if err != nil {
+			t.Fatalf("NewSQLiteRepository: %v", err)
+		}
+		return repo
+	})
+}
+
+func TestInMemoryWebhookStoreConformance(t *testing.T) {
+	storagetest.RunWebhookStore(t, func(t *testing.T) storagetest.WebhookRepository {
+		return storage.NewInMemoryRepository()
+	})
+}
+
+func TestSQLiteWebhookStoreConformance(t *testing.T) {
+	storagetest.RunWebhookStore(t, func(t *testing.T) storagetest.WebhookRepository {
+		repo, err := storage.NewSQLiteRepository(filepath.Join(t.TempDir(), "test.db"), storage.DefaultSQLiteOptions())
+		if err != nil {
+			t.Fatalf("NewSQLiteRepository: %v", err)
+		}
+		return repo
+	})
+}
+
+func TestInMemoryDeviceStoreConformance(t *testing.T) {
+	storagetest.RunDeviceStore(t, func(t *testing.T) storagetest.DeviceRepository {
+		return storage.NewInMemoryRepository()
+	})
+}
+
+func TestSQLiteDeviceStoreConformance(t *testing.T) {
+	storagetest.RunDeviceStore(t, func(t *testing.T) storagetest.DeviceRepository {
+		repo, err := storage.NewSQLiteRepository(filepath.Join(t.TempDir(), "test.db"), storage.DefaultSQLiteOptions())
+		if err != nil {
+			t.Fatalf("NewSQLiteRepository: %v", err)
+		}
+		return repo
+	})
+}
@@ -0,0 +1,322 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrDeviceNotFound is returned for an unknown trusted device.
+var ErrDeviceNotFound = errors.New("trusted device not found")
+
+// TrustedDevice is a device on which a user may skip the TOTP prompt.
+// Only a hash of the device token is stored.
+type TrustedDevice struct {
+	ID        string // public part of the token, safe to log
+	TenantID  string
+	UserID    string
+	Label     string
+	TokenHash string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	// LastUsedAt is the last successful check; zero if none.
+	LastUsedAt time.Time
+}
+
+// Expired reports whether the device is no longer trusted at now.
+func (d *TrustedDevice) Expired(now time.Time) bool {
+	return !now.Before(d.ExpiresAt)
+}
+
+// DeviceStore keeps trusted devices. Every call is scoped to the context's
+// tenant.
+//
+// A user's devices are removed by the Repository whenever its secret
+// changes, 2FA is disabled or the user is deleted, so a device never
+// outlives the enrollment it was trusted under.
+type DeviceStore interface {
+	// CreateTrustedDevice stores a new device of an existing user, failing
+	// with ErrUserNotFound if there is none and ErrConflict if the ID is
+	// taken.
+	CreateTrustedDevice(ctx context.Context, d *TrustedDevice) error
+	GetTrustedDevice(ctx context.Context, id string) (*TrustedDevice, error)
+	// ListTrustedDevices returns a user's devices, oldest first, including
+	// expired ones.
+	ListTrustedDevices(ctx context.Context, userID string) ([]*TrustedDevice, error)
+	// TouchTrustedDevice sets LastUsedAt.
+	TouchTrustedDevice(ctx context.Context, id string, at time.Time) error
+	DeleteTrustedDevice(ctx context.Context, id string) error
+	// DeleteTrustedDevices removes all of a user's devices and returns how
+	// many there were.
+	DeleteTrustedDevices(ctx context.Context, userID string) (int, error)
+}
+
+// deleteDevicesLocked drops the devices of a user of a tenant. Callers
+// hold mu for writing.
+func (r *InMemoryRepository) deleteDevicesLocked(tenantID, userID string) int {
+	n := 0
+	for id, d := range r.devices {
+		if d.TenantID == tenantID && d.UserID == userID {
+			delete(r.devices, id)
+			n++
+		}
+	}
+	return n
+}
+
+// deviceLocked returns a device of a tenant. Callers hold mu.
+func (r *InMemoryRepository) deviceLocked(tenantID, id string) (*TrustedDevice, error) {
+	d, ok := r.devices[id]
+	if !ok || d.TenantID != tenantID {
+		return nil, ErrDeviceNotFound
+	}
+	return d, nil
+}
+
+func (r *InMemoryRepository) CreateTrustedDevice(ctx context.Context, d *TrustedDevice) error {
+	tenantID, err := scope(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.usersLocked(tenantID, false)[d.UserID]; !ok {
+		return ErrUserNotFound
+	}
+	if _, ok := r.devices[d.ID]; ok {
+		return ErrConflict
+	}
+	d.TenantID = tenantID
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now().UTC()
+	}
+	deviceCopy := *d
+	r.devices[d.ID] = &deviceCopy
+	return nil
+}
+
+func (r *InMemoryRepository) GetTrustedDevice(ctx context.Context, id string) (*TrustedDevice, error) {
+	tenantID, err := scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	d, err := r.deviceLocked(tenantID, id)
+	if err != nil {
+		return nil, err
+	}
+	deviceCopy := *d
+	return &deviceCopy, nil
+}
+
+func (r *InMemoryRepository) ListTrustedDevices(ctx context.Context, userID string) ([]*TrustedDevice, error) {
+	tenantID, err := scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var devices []*TrustedDevice
+	for _, d := range r.devices {
+		if d.TenantID == tenantID && d.UserID == userID {
+			deviceCopy := *d
+			devices = append(devices, &deviceCopy)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if !devices[i].CreatedAt.Equal(devices[j].CreatedAt) {
+			return devices[i].CreatedAt.Before(devices[j].CreatedAt)
+		}
+		return devices[i].ID < devices[j].ID
+	})
+	return devices, nil
+}
+
+func (r *InMemoryRepository) TouchTrustedDevice(ctx context.Context, id string, at time.Time) error {
+	tenantID, err := scope(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, err := r.deviceLocked(tenantID, id)
+	if err != nil {
+		return err
+	}
+	d.LastUsedAt = at.UTC()
+	return nil
+}
+
+func (r *InMemoryRepository) DeleteTrustedDevice(ctx context.Context, id string) error {
+	tenantID, err := scope(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.deviceLocked(tenantID, id); err != nil {
+		return err
+	}
+	delete(r.devices, id)
+	return nil
+}
+
+func (r *InMemoryRepository) DeleteTrustedDevices(ctx context.Context, userID string) (int, error) {
+	tenantID, err := scope(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.deleteDevicesLocked(tenantID, userID), nil
+}
+
+const trustedDeviceColumns = `id, tenant_id, user_id, label, token_hash, created_at, expires_at, last_used_at`
+
+func scanTrustedDevice(row rowScanner) (*TrustedDevice, error) {
+	var d TrustedDevice
+	var lastUsedAt sql.NullTime
+	err := row.Scan(&d.ID, &d.TenantID, &d.UserID, &d.Label, &d.TokenHash, &d.CreatedAt, &d.ExpiresAt, &lastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	d.CreatedAt = d.CreatedAt.UTC()
+	d.ExpiresAt = d.ExpiresAt.UTC()
+	d.LastUsedAt = lastUsedAt.Time.UTC()
+	return &d, nil
+}
+
+func (r *SQLiteRepository) CreateTrustedDevice(ctx context.Context, d *TrustedDevice) error {
+	return r.translateError(r.createTrustedDevice(ctx, d))
+}
+
+func (r *SQLiteRepository) createTrustedDevice(ctx context.Context, d *TrustedDevice) error {
+	tenantID, err := TenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	var exists int
+	err = r.db.QueryRowContext(ctx, "SELECT 1 FROM users WHERE tenant_id = ? AND id = ?", tenantID, d.UserID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	createdAt := d.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now().UTC()
+	}
+	_, err = r.db.ExecContext(ctx, `
+		INSERT INTO trusted_devices (`+trustedDeviceColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, d.ID, tenantID, d.UserID, d.Label, d.TokenHash, createdAt.UTC(), d.ExpiresAt.UTC(), nullTime(d.LastUsedAt))
+	if err != nil {
+		return err
+	}
+	d.TenantID = tenantID
+	d.CreatedAt = createdAt
+	return nil
+}
+
+func (r *SQLiteRepository) GetTrustedDevice(ctx context.Context, id string) (*TrustedDevice, error) {
+	tenantID, err := TenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d, err := scanTrustedDevice(r.db.QueryRowContext(ctx,
+		"SELECT "+trustedDeviceColumns+" FROM trusted_devices WHERE id = ? AND tenant_id = ?", id, tenantID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrDeviceNotFound
+	}
+	return d, r.translateError(err)
+}
+
+func (r *SQLiteRepository) ListTrustedDevices(ctx context.Context, userID string) ([]*TrustedDevice, error) {
+	devices, err := r.listTrustedDevices(ctx, userID)
+	return devices, r.translateError(err)
+}
+
+func (r *SQLiteRepository) listTrustedDevices(ctx context.Context, userID string) ([]*TrustedDevice, error) {
+	tenantID, err := TenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.db.QueryContext(ctx, "SELECT "+trustedDeviceColumns+
+		" FROM trusted_devices WHERE tenant_id = ? AND user_id = ? ORDER BY created_at, id", tenantID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []*TrustedDevice
+	for rows.Next() {
+		d, err := scanTrustedDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+func (r *SQLiteRepository) TouchTrustedDevice(ctx context.Context, id string, at time.Time) error {
+	tenantID, err := TenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	res, err := r.db.ExecContext(ctx, "UPDATE trusted_devices SET last_used_at = ? WHERE id = ? AND tenant_id = ?",
+		at.UTC(), id, tenantID)
+	if err != nil {
+		return r.translateError(err)
+	}
+	if err := rowsOrNotFound(res); err != nil {
+		return ErrDeviceNotFound
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) DeleteTrustedDevice(ctx context.Context, id string) error {
+	tenantID, err := TenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	res, err := r.db.ExecContext(ctx, "DELETE FROM trusted_devices WHERE id = ? AND tenant_id = ?", id, tenantID)
+	if err != nil {
+		return r.translateError(err)
+	}
+	if err := rowsOrNotFound(res); err != nil {
+		return ErrDeviceNotFound
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) DeleteTrustedDevices(ctx context.Context, userID string) (int, error) {
+	tenantID, err := TenantFromContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	res, err := r.db.ExecContext(ctx, "DELETE FROM trusted_devices WHERE tenant_id = ? AND user_id = ?",
+		tenantID, userID)
+	if err != nil {
+		return 0, r.translateError(err)
+	}
+	n, err := res.RowsAffected()
+	return int(n), r.translateError(err)
+}
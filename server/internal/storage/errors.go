@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	// ErrKeyNotFound is returned by KeyStore for an unknown API key ID.
+	ErrKeyNotFound = errors.New("api key not found")
+	// ErrConflict is returned when a write collides with an existing record.
+	ErrConflict = errors.New("record already exists")
+	// ErrVersionMismatch is returned when a record changed since it was loaded.
+	ErrVersionMismatch = errors.New("record was modified concurrently")
+	// ErrUnavailable is returned when the backend cannot serve the request
+	// right now (locked, closed, timed out). Callers may retry later.
+	// A canceled context is not an outage: it is returned as context.Canceled.
+	ErrUnavailable = errors.New("storage backend unavailable")
+	// ErrNoTenant is returned by tenant-scoped calls whose context was not
+	// scoped with WithTenant.
+	ErrNoTenant = errors.New("context carries no tenant")
+	// ErrInvalidCursor is returned by ListUsers for a malformed page cursor.
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// unavailableError wraps a backend error as ErrUnavailable while keeping
+// the original cause (e.g. context.DeadlineExceeded) reachable via errors.Is.
+type unavailableError struct {
+	cause error
+}
+
+func (e *unavailableError) Error() string {
+	return ErrUnavailable.Error() + ": " + e.cause.Error()
+}
+
+func (e *unavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.cause
+}
+
+// contextError maps a ctx.Err() result: cancellation means the caller went
+// away and is passed through, a missed deadline is a backend timeout.
+func contextError(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	return &unavailableError{cause: err}
+}
@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var (
+	// ErrSchemaTooNew is returned when the database has migrations applied
+	// that this binary does not know about (i.e. it was migrated by a newer build).
+	ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+	// ErrPendingMigrations is returned when auto-migration is disabled and
+	// the database is behind the embedded migrations.
+	ErrPendingMigrations = errors.New("database has pending migrations")
+)
+
+// Migration is a single forward-only schema change.
+// Files are named NNNN_description.sql and applied in version order.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Migrator applies embedded migrations and records them in schema_migrations.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// NewMigrator creates a migrator for the embedded migration set.
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	seen := make(map[int]string)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".sql") {
+			continue
+		}
+		base := strings.TrimSuffix(e.Name(), ".sql")
+		num, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %q: expected NNNN_name.sql", e.Name())
+		}
+		version, err := strconv.Atoi(num)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %q: invalid version", e.Name())
+		}
+		if prev, dup := seen[version]; dup {
+			return nil, fmt.Errorf("migration %q: version %d already used by %q", e.Name(), version, prev)
+		}
+		seen[version] = e.Name()
+
+		body, err := fs.ReadFile(fsys, path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name, SQL: string(body)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Latest returns the highest migration version embedded in this binary.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+func (m *Migrator) ensureTable() error {
+	_, err := m.db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	return err
+}
+
+// CurrentVersion returns the highest applied migration version (0 for a fresh database).
+// It only reads: a database without schema_migrations reports version 0.
+func (m *Migrator) CurrentVersion() (int, error) {
+	var exists int
+	err := m.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'").Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if exists == 0 {
+		return 0, nil
+	}
+	var version sql.NullInt64
+	if err := m.db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// Pending returns the migrations that have not been applied yet.
+// It returns ErrSchemaTooNew if the database is ahead of this binary.
+func (m *Migrator) Pending() ([]Migration, error) {
+	current, err := m.CurrentVersion()
+	if err != nil {
+		return nil, err
+	}
+	if current > m.Latest() {
+		return nil, fmt.Errorf("%w: database at version %d, binary supports up to %d", ErrSchemaTooNew, current, m.Latest())
+	}
+
+	var pending []Migration
+	for _, mig := range m.migrations {
+		if mig.Version > current {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies all pending migrations, each in its own transaction.
+// With dryRun set, nothing is executed and the pending list is returned as-is.
+func (m *Migrator) Migrate(dryRun bool) ([]Migration, error) {
+	pending, err := m.Pending()
+	if err != nil {
+		return nil, err
+	}
+	if dryRun || len(pending) == 0 {
+		return pending, nil
+	}
+	if err := m.ensureTable(); err != nil {
+		return nil, err
+	}
+
+	for i, mig := range pending {
+		if err := m.apply(mig); err != nil {
+			return pending[:i], fmt.Errorf("migration %04d_%s: %w", mig.Version, mig.Name, err)
+		}
+	}
+	return pending, nil
+}
+
+func (m *Migrator) apply(mig Migration) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(mig.SQL); err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+		mig.Version, mig.Name, time.Now().UTC(),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	// Foreign keys on, as in production, so table rebuilds must respect them.
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigrateFreshDatabase(t *testing.T) {
+	db := openTestDB(t)
+	m, err := NewMigrator(db)
+	if err != nil {
+		t.Fatalf("NewMigrator: %v", err)
+	}
+
+	pending, err := m.Migrate(true)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if len(pending) != len(m.migrations) {
+		t.Fatalf("dry run returned %d migrations, want %d", len(pending), len(m.migrations))
+	}
+	if v, _ := m.CurrentVersion(); v != 0 {
+		t.Fatalf("dry run changed version to %d", v)
+	}
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master").Scan(&tables); err != nil || tables != 0 {
+		t.Fatalf("dry run created %d schema objects (err %v), want none", tables, err)
+	}
+
+	if _, err := m.Migrate(false); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if v, _ := m.CurrentVersion(); v != m.Latest() {
+		t.Fatalf("version = %d, want %d", v, m.Latest())
+	}
+
+	// Second run is a no-op.
+	applied, err := m.Migrate(false)
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("second Migrate = %d, %v; want 0, nil", len(applied), err)
+	}
+}
+
+func TestMigrateAdoptsLegacyDatabase(t *testing.T) {
+	db := openTestDB(t)
+	// Schema as created by the pre-migration initSchema.
+	_, err := db.Exec(`
+	CREATE TABLE users (id TEXT PRIMARY KEY, encrypted_secret TEXT NOT NULL, enabled BOOLEAN NOT NULL DEFAULT 0);
+	CREATE TABLE recovery_codes (user_id TEXT, code_hash TEXT, FOREIGN KEY(user_id) REFERENCES users(id));
+	INSERT INTO users (id, encrypted_secret, enabled) VALUES ('alice', 'blob', 1);
+	INSERT INTO recovery_codes (user_id, code_hash) VALUES ('alice', 'hash');
+	`)
+	if err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+
+	m, _ := NewMigrator(db)
+	if _, err := m.Migrate(false); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE tenant_id = 'default' AND id = 'alice'").Scan(&count); err != nil || count != 1 {
+		t.Fatalf("legacy user lost: count=%d err=%v", count, err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE tenant_id = 'default' AND user_id = 'alice'").Scan(&count); err != nil || count != 1 {
+		t.Fatalf("legacy recovery code lost: count=%d err=%v", count, err)
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	db := openTestDB(t)
+	m, _ := NewMigrator(db)
+	if _, err := m.Migrate(false); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'future', CURRENT_TIMESTAMP)", m.Latest()+1); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	if _, err := m.Pending(); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("Pending err = %v, want ErrSchemaTooNew", err)
+	}
+}
+
+func TestNewSQLiteRepositoryWithoutAutoMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	manualMigrate := DefaultSQLiteOptions()
+	manualMigrate.AutoMigrate = false
+	if _, err := NewSQLiteRepository(path, manualMigrate); !errors.Is(err, ErrPendingMigrations) {
+		t.Fatalf("err = %v, want ErrPendingMigrations", err)
+	}
+	if _, err := NewSQLiteRepository(path, DefaultSQLiteOptions()); err != nil {
+		t.Fatalf("auto migrate: %v", err)
+	}
+	if _, err := NewSQLiteRepository(path, manualMigrate); err != nil {
+		t.Fatalf("reopen after migrate: %v", err)
+	}
+}
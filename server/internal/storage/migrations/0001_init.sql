@@ -0,0 +1,13 @@
+-- Baseline schema. Uses IF NOT EXISTS so databases created before the
+-- migration system was introduced are adopted without changes.
+CREATE TABLE IF NOT EXISTS users (
+	id TEXT PRIMARY KEY,
+	encrypted_secret TEXT NOT NULL,
+	enabled BOOLEAN NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+	user_id TEXT,
+	code_hash TEXT,
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
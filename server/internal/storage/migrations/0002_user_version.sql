@@ -0,0 +1,3 @@
+-- Optimistic concurrency: every successful SaveUser bumps the version and
+-- updates are conditional on the version the caller loaded.
+ALTER TABLE users ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,18 @@
+-- Track enrollment time so users can be listed by creation range.
+-- SQLite cannot add a column with a non-constant default, so backfill it.
+ALTER TABLE users ADD COLUMN created_at TIMESTAMP;
+UPDATE users SET created_at = strftime('%Y-%m-%d %H:%M:%S+00:00', 'now') WHERE created_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_users_created_at ON users(created_at);
+
+-- Rebuild recovery_codes so deleting a user cascades to its codes.
+-- Orphaned rows (possible while foreign keys were not enforced) are dropped.
+CREATE TABLE recovery_codes_new (
+	user_id TEXT NOT NULL,
+	code_hash TEXT NOT NULL,
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+INSERT INTO recovery_codes_new (user_id, code_hash)
+	SELECT user_id, code_hash FROM recovery_codes WHERE user_id IN (SELECT id FROM users);
+DROP TABLE recovery_codes;
+ALTER TABLE recovery_codes_new RENAME TO recovery_codes;
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes(user_id);
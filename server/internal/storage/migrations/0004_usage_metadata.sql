@@ -0,0 +1,10 @@
+-- Usage metadata. Times are NULL until the event first happens.
+ALTER TABLE users ADD COLUMN enabled_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN last_verified_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN last_failed_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN failed_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN total_failures INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS idx_users_last_verified_at ON users(last_verified_at);
+
+-- Recovery codes are soft-consumed: used_at is set instead of deleting the row.
+ALTER TABLE recovery_codes ADD COLUMN used_at TIMESTAMP;
@@ -0,0 +1,40 @@
+-- Scope users by tenant. Existing users move to the 'default' tenant.
+-- The primary key changes, so both tables are rebuilt. recovery_codes is
+-- dropped before users so the cascade does not delete the copied rows.
+CREATE TABLE users_new (
+	tenant_id TEXT NOT NULL,
+	id TEXT NOT NULL,
+	encrypted_secret TEXT NOT NULL,
+	enabled BOOLEAN NOT NULL DEFAULT 0,
+	version INTEGER NOT NULL DEFAULT 1,
+	created_at TIMESTAMP,
+	enabled_at TIMESTAMP,
+	last_verified_at TIMESTAMP,
+	last_failed_at TIMESTAMP,
+	failed_attempts INTEGER NOT NULL DEFAULT 0,
+	total_failures INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (tenant_id, id)
+);
+INSERT INTO users_new (tenant_id, id, encrypted_secret, enabled, version, created_at, enabled_at,
+		last_verified_at, last_failed_at, failed_attempts, total_failures)
+	SELECT 'default', id, encrypted_secret, enabled, version, created_at, enabled_at,
+		last_verified_at, last_failed_at, failed_attempts, total_failures FROM users;
+
+CREATE TABLE recovery_codes_new (
+	tenant_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	code_hash TEXT NOT NULL,
+	used_at TIMESTAMP,
+	FOREIGN KEY(tenant_id, user_id) REFERENCES users_new(tenant_id, id) ON DELETE CASCADE
+);
+INSERT INTO recovery_codes_new (tenant_id, user_id, code_hash, used_at)
+	SELECT 'default', user_id, code_hash, used_at FROM recovery_codes ORDER BY rowid;
+
+DROP TABLE recovery_codes;
+DROP TABLE users;
+ALTER TABLE users_new RENAME TO users;
+ALTER TABLE recovery_codes_new RENAME TO recovery_codes;
+
+CREATE INDEX IF NOT EXISTS idx_users_created_at ON users(tenant_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_users_last_verified_at ON users(tenant_id, last_verified_at);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes(tenant_id, user_id);
@@ -0,0 +1,14 @@
+-- API keys. Only a hash of the secret is stored; the signing secret is
+-- encrypted with the tenant's key.
+CREATE TABLE api_keys (
+	id TEXT PRIMARY KEY,
+	tenant_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	secret_hash TEXT NOT NULL,
+	scopes TEXT NOT NULL,
+	rate_limit INTEGER NOT NULL DEFAULT 0,
+	signing_secret TEXT,
+	created_at TIMESTAMP NOT NULL,
+	revoked_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_api_keys_tenant_id ON api_keys(tenant_id, created_at);
@@ -0,0 +1,3 @@
+-- Bind API keys to mutual-TLS client certificates by subject DN.
+ALTER TABLE api_keys ADD COLUMN cert_subject TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_api_keys_cert_subject ON api_keys(cert_subject) WHERE cert_subject IS NOT NULL;
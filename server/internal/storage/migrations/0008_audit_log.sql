@@ -0,0 +1,31 @@
+-- Append-only, hash-chained audit log of security events. Each row's hash
+-- covers the previous row's hash, so edits and deletions are detectable;
+-- the triggers reject them outright.
+CREATE TABLE audit_log (
+	seq INTEGER PRIMARY KEY,
+	tenant_id TEXT NOT NULL,
+	at TIMESTAMP NOT NULL,
+	type TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	user_id TEXT NOT NULL DEFAULT '',
+	credential TEXT NOT NULL DEFAULT '',
+	outcome TEXT NOT NULL,
+	detail TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT '',
+	request_id TEXT NOT NULL DEFAULT '',
+	prev_hash TEXT NOT NULL,
+	hash TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_audit_log_tenant_user ON audit_log(tenant_id, user_id, seq);
+CREATE INDEX IF NOT EXISTS idx_audit_log_tenant_at ON audit_log(tenant_id, at);
+
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN
+	SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+
+CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN
+	SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
@@ -0,0 +1,33 @@
+-- Outbound webhooks. The signing secret is encrypted with the tenant's key.
+CREATE TABLE webhook_endpoints (
+	id TEXT PRIMARY KEY,
+	tenant_id TEXT NOT NULL,
+	url TEXT NOT NULL,
+	events TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_endpoints_tenant_id ON webhook_endpoints(tenant_id, created_at);
+
+-- Outbox: one row per event and endpoint, written with the event and sent
+-- by the dispatcher until it is delivered or runs out of attempts.
+CREATE TABLE webhook_deliveries (
+	id INTEGER PRIMARY KEY,
+	tenant_id TEXT NOT NULL,
+	endpoint_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	event_type TEXT NOT NULL,
+	payload BLOB NOT NULL,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMP NOT NULL,
+	last_status INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL,
+	delivered_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_tenant ON webhook_deliveries(tenant_id, status, id);
+
+CREATE VIEW webhook_dead_letters AS
+	SELECT * FROM webhook_deliveries WHERE status = 'dead';
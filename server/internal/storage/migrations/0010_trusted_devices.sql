@@ -0,0 +1,22 @@
+-- Devices a user chose to trust after a successful /validate. Only a hash
+-- of the device token is stored. Trust ends with the user's enrollment:
+-- the trigger drops a user's devices when the secret changes or 2FA is
+-- turned off, and the cascade when the user is deleted.
+CREATE TABLE trusted_devices (
+	id TEXT PRIMARY KEY,
+	tenant_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	label TEXT NOT NULL,
+	token_hash TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	last_used_at TIMESTAMP,
+	FOREIGN KEY(tenant_id, user_id) REFERENCES users(tenant_id, id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_trusted_devices_user ON trusted_devices(tenant_id, user_id, created_at);
+
+CREATE TRIGGER trusted_devices_revoke AFTER UPDATE OF encrypted_secret, enabled ON users
+WHEN NEW.encrypted_secret != OLD.encrypted_secret OR NOT NEW.enabled
+BEGIN
+	DELETE FROM trusted_devices WHERE tenant_id = NEW.tenant_id AND user_id = NEW.id;
+END;
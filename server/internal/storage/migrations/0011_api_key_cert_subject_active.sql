@@ -0,0 +1,5 @@
+-- Only active keys claim a certificate subject, so a certificate whose key
+-- was revoked can be bound to a new key.
+DROP INDEX IF EXISTS idx_api_keys_cert_subject;
+CREATE UNIQUE INDEX idx_api_keys_cert_subject ON api_keys(cert_subject)
+	WHERE cert_subject IS NOT NULL AND revoked_at IS NULL;
@@ -0,0 +1,3 @@
+-- Hash of the user's static password, for RADIUS clients that want it
+-- in front of the code. Empty means the user has none.
+ALTER TABLE users ADD COLUMN static_password_hash TEXT NOT NULL DEFAULT '';
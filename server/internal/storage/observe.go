@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// ObserveFunc receives the name, duration and error of a repository call.
+type ObserveFunc func(operation string, d time.Duration, err error)
+
+// ObservedRepository reports every call to the wrapped Repository to an
+// ObserveFunc, e.g. to record latency metrics, without the storage layer
+// knowing where they go.
+type ObservedRepository struct {
+	next    Repository
+	observe ObserveFunc
+}
+
+// NewObservedRepository wraps next.
+func NewObservedRepository(next Repository, observe ObserveFunc) *ObservedRepository {
+	return &ObservedRepository{next: next, observe: observe}
+}
+
+func (o *ObservedRepository) record(operation string, start time.Time, err error) {
+	o.observe(operation, time.Since(start), err)
+}
+
+func (o *ObservedRepository) GetUser(ctx context.Context, id string) (*User, error) {
+	start := time.Now()
+	user, err := o.next.GetUser(ctx, id)
+	o.record("get_user", start, err)
+	return user, err
+}
+
+func (o *ObservedRepository) SaveUser(ctx context.Context, user *User) error {
+	start := time.Now()
+	err := o.next.SaveUser(ctx, user)
+	o.record("save_user", start, err)
+	return err
+}
+
+func (o *ObservedRepository) DeleteUser(ctx context.Context, id string) error {
+	start := time.Now()
+	err := o.next.DeleteUser(ctx, id)
+	o.record("delete_user", start, err)
+	return err
+}
+
+func (o *ObservedRepository) DisableUser(ctx context.Context, id string) error {
+	start := time.Now()
+	err := o.next.DisableUser(ctx, id)
+	o.record("disable_user", start, err)
+	return err
+}
+
+func (o *ObservedRepository) ListUsers(ctx context.Context, opts ListUsersOptions) (*UserPage, error) {
+	start := time.Now()
+	page, err := o.next.ListUsers(ctx, opts)
+	o.record("list_users", start, err)
+	return page, err
+}
+
+func (o *ObservedRepository) RecordAttempt(ctx context.Context, id string, success bool, at time.Time) error {
+	start := time.Now()
+	err := o.next.RecordAttempt(ctx, id, success, at)
+	o.record("record_attempt", start, err)
+	return err
+}
+
+// Ping checks the wrapped repository if it is a Pinger.
+func (o *ObservedRepository) Ping(ctx context.Context) error {
+	if p, ok := o.next.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
@@ -1,57 +1,387 @@
 package storage
 
 import (
-	"errors"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
-var ErrUserNotFound = errors.New("user not found")
+const (
+	// DefaultListLimit is the page size used when ListUsersOptions.Limit is zero.
+	DefaultListLimit = 50
+	// MaxListLimit caps the page size a caller may request.
+	MaxListLimit = 500
+)
+
+// RecoveryCode is a hashed recovery code. Used codes are kept with UsedAt
+// set rather than deleted, so admins can see which code was used when.
+type RecoveryCode struct {
+	Hash   string
+	UsedAt time.Time // zero while unused
+}
+
+// Used reports whether the code has been consumed.
+func (c RecoveryCode) Used() bool {
+	return !c.UsedAt.IsZero()
+}
 
 // User represents a user's TOTP state.
+// Zero times mean the event has not happened yet.
 type User struct {
 	ID              string
 	EncryptedSecret string
 	Enabled         bool
-	RecoveryCodes   []string // Hashed recovery codes
+	RecoveryCodes   []RecoveryCode
+	// Version is the optimistic-concurrency token. Zero means the user has
+	// never been saved; SaveUser then inserts and fails with ErrConflict if
+	// the ID is taken. Otherwise SaveUser only succeeds if the stored version
+	// still matches, and increments Version on success.
+	Version int64
+	// CreatedAt is set by the repository when the user is first saved.
+	CreatedAt time.Time
+	EnabledAt time.Time
+	// StaticPasswordHash is the hash of the user's static password (see
+	// package password), checked together with the code by RADIUS clients
+	// that ask for it. Empty means the user has none.
+	StaticPasswordHash string
+
+	// Usage metadata, maintained by RecordAttempt. SaveUser only writes
+	// these when inserting a new user and never overwrites them afterwards.
+	LastVerifiedAt time.Time
+	LastFailedAt   time.Time
+	FailedAttempts int // consecutive failures since the last success
+	TotalFailures  int
+}
+
+// NewRecoveryCodes wraps freshly generated hashes as unused recovery codes.
+func NewRecoveryCodes(hashes []string) []RecoveryCode {
+	codes := make([]RecoveryCode, len(hashes))
+	for i, h := range hashes {
+		codes[i] = RecoveryCode{Hash: h}
+	}
+	return codes
+}
+
+// RemainingRecoveryCodes counts the unused recovery codes.
+func (u *User) RemainingRecoveryCodes() int {
+	n := 0
+	for _, c := range u.RecoveryCodes {
+		if !c.Used() {
+			n++
+		}
+	}
+	return n
+}
+
+// ListUsersOptions filters and paginates ListUsers.
+// Zero values mean "no filter".
+type ListUsersOptions struct {
+	// Cursor is the opaque NextCursor from a previous page.
+	Cursor string
+	Limit  int
+	// Enabled restricts the result to users with 2FA on (true) or off (false).
+	Enabled *bool
+	// CreatedAfter and CreatedBefore bound CreatedAt (inclusive, exclusive).
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// LastVerifiedAfter and LastVerifiedBefore bound LastVerifiedAt.
+	// Users that never verified match neither.
+	LastVerifiedAfter  time.Time
+	LastVerifiedBefore time.Time
+	// MinFailedAttempts keeps users with at least this many consecutive failures.
+	MinFailedAttempts int
+}
+
+// UserPage is one page of ListUsers results, ordered by user ID.
+// Users in a page do not have RecoveryCodes populated.
+type UserPage struct {
+	Users []*User
+	// NextCursor is empty on the last page.
+	NextCursor string
 }
 
 // Repository defines the interface for user storage.
+// Every call is scoped to the tenant carried by ctx (see WithTenant); users
+// of other tenants are invisible, even with the same ID. A ctx without a
+// tenant fails with ErrNoTenant.
+// Implementations must honour ctx cancellation and return the sentinel
+// errors from errors.go (ErrUserNotFound, ErrConflict, ErrVersionMismatch,
+// ErrUnavailable) so callers can map them without knowing the backend.
 type Repository interface {
-	GetUser(id string) (*User, error)
-	SaveUser(user *User) error
+	GetUser(ctx context.Context, id string) (*User, error)
+	// SaveUser, DeleteUser and DisableUser also queue the webhook events
+	// attached with WithWebhookEvents, atomically with the write.
+	SaveUser(ctx context.Context, user *User) error
+	// DeleteUser removes the user, its recovery codes and trusted devices.
+	DeleteUser(ctx context.Context, id string) error
+	// DisableUser turns 2FA off and discards the remaining recovery codes
+	// and trusted devices.
+	DisableUser(ctx context.Context, id string) error
+	ListUsers(ctx context.Context, opts ListUsersOptions) (*UserPage, error)
+	// RecordAttempt updates the usage metadata after a code check. A success
+	// sets LastVerifiedAt and resets FailedAttempts; a failure sets
+	// LastFailedAt and increments the failure counters. It does not change
+	// Version, so it never conflicts with a concurrent SaveUser.
+	RecordAttempt(ctx context.Context, id string, success bool, at time.Time) error
+}
+
+// Pinger is implemented by backends that can report whether they are
+// reachable, for readiness checks. In-memory storage has nothing to check.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// normalize applies the default and maximum page size and decodes the cursor
+// into the last user ID of the previous page.
+func (o ListUsersOptions) normalize() (limit int, after string, err error) {
+	limit = o.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+	if o.Cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(o.Cursor)
+		if err != nil {
+			return 0, "", fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+		}
+		after = string(raw)
+	}
+	return limit, after, nil
+}
+
+func encodeCursor(lastID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(lastID))
 }
 
 // InMemoryRepository is a thread-safe in-memory implementation.
 type InMemoryRepository struct {
-	mu    sync.RWMutex
-	users map[string]*User
+	mu      sync.RWMutex
+	tenants map[string]map[string]*User // tenant ID -> user ID -> user
+	apiKeys map[string]*APIKey
+	audit   []AuditEvent
+
+	webhooks   map[string]*WebhookEndpoint
+	deliveries []*WebhookDelivery // ID is index+1
+
+	devices map[string]*TrustedDevice
 }
 
 func NewInMemoryRepository() *InMemoryRepository {
 	return &InMemoryRepository{
-		users: make(map[string]*User),
+		tenants:  make(map[string]map[string]*User),
+		apiKeys:  make(map[string]*APIKey),
+		webhooks: make(map[string]*WebhookEndpoint),
+		devices:  make(map[string]*TrustedDevice),
 	}
 }
 
-func (r *InMemoryRepository) GetUser(id string) (*User, error) {
+// usersLocked returns the user map of a tenant, creating it when asked.
+// Callers must hold mu (for writing when create is set).
+func (r *InMemoryRepository) usersLocked(tenantID string, create bool) map[string]*User {
+	users := r.tenants[tenantID]
+	if users == nil && create {
+		users = make(map[string]*User)
+		r.tenants[tenantID] = users
+	}
+	return users
+}
+
+func (r *InMemoryRepository) GetUser(ctx context.Context, id string) (*User, error) {
+	tenantID, err := scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	u, ok := r.users[id]
+	u, ok := r.usersLocked(tenantID, false)[id]
 	if !ok {
 		return nil, ErrUserNotFound
 	}
 	// Return a copy to avoid race conditions if caller modifies it
-	userCopy := *u
-	return &userCopy, nil
+	return cloneUser(u), nil
 }
 
-func (r *InMemoryRepository) SaveUser(user *User) error {
+func (r *InMemoryRepository) SaveUser(ctx context.Context, user *User) error {
+	tenantID, err := scope(ctx)
+	if err != nil {
+		return err
+	}
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	users := r.usersLocked(tenantID, true)
+	existing, ok := users[user.ID]
+	switch {
+	case user.Version == 0 && ok:
+		return ErrConflict
+	case user.Version != 0 && !ok:
+		return ErrUserNotFound
+	case user.Version != 0 && existing.Version != user.Version:
+		return ErrVersionMismatch
+	}
+
 	// Create a copy to store
-	userCopy := *user
-	r.users[user.ID] = &userCopy
+	userCopy := cloneUser(user)
+	if ok {
+		if existing.EncryptedSecret != user.EncryptedSecret || !user.Enabled {
+			r.deleteDevicesLocked(tenantID, user.ID)
+		}
+		userCopy.CreatedAt = existing.CreatedAt
+		userCopy.LastVerifiedAt = existing.LastVerifiedAt
+		userCopy.LastFailedAt = existing.LastFailedAt
+		userCopy.FailedAttempts = existing.FailedAttempts
+		userCopy.TotalFailures = existing.TotalFailures
+	} else if userCopy.CreatedAt.IsZero() {
+		userCopy.CreatedAt = time.Now().UTC()
+	}
+	userCopy.Version++
+	users[user.ID] = userCopy
+	r.enqueueEventsLocked(ctx, tenantID)
+	user.Version = userCopy.Version
+	user.CreatedAt = userCopy.CreatedAt
+	return nil
+}
+
+// cloneUser deep-copies a user so callers never share the RecoveryCodes
+// backing array with the stored record.
+func cloneUser(u *User) *User {
+	userCopy := *u
+	if u.RecoveryCodes != nil {
+		userCopy.RecoveryCodes = make([]RecoveryCode, len(u.RecoveryCodes))
+		copy(userCopy.RecoveryCodes, u.RecoveryCodes)
+	}
+	return &userCopy
+}
+
+func (r *InMemoryRepository) DeleteUser(ctx context.Context, id string) error {
+	tenantID, err := scope(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	users := r.usersLocked(tenantID, false)
+	if _, ok := users[id]; !ok {
+		return ErrUserNotFound
+	}
+	delete(users, id)
+	r.deleteDevicesLocked(tenantID, id)
+	r.enqueueEventsLocked(ctx, tenantID)
+	return nil
+}
+
+func (r *InMemoryRepository) DisableUser(ctx context.Context, id string) error {
+	tenantID, err := scope(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	users := r.usersLocked(tenantID, false)
+	u, ok := users[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	userCopy := *u
+	userCopy.Enabled = false
+	userCopy.EnabledAt = time.Time{}
+	userCopy.RecoveryCodes = nil
+	userCopy.Version++
+	users[id] = &userCopy
+	r.deleteDevicesLocked(tenantID, id)
+	r.enqueueEventsLocked(ctx, tenantID)
+	return nil
+}
+
+func (r *InMemoryRepository) ListUsers(ctx context.Context, opts ListUsersOptions) (*UserPage, error) {
+	tenantID, err := scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	limit, after, err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := r.usersLocked(tenantID, false)
+	ids := make([]string, 0, len(users))
+	for id := range users {
+		if id > after {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	page := &UserPage{}
+	for _, id := range ids {
+		u := users[id]
+		if opts.Enabled != nil && u.Enabled != *opts.Enabled {
+			continue
+		}
+		if !opts.CreatedAfter.IsZero() && u.CreatedAt.Before(opts.CreatedAfter) {
+			continue
+		}
+		if !opts.CreatedBefore.IsZero() && !u.CreatedAt.Before(opts.CreatedBefore) {
+			continue
+		}
+		if !opts.LastVerifiedAfter.IsZero() && (u.LastVerifiedAt.IsZero() || u.LastVerifiedAt.Before(opts.LastVerifiedAfter)) {
+			continue
+		}
+		if !opts.LastVerifiedBefore.IsZero() && (u.LastVerifiedAt.IsZero() || !u.LastVerifiedAt.Before(opts.LastVerifiedBefore)) {
+			continue
+		}
+		if u.FailedAttempts < opts.MinFailedAttempts {
+			continue
+		}
+		if len(page.Users) == limit {
+			page.NextCursor = encodeCursor(page.Users[limit-1].ID)
+			break
+		}
+		userCopy := *u
+		userCopy.RecoveryCodes = nil
+		page.Users = append(page.Users, &userCopy)
+	}
+	return page, nil
+}
+
+func (r *InMemoryRepository) RecordAttempt(ctx context.Context, id string, success bool, at time.Time) error {
+	tenantID, err := scope(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	users := r.usersLocked(tenantID, false)
+	u, ok := users[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	userCopy := *u
+	if success {
+		userCopy.LastVerifiedAt = at.UTC()
+		userCopy.FailedAttempts = 0
+	} else {
+		userCopy.LastFailedAt = at.UTC()
+		userCopy.FailedAttempts++
+		userCopy.TotalFailures++
+	}
+	users[id] = &userCopy
 	return nil
 }
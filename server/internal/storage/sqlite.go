@@ -1,116 +1,507 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 type SQLiteRepository struct {
 	db *sql.DB
+	// closed is set by Close; database/sql does not export its
+	// "database is closed" error, so translateError checks this instead.
+	closed atomic.Bool
 }
 
-func NewSQLiteRepository(dbPath string) (*SQLiteRepository, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+// SQLiteOptions tunes the SQLite connection. Use DefaultSQLiteOptions as the base.
+type SQLiteOptions struct {
+	// AutoMigrate applies pending migrations on open; otherwise opening
+	// fails with ErrPendingMigrations.
+	AutoMigrate bool
+	// JournalMode is one of DELETE, TRUNCATE, PERSIST, MEMORY, WAL, OFF.
+	// WAL lets readers proceed while a write is in progress.
+	JournalMode string
+	// BusyTimeout is how long a connection waits on a locked database
+	// before failing with "database is locked".
+	BusyTimeout time.Duration
+	// Synchronous is one of OFF, NORMAL, FULL, EXTRA. NORMAL is durable
+	// across application crashes in WAL mode and much faster than FULL.
+	Synchronous     string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// DefaultSQLiteOptions returns settings suited to a concurrent API server.
+func DefaultSQLiteOptions() SQLiteOptions {
+	return SQLiteOptions{
+		AutoMigrate:  true,
+		JournalMode:  "WAL",
+		BusyTimeout:  5 * time.Second,
+		Synchronous:  "NORMAL",
+		MaxOpenConns: 10,
+		MaxIdleConns: 10,
+	}
+}
+
+var (
+	validJournalModes = map[string]bool{"DELETE": true, "TRUNCATE": true, "PERSIST": true, "MEMORY": true, "WAL": true, "OFF": true}
+	validSynchronous  = map[string]bool{"OFF": true, "NORMAL": true, "FULL": true, "EXTRA": true}
+)
+
+// dsn builds the go-sqlite3 connection string. Pragmas are passed in the
+// DSN rather than executed once because SQLite applies most of them per
+// connection, and database/sql opens connections on demand.
+func (o SQLiteOptions) dsn(dbPath string) (string, error) {
+	journal := strings.ToUpper(o.JournalMode)
+	if !validJournalModes[journal] {
+		return "", fmt.Errorf("invalid SQLite journal mode %q", o.JournalMode)
+	}
+	synchronous := strings.ToUpper(o.Synchronous)
+	if !validSynchronous[synchronous] {
+		return "", fmt.Errorf("invalid SQLite synchronous level %q", o.Synchronous)
+	}
+
+	params := url.Values{}
+	params.Set("_journal_mode", journal)
+	params.Set("_synchronous", synchronous)
+	params.Set("_busy_timeout", strconv.FormatInt(o.BusyTimeout.Milliseconds(), 10))
+	// Needed for ON DELETE CASCADE.
+	params.Set("_foreign_keys", "on")
+	// Every transaction here writes, so take the write lock up front. A
+	// deferred transaction that upgrades to a writer fails immediately with
+	// SQLITE_BUSY instead of waiting for busy_timeout.
+	params.Set("_txlock", "immediate")
+
+	sep := "?"
+	if strings.Contains(dbPath, "?") {
+		sep = "&"
+	}
+	return dbPath + sep + params.Encode(), nil
+}
+
+// OpenSQLite opens a connection pool configured by opts without touching the schema.
+func OpenSQLite(dbPath string, opts SQLiteOptions) (*sql.DB, error) {
+	dsn, err := opts.dsn(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, err
 	}
+	db.SetMaxOpenConns(opts.MaxOpenConns)
+	db.SetMaxIdleConns(opts.MaxIdleConns)
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
 
 	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// NewSQLiteRepository opens the database at dbPath and brings its schema up to date.
+// When opts.AutoMigrate is false, it refuses to start if migrations are pending.
+func NewSQLiteRepository(dbPath string, opts SQLiteOptions) (*SQLiteRepository, error) {
+	db, err := OpenSQLite(dbPath, opts)
+	if err != nil {
 		return nil, err
 	}
 
 	repo := &SQLiteRepository{db: db}
-	if err := repo.initSchema(); err != nil {
+	if err := repo.initSchema(opts.AutoMigrate); err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return repo, nil
 }
 
-func (r *SQLiteRepository) initSchema() error {
-	query := `
-	CREATE TABLE IF NOT EXISTS users (
-		id TEXT PRIMARY KEY,
-		encrypted_secret TEXT NOT NULL,
-		enabled BOOLEAN NOT NULL DEFAULT 0
-	);
-	CREATE TABLE IF NOT EXISTS recovery_codes (
-		user_id TEXT,
-		code_hash TEXT,
-		FOREIGN KEY(user_id) REFERENCES users(id)
-	);
-	`
-	_, err := r.db.Exec(query)
+// Close releases the connection pool.
+func (r *SQLiteRepository) Close() error {
+	r.closed.Store(true)
+	return r.db.Close()
+}
+
+// Ping runs a trivial query, so it fails when the pool is closed or the
+// database file cannot be read.
+func (r *SQLiteRepository) Ping(ctx context.Context) error {
+	var n int
+	return r.translateError(r.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM schema_migrations").Scan(&n))
+}
+
+func (r *SQLiteRepository) initSchema(autoMigrate bool) error {
+	migrator, err := NewMigrator(r.db)
+	if err != nil {
+		return err
+	}
+
+	// Pending also guards against running on a database migrated by a newer binary.
+	pending, err := migrator.Pending()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	if !autoMigrate {
+		return fmt.Errorf("%w: %d to apply, run `totpctl migrate`", ErrPendingMigrations, len(pending))
+	}
+
+	applied, err := migrator.Migrate(false)
+	for _, m := range applied {
+		slog.Info("Applied migration", "version", m.Version, "name", m.Name)
+	}
+	return err
+}
+
+// translateError maps driver errors onto the package's sentinel errors.
+func (r *SQLiteRepository) translateError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return contextError(err)
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch {
+		case sqliteErr.Code == sqlite3.ErrBusy, sqliteErr.Code == sqlite3.ErrLocked:
+			return &unavailableError{cause: err}
+		case sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique,
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey:
+			return fmt.Errorf("%w: %v", ErrConflict, err)
+		}
+	}
+	if errors.Is(err, sql.ErrConnDone) || r.closed.Load() {
+		return &unavailableError{cause: err}
+	}
 	return err
 }
 
-func (r *SQLiteRepository) GetUser(id string) (*User, error) {
+func (r *SQLiteRepository) GetUser(ctx context.Context, id string) (*User, error) {
+	user, err := r.getUser(ctx, id)
+	return user, r.translateError(err)
+}
+
+// userColumns is the column list read by scanUser.
+const userColumns = `id, encrypted_secret, enabled, version, created_at, enabled_at,
+	static_password_hash, last_verified_at, last_failed_at, failed_attempts, total_failures`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner) (*User, error) {
 	var user User
-	var enabled bool // driver handles BOOLEAN as bool
+	var enabledAt, lastVerifiedAt, lastFailedAt sql.NullTime
+	err := row.Scan(&user.ID, &user.EncryptedSecret, &user.Enabled, &user.Version, &user.CreatedAt,
+		&enabledAt, &user.StaticPasswordHash, &lastVerifiedAt, &lastFailedAt, &user.FailedAttempts, &user.TotalFailures)
+	if err != nil {
+		return nil, err
+	}
+	user.EnabledAt = enabledAt.Time
+	user.LastVerifiedAt = lastVerifiedAt.Time
+	user.LastFailedAt = lastFailedAt.Time
+	return &user, nil
+}
+
+// nullTime stores the zero time as NULL.
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
 
-	err := r.db.QueryRow("SELECT id, encrypted_secret, enabled FROM users WHERE id = ?", id).Scan(&user.ID, &user.EncryptedSecret, &enabled)
+func (r *SQLiteRepository) getUser(ctx context.Context, id string) (*User, error) {
+	tenantID, err := TenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, err := scanUser(r.db.QueryRowContext(ctx,
+		"SELECT "+userColumns+" FROM users WHERE tenant_id = ? AND id = ?", tenantID, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrUserNotFound
 		}
 		return nil, err
 	}
-	user.Enabled = enabled
 
-	// Load recovery codes
-	rows, err := r.db.Query("SELECT code_hash FROM recovery_codes WHERE user_id = ?", id)
+	// Load recovery codes, keeping their original order
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT code_hash, used_at FROM recovery_codes WHERE tenant_id = ? AND user_id = ? ORDER BY rowid", tenantID, id)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var hash string
-		if err := rows.Scan(&hash); err != nil {
+		var code RecoveryCode
+		var usedAt sql.NullTime
+		if err := rows.Scan(&code.Hash, &usedAt); err != nil {
 			return nil, err
 		}
-		user.RecoveryCodes = append(user.RecoveryCodes, hash)
+		code.UsedAt = usedAt.Time
+		user.RecoveryCodes = append(user.RecoveryCodes, code)
 	}
 
-	return &user, nil
+	return user, rows.Err()
 }
 
-func (r *SQLiteRepository) SaveUser(user *User) error {
-	tx, err := r.db.Begin()
+func (r *SQLiteRepository) SaveUser(ctx context.Context, user *User) error {
+	return r.translateError(r.saveUser(ctx, user))
+}
+
+func (r *SQLiteRepository) saveUser(ctx context.Context, user *User) error {
+	tenantID, err := TenantFromContext(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
-
-	// 1. Upsert User
-	_, err = tx.Exec(`
-		INSERT INTO users (id, encrypted_secret, enabled) VALUES (?, ?, ?)
-		ON CONFLICT(id) DO UPDATE SET encrypted_secret = ?, enabled = ?
-	`, user.ID, user.EncryptedSecret, user.Enabled, user.EncryptedSecret, user.Enabled)
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+
+	// 1. Insert or conditionally update the user row
+	createdAt := user.CreatedAt
+	if user.Version == 0 {
+		if createdAt.IsZero() {
+			createdAt = time.Now().UTC()
+		}
+		// Usage metadata is only written on insert (e.g. by an import);
+		// afterwards RecordAttempt owns those columns.
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO users (tenant_id, id, encrypted_secret, enabled, version, created_at, enabled_at,
+				static_password_hash, last_verified_at, last_failed_at, failed_attempts, total_failures)
+			VALUES (?, ?, ?, ?, 1, ?, ?, ?, ?, ?, ?, ?)
+		`, tenantID, user.ID, user.EncryptedSecret, user.Enabled, createdAt, nullTime(user.EnabledAt),
+			user.StaticPasswordHash, nullTime(user.LastVerifiedAt), nullTime(user.LastFailedAt), user.FailedAttempts, user.TotalFailures)
+		if err != nil {
+			return err
+		}
+	} else {
+		res, err := tx.ExecContext(ctx, `
+			UPDATE users SET encrypted_secret = ?, enabled = ?, enabled_at = ?, static_password_hash = ?,
+				version = version + 1
+			WHERE tenant_id = ? AND id = ? AND version = ?
+		`, user.EncryptedSecret, user.Enabled, nullTime(user.EnabledAt), user.StaticPasswordHash, tenantID, user.ID, user.Version)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			var exists int
+			err := tx.QueryRowContext(ctx, "SELECT 1 FROM users WHERE tenant_id = ? AND id = ?", tenantID, user.ID).Scan(&exists)
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrUserNotFound
+			}
+			if err != nil {
+				return err
+			}
+			return ErrVersionMismatch
+		}
+	}
 
 	// 2. Replace Recovery Codes (Full replace strategy for simplicity)
-	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", user.ID)
+	_, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE tenant_id = ? AND user_id = ?", tenantID, user.ID)
 	if err != nil {
 		return err
 	}
 
 	// Bulk insert could be better, but loop is fine for 8 codes
-	stmt, err := tx.Prepare("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)")
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO recovery_codes (tenant_id, user_id, code_hash, used_at) VALUES (?, ?, ?, ?)")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	for _, hash := range user.RecoveryCodes {
-		if _, err := stmt.Exec(user.ID, hash); err != nil {
+	for _, code := range user.RecoveryCodes {
+		if _, err := stmt.ExecContext(ctx, tenantID, user.ID, code.Hash, nullTime(code.UsedAt)); err != nil {
 			return err
 		}
 	}
+	if err := enqueueWebhookEvents(ctx, tx, tenantID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	user.Version++
+	user.CreatedAt = createdAt
+	return nil
+}
+
+func (r *SQLiteRepository) DeleteUser(ctx context.Context, id string) error {
+	return r.translateError(r.deleteUser(ctx, id))
+}
+
+func (r *SQLiteRepository) deleteUser(ctx context.Context, id string) error {
+	tenantID, err := TenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// recovery_codes rows go with it via ON DELETE CASCADE.
+	res, err := tx.ExecContext(ctx, "DELETE FROM users WHERE tenant_id = ? AND id = ?", tenantID, id)
+	if err != nil {
+		return err
+	}
+	if err := rowsOrNotFound(res); err != nil {
+		return err
+	}
+	if err := enqueueWebhookEvents(ctx, tx, tenantID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *SQLiteRepository) DisableUser(ctx context.Context, id string) error {
+	return r.translateError(r.disableUser(ctx, id))
+}
+
+func (r *SQLiteRepository) disableUser(ctx context.Context, id string) error {
+	tenantID, err := TenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
+	res, err := tx.ExecContext(ctx,
+		"UPDATE users SET enabled = 0, enabled_at = NULL, version = version + 1 WHERE tenant_id = ? AND id = ?", tenantID, id)
+	if err != nil {
+		return err
+	}
+	if err := rowsOrNotFound(res); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE tenant_id = ? AND user_id = ?", tenantID, id); err != nil {
+		return err
+	}
+	if err := enqueueWebhookEvents(ctx, tx, tenantID); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
+
+func (r *SQLiteRepository) ListUsers(ctx context.Context, opts ListUsersOptions) (*UserPage, error) {
+	page, err := r.listUsers(ctx, opts)
+	return page, r.translateError(err)
+}
+
+func (r *SQLiteRepository) listUsers(ctx context.Context, opts ListUsersOptions) (*UserPage, error) {
+	tenantID, err := TenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	limit, after, err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	query := "SELECT " + userColumns + " FROM users WHERE tenant_id = ? AND id > ?"
+	args := []any{tenantID, after}
+	if opts.Enabled != nil {
+		query += " AND enabled = ?"
+		args = append(args, *opts.Enabled)
+	}
+	if !opts.CreatedAfter.IsZero() {
+		query += " AND created_at >= ?"
+		args = append(args, opts.CreatedAfter.UTC())
+	}
+	if !opts.CreatedBefore.IsZero() {
+		query += " AND created_at < ?"
+		args = append(args, opts.CreatedBefore.UTC())
+	}
+	if !opts.LastVerifiedAfter.IsZero() {
+		query += " AND last_verified_at >= ?"
+		args = append(args, opts.LastVerifiedAfter.UTC())
+	}
+	if !opts.LastVerifiedBefore.IsZero() {
+		query += " AND last_verified_at < ?"
+		args = append(args, opts.LastVerifiedBefore.UTC())
+	}
+	if opts.MinFailedAttempts > 0 {
+		query += " AND failed_attempts >= ?"
+		args = append(args, opts.MinFailedAttempts)
+	}
+	// Fetch one extra row to know whether there is a next page.
+	query += " ORDER BY id LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &UserPage{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Users = append(page.Users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Users) > limit {
+		page.Users = page.Users[:limit]
+		page.NextCursor = encodeCursor(page.Users[limit-1].ID)
+	}
+	return page, nil
+}
+
+func (r *SQLiteRepository) RecordAttempt(ctx context.Context, id string, success bool, at time.Time) error {
+	tenantID, err := TenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	query := "UPDATE users SET last_verified_at = ?, failed_attempts = 0 WHERE tenant_id = ? AND id = ?"
+	if !success {
+		query = "UPDATE users SET last_failed_at = ?, failed_attempts = failed_attempts + 1, total_failures = total_failures + 1 WHERE tenant_id = ? AND id = ?"
+	}
+	res, err := r.db.ExecContext(ctx, query, at.UTC(), tenantID, id)
+	if err != nil {
+		return r.translateError(err)
+	}
+	return rowsOrNotFound(res)
+}
+
+func rowsOrNotFound(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
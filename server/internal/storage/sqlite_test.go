@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLiteDeleteCascadesRecoveryCodes(t *testing.T) {
+	repo, err := NewSQLiteRepository(filepath.Join(t.TempDir(), "test.db"), DefaultSQLiteOptions())
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository: %v", err)
+	}
+	ctx := testContext()
+	if err := repo.SaveUser(ctx, &User{ID: "alice", EncryptedSecret: "blob", RecoveryCodes: NewRecoveryCodes([]string{"a", "b"})}); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+	// Delete through raw SQL so only the foreign key can remove the codes.
+	if _, err := repo.db.Exec("DELETE FROM users WHERE id = 'alice'"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	var n int
+	if err := repo.db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = 'alice'").Scan(&n); err != nil || n != 0 {
+		t.Fatalf("recovery codes left = %d (err %v), want 0", n, err)
+	}
+}
+
+func TestSQLiteClosedIsUnavailable(t *testing.T) {
+	repo, err := NewSQLiteRepository(filepath.Join(t.TempDir(), "test.db"), DefaultSQLiteOptions())
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository: %v", err)
+	}
+	repo.Close()
+	if _, err := repo.GetUser(testContext(), "alice"); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("GetUser after Close err = %v, want ErrUnavailable", err)
+	}
+}
+
+func TestSQLiteAuditLogIsAppendOnly(t *testing.T) {
+	repo, err := NewSQLiteRepository(filepath.Join(t.TempDir(), "test.db"), DefaultSQLiteOptions())
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository: %v", err)
+	}
+	if err := repo.AppendAuditEvent(testContext(), &AuditEvent{Type: "validate", Actor: "anonymous", Outcome: "success"}); err != nil {
+		t.Fatalf("AppendAuditEvent: %v", err)
+	}
+	for _, stmt := range []string{
+		"UPDATE audit_log SET outcome = 'invalid_code'",
+		"DELETE FROM audit_log",
+	} {
+		if _, err := repo.db.Exec(stmt); err == nil {
+			t.Errorf("%s succeeded, want the trigger to reject it", stmt)
+		}
+	}
+}
+
+func TestSQLiteOptionsApplyToEveryConnection(t *testing.T) {
+	opts := DefaultSQLiteOptions()
+	opts.BusyTimeout = 1234 * time.Millisecond
+	repo, err := NewSQLiteRepository(filepath.Join(t.TempDir(), "test.db"), opts)
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository: %v", err)
+	}
+	defer repo.Close()
+
+	// Hold several connections at once so the pragmas are checked on more
+	// than the one used for migrations.
+	ctx := testContext()
+	for i := 0; i < 3; i++ {
+		conn, err := repo.db.Conn(ctx)
+		if err != nil {
+			t.Fatalf("Conn: %v", err)
+		}
+		defer conn.Close()
+
+		var journal string
+		var busy, fk, sync int
+		if err := conn.QueryRowContext(ctx, "PRAGMA journal_mode").Scan(&journal); err != nil {
+			t.Fatalf("journal_mode: %v", err)
+		}
+		conn.QueryRowContext(ctx, "PRAGMA busy_timeout").Scan(&busy)
+		conn.QueryRowContext(ctx, "PRAGMA foreign_keys").Scan(&fk)
+		conn.QueryRowContext(ctx, "PRAGMA synchronous").Scan(&sync)
+		if journal != "wal" || busy != 1234 || fk != 1 || sync != 1 {
+			t.Fatalf("conn %d: journal=%s busy=%d fk=%d synchronous=%d", i, journal, busy, fk, sync)
+		}
+	}
+}
+
+func TestSQLiteOptionsRejectInvalidValues(t *testing.T) {
+	opts := DefaultSQLiteOptions()
+	opts.JournalMode = "sideways"
+	if _, err := NewSQLiteRepository(filepath.Join(t.TempDir(), "test.db"), opts); err == nil {
+		t.Fatal("expected error for invalid journal mode")
+	}
+	opts = DefaultSQLiteOptions()
+	opts.Synchronous = "sometimes"
+	if _, err := NewSQLiteRepository(filepath.Join(t.TempDir(), "test.db"), opts); err == nil {
+		t.Fatal("expected error for invalid synchronous level")
+	}
+}
+
+func TestSQLiteBackupWhileWriting(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewSQLiteRepository(filepath.Join(dir, "live.db"), DefaultSQLiteOptions())
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository: %v", err)
+	}
+	defer repo.Close()
+
+	ctx := testContext()
+	for i := 0; i < 50; i++ {
+		if err := repo.SaveUser(ctx, &User{ID: fmt.Sprintf("user-%02d", i), EncryptedSecret: "blob", RecoveryCodes: NewRecoveryCodes([]string{"h"})}); err != nil {
+			t.Fatalf("SaveUser: %v", err)
+		}
+	}
+
+	// Keep writing while the backup runs.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				repo.RecordAttempt(ctx, "user-00", false, time.Now())
+			}
+		}
+	}()
+
+	backupPath := filepath.Join(dir, "backup.db")
+	err = repo.Backup(ctx, backupPath)
+	close(stop)
+	<-done
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if err := repo.Backup(ctx, backupPath); err == nil {
+		t.Fatal("Backup overwrote an existing file")
+	}
+
+	restored, err := NewSQLiteRepository(backupPath, DefaultSQLiteOptions())
+	if err != nil {
+		t.Fatalf("open backup: %v", err)
+	}
+	defer restored.Close()
+	page, err := restored.ListUsers(ctx, ListUsersOptions{Limit: MaxListLimit})
+	if err != nil || len(page.Users) != 50 {
+		t.Fatalf("backup has %d users (err %v), want 50", len(page.Users), err)
+	}
+	if u, err := restored.GetUser(ctx, "user-49"); err != nil || len(u.RecoveryCodes) != 1 {
+		t.Fatalf("backup user-49 = %+v, %v", u, err)
+	}
+}
+
+func TestBackupSQLiteDoesNotMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := OpenSQLite(path, DefaultSQLiteOptions())
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE users (id TEXT PRIMARY KEY, encrypted_secret TEXT NOT NULL)"); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+
+	if err := BackupSQLite(testContext(), db, filepath.Join(t.TempDir(), "backup.db")); err != nil {
+		t.Fatalf("BackupSQLite: %v", err)
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'schema_migrations'").Scan(&n); err != nil || n != 0 {
+		t.Fatalf("backup migrated the source database (n=%d, err %v)", n, err)
+	}
+}
@@ -0,0 +1,157 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"go-auth-totp/internal/storage"
+	"testing"
+	"time"
+)
+
+// AuditStoreFactory returns a new, empty audit store.
+type AuditStoreFactory func(t *testing.T) storage.AuditStore
+
+// RunAuditStore executes the storage.AuditStore conformance suite.
+func RunAuditStore(t *testing.T, newStore AuditStoreFactory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, store storage.AuditStore)
+	}{
+		{"Chain", testAuditChain},
+		{"TenantScope", testAuditTenantScope},
+		{"Query", testAuditQuery},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newStore(t))
+		})
+	}
+}
+
+func appendEvent(t *testing.T, ctx context.Context, store storage.AuditStore, e storage.AuditEvent) storage.AuditEvent {
+	t.Helper()
+	if e.Actor == "" {
+		e.Actor = "anonymous"
+	}
+	if e.Outcome == "" {
+		e.Outcome = "success"
+	}
+	if err := store.AppendAuditEvent(ctx, &e); err != nil {
+		t.Fatalf("AppendAuditEvent: %v", err)
+	}
+	return e
+}
+
+func testAuditChain(t *testing.T, store storage.AuditStore) {
+	ctx := scoped()
+	first := appendEvent(t, ctx, store, storage.AuditEvent{
+		Type: "validate", UserID: "alice", Credential: "totp", Outcome: "invalid_code",
+		IP: "192.0.2.1", UserAgent: "test", RequestID: "r1",
+		Time: time.Date(2024, 1, 2, 3, 4, 5, 123456789, time.UTC),
+	})
+	if first.Seq != 1 || first.PrevHash != storage.GenesisHash || first.Hash != first.ComputeHash() {
+		t.Fatalf("first event = %+v", first)
+	}
+	second := appendEvent(t, ctx, store, storage.AuditEvent{Type: "validate", UserID: "alice"})
+	if second.Seq != 2 || second.PrevHash != first.Hash {
+		t.Fatalf("second event does not link to the first: %+v", second)
+	}
+	appendEvent(t, ctx, store, storage.AuditEvent{Type: "recover", UserID: "alice", Credential: "recovery_code"})
+
+	events, err := store.ListAuditEvents(ctx, storage.AuditQuery{AllTenants: true})
+	if err != nil {
+		t.Fatalf("ListAuditEvents: %v", err)
+	}
+	if len(events) != 3 || events[0] != first {
+		t.Fatalf("events = %+v, want 3 starting with %+v", events, first)
+	}
+	// Hashes survive the round trip through the store.
+	if err := storage.VerifyAuditChain(events); err != nil {
+		t.Fatalf("VerifyAuditChain: %v", err)
+	}
+
+	tampered := append([]storage.AuditEvent(nil), events...)
+	tampered[1].UserID = "mallory"
+	if err := storage.VerifyAuditChain(tampered); !errors.Is(err, storage.ErrAuditChainBroken) {
+		t.Fatalf("edited event: err = %v, want ErrAuditChainBroken", err)
+	}
+	removed := []storage.AuditEvent{events[0], events[2]}
+	if err := storage.VerifyAuditChain(removed); !errors.Is(err, storage.ErrAuditChainBroken) {
+		t.Fatalf("removed event: err = %v, want ErrAuditChainBroken", err)
+	}
+	// Re-hashing an edited event does not help: the next event still
+	// links to the original hash.
+	tampered[1].Hash = tampered[1].ComputeHash()
+	if err := storage.VerifyAuditChain(tampered); !errors.Is(err, storage.ErrAuditChainBroken) {
+		t.Fatalf("re-hashed event: err = %v, want ErrAuditChainBroken", err)
+	}
+}
+
+func testAuditTenantScope(t *testing.T, store storage.AuditStore) {
+	acme := storage.WithTenant(context.Background(), "acme")
+	globex := storage.WithTenant(context.Background(), "globex")
+	appendEvent(t, acme, store, storage.AuditEvent{Type: "enroll", UserID: "alice"})
+	appendEvent(t, globex, store, storage.AuditEvent{Type: "enroll", UserID: "alice"})
+
+	events, err := store.ListAuditEvents(acme, storage.AuditQuery{})
+	if err != nil {
+		t.Fatalf("ListAuditEvents: %v", err)
+	}
+	if len(events) != 1 || events[0].TenantID != "acme" {
+		t.Fatalf("acme events = %+v", events)
+	}
+	// One chain spans all tenants.
+	all, err := store.ListAuditEvents(acme, storage.AuditQuery{AllTenants: true})
+	if err != nil {
+		t.Fatalf("ListAuditEvents(all): %v", err)
+	}
+	if len(all) != 2 || all[1].TenantID != "globex" || all[1].PrevHash != all[0].Hash {
+		t.Fatalf("all events = %+v", all)
+	}
+}
+
+func testAuditQuery(t *testing.T, store storage.AuditStore) {
+	ctx := scoped()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, e := range []storage.AuditEvent{
+		{Type: "enroll", UserID: "alice"},
+		{Type: "validate", UserID: "alice"},
+		{Type: "validate", UserID: "bob"},
+		{Type: "recover", UserID: "alice"},
+	} {
+		e.Time = base.Add(time.Duration(i) * time.Hour)
+		appendEvent(t, ctx, store, e)
+	}
+
+	tests := []struct {
+		name string
+		q    storage.AuditQuery
+		want []int64
+	}{
+		{"all", storage.AuditQuery{}, []int64{1, 2, 3, 4}},
+		{"user", storage.AuditQuery{UserID: "alice"}, []int64{1, 2, 4}},
+		{"type", storage.AuditQuery{Type: "validate"}, []int64{2, 3}},
+		{"time range", storage.AuditQuery{Since: base.Add(time.Hour), Until: base.Add(3 * time.Hour)}, []int64{2, 3}},
+		{"page", storage.AuditQuery{AfterSeq: 1, Limit: 2}, []int64{2, 3}},
+	}
+	for _, tc := range tests {
+		events, err := store.ListAuditEvents(ctx, tc.q)
+		if err != nil {
+			t.Fatalf("%s: ListAuditEvents: %v", tc.name, err)
+		}
+		var got []int64
+		for _, e := range events {
+			got = append(got, e.Seq)
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: seqs = %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s: seqs = %v, want %v", tc.name, got, tc.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"go-auth-totp/internal/storage"
+	"testing"
+	"time"
+)
+
+// DeviceRepository is a Repository that also keeps trusted devices, so the
+// suite can check that devices go with the enrollment.
+type DeviceRepository interface {
+	storage.Repository
+	storage.DeviceStore
+}
+
+// DeviceStoreFactory returns a new, empty repository.
+type DeviceStoreFactory func(t *testing.T) DeviceRepository
+
+// RunDeviceStore executes the storage.DeviceStore conformance suite.
+func RunDeviceStore(t *testing.T, newStore DeviceStoreFactory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, repo DeviceRepository)
+	}{
+		{"CRUD", testDeviceCRUD},
+		{"TenantIsolation", testDeviceTenantIsolation},
+		{"RevokedWithEnrollment", testDevicesRevokedWithEnrollment},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newStore(t))
+		})
+	}
+}
+
+// trustDevices saves an enabled user and trusts one device per ID.
+func trustDevices(t *testing.T, ctx context.Context, repo DeviceRepository, userID string, ids ...string) {
+	t.Helper()
+	if _, err := repo.GetUser(ctx, userID); errors.Is(err, storage.ErrUserNotFound) {
+		if err := repo.SaveUser(ctx, &storage.User{ID: userID, EncryptedSecret: "secret-1", Enabled: true}); err != nil {
+			t.Fatalf("SaveUser(%s): %v", userID, err)
+		}
+	}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, id := range ids {
+		d := &storage.TrustedDevice{
+			ID: id, UserID: userID, Label: "laptop " + id, TokenHash: "hash-" + id,
+			CreatedAt: base.Add(time.Duration(i) * time.Minute),
+			ExpiresAt: base.Add(30 * 24 * time.Hour),
+		}
+		if err := repo.CreateTrustedDevice(ctx, d); err != nil {
+			t.Fatalf("CreateTrustedDevice(%s): %v", id, err)
+		}
+	}
+}
+
+func deviceIDs(t *testing.T, ctx context.Context, repo DeviceRepository, userID string) []string {
+	t.Helper()
+	devices, err := repo.ListTrustedDevices(ctx, userID)
+	if err != nil {
+		t.Fatalf("ListTrustedDevices(%s): %v", userID, err)
+	}
+	ids := make([]string, len(devices))
+	for i, d := range devices {
+		ids[i] = d.ID
+	}
+	return ids
+}
+
+func testDeviceCRUD(t *testing.T, repo DeviceRepository) {
+	ctx := storage.WithTenant(context.Background(), "acme")
+	trustDevices(t, ctx, repo, "alice", "d2", "d1")
+
+	if err := repo.CreateTrustedDevice(ctx, &storage.TrustedDevice{ID: "d9", UserID: "nobody", ExpiresAt: time.Now()}); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Fatalf("device of unknown user: err = %v, want ErrUserNotFound", err)
+	}
+	if err := repo.CreateTrustedDevice(ctx, &storage.TrustedDevice{ID: "d1", UserID: "alice", ExpiresAt: time.Now()}); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("duplicate ID: err = %v, want ErrConflict", err)
+	}
+
+	got, err := repo.GetTrustedDevice(ctx, "d1")
+	if err != nil {
+		t.Fatalf("GetTrustedDevice: %v", err)
+	}
+	if got.TenantID != "acme" || got.UserID != "alice" || got.Label != "laptop d1" || got.TokenHash != "hash-d1" ||
+		!got.LastUsedAt.IsZero() || got.Expired(got.CreatedAt) || !got.Expired(got.ExpiresAt) {
+		t.Fatalf("device = %+v", got)
+	}
+	if _, err := repo.GetTrustedDevice(ctx, "missing"); !errors.Is(err, storage.ErrDeviceNotFound) {
+		t.Fatalf("GetTrustedDevice(missing): err = %v, want ErrDeviceNotFound", err)
+	}
+
+	if ids := deviceIDs(t, ctx, repo, "alice"); len(ids) != 2 || ids[0] != "d2" || ids[1] != "d1" {
+		t.Fatalf("devices = %v, want [d2 d1]", ids)
+	}
+
+	used := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := repo.TouchTrustedDevice(ctx, "d1", used); err != nil {
+		t.Fatalf("TouchTrustedDevice: %v", err)
+	}
+	if got, _ := repo.GetTrustedDevice(ctx, "d1"); !got.LastUsedAt.Equal(used) {
+		t.Fatalf("LastUsedAt = %v, want %v", got.LastUsedAt, used)
+	}
+	if err := repo.TouchTrustedDevice(ctx, "missing", used); !errors.Is(err, storage.ErrDeviceNotFound) {
+		t.Fatalf("TouchTrustedDevice(missing): err = %v, want ErrDeviceNotFound", err)
+	}
+
+	if err := repo.DeleteTrustedDevice(ctx, "d2"); err != nil {
+		t.Fatalf("DeleteTrustedDevice: %v", err)
+	}
+	if err := repo.DeleteTrustedDevice(ctx, "d2"); !errors.Is(err, storage.ErrDeviceNotFound) {
+		t.Fatalf("second DeleteTrustedDevice: err = %v, want ErrDeviceNotFound", err)
+	}
+	trustDevices(t, ctx, repo, "alice", "d3")
+	if n, err := repo.DeleteTrustedDevices(ctx, "alice"); err != nil || n != 2 {
+		t.Fatalf("DeleteTrustedDevices = %d, %v, want 2", n, err)
+	}
+	if ids := deviceIDs(t, ctx, repo, "alice"); len(ids) != 0 {
+		t.Fatalf("devices after DeleteTrustedDevices = %v", ids)
+	}
+}
+
+func testDeviceTenantIsolation(t *testing.T, repo DeviceRepository) {
+	acme := storage.WithTenant(context.Background(), "acme")
+	globex := storage.WithTenant(context.Background(), "globex")
+	trustDevices(t, acme, repo, "alice", "d1")
+	trustDevices(t, globex, repo, "alice", "d2")
+
+	if _, err := repo.GetTrustedDevice(globex, "d1"); !errors.Is(err, storage.ErrDeviceNotFound) {
+		t.Fatalf("other tenant's device: err = %v, want ErrDeviceNotFound", err)
+	}
+	if err := repo.DeleteTrustedDevice(globex, "d1"); !errors.Is(err, storage.ErrDeviceNotFound) {
+		t.Fatalf("deleting other tenant's device: err = %v, want ErrDeviceNotFound", err)
+	}
+	if n, _ := repo.DeleteTrustedDevices(globex, "alice"); n != 1 {
+		t.Fatalf("DeleteTrustedDevices(globex) = %d, want 1", n)
+	}
+	if ids := deviceIDs(t, acme, repo, "alice"); len(ids) != 1 || ids[0] != "d1" {
+		t.Fatalf("acme devices = %v, want [d1]", ids)
+	}
+}
+
+func testDevicesRevokedWithEnrollment(t *testing.T, repo DeviceRepository) {
+	ctx := storage.WithTenant(context.Background(), "acme")
+	trustDevices(t, ctx, repo, "alice", "d1")
+	trustDevices(t, ctx, repo, "bob", "d2")
+	trustDevices(t, ctx, repo, "carol", "d3")
+
+	// Saving without changing the secret, e.g. using a recovery code,
+	// keeps the devices.
+	alice, err := repo.GetUser(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if err := repo.SaveUser(ctx, alice); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+	if ids := deviceIDs(t, ctx, repo, "alice"); len(ids) != 1 {
+		t.Fatalf("devices after an unrelated save = %v, want [d1]", ids)
+	}
+
+	// Re-enrolling rotates the secret.
+	alice.EncryptedSecret = "secret-2"
+	if err := repo.SaveUser(ctx, alice); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+	if ids := deviceIDs(t, ctx, repo, "alice"); len(ids) != 0 {
+		t.Fatalf("devices after rotation = %v, want none", ids)
+	}
+
+	if err := repo.DisableUser(ctx, "bob"); err != nil {
+		t.Fatalf("DisableUser: %v", err)
+	}
+	if ids := deviceIDs(t, ctx, repo, "bob"); len(ids) != 0 {
+		t.Fatalf("devices after disable = %v, want none", ids)
+	}
+
+	if err := repo.DeleteUser(ctx, "carol"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if _, err := repo.GetTrustedDevice(ctx, "d3"); !errors.Is(err, storage.ErrDeviceNotFound) {
+		t.Fatalf("device of deleted user: err = %v, want ErrDeviceNotFound", err)
+	}
+}
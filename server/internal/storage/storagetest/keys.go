@@ -0,0 +1,161 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"go-auth-totp/internal/storage"
+	"testing"
+	"time"
+)
+
+// KeyStoreFactory returns a new, empty key store.
+type KeyStoreFactory func(t *testing.T) storage.KeyStore
+
+// RunKeyStore executes the storage.KeyStore conformance suite.
+func RunKeyStore(t *testing.T, newStore KeyStoreFactory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, store storage.KeyStore)
+	}{
+		{"RoundTrip", testKeyRoundTrip},
+		{"List", testKeyList},
+		{"Revoke", testKeyRevoke},
+		{"CertSubject", testKeyCertSubject},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newStore(t))
+		})
+	}
+}
+
+func testKeyRoundTrip(t *testing.T, store storage.KeyStore) {
+	ctx := context.Background()
+	key := &storage.APIKey{
+		ID: "k1", TenantID: "acme", Name: "web", SecretHash: "hash",
+		Scopes: []string{"enroll", "validate"}, RateLimit: 60, SigningSecret: "blob",
+	}
+	if err := store.CreateAPIKey(ctx, key); err != nil {
+		t.Fatalf("CreateAPIKey: %v", err)
+	}
+	if key.CreatedAt.IsZero() {
+		t.Fatal("CreateAPIKey did not set CreatedAt")
+	}
+	if err := store.CreateAPIKey(ctx, &storage.APIKey{ID: "k1", TenantID: "acme", Name: "dup", SecretHash: "h"}); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("duplicate CreateAPIKey err = %v, want ErrConflict", err)
+	}
+
+	got, err := store.GetAPIKey(ctx, "k1")
+	if err != nil {
+		t.Fatalf("GetAPIKey: %v", err)
+	}
+	if got.TenantID != "acme" || got.Name != "web" || got.SecretHash != "hash" || got.RateLimit != 60 ||
+		got.SigningSecret != "blob" || len(got.Scopes) != 2 || got.Scopes[1] != "validate" || got.Revoked() {
+		t.Fatalf("GetAPIKey = %+v", got)
+	}
+	got.Scopes[0] = "admin"
+	if again, _ := store.GetAPIKey(ctx, "k1"); again.Scopes[0] != "enroll" {
+		t.Fatal("returned key shares scopes with the stored record")
+	}
+
+	if _, err := store.GetAPIKey(ctx, "missing"); !errors.Is(err, storage.ErrKeyNotFound) {
+		t.Fatalf("GetAPIKey(missing) err = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func testKeyList(t *testing.T, store storage.KeyStore) {
+	ctx := context.Background()
+	for i, k := range []struct{ id, tenant string }{{"a1", "acme"}, {"g1", "globex"}, {"a2", "acme"}} {
+		key := &storage.APIKey{ID: k.id, TenantID: k.tenant, Name: k.id, SecretHash: "h",
+			Scopes: []string{"validate"}, CreatedAt: epoch.Add(time.Duration(i) * time.Hour)}
+		if err := store.CreateAPIKey(ctx, key); err != nil {
+			t.Fatalf("CreateAPIKey(%s): %v", k.id, err)
+		}
+	}
+
+	ids := func(tenantID string) []string {
+		keys, err := store.ListAPIKeys(ctx, tenantID)
+		if err != nil {
+			t.Fatalf("ListAPIKeys(%q): %v", tenantID, err)
+		}
+		var out []string
+		for _, k := range keys {
+			out = append(out, k.ID)
+		}
+		return out
+	}
+	if got := ids("acme"); len(got) != 2 || got[0] != "a1" || got[1] != "a2" {
+		t.Fatalf("ListAPIKeys(acme) = %v", got)
+	}
+	if got := ids(""); len(got) != 3 || got[2] != "g1" {
+		t.Fatalf("ListAPIKeys(all) = %v", got)
+	}
+}
+
+func testKeyRevoke(t *testing.T, store storage.KeyStore) {
+	ctx := context.Background()
+	if err := store.CreateAPIKey(ctx, &storage.APIKey{ID: "k1", TenantID: "acme", Name: "web", SecretHash: "h"}); err != nil {
+		t.Fatalf("CreateAPIKey: %v", err)
+	}
+
+	if err := store.RevokeAPIKey(ctx, "k1", epoch); err != nil {
+		t.Fatalf("RevokeAPIKey: %v", err)
+	}
+	if err := store.RevokeAPIKey(ctx, "k1", epoch.Add(time.Duration(1)*time.Hour)); err != nil {
+		t.Fatalf("second RevokeAPIKey: %v", err)
+	}
+	got, err := store.GetAPIKey(ctx, "k1")
+	if err != nil {
+		t.Fatalf("GetAPIKey: %v", err)
+	}
+	if !got.RevokedAt.Equal(epoch) {
+		t.Fatalf("RevokedAt = %v, want first revocation %v", got.RevokedAt, epoch)
+	}
+
+	if err := store.RevokeAPIKey(ctx, "missing", epoch); !errors.Is(err, storage.ErrKeyNotFound) {
+		t.Fatalf("RevokeAPIKey(missing) err = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func testKeyCertSubject(t *testing.T, store storage.KeyStore) {
+	ctx := context.Background()
+	bound := &storage.APIKey{ID: "k1", TenantID: "acme", Name: "billing", SecretHash: "h", CertSubject: "CN=billing,O=Acme"}
+	if err := store.CreateAPIKey(ctx, bound); err != nil {
+		t.Fatalf("CreateAPIKey: %v", err)
+	}
+	// Any number of keys may be token-only.
+	for _, id := range []string{"k2", "k3"} {
+		if err := store.CreateAPIKey(ctx, &storage.APIKey{ID: id, TenantID: "acme", Name: id, SecretHash: "h"}); err != nil {
+			t.Fatalf("CreateAPIKey(%s): %v", id, err)
+		}
+	}
+
+	got, err := store.GetAPIKeyByCertSubject(ctx, "CN=billing,O=Acme")
+	if err != nil || got.ID != "k1" || got.CertSubject != "CN=billing,O=Acme" {
+		t.Fatalf("GetAPIKeyByCertSubject = %+v, %v", got, err)
+	}
+	for _, subject := range []string{"CN=other", ""} {
+		if _, err := store.GetAPIKeyByCertSubject(ctx, subject); !errors.Is(err, storage.ErrKeyNotFound) {
+			t.Fatalf("GetAPIKeyByCertSubject(%q) err = %v, want ErrKeyNotFound", subject, err)
+		}
+	}
+
+	dup := &storage.APIKey{ID: "k4", TenantID: "globex", Name: "dup", SecretHash: "h", CertSubject: "CN=billing,O=Acme"}
+	if err := store.CreateAPIKey(ctx, dup); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("second key for the same subject err = %v, want ErrConflict", err)
+	}
+
+	// Revoking the key frees the subject for a replacement.
+	if err := store.RevokeAPIKey(ctx, "k1", time.Now()); err != nil {
+		t.Fatalf("RevokeAPIKey: %v", err)
+	}
+	if got, err := store.GetAPIKeyByCertSubject(ctx, "CN=billing,O=Acme"); err != nil || !got.Revoked() {
+		t.Fatalf("GetAPIKeyByCertSubject after revoke = %+v, %v; want the revoked key", got, err)
+	}
+	if err := store.CreateAPIKey(ctx, dup); err != nil {
+		t.Fatalf("rebinding a revoked key's subject: %v", err)
+	}
+	if got, err := store.GetAPIKeyByCertSubject(ctx, "CN=billing,O=Acme"); err != nil || got.ID != "k4" {
+		t.Fatalf("GetAPIKeyByCertSubject after rebind = %+v, %v; want k4", got, err)
+	}
+}
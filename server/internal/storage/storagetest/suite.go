@@ -0,0 +1,528 @@
+// Package storagetest provides a behavioural test suite that every
+// storage.Repository implementation must pass. Backends wire it up from
+// their own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Repository {
+//			return newMyRepository(t)
+//		})
+//	}
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-auth-totp/internal/storage"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Factory returns a new, empty repository. It is called once per subtest;
+// use t.Cleanup to release resources.
+type Factory func(t *testing.T) storage.Repository
+
+// Run executes the conformance suite against repositories built by newRepo.
+func Run(t *testing.T, newRepo Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, repo storage.Repository)
+	}{
+		{"RoundTrip", testRoundTrip},
+		{"NotFound", testNotFound},
+		{"ReturnedCopiesAreIsolated", testReturnedCopiesAreIsolated},
+		{"SavedCopiesAreIsolated", testSavedCopiesAreIsolated},
+		{"Versioning", testVersioning},
+		{"RecoveryCodeReplacement", testRecoveryCodeReplacement},
+		{"ConcurrentUpdates", testConcurrentUpdates},
+		{"ConcurrentRecordAttempt", testConcurrentRecordAttempt},
+		{"RecordAttempt", testRecordAttempt},
+		{"DisableAndDelete", testDisableAndDelete},
+		{"ListUsersPagination", testListUsersPagination},
+		{"ListUsersFilters", testListUsersFilters},
+		{"CanceledContext", testCanceledContext},
+		{"TenantIsolation", testTenantIsolation},
+		{"UnscopedContext", testUnscopedContext},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newRepo(t))
+		})
+	}
+}
+
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// scoped returns a context scoped to the default tenant; repository calls
+// fail with storage.ErrNoTenant without one.
+func scoped() context.Context {
+	return storage.WithTenant(context.Background(), storage.DefaultTenant)
+}
+
+func mustSave(t *testing.T, repo storage.Repository, u *storage.User) {
+	t.Helper()
+	if err := repo.SaveUser(scoped(), u); err != nil {
+		t.Fatalf("SaveUser(%s): %v", u.ID, err)
+	}
+}
+
+func mustGet(t *testing.T, repo storage.Repository, id string) *storage.User {
+	t.Helper()
+	u, err := repo.GetUser(scoped(), id)
+	if err != nil {
+		t.Fatalf("GetUser(%s): %v", id, err)
+	}
+	return u
+}
+
+func testRoundTrip(t *testing.T, repo storage.Repository) {
+	in := &storage.User{
+		ID:                 "alice",
+		EncryptedSecret:    "ciphertext",
+		Enabled:            true,
+		RecoveryCodes:      storage.NewRecoveryCodes([]string{"h1", "h2", "h3"}),
+		CreatedAt:          epoch,
+		EnabledAt:          epoch.Add(time.Minute),
+		StaticPasswordHash: "password-hash",
+	}
+	in.RecoveryCodes[2].UsedAt = epoch.Add(time.Hour)
+	mustSave(t, repo, in)
+
+	got := mustGet(t, repo, "alice")
+	if got.ID != in.ID || got.EncryptedSecret != in.EncryptedSecret || got.Enabled != in.Enabled ||
+		got.StaticPasswordHash != in.StaticPasswordHash {
+		t.Fatalf("got %+v, want %+v", got, in)
+	}
+	if got.Version != 1 || in.Version != 1 {
+		t.Fatalf("Version = %d (saved struct %d), want 1", got.Version, in.Version)
+	}
+	if !got.CreatedAt.Equal(epoch) || !got.EnabledAt.Equal(in.EnabledAt) {
+		t.Fatalf("timestamps = %v / %v", got.CreatedAt, got.EnabledAt)
+	}
+	if len(got.RecoveryCodes) != 3 {
+		t.Fatalf("RecoveryCodes = %+v", got.RecoveryCodes)
+	}
+	for i, c := range got.RecoveryCodes {
+		if c.Hash != in.RecoveryCodes[i].Hash || !c.UsedAt.Equal(in.RecoveryCodes[i].UsedAt) {
+			t.Fatalf("RecoveryCodes[%d] = %+v, want %+v (order must be preserved)", i, c, in.RecoveryCodes[i])
+		}
+	}
+
+	// Updates write the static password too.
+	got.StaticPasswordHash = ""
+	mustSave(t, repo, got)
+	if again := mustGet(t, repo, "alice"); again.StaticPasswordHash != "" {
+		t.Fatalf("StaticPasswordHash = %q after clearing it", again.StaticPasswordHash)
+	}
+
+	// CreatedAt defaults to the save time when unset.
+	before := time.Now().Add(-time.Second)
+	mustSave(t, repo, &storage.User{ID: "bob", EncryptedSecret: "x"})
+	if bob := mustGet(t, repo, "bob"); bob.CreatedAt.Before(before) {
+		t.Fatalf("default CreatedAt = %v, want >= %v", bob.CreatedAt, before)
+	}
+}
+
+func testNotFound(t *testing.T, repo storage.Repository) {
+	ctx := scoped()
+	if _, err := repo.GetUser(ctx, "ghost"); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Errorf("GetUser err = %v, want ErrUserNotFound", err)
+	}
+	if err := repo.SaveUser(ctx, &storage.User{ID: "ghost", Version: 1}); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Errorf("SaveUser(version 1) err = %v, want ErrUserNotFound", err)
+	}
+	if err := repo.DeleteUser(ctx, "ghost"); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Errorf("DeleteUser err = %v, want ErrUserNotFound", err)
+	}
+	if err := repo.DisableUser(ctx, "ghost"); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Errorf("DisableUser err = %v, want ErrUserNotFound", err)
+	}
+	if err := repo.RecordAttempt(ctx, "ghost", true, epoch); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Errorf("RecordAttempt err = %v, want ErrUserNotFound", err)
+	}
+}
+
+func testReturnedCopiesAreIsolated(t *testing.T, repo storage.Repository) {
+	mustSave(t, repo, &storage.User{ID: "alice", EncryptedSecret: "s", RecoveryCodes: storage.NewRecoveryCodes([]string{"a", "b"})})
+
+	got := mustGet(t, repo, "alice")
+	got.EncryptedSecret = "mutated"
+	got.RecoveryCodes[0].UsedAt = epoch
+	got.RecoveryCodes[1].Hash = "mutated"
+	got.RecoveryCodes = append(got.RecoveryCodes[:0], got.RecoveryCodes[1:]...)
+
+	again := mustGet(t, repo, "alice")
+	if again.EncryptedSecret != "s" || len(again.RecoveryCodes) != 2 ||
+		again.RecoveryCodes[0].Hash != "a" || again.RecoveryCodes[0].Used() || again.RecoveryCodes[1].Hash != "b" {
+		t.Fatalf("mutating a returned user changed the stored one: %+v", again)
+	}
+}
+
+func testSavedCopiesAreIsolated(t *testing.T, repo storage.Repository) {
+	u := &storage.User{ID: "alice", EncryptedSecret: "s", RecoveryCodes: storage.NewRecoveryCodes([]string{"a"})}
+	mustSave(t, repo, u)
+	u.EncryptedSecret = "mutated"
+	u.RecoveryCodes[0].Hash = "mutated"
+
+	got := mustGet(t, repo, "alice")
+	if got.EncryptedSecret != "s" || got.RecoveryCodes[0].Hash != "a" {
+		t.Fatalf("mutating the saved struct changed the stored one: %+v", got)
+	}
+}
+
+func testVersioning(t *testing.T, repo storage.Repository) {
+	ctx := scoped()
+	mustSave(t, repo, &storage.User{ID: "alice", EncryptedSecret: "v1"})
+
+	if err := repo.SaveUser(ctx, &storage.User{ID: "alice", EncryptedSecret: "dup"}); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("duplicate insert err = %v, want ErrConflict", err)
+	}
+
+	a := mustGet(t, repo, "alice")
+	b := mustGet(t, repo, "alice")
+	a.Enabled = true
+	mustSave(t, repo, a)
+	if a.Version != 2 {
+		t.Fatalf("Version after update = %d, want 2", a.Version)
+	}
+
+	b.EncryptedSecret = "stale"
+	if err := repo.SaveUser(ctx, b); !errors.Is(err, storage.ErrVersionMismatch) {
+		t.Fatalf("stale update err = %v, want ErrVersionMismatch", err)
+	}
+
+	got := mustGet(t, repo, "alice")
+	if got.Version != 2 || !got.Enabled || got.EncryptedSecret != "v1" {
+		t.Fatalf("got %+v, want version 2, enabled, secret v1", got)
+	}
+}
+
+func testRecoveryCodeReplacement(t *testing.T, repo storage.Repository) {
+	u := &storage.User{ID: "alice", EncryptedSecret: "s", RecoveryCodes: storage.NewRecoveryCodes([]string{"a", "b", "c"})}
+	mustSave(t, repo, u)
+
+	u = mustGet(t, repo, "alice")
+	u.RecoveryCodes = storage.NewRecoveryCodes([]string{"x", "y"})
+	mustSave(t, repo, u)
+
+	got := mustGet(t, repo, "alice")
+	if len(got.RecoveryCodes) != 2 || got.RecoveryCodes[0].Hash != "x" || got.RecoveryCodes[1].Hash != "y" {
+		t.Fatalf("RecoveryCodes = %+v, want [x y]", got.RecoveryCodes)
+	}
+
+	got.RecoveryCodes = nil
+	mustSave(t, repo, got)
+	if got := mustGet(t, repo, "alice"); len(got.RecoveryCodes) != 0 {
+		t.Fatalf("RecoveryCodes after clearing = %+v", got.RecoveryCodes)
+	}
+}
+
+// testConcurrentUpdates runs load-modify-save loops in parallel. With
+// correct optimistic concurrency every append survives.
+func testConcurrentUpdates(t *testing.T, repo storage.Repository) {
+	ctx := scoped()
+	mustSave(t, repo, &storage.User{ID: "alice", EncryptedSecret: "s"})
+
+	const workers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				u, err := repo.GetUser(ctx, "alice")
+				if err != nil {
+					errs <- err
+					return
+				}
+				u.RecoveryCodes = append(u.RecoveryCodes, storage.RecoveryCode{Hash: fmt.Sprintf("code-%d", i)})
+				err = repo.SaveUser(ctx, u)
+				if errors.Is(err, storage.ErrVersionMismatch) {
+					continue
+				}
+				if err != nil {
+					errs <- err
+				}
+				return
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent update: %v", err)
+	}
+
+	got := mustGet(t, repo, "alice")
+	if len(got.RecoveryCodes) != workers || got.Version != workers+1 {
+		t.Fatalf("got %d codes at version %d, want %d at %d", len(got.RecoveryCodes), got.Version, workers, workers+1)
+	}
+}
+
+func testConcurrentRecordAttempt(t *testing.T, repo storage.Repository) {
+	ctx := scoped()
+	mustSave(t, repo, &storage.User{ID: "alice", EncryptedSecret: "s"})
+
+	const attempts = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := repo.RecordAttempt(ctx, "alice", false, epoch); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("RecordAttempt: %v", err)
+	}
+
+	if got := mustGet(t, repo, "alice"); got.TotalFailures != attempts || got.Version != 1 {
+		t.Fatalf("TotalFailures = %d at version %d, want %d at 1", got.TotalFailures, got.Version, attempts)
+	}
+}
+
+func testRecordAttempt(t *testing.T, repo storage.Repository) {
+	ctx := scoped()
+	mustSave(t, repo, &storage.User{ID: "alice", EncryptedSecret: "s"})
+
+	for i := 0; i < 2; i++ {
+		if err := repo.RecordAttempt(ctx, "alice", false, epoch); err != nil {
+			t.Fatalf("RecordAttempt: %v", err)
+		}
+	}
+	if got := mustGet(t, repo, "alice"); got.FailedAttempts != 2 || !got.LastFailedAt.Equal(epoch) {
+		t.Fatalf("after failures: %+v", got)
+	}
+	if err := repo.RecordAttempt(ctx, "alice", true, epoch.Add(time.Minute)); err != nil {
+		t.Fatalf("RecordAttempt: %v", err)
+	}
+
+	got := mustGet(t, repo, "alice")
+	if got.FailedAttempts != 0 || got.TotalFailures != 2 || !got.LastVerifiedAt.Equal(epoch.Add(time.Minute)) {
+		t.Fatalf("after success: %+v", got)
+	}
+
+	// SaveUser on an existing user must not clobber the usage metadata.
+	got.Enabled = true
+	mustSave(t, repo, got)
+	if again := mustGet(t, repo, "alice"); again.TotalFailures != 2 || !again.LastVerifiedAt.Equal(got.LastVerifiedAt) {
+		t.Fatalf("SaveUser reset usage metadata: %+v", again)
+	}
+}
+
+func testDisableAndDelete(t *testing.T, repo storage.Repository) {
+	ctx := scoped()
+	mustSave(t, repo, &storage.User{
+		ID: "alice", EncryptedSecret: "s", Enabled: true, EnabledAt: epoch,
+		RecoveryCodes: storage.NewRecoveryCodes([]string{"a", "b"}),
+	})
+
+	if err := repo.DisableUser(ctx, "alice"); err != nil {
+		t.Fatalf("DisableUser: %v", err)
+	}
+	got := mustGet(t, repo, "alice")
+	if got.Enabled || !got.EnabledAt.IsZero() || len(got.RecoveryCodes) != 0 || got.Version != 2 {
+		t.Fatalf("after disable: %+v", got)
+	}
+
+	if err := repo.DeleteUser(ctx, "alice"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if _, err := repo.GetUser(ctx, "alice"); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Fatalf("GetUser after delete err = %v", err)
+	}
+
+	// The ID can be reused, starting from a clean slate.
+	mustSave(t, repo, &storage.User{ID: "alice", EncryptedSecret: "new"})
+	if got := mustGet(t, repo, "alice"); got.Version != 1 || len(got.RecoveryCodes) != 0 {
+		t.Fatalf("recreated user: %+v", got)
+	}
+}
+
+func seedUsers(t *testing.T, repo storage.Repository, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		mustSave(t, repo, &storage.User{
+			ID:              fmt.Sprintf("user-%02d", i),
+			EncryptedSecret: "s",
+			Enabled:         i%2 == 0,
+			RecoveryCodes:   storage.NewRecoveryCodes([]string{"h"}),
+			CreatedAt:       epoch.Add(time.Duration(i) * time.Hour),
+		})
+	}
+}
+
+func listAll(t *testing.T, repo storage.Repository, opts storage.ListUsersOptions) []string {
+	t.Helper()
+	var ids []string
+	for {
+		page, err := repo.ListUsers(scoped(), opts)
+		if err != nil {
+			t.Fatalf("ListUsers: %v", err)
+		}
+		for _, u := range page.Users {
+			if len(u.RecoveryCodes) != 0 {
+				t.Fatalf("ListUsers populated RecoveryCodes for %s", u.ID)
+			}
+			ids = append(ids, u.ID)
+		}
+		if page.NextCursor == "" {
+			return ids
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+func testListUsersPagination(t *testing.T, repo storage.Repository) {
+	if ids := listAll(t, repo, storage.ListUsersOptions{}); len(ids) != 0 {
+		t.Fatalf("empty repository listed %v", ids)
+	}
+
+	seedUsers(t, repo, 7)
+	for _, limit := range []int{1, 2, 3, 7, 10} {
+		ids := listAll(t, repo, storage.ListUsersOptions{Limit: limit})
+		if len(ids) != 7 || !sort.StringsAreSorted(ids) {
+			t.Fatalf("limit %d: listed %v, want 7 sorted IDs", limit, ids)
+		}
+	}
+
+	page, err := repo.ListUsers(scoped(), storage.ListUsersOptions{Limit: 7})
+	if err != nil || page.NextCursor != "" {
+		t.Fatalf("exact-size page: cursor %q, err %v; want no next cursor", page.NextCursor, err)
+	}
+
+	if _, err := repo.ListUsers(scoped(), storage.ListUsersOptions{Cursor: "%%%"}); !errors.Is(err, storage.ErrInvalidCursor) {
+		t.Fatalf("bad cursor err = %v, want ErrInvalidCursor", err)
+	}
+}
+
+func testListUsersFilters(t *testing.T, repo storage.Repository) {
+	ctx := scoped()
+	seedUsers(t, repo, 6)
+	if err := repo.RecordAttempt(ctx, "user-03", true, epoch.Add(24*time.Hour)); err != nil {
+		t.Fatalf("RecordAttempt: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := repo.RecordAttempt(ctx, "user-04", false, epoch); err != nil {
+			t.Fatalf("RecordAttempt: %v", err)
+		}
+	}
+
+	enabled, disabled := true, false
+	tests := []struct {
+		name string
+		opts storage.ListUsersOptions
+		want string
+	}{
+		{"enabled", storage.ListUsersOptions{Enabled: &enabled}, "[user-00 user-02 user-04]"},
+		{"disabled", storage.ListUsersOptions{Enabled: &disabled}, "[user-01 user-03 user-05]"},
+		{"created range", storage.ListUsersOptions{CreatedAfter: epoch.Add(time.Hour), CreatedBefore: epoch.Add(3 * time.Hour)}, "[user-01 user-02]"},
+		{"combined", storage.ListUsersOptions{Enabled: &enabled, CreatedAfter: epoch.Add(time.Hour)}, "[user-02 user-04]"},
+		{"verified after", storage.ListUsersOptions{LastVerifiedAfter: epoch}, "[user-03]"},
+		{"verified before", storage.ListUsersOptions{LastVerifiedBefore: epoch.Add(time.Hour)}, "[]"},
+		{"failed attempts", storage.ListUsersOptions{MinFailedAttempts: 2}, "[user-04]"},
+		{"filtered pagination", storage.ListUsersOptions{Enabled: &enabled, Limit: 1}, "[user-00 user-02 user-04]"},
+	}
+	for _, tc := range tests {
+		if got := fmt.Sprint(listAll(t, repo, tc.opts)); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func testCanceledContext(t *testing.T, repo storage.Repository) {
+	mustSave(t, repo, &storage.User{ID: "alice", EncryptedSecret: "s"})
+
+	ctx, cancel := context.WithCancel(scoped())
+	cancel()
+	// A canceled request is the caller going away, not a backend outage.
+	if _, err := repo.GetUser(ctx, "alice"); !errors.Is(err, context.Canceled) || errors.Is(err, storage.ErrUnavailable) {
+		t.Errorf("GetUser err = %v, want context.Canceled and not ErrUnavailable", err)
+	}
+	if err := repo.SaveUser(ctx, &storage.User{ID: "bob"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("SaveUser err = %v, want context.Canceled", err)
+	}
+	if _, err := repo.ListUsers(ctx, storage.ListUsersOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("ListUsers err = %v, want context.Canceled", err)
+	}
+
+	deadline, cancelDeadline := context.WithDeadline(scoped(), time.Now().Add(-time.Second))
+	defer cancelDeadline()
+	if _, err := repo.GetUser(deadline, "alice"); !errors.Is(err, storage.ErrUnavailable) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetUser err = %v, want ErrUnavailable wrapping context.DeadlineExceeded", err)
+	}
+}
+
+func testUnscopedContext(t *testing.T, repo storage.Repository) {
+	mustSave(t, repo, &storage.User{ID: "alice", EncryptedSecret: "s"})
+
+	// No silent fallback to the default tenant.
+	ctx := context.Background()
+	if _, err := repo.GetUser(ctx, "alice"); !errors.Is(err, storage.ErrNoTenant) {
+		t.Errorf("GetUser err = %v, want ErrNoTenant", err)
+	}
+	if err := repo.SaveUser(ctx, &storage.User{ID: "bob"}); !errors.Is(err, storage.ErrNoTenant) {
+		t.Errorf("SaveUser err = %v, want ErrNoTenant", err)
+	}
+	if err := repo.DeleteUser(ctx, "alice"); !errors.Is(err, storage.ErrNoTenant) {
+		t.Errorf("DeleteUser err = %v, want ErrNoTenant", err)
+	}
+	if _, err := repo.ListUsers(ctx, storage.ListUsersOptions{}); !errors.Is(err, storage.ErrNoTenant) {
+		t.Errorf("ListUsers err = %v, want ErrNoTenant", err)
+	}
+	mustGet(t, repo, "alice")
+}
+
+func testTenantIsolation(t *testing.T, repo storage.Repository) {
+	acme := storage.WithTenant(context.Background(), "acme")
+	globex := storage.WithTenant(context.Background(), "globex")
+
+	// The same ID in two tenants is two independent users.
+	for tenantID, ctx := range map[string]context.Context{"acme": acme, "globex": globex} {
+		u := &storage.User{ID: "alice", EncryptedSecret: tenantID,
+			RecoveryCodes: storage.NewRecoveryCodes([]string{"h"})}
+		if err := repo.SaveUser(ctx, u); err != nil {
+			t.Fatalf("SaveUser in %s: %v", tenantID, err)
+		}
+	}
+	if _, err := repo.GetUser(scoped(), "alice"); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Fatalf("default tenant sees other tenants' user: err = %v", err)
+	}
+
+	if err := repo.DisableUser(acme, "alice"); err != nil {
+		t.Fatalf("DisableUser: %v", err)
+	}
+	if err := repo.RecordAttempt(acme, "alice", false, epoch); err != nil {
+		t.Fatalf("RecordAttempt: %v", err)
+	}
+	got, err := repo.GetUser(globex, "alice")
+	if err != nil {
+		t.Fatalf("GetUser(globex): %v", err)
+	}
+	if got.EncryptedSecret != "globex" || got.Version != 1 || len(got.RecoveryCodes) != 1 || got.FailedAttempts != 0 {
+		t.Fatalf("globex user changed by writes to acme: %+v", got)
+	}
+
+	page, err := repo.ListUsers(globex, storage.ListUsersOptions{})
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	if len(page.Users) != 1 || page.Users[0].EncryptedSecret != "globex" {
+		t.Fatalf("ListUsers(globex) = %+v", page.Users)
+	}
+
+	if err := repo.DeleteUser(acme, "alice"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if got, err := repo.GetUser(globex, "alice"); err != nil || len(got.RecoveryCodes) != 1 {
+		t.Fatalf("globex user after acme delete: %+v, %v", got, err)
+	}
+}
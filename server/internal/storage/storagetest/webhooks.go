@@ -0,0 +1,246 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"go-auth-totp/internal/storage"
+	"testing"
+	"time"
+)
+
+// WebhookRepository is a Repository that also keeps the webhook outbox, so
+// the suite can check that user writes queue their events.
+type WebhookRepository interface {
+	storage.Repository
+	storage.WebhookStore
+}
+
+// WebhookStoreFactory returns a new, empty repository.
+type WebhookStoreFactory func(t *testing.T) WebhookRepository
+
+// RunWebhookStore executes the storage.WebhookStore conformance suite.
+func RunWebhookStore(t *testing.T, newStore WebhookStoreFactory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, store WebhookRepository)
+	}{
+		{"Endpoints", testWebhookEndpoints},
+		{"Outbox", testWebhookOutbox},
+		{"DeadLetters", testWebhookDeadLetters},
+		{"EventsWithUserWrites", testWebhookEventsWithUserWrites},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newStore(t))
+		})
+	}
+}
+
+func testWebhookEndpoints(t *testing.T, store WebhookRepository) {
+	ctx := scoped()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, e := range []*storage.WebhookEndpoint{
+		{ID: "w2", TenantID: "globex", URL: "https://globex.example/hook", Events: []string{"*"}},
+		{ID: "w1", TenantID: "acme", URL: "https://acme.example/hook", Events: []string{"totp.enabled", "recovery_code.used"}},
+	} {
+		e.Secret = "blob"
+		e.CreatedAt = base.Add(time.Duration(i) * time.Minute)
+		if err := store.CreateWebhookEndpoint(ctx, e); err != nil {
+			t.Fatalf("CreateWebhookEndpoint(%s): %v", e.ID, err)
+		}
+	}
+	if err := store.CreateWebhookEndpoint(ctx, &storage.WebhookEndpoint{ID: "w1", TenantID: "acme", Events: []string{"*"}}); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("duplicate ID: err = %v, want ErrConflict", err)
+	}
+
+	got, err := store.GetWebhookEndpoint(ctx, "w1")
+	if err != nil {
+		t.Fatalf("GetWebhookEndpoint: %v", err)
+	}
+	if got.URL != "https://acme.example/hook" || got.Secret != "blob" || len(got.Events) != 2 ||
+		!got.Wants("totp.enabled") || got.Wants("recovery_codes.low") {
+		t.Fatalf("endpoint = %+v", got)
+	}
+
+	all, err := store.ListWebhookEndpoints(ctx, "")
+	if err != nil {
+		t.Fatalf("ListWebhookEndpoints: %v", err)
+	}
+	if len(all) != 2 || all[0].ID != "w1" || all[1].ID != "w2" {
+		t.Fatalf("all endpoints = %+v, want w1, w2", all)
+	}
+	acme, err := store.ListWebhookEndpoints(ctx, "acme")
+	if err != nil || len(acme) != 1 {
+		t.Fatalf("acme endpoints = %+v, %v", acme, err)
+	}
+
+	if err := store.DeleteWebhookEndpoint(ctx, "w1"); err != nil {
+		t.Fatalf("DeleteWebhookEndpoint: %v", err)
+	}
+	if _, err := store.GetWebhookEndpoint(ctx, "w1"); !errors.Is(err, storage.ErrWebhookNotFound) {
+		t.Fatalf("get deleted: err = %v, want ErrWebhookNotFound", err)
+	}
+	if err := store.DeleteWebhookEndpoint(ctx, "w1"); !errors.Is(err, storage.ErrWebhookNotFound) {
+		t.Fatalf("delete twice: err = %v, want ErrWebhookNotFound", err)
+	}
+}
+
+func enqueue(t *testing.T, store storage.WebhookStore, deliveries ...*storage.WebhookDelivery) {
+	t.Helper()
+	if err := store.EnqueueWebhookDeliveries(scoped(), deliveries); err != nil {
+		t.Fatalf("EnqueueWebhookDeliveries: %v", err)
+	}
+}
+
+func testWebhookOutbox(t *testing.T, store WebhookRepository) {
+	ctx := scoped()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	first := &storage.WebhookDelivery{TenantID: "acme", EndpointID: "w1", EventID: "e1", EventType: "totp.enabled",
+		Payload: []byte(`{"type":"totp.enabled"}`), CreatedAt: now}
+	later := &storage.WebhookDelivery{TenantID: "acme", EndpointID: "w1", EventID: "e2", EventType: "totp.enabled",
+		Payload: []byte(`{}`), CreatedAt: now, NextAttemptAt: now.Add(time.Hour)}
+	enqueue(t, store, first, later)
+	if first.ID == 0 || later.ID <= first.ID || first.Status != storage.DeliveryPending || !first.NextAttemptAt.Equal(now) {
+		t.Fatalf("enqueued = %+v, %+v", first, later)
+	}
+
+	due, err := store.DueWebhookDeliveries(ctx, now, 10)
+	if err != nil {
+		t.Fatalf("DueWebhookDeliveries: %v", err)
+	}
+	if len(due) != 1 || due[0].ID != first.ID || string(due[0].Payload) != `{"type":"totp.enabled"}` || due[0].EventID != "e1" {
+		t.Fatalf("due = %+v, want only the first delivery", due)
+	}
+
+	// A failed attempt pushes the delivery back.
+	d := due[0]
+	d.Attempts, d.LastStatus, d.LastError, d.NextAttemptAt = 1, 500, "server error", now.Add(2*time.Hour)
+	if err := store.UpdateWebhookDelivery(ctx, d); err != nil {
+		t.Fatalf("UpdateWebhookDelivery: %v", err)
+	}
+	if due, _ := store.DueWebhookDeliveries(ctx, now.Add(90*time.Minute), 10); len(due) != 1 || due[0].ID != later.ID {
+		t.Fatalf("due after retry scheduled = %+v, want only the later delivery", due)
+	}
+	due, _ = store.DueWebhookDeliveries(ctx, now.Add(3*time.Hour), 1)
+	if len(due) != 1 || due[0].ID != first.ID || due[0].Attempts != 1 || due[0].LastStatus != 500 || due[0].LastError != "server error" {
+		t.Fatalf("due with limit 1 = %+v, want the first delivery with its attempt", due)
+	}
+
+	d = due[0]
+	d.Status, d.DeliveredAt = storage.DeliveryDelivered, now.Add(3*time.Hour)
+	if err := store.UpdateWebhookDelivery(ctx, d); err != nil {
+		t.Fatalf("UpdateWebhookDelivery: %v", err)
+	}
+	if due, _ := store.DueWebhookDeliveries(ctx, now.Add(3*time.Hour), 10); len(due) != 1 || due[0].ID != later.ID {
+		t.Fatalf("delivered delivery still due: %+v", due)
+	}
+	if err := store.UpdateWebhookDelivery(ctx, &storage.WebhookDelivery{ID: 999, Status: storage.DeliveryDead}); !errors.Is(err, storage.ErrWebhookNotFound) {
+		t.Fatalf("update unknown: err = %v, want ErrWebhookNotFound", err)
+	}
+}
+
+func testWebhookDeadLetters(t *testing.T, store WebhookRepository) {
+	acme := storage.WithTenant(context.Background(), "acme")
+	globex := storage.WithTenant(context.Background(), "globex")
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	a := &storage.WebhookDelivery{TenantID: "acme", EndpointID: "w1", EventID: "e1", EventType: "totp.enabled", Payload: []byte(`{}`), CreatedAt: now}
+	g := &storage.WebhookDelivery{TenantID: "globex", EndpointID: "w2", EventID: "e2", EventType: "totp.enabled", Payload: []byte(`{}`), CreatedAt: now}
+	enqueue(t, store, a, g)
+	for _, d := range []*storage.WebhookDelivery{a, g} {
+		d.Status, d.Attempts, d.LastError = storage.DeliveryDead, 8, "connection refused"
+		if err := store.UpdateWebhookDelivery(scoped(), d); err != nil {
+			t.Fatalf("UpdateWebhookDelivery: %v", err)
+		}
+	}
+
+	dead, err := store.ListDeadWebhookDeliveries(acme, 0, 10)
+	if err != nil {
+		t.Fatalf("ListDeadWebhookDeliveries: %v", err)
+	}
+	if len(dead) != 1 || dead[0].ID != a.ID || dead[0].Attempts != 8 || dead[0].LastError != "connection refused" {
+		t.Fatalf("acme dead letters = %+v", dead)
+	}
+	if dead, _ := store.ListDeadWebhookDeliveries(acme, a.ID, 10); len(dead) != 0 {
+		t.Fatalf("dead letters after %d = %+v", a.ID, dead)
+	}
+	if due, _ := store.DueWebhookDeliveries(scoped(), now.Add(time.Hour), 10); len(due) != 0 {
+		t.Fatalf("dead deliveries are due: %+v", due)
+	}
+
+	// Retrying is scoped to the tenant and only applies to dead deliveries.
+	if err := store.RetryWebhookDelivery(globex, a.ID, now); !errors.Is(err, storage.ErrWebhookNotFound) {
+		t.Fatalf("retry from another tenant: err = %v, want ErrWebhookNotFound", err)
+	}
+	if err := store.RetryWebhookDelivery(acme, a.ID, now.Add(time.Hour)); err != nil {
+		t.Fatalf("RetryWebhookDelivery: %v", err)
+	}
+	if err := store.RetryWebhookDelivery(acme, a.ID, now); !errors.Is(err, storage.ErrWebhookNotFound) {
+		t.Fatalf("retry a pending delivery: err = %v, want ErrWebhookNotFound", err)
+	}
+	due, _ := store.DueWebhookDeliveries(scoped(), now.Add(time.Hour), 10)
+	if len(due) != 1 || due[0].ID != a.ID || due[0].Attempts != 0 {
+		t.Fatalf("due after retry = %+v", due)
+	}
+	if dead, _ := store.ListDeadWebhookDeliveries(acme, 0, 10); len(dead) != 0 {
+		t.Fatalf("retried delivery still dead: %+v", dead)
+	}
+}
+
+func testWebhookEventsWithUserWrites(t *testing.T, store WebhookRepository) {
+	acme := storage.WithTenant(context.Background(), "acme")
+	for _, e := range []*storage.WebhookEndpoint{
+		{ID: "w1", TenantID: "acme", URL: "https://a.example/hook", Events: []string{"*"}, Secret: "s", CreatedAt: epoch},
+		{ID: "w2", TenantID: "acme", URL: "https://b.example/hook", Events: []string{"totp.enabled"}, Secret: "s", CreatedAt: epoch.Add(time.Hour)},
+		{ID: "w3", TenantID: "globex", URL: "https://c.example/hook", Events: []string{"*"}, Secret: "s", CreatedAt: epoch},
+	} {
+		if err := store.CreateWebhookEndpoint(acme, e); err != nil {
+			t.Fatalf("CreateWebhookEndpoint(%s): %v", e.ID, err)
+		}
+	}
+	queued := func() []*storage.WebhookDelivery {
+		t.Helper()
+		due, err := store.DueWebhookDeliveries(acme, time.Now().Add(time.Hour), 100)
+		if err != nil {
+			t.Fatalf("DueWebhookDeliveries: %v", err)
+		}
+		return due
+	}
+	withEvent := func(id, eventType string) context.Context {
+		return storage.WithWebhookEvents(acme, storage.WebhookEvent{ID: id, Type: eventType, Payload: []byte(`{"id":"` + id + `"}`)})
+	}
+
+	// Each event goes to the tenant's endpoints that want it.
+	if err := store.SaveUser(withEvent("e1", "totp.enabled"), &storage.User{ID: "alice", Enabled: true}); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+	due := queued()
+	if len(due) != 2 || due[0].EndpointID != "w1" || due[1].EndpointID != "w2" || due[0].EventID != "e1" ||
+		due[0].TenantID != "acme" || due[0].EventType != "totp.enabled" || string(due[1].Payload) != `{"id":"e1"}` {
+		t.Fatalf("queued after SaveUser = %+v", due)
+	}
+
+	// Failed writes queue nothing.
+	if err := store.SaveUser(withEvent("e2", "totp.enabled"), &storage.User{ID: "alice"}); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("conflicting SaveUser err = %v, want ErrConflict", err)
+	}
+	if err := store.DisableUser(withEvent("e3", "totp.disabled"), "bob"); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Fatalf("DisableUser(missing) err = %v, want ErrUserNotFound", err)
+	}
+	if err := store.DeleteUser(withEvent("e4", "totp.disabled"), "bob"); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Fatalf("DeleteUser(missing) err = %v, want ErrUserNotFound", err)
+	}
+	if due := queued(); len(due) != 2 {
+		t.Fatalf("failed writes queued deliveries: %+v", due[2:])
+	}
+
+	if err := store.DisableUser(withEvent("e5", "totp.disabled"), "alice"); err != nil {
+		t.Fatalf("DisableUser: %v", err)
+	}
+	if err := store.DeleteUser(withEvent("e6", "totp.disabled"), "alice"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	due = queued()
+	if len(due) != 4 || due[2].EventID != "e5" || due[3].EventID != "e6" || due[3].EndpointID != "w1" {
+		t.Fatalf("queued after DisableUser and DeleteUser = %+v", due)
+	}
+}
@@ -0,0 +1,34 @@
+package storage
+
+import "context"
+
+// DefaultTenant owns users created before tenants existed. Single-tenant
+// deployments scope every request to it explicitly.
+const DefaultTenant = "default"
+
+type tenantKey struct{}
+
+// WithTenant scopes every repository call made with ctx to one tenant.
+// User IDs are only unique within a tenant.
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantID)
+}
+
+// TenantFromContext returns the tenant set by WithTenant. A context that
+// was never scoped yields ErrNoTenant rather than a default, so a caller
+// that forgot WithTenant fails instead of touching another tenant's data.
+func TenantFromContext(ctx context.Context) (string, error) {
+	if id, ok := ctx.Value(tenantKey{}).(string); ok && id != "" {
+		return id, nil
+	}
+	return "", ErrNoTenant
+}
+
+// scope is the preamble of every tenant-scoped repository call: it fails
+// on a done context, then on a missing tenant.
+func scope(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", contextError(err)
+	}
+	return TenantFromContext(ctx)
+}
@@ -0,0 +1,614 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Delivery states.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	// DeliveryDead marks a delivery that ran out of attempts. Dead
+	// deliveries form the dead-letter view and can be retried by hand.
+	DeliveryDead = "dead"
+)
+
+// ErrWebhookNotFound is returned for an unknown webhook endpoint or
+// delivery.
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// WebhookEndpoint is a URL that receives a tenant's events.
+type WebhookEndpoint struct {
+	ID       string
+	TenantID string
+	URL      string
+	// Events are the event types sent to the endpoint; "*" sends all.
+	Events []string
+	// Secret is the HMAC signing secret encrypted with the tenant's key.
+	Secret    string
+	CreatedAt time.Time
+}
+
+// Wants reports whether the endpoint subscribes to eventType.
+func (e *WebhookEndpoint) Wants(eventType string) bool {
+	for _, ev := range e.Events {
+		if ev == "*" || ev == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is one event on its way to one endpoint.
+type WebhookDelivery struct {
+	ID         int64
+	TenantID   string
+	EndpointID string
+	// EventID is shared by the deliveries of one event, so receivers can
+	// drop duplicates.
+	EventID       string
+	EventType     string
+	Payload       []byte
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	// LastStatus is the HTTP status of the last attempt, 0 if none came back.
+	LastStatus  int
+	LastError   string
+	CreatedAt   time.Time
+	DeliveredAt time.Time
+}
+
+// WebhookEvent is an event queued by the user write that causes it; see
+// WithWebhookEvents. Payload is the body sent to every endpoint of the
+// tenant that wants Type.
+type WebhookEvent struct {
+	ID      string
+	Type    string
+	Payload []byte
+}
+
+type webhookEventsKey struct{}
+
+// WithWebhookEvents attaches events to the user writes made with ctx.
+// SaveUser, DeleteUser and DisableUser enqueue a delivery of each event to
+// every endpoint of the context's tenant that wants it, in the same
+// transaction as the write: the events are queued if and only if the
+// write commits.
+func WithWebhookEvents(ctx context.Context, events ...WebhookEvent) context.Context {
+	if len(events) == 0 {
+		return ctx
+	}
+	all := append(append([]WebhookEvent(nil), webhookEvents(ctx)...), events...)
+	return context.WithValue(ctx, webhookEventsKey{}, all)
+}
+
+func webhookEvents(ctx context.Context) []WebhookEvent {
+	events, _ := ctx.Value(webhookEventsKey{}).([]WebhookEvent)
+	return events
+}
+
+// WebhookStore keeps webhook endpoints and the delivery outbox. Endpoints
+// and due deliveries are not scoped by the context's tenant: the
+// dispatcher serves all tenants. The dead-letter calls are.
+type WebhookStore interface {
+	// CreateWebhookEndpoint stores a new endpoint, failing with ErrConflict
+	// if the ID is taken.
+	CreateWebhookEndpoint(ctx context.Context, e *WebhookEndpoint) error
+	GetWebhookEndpoint(ctx context.Context, id string) (*WebhookEndpoint, error)
+	// ListWebhookEndpoints returns the endpoints of one tenant, or of all
+	// tenants when tenantID is empty, ordered by tenant and creation time.
+	ListWebhookEndpoints(ctx context.Context, tenantID string) ([]*WebhookEndpoint, error)
+	DeleteWebhookEndpoint(ctx context.Context, id string) error
+
+	// EnqueueWebhookDeliveries adds pending deliveries to the outbox,
+	// assigning their IDs.
+	EnqueueWebhookDeliveries(ctx context.Context, deliveries []*WebhookDelivery) error
+	// DueWebhookDeliveries returns up to limit pending deliveries whose
+	// next attempt is at or before now, oldest first.
+	DueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]*WebhookDelivery, error)
+	// UpdateWebhookDelivery saves the outcome of an attempt: Status,
+	// Attempts, NextAttemptAt, LastStatus, LastError and DeliveredAt.
+	UpdateWebhookDelivery(ctx context.Context, d *WebhookDelivery) error
+
+	// ListDeadWebhookDeliveries returns up to limit dead deliveries of the
+	// context's tenant with IDs above afterID.
+	ListDeadWebhookDeliveries(ctx context.Context, afterID int64, limit int) ([]*WebhookDelivery, error)
+	// RetryWebhookDelivery moves a dead delivery of the context's tenant
+	// back to pending, due at now, with its attempts reset.
+	RetryWebhookDelivery(ctx context.Context, id int64, now time.Time) error
+}
+
+func cloneWebhookEndpoint(e *WebhookEndpoint) *WebhookEndpoint {
+	c := *e
+	c.Events = append([]string(nil), e.Events...)
+	return &c
+}
+
+func cloneWebhookDelivery(d *WebhookDelivery) *WebhookDelivery {
+	c := *d
+	c.Payload = append([]byte(nil), d.Payload...)
+	return &c
+}
+
+func (r *InMemoryRepository) CreateWebhookEndpoint(ctx context.Context, e *WebhookEndpoint) error {
+	if err := ctx.Err(); err != nil {
+		return contextError(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.webhooks[e.ID]; ok {
+		return ErrConflict
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	r.webhooks[e.ID] = cloneWebhookEndpoint(e)
+	return nil
+}
+
+func (r *InMemoryRepository) GetWebhookEndpoint(ctx context.Context, id string) (*WebhookEndpoint, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(err)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	e, ok := r.webhooks[id]
+	if !ok {
+		return nil, ErrWebhookNotFound
+	}
+	return cloneWebhookEndpoint(e), nil
+}
+
+func (r *InMemoryRepository) ListWebhookEndpoints(ctx context.Context, tenantID string) ([]*WebhookEndpoint, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(err)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var endpoints []*WebhookEndpoint
+	for _, e := range r.webhooks {
+		if tenantID == "" || e.TenantID == tenantID {
+			endpoints = append(endpoints, cloneWebhookEndpoint(e))
+		}
+	}
+	sortWebhookEndpoints(endpoints)
+	return endpoints, nil
+}
+
+// sortWebhookEndpoints orders endpoints by tenant, creation time and ID,
+// like the SQLite queries do.
+func sortWebhookEndpoints(endpoints []*WebhookEndpoint) {
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].TenantID != endpoints[j].TenantID {
+			return endpoints[i].TenantID < endpoints[j].TenantID
+		}
+		if !endpoints[i].CreatedAt.Equal(endpoints[j].CreatedAt) {
+			return endpoints[i].CreatedAt.Before(endpoints[j].CreatedAt)
+		}
+		return endpoints[i].ID < endpoints[j].ID
+	})
+}
+
+func (r *InMemoryRepository) DeleteWebhookEndpoint(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return contextError(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.webhooks[id]; !ok {
+		return ErrWebhookNotFound
+	}
+	delete(r.webhooks, id)
+	return nil
+}
+
+func (r *InMemoryRepository) EnqueueWebhookDeliveries(ctx context.Context, deliveries []*WebhookDelivery) error {
+	if err := ctx.Err(); err != nil {
+		return contextError(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, d := range deliveries {
+		r.enqueueLocked(d)
+	}
+	return nil
+}
+
+// enqueueLocked adds d to the outbox. Callers must hold mu for writing.
+func (r *InMemoryRepository) enqueueLocked(d *WebhookDelivery) {
+	d.ID = int64(len(r.deliveries)) + 1
+	d.Status = DeliveryPending
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now().UTC()
+	}
+	if d.NextAttemptAt.IsZero() {
+		d.NextAttemptAt = d.CreatedAt
+	}
+	r.deliveries = append(r.deliveries, cloneWebhookDelivery(d))
+}
+
+// enqueueEventsLocked queues the events attached to ctx for the endpoints
+// of tenantID that want them. Callers must hold mu for writing.
+func (r *InMemoryRepository) enqueueEventsLocked(ctx context.Context, tenantID string) {
+	events := webhookEvents(ctx)
+	if len(events) == 0 {
+		return
+	}
+	var endpoints []*WebhookEndpoint
+	for _, e := range r.webhooks {
+		if e.TenantID == tenantID {
+			endpoints = append(endpoints, e)
+		}
+	}
+	sortWebhookEndpoints(endpoints)
+	for _, ev := range events {
+		for _, e := range endpoints {
+			if e.Wants(ev.Type) {
+				r.enqueueLocked(&WebhookDelivery{TenantID: tenantID, EndpointID: e.ID, EventID: ev.ID,
+					EventType: ev.Type, Payload: ev.Payload})
+			}
+		}
+	}
+}
+
+func (r *InMemoryRepository) DueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]*WebhookDelivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(err)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var due []*WebhookDelivery
+	for _, d := range r.deliveries {
+		if len(due) == limit {
+			break
+		}
+		if d.Status == DeliveryPending && !d.NextAttemptAt.After(now) {
+			due = append(due, cloneWebhookDelivery(d))
+		}
+	}
+	return due, nil
+}
+
+func (r *InMemoryRepository) UpdateWebhookDelivery(ctx context.Context, d *WebhookDelivery) error {
+	if err := ctx.Err(); err != nil {
+		return contextError(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if d.ID < 1 || d.ID > int64(len(r.deliveries)) {
+		return ErrWebhookNotFound
+	}
+	stored := r.deliveries[d.ID-1]
+	stored.Status = d.Status
+	stored.Attempts = d.Attempts
+	stored.NextAttemptAt = d.NextAttemptAt
+	stored.LastStatus = d.LastStatus
+	stored.LastError = d.LastError
+	stored.DeliveredAt = d.DeliveredAt
+	return nil
+}
+
+func (r *InMemoryRepository) ListDeadWebhookDeliveries(ctx context.Context, afterID int64, limit int) ([]*WebhookDelivery, error) {
+	tenantID, err := scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var dead []*WebhookDelivery
+	for _, d := range r.deliveries {
+		if len(dead) == limit {
+			break
+		}
+		if d.ID > afterID && d.Status == DeliveryDead && d.TenantID == tenantID {
+			dead = append(dead, cloneWebhookDelivery(d))
+		}
+	}
+	return dead, nil
+}
+
+func (r *InMemoryRepository) RetryWebhookDelivery(ctx context.Context, id int64, now time.Time) error {
+	tenantID, err := scope(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id < 1 || id > int64(len(r.deliveries)) {
+		return ErrWebhookNotFound
+	}
+	d := r.deliveries[id-1]
+	if d.Status != DeliveryDead || d.TenantID != tenantID {
+		return ErrWebhookNotFound
+	}
+	d.Status = DeliveryPending
+	d.Attempts = 0
+	d.NextAttemptAt = now.UTC()
+	return nil
+}
+
+const webhookEndpointColumns = `id, tenant_id, url, events, secret, created_at`
+
+func scanWebhookEndpoint(row rowScanner) (*WebhookEndpoint, error) {
+	var e WebhookEndpoint
+	var events string
+	if err := row.Scan(&e.ID, &e.TenantID, &e.URL, &events, &e.Secret, &e.CreatedAt); err != nil {
+		return nil, err
+	}
+	if events != "" {
+		e.Events = strings.Split(events, ",")
+	}
+	return &e, nil
+}
+
+func (r *SQLiteRepository) CreateWebhookEndpoint(ctx context.Context, e *WebhookEndpoint) error {
+	createdAt := e.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now().UTC()
+	}
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO webhook_endpoints (`+webhookEndpointColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, e.ID, e.TenantID, e.URL, strings.Join(e.Events, ","), e.Secret, createdAt)
+	if err != nil {
+		return r.translateError(err)
+	}
+	e.CreatedAt = createdAt
+	return nil
+}
+
+func (r *SQLiteRepository) GetWebhookEndpoint(ctx context.Context, id string) (*WebhookEndpoint, error) {
+	e, err := scanWebhookEndpoint(r.db.QueryRowContext(ctx,
+		"SELECT "+webhookEndpointColumns+" FROM webhook_endpoints WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWebhookNotFound
+	}
+	return e, r.translateError(err)
+}
+
+func (r *SQLiteRepository) ListWebhookEndpoints(ctx context.Context, tenantID string) ([]*WebhookEndpoint, error) {
+	endpoints, err := r.listWebhookEndpoints(ctx, tenantID)
+	return endpoints, r.translateError(err)
+}
+
+func (r *SQLiteRepository) listWebhookEndpoints(ctx context.Context, tenantID string) ([]*WebhookEndpoint, error) {
+	query := "SELECT " + webhookEndpointColumns + " FROM webhook_endpoints"
+	var args []any
+	if tenantID != "" {
+		query += " WHERE tenant_id = ?"
+		args = append(args, tenantID)
+	}
+	query += " ORDER BY tenant_id, created_at, id"
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var endpoints []*WebhookEndpoint
+	for rows.Next() {
+		e, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, rows.Err()
+}
+
+func (r *SQLiteRepository) DeleteWebhookEndpoint(ctx context.Context, id string) error {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM webhook_endpoints WHERE id = ?", id)
+	if err != nil {
+		return r.translateError(err)
+	}
+	if err := rowsOrNotFound(res); err != nil {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) EnqueueWebhookDeliveries(ctx context.Context, deliveries []*WebhookDelivery) error {
+	return r.translateError(r.enqueueWebhookDeliveries(ctx, deliveries))
+}
+
+func (r *SQLiteRepository) enqueueWebhookDeliveries(ctx context.Context, deliveries []*WebhookDelivery) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ids := make([]int64, len(deliveries))
+	now := time.Now().UTC()
+	for i, d := range deliveries {
+		if ids[i], err = insertWebhookDelivery(ctx, tx, d, now); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for i, d := range deliveries {
+		d.ID = ids[i]
+		d.Status = DeliveryPending
+		if d.CreatedAt.IsZero() {
+			d.CreatedAt = now
+		}
+		if d.NextAttemptAt.IsZero() {
+			d.NextAttemptAt = d.CreatedAt
+		}
+	}
+	return nil
+}
+
+// insertWebhookDelivery adds d to the outbox within tx and returns its ID.
+// Zero times default to now.
+func insertWebhookDelivery(ctx context.Context, tx *sql.Tx, d *WebhookDelivery, now time.Time) (int64, error) {
+	createdAt, next := d.CreatedAt, d.NextAttemptAt
+	if createdAt.IsZero() {
+		createdAt = now
+	}
+	if next.IsZero() {
+		next = createdAt
+	}
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (tenant_id, endpoint_id, event_id, event_type, payload, status,
+			next_attempt_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, d.TenantID, d.EndpointID, d.EventID, d.EventType, d.Payload, DeliveryPending, next.UTC(), createdAt.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// enqueueWebhookEvents queues the events attached to ctx for the endpoints
+// of tenantID that want them, within tx.
+func enqueueWebhookEvents(ctx context.Context, tx *sql.Tx, tenantID string) error {
+	events := webhookEvents(ctx)
+	if len(events) == 0 {
+		return nil
+	}
+	rows, err := tx.QueryContext(ctx,
+		"SELECT "+webhookEndpointColumns+" FROM webhook_endpoints WHERE tenant_id = ? ORDER BY created_at, id", tenantID)
+	if err != nil {
+		return err
+	}
+	var endpoints []*WebhookEndpoint
+	for rows.Next() {
+		e, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		endpoints = append(endpoints, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, ev := range events {
+		for _, e := range endpoints {
+			if !e.Wants(ev.Type) {
+				continue
+			}
+			d := &WebhookDelivery{TenantID: tenantID, EndpointID: e.ID, EventID: ev.ID, EventType: ev.Type, Payload: ev.Payload}
+			if _, err := insertWebhookDelivery(ctx, tx, d, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+const webhookDeliveryColumns = `id, tenant_id, endpoint_id, event_id, event_type, payload, status, attempts,
+	next_attempt_at, last_status, last_error, created_at, delivered_at`
+
+func scanWebhookDelivery(row rowScanner) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	var deliveredAt sql.NullTime
+	err := row.Scan(&d.ID, &d.TenantID, &d.EndpointID, &d.EventID, &d.EventType, &d.Payload, &d.Status,
+		&d.Attempts, &d.NextAttemptAt, &d.LastStatus, &d.LastError, &d.CreatedAt, &deliveredAt)
+	if err != nil {
+		return nil, err
+	}
+	d.DeliveredAt = deliveredAt.Time
+	return &d, nil
+}
+
+// queryWebhookDeliveries runs a SELECT of webhookDeliveryColumns from
+// source (the outbox or the dead-letter view) with the given condition.
+func (r *SQLiteRepository) queryWebhookDeliveries(ctx context.Context, source, where string, args ...any) ([]*WebhookDelivery, error) {
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT "+webhookDeliveryColumns+" FROM "+source+" WHERE "+where+" ORDER BY id LIMIT ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*WebhookDelivery
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (r *SQLiteRepository) DueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]*WebhookDelivery, error) {
+	due, err := r.queryWebhookDeliveries(ctx, "webhook_deliveries", "status = ? AND next_attempt_at <= ?",
+		DeliveryPending, now.UTC(), limit)
+	return due, r.translateError(err)
+}
+
+func (r *SQLiteRepository) UpdateWebhookDelivery(ctx context.Context, d *WebhookDelivery) error {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET status = ?, attempts = ?, next_attempt_at = ?, last_status = ?, last_error = ?, delivered_at = ?
+		WHERE id = ?
+	`, d.Status, d.Attempts, d.NextAttemptAt.UTC(), d.LastStatus, d.LastError, nullTime(d.DeliveredAt), d.ID)
+	if err != nil {
+		return r.translateError(err)
+	}
+	if err := rowsOrNotFound(res); err != nil {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) ListDeadWebhookDeliveries(ctx context.Context, afterID int64, limit int) ([]*WebhookDelivery, error) {
+	tenantID, err := TenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dead, err := r.queryWebhookDeliveries(ctx, "webhook_dead_letters", "tenant_id = ? AND id > ?",
+		tenantID, afterID, limit)
+	return dead, r.translateError(err)
+}
+
+func (r *SQLiteRepository) RetryWebhookDelivery(ctx context.Context, id int64, now time.Time) error {
+	tenantID, err := TenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE webhook_deliveries SET status = ?, attempts = 0, next_attempt_at = ?
+		WHERE id = ? AND tenant_id = ? AND status = ?
+	`, DeliveryPending, now.UTC(), id, tenantID, DeliveryDead)
+	if err != nil {
+		return r.translateError(err)
+	}
+	if err := rowsOrNotFound(res); err != nil {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
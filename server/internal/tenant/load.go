@@ -0,0 +1,154 @@
+package tenant
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go-auth-totp/internal/config"
+	"go-auth-totp/internal/crypto"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/pkg/totp"
+	"os"
+)
+
+// File is the format of TENANTS_FILE.
+//
+//	{
+//	  "default_tenant": "acme",
+//	  "tenants": [
+//	    {"id": "acme", "issuer": "Acme", "master_key_env": "ACME_MASTER_KEY",
+//	     "digits": 6, "period": 30, "window": 1,
+//	     "assertion_audiences": ["billing"]}
+//	  ]
+//	}
+//
+// Keys are never stored in the file itself: master_key_env names the
+// environment variable holding the tenant's hex master key. The "default"
+// tenant may omit it and uses TOTP_MASTER_KEY, so users created before
+// tenants existed stay readable; likewise only it falls back to
+// ASSERTION_AUDIENCES. API keys, which select the tenant of a
+// request, are managed with `totpctl keys`.
+type File struct {
+	DefaultTenant string       `json:"default_tenant"`
+	Tenants       []FileTenant `json:"tenants"`
+}
+
+// FileTenant is one tenant entry of File. Zero policy fields take the
+// server-wide defaults.
+type FileTenant struct {
+	ID           string  `json:"id"`
+	Issuer       string  `json:"issuer"`
+	MasterKeyEnv string  `json:"master_key_env"`
+	Digits       int     `json:"digits"`
+	Period       uint64  `json:"period"`
+	Window       *uint64 `json:"window"`
+	// AssertionAudiences are the audiences the tenant's assertions may be
+	// requested for.
+	AssertionAudiences []string `json:"assertion_audiences"`
+}
+
+// Load builds the registry for cfg. Without TENANTS_FILE the deployment
+// has a single "default" tenant using TOTP_APP_NAME, WINDOW_SIZE and
+// TOTP_MASTER_KEY, which is how the server behaved before tenants.
+func Load(cfg *config.Config) (*Registry, error) {
+	if cfg.TenantsFile == "" {
+		return single(cfg)
+	}
+
+	data, err := os.ReadFile(cfg.TenantsFile)
+	if err != nil {
+		return nil, fmt.Errorf("read tenants file: %w", err)
+	}
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parse tenants file: %w", err)
+	}
+	return FromFile(&f, cfg)
+}
+
+// FromFile builds a registry from a parsed tenants file.
+func FromFile(f *File, cfg *config.Config) (*Registry, error) {
+	if len(f.Tenants) == 0 {
+		return nil, fmt.Errorf("tenants file lists no tenants")
+	}
+
+	reg := NewRegistry(f.DefaultTenant)
+	for _, ft := range f.Tenants {
+		policy := totp.DefaultPolicy()
+		policy.Window = cfg.WindowSize
+		if ft.Digits != 0 {
+			policy.Digits = ft.Digits
+		}
+		if ft.Period != 0 {
+			policy.Period = ft.Period
+		}
+		if ft.Window != nil {
+			policy.Window = *ft.Window
+		}
+
+		key, ephemeral, err := tenantKey(ft, cfg)
+		if err != nil {
+			return nil, err
+		}
+		cs, err := crypto.NewAESGCMEncryption(key)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", ft.ID, err)
+		}
+
+		t, err := New(ft.ID, ft.Issuer, policy, cs)
+		if err != nil {
+			return nil, err
+		}
+		t.EphemeralKey = ephemeral
+		t.AssertionAudiences = ft.AssertionAudiences
+		if t.AssertionAudiences == nil && ft.ID == storage.DefaultTenant {
+			t.AssertionAudiences = cfg.AssertionAudiences
+		}
+		if err := reg.Add(t); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := reg.Default(); f.DefaultTenant != "" && !ok {
+		return nil, fmt.Errorf("default_tenant %q is not defined", f.DefaultTenant)
+	}
+	return reg, nil
+}
+
+func tenantKey(ft FileTenant, cfg *config.Config) (key []byte, ephemeral bool, err error) {
+	if ft.MasterKeyEnv == "" {
+		if ft.ID != storage.DefaultTenant {
+			return nil, false, fmt.Errorf("tenant %s: master_key_env is required", ft.ID)
+		}
+		return cfg.MasterKey, cfg.EphemeralKey, nil
+	}
+	keyHex := os.Getenv(ft.MasterKeyEnv)
+	if keyHex == "" {
+		return nil, false, fmt.Errorf("tenant %s: %s is not set", ft.ID, ft.MasterKeyEnv)
+	}
+	key, err = hex.DecodeString(keyHex)
+	if err != nil {
+		return nil, false, fmt.Errorf("tenant %s: invalid %s hex: %w", ft.ID, ft.MasterKeyEnv, err)
+	}
+	return key, false, nil
+}
+
+func single(cfg *config.Config) (*Registry, error) {
+	cs, err := crypto.NewAESGCMEncryption(cfg.MasterKey)
+	if err != nil {
+		return nil, err
+	}
+	policy := totp.DefaultPolicy()
+	policy.Window = cfg.WindowSize
+	t, err := New(storage.DefaultTenant, cfg.AppName, policy, cs)
+	if err != nil {
+		return nil, err
+	}
+	t.EphemeralKey = cfg.EphemeralKey
+	t.AssertionAudiences = cfg.AssertionAudiences
+
+	reg := NewRegistry(t.ID)
+	if err := reg.Add(t); err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
@@ -0,0 +1,75 @@
+package tenant
+
+import (
+	"bytes"
+	"go-auth-totp/internal/config"
+	"strings"
+	"testing"
+)
+
+func TestFromFile(t *testing.T) {
+	cfg := &config.Config{MasterKey: bytes.Repeat([]byte{1}, 32), WindowSize: 2, AssertionAudiences: []string{"legacy"}}
+	t.Setenv("ACME_MASTER_KEY", strings.Repeat("02", 32))
+	t.Setenv("GLOBEX_MASTER_KEY", strings.Repeat("03", 32))
+	window := uint64(0)
+
+	reg, err := FromFile(&File{
+		DefaultTenant: "default",
+		Tenants: []FileTenant{
+			{ID: "default", Issuer: "Legacy"},
+			{ID: "acme", Issuer: "Acme", MasterKeyEnv: "ACME_MASTER_KEY", Digits: 8, Window: &window,
+				AssertionAudiences: []string{"billing"}},
+			{ID: "globex", Issuer: "Globex", MasterKeyEnv: "GLOBEX_MASTER_KEY"},
+		},
+	}, cfg)
+	if err != nil {
+		t.Fatalf("FromFile: %v", err)
+	}
+
+	def, ok := reg.Default()
+	if !ok || def.ID != "default" || def.Policy.Window != 2 {
+		t.Fatalf("default tenant = %+v, %v", def, ok)
+	}
+	acme, ok := reg.Get("acme")
+	if !ok || acme.Policy.Digits != 8 || acme.Policy.Period != 30 || acme.Policy.Window != 0 {
+		t.Fatalf("acme = %+v, %v", acme, ok)
+	}
+
+	// Only the default tenant falls back to ASSERTION_AUDIENCES.
+	globex, _ := reg.Get("globex")
+	if !def.AllowsAudience("legacy") || !acme.AllowsAudience("billing") || acme.AllowsAudience("legacy") ||
+		len(globex.AssertionAudiences) != 0 {
+		t.Fatalf("audiences: default %v, acme %v, globex %v", def.AssertionAudiences, acme.AssertionAudiences, globex.AssertionAudiences)
+	}
+
+	// The default tenant falls back to TOTP_MASTER_KEY; acme uses its own key.
+	blob, err := def.Crypto.Encrypt([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if _, err := acme.Crypto.Decrypt(blob); err == nil {
+		t.Fatal("tenants share a key")
+	}
+}
+
+func TestFromFileRejectsInvalidConfig(t *testing.T) {
+	cfg := &config.Config{MasterKey: bytes.Repeat([]byte{1}, 32)}
+	t.Setenv("ACME_MASTER_KEY", strings.Repeat("02", 32))
+	acme := FileTenant{ID: "acme", Issuer: "Acme", MasterKeyEnv: "ACME_MASTER_KEY"}
+
+	tests := map[string]File{
+		"no tenants":        {},
+		"missing key env":   {Tenants: []FileTenant{{ID: "acme", Issuer: "Acme"}}},
+		"unset key env":     {Tenants: []FileTenant{{ID: "acme", Issuer: "Acme", MasterKeyEnv: "NOT_SET_ANYWHERE"}}},
+		"bad id":            {Tenants: []FileTenant{{ID: "Acme Corp", Issuer: "Acme", MasterKeyEnv: "ACME_MASTER_KEY"}}},
+		"missing issuer":    {Tenants: []FileTenant{{ID: "acme", MasterKeyEnv: "ACME_MASTER_KEY"}}},
+		"bad digits":        {Tenants: []FileTenant{{ID: "acme", Issuer: "Acme", MasterKeyEnv: "ACME_MASTER_KEY", Digits: 4}}},
+		"duplicate tenant":  {Tenants: []FileTenant{acme, acme}},
+		"undefined default": {DefaultTenant: "globex", Tenants: []FileTenant{acme}},
+	}
+	for name, f := range tests {
+		if _, err := FromFile(&f, cfg); err == nil {
+			t.Errorf("%s: FromFile succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Package tenant holds the per-tenant settings of a shared deployment:
+// issuer name, TOTP policy, encryption key and assertion audiences. Users
+// are scoped by tenant in storage, so the same user ID can exist in
+// several tenants.
+package tenant
+
+import (
+	"context"
+	"fmt"
+	"go-auth-totp/internal/auth/enroll"
+	"go-auth-totp/internal/crypto"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/pkg/totp"
+	"regexp"
+	"slices"
+	"sort"
+)
+
+// validID keeps tenant IDs safe to use in URL paths and log lines.
+var validID = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// Tenant is one isolated customer of the deployment.
+type Tenant struct {
+	ID     string
+	Issuer string
+	Policy totp.Policy
+	Crypto crypto.CryptoService
+	// EphemeralKey is set when the tenant's key was generated for this
+	// process only (TOTP_MASTER_KEY unset).
+	EphemeralKey bool
+	// AssertionAudiences are the services this tenant's assertions may be
+	// requested for. Empty refuses every assertion request.
+	AssertionAudiences []string
+
+	Enroll   *enroll.Service
+	Verifier *totp.Verifier
+}
+
+// New validates the settings and builds the tenant's enrollment and
+// verification services.
+func New(id, issuer string, policy totp.Policy, cs crypto.CryptoService) (*Tenant, error) {
+	if !validID.MatchString(id) {
+		return nil, fmt.Errorf("invalid tenant id %q", id)
+	}
+	if issuer == "" {
+		return nil, fmt.Errorf("tenant %s: issuer is required", id)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("tenant %s: %w", id, err)
+	}
+	return &Tenant{
+		ID:       id,
+		Issuer:   issuer,
+		Policy:   policy,
+		Crypto:   cs,
+		Enroll:   enroll.NewPolicyService(issuer, cs, policy),
+		Verifier: totp.NewPolicyVerifier(nil, policy),
+	}, nil
+}
+
+// AllowsAudience reports whether assertions may be requested for aud.
+func (t *Tenant) AllowsAudience(aud string) bool {
+	return slices.Contains(t.AssertionAudiences, aud)
+}
+
+// Registry looks tenants up by ID.
+type Registry struct {
+	tenants   map[string]*Tenant
+	defaultID string
+}
+
+// NewRegistry creates an empty registry. Requests that name no tenant are
+// served by defaultID; leave it empty to reject them instead.
+func NewRegistry(defaultID string) *Registry {
+	return &Registry{
+		tenants:   make(map[string]*Tenant),
+		defaultID: defaultID,
+	}
+}
+
+// Add registers t.
+func (r *Registry) Add(t *Tenant) error {
+	if _, ok := r.tenants[t.ID]; ok {
+		return fmt.Errorf("duplicate tenant %s", t.ID)
+	}
+	r.tenants[t.ID] = t
+	return nil
+}
+
+// Get returns the tenant with the given ID.
+func (r *Registry) Get(id string) (*Tenant, bool) {
+	t, ok := r.tenants[id]
+	return t, ok
+}
+
+// Default returns the tenant for requests that do not name one.
+func (r *Registry) Default() (*Tenant, bool) {
+	if r.defaultID == "" {
+		return nil, false
+	}
+	return r.Get(r.defaultID)
+}
+
+// IDs returns the registered tenant IDs in sorted order.
+func (r *Registry) IDs() []string {
+	ids := make([]string, 0, len(r.tenants))
+	for id := range r.tenants {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+type contextKey struct{}
+
+// NewContext attaches t to ctx and scopes repository calls made with the
+// returned context to t (see storage.WithTenant).
+func NewContext(ctx context.Context, t *Tenant) context.Context {
+	ctx = context.WithValue(ctx, contextKey{}, t)
+	return storage.WithTenant(ctx, t.ID)
+}
+
+// FromContext returns the tenant attached by NewContext.
+func FromContext(ctx context.Context) (*Tenant, bool) {
+	t, ok := ctx.Value(contextKey{}).(*Tenant)
+	return t, ok
+}
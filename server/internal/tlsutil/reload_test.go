@@ -0,0 +1,174 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"go-auth-totp/internal/tlsutil/tlstest"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatalf("read %s: %v", src, err)
+	}
+	if err := os.WriteFile(dst, data, 0o600); err != nil {
+		t.Fatalf("write %s: %v", dst, err)
+	}
+}
+
+// startServer serves the subject CN of the verified client certificate.
+func startServer(t *testing.T, r *Reloader) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if len(req.TLS.VerifiedChains) > 0 {
+			io.WriteString(w, req.TLS.VerifiedChains[0][0].Subject.CommonName)
+		}
+	}))
+	srv.TLS = r.TLSConfig()
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func get(srv *httptest.Server, roots *x509.CertPool, clientCert *tls.Certificate) (string, error) {
+	cfg := &tls.Config{RootCAs: roots}
+	if clientCert != nil {
+		cfg.Certificates = []tls.Certificate{*clientCert}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestMutualTLS(t *testing.T) {
+	serverCA := tlstest.NewCA(t, "server-ca")
+	clientCA := tlstest.NewCA(t, "client-ca")
+	otherCA := tlstest.NewCA(t, "other-ca")
+	server := serverCA.Server(t)
+
+	r, err := NewReloader(Options{CertFile: server.CertFile, KeyFile: server.KeyFile, ClientCAFile: clientCA.File})
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+	srv := startServer(t, r)
+
+	good := clientCA.Client(t, pkix.Name{CommonName: "billing"}).TLSCertificate(t)
+	if cn, err := get(srv, serverCA.Pool(), &good); err != nil || cn != "billing" {
+		t.Fatalf("trusted client cert: %q, %v", cn, err)
+	}
+	if _, err := get(srv, serverCA.Pool(), nil); err == nil {
+		t.Fatal("request without client cert succeeded")
+	}
+	untrusted := otherCA.Client(t, pkix.Name{CommonName: "billing"}).TLSCertificate(t)
+	if _, err := get(srv, serverCA.Pool(), &untrusted); err == nil {
+		t.Fatal("client cert from an untrusted CA accepted")
+	}
+}
+
+func TestReload(t *testing.T) {
+	oldCA := tlstest.NewCA(t, "old-ca")
+	newCA := tlstest.NewCA(t, "new-ca")
+	oldPair, newPair := oldCA.Server(t), newCA.Server(t)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	copyFile(t, oldPair.CertFile, certFile)
+	copyFile(t, oldPair.KeyFile, keyFile)
+
+	r, err := NewReloader(Options{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+	if r.MutualTLS() {
+		t.Fatal("MutualTLS without a client CA")
+	}
+	srv := startServer(t, r)
+	if _, err := get(srv, oldCA.Pool(), nil); err != nil {
+		t.Fatalf("before reload: %v", err)
+	}
+
+	// A broken file keeps the previous certificate in service.
+	if err := os.WriteFile(certFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("Reload accepted a broken certificate")
+	}
+	if _, err := get(srv, oldCA.Pool(), nil); err != nil {
+		t.Fatalf("after failed reload: %v", err)
+	}
+
+	copyFile(t, newPair.CertFile, certFile)
+	copyFile(t, newPair.KeyFile, keyFile)
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if _, err := get(srv, newCA.Pool(), nil); err != nil {
+		t.Fatalf("after reload: %v", err)
+	}
+	if _, err := get(srv, oldCA.Pool(), nil); err == nil {
+		t.Fatal("old certificate still served after reload")
+	}
+}
+
+func TestNewReloaderRejectsInvalidOptions(t *testing.T) {
+	ca := tlstest.NewCA(t, "ca")
+	pair := ca.Server(t)
+	for name, opts := range map[string]Options{
+		"no files":      {},
+		"missing key":   {CertFile: pair.CertFile},
+		"bad client CA": {CertFile: pair.CertFile, KeyFile: pair.KeyFile, ClientCAFile: pair.KeyFile},
+		"bad CA mode":   {CertFile: pair.CertFile, KeyFile: pair.KeyFile, ClientCAFile: ca.File, ClientAuth: "sometimes"},
+		"missing CA":    {CertFile: pair.CertFile, KeyFile: pair.KeyFile, ClientCAFile: filepath.Join(t.TempDir(), "nope.pem")},
+	} {
+		if _, err := NewReloader(opts); err == nil {
+			t.Errorf("%s: NewReloader succeeded", name)
+		}
+	}
+}
+
+func TestGRPCConfig(t *testing.T) {
+	serverCA := tlstest.NewCA(t, "server-ca")
+	clientCA := tlstest.NewCA(t, "client-ca")
+	server := serverCA.Server(t)
+	r, err := NewReloader(Options{CertFile: server.CertFile, KeyFile: server.KeyFile, ClientCAFile: clientCA.File})
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", r.GRPCConfig())
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	// No client certificate is asked for, even under mutual TLS.
+	conn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{RootCAs: serverCA.Pool(), NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	if p := conn.ConnectionState().NegotiatedProtocol; p != "h2" {
+		t.Errorf("negotiated protocol = %q, want h2", p)
+	}
+}
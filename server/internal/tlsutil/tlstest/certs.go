@@ -0,0 +1,138 @@
+// Package tlstest generates throwaway certificates for tests.
+package tlstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// CA is a self-signed certificate authority.
+type CA struct {
+	Cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// File is the CA certificate in PEM form.
+	File string
+}
+
+// Pair is an issued certificate and its key as PEM files.
+type Pair struct {
+	Cert     *x509.Certificate
+	CertFile string
+	KeyFile  string
+}
+
+// NewCA creates a CA with the given common name under t.TempDir().
+func NewCA(t testing.TB, commonName string) *CA {
+	t.Helper()
+	key := newKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial(t),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	dir := t.TempDir()
+	return &CA{Cert: cert, key: key, File: writePEM(t, dir, "ca.pem", "CERTIFICATE", der)}
+}
+
+// Server issues a server certificate valid for localhost and 127.0.0.1.
+func (ca *CA) Server(t testing.TB) *Pair {
+	t.Helper()
+	return ca.issue(t, pkix.Name{CommonName: "localhost"}, x509.ExtKeyUsageServerAuth)
+}
+
+// Client issues a client certificate with the given subject.
+func (ca *CA) Client(t testing.TB, subject pkix.Name) *Pair {
+	t.Helper()
+	return ca.issue(t, subject, x509.ExtKeyUsageClientAuth)
+}
+
+func (ca *CA) issue(t testing.TB, subject pkix.Name, usage x509.ExtKeyUsage) *Pair {
+	key := newKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial(t),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("issue certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	dir := t.TempDir()
+	return &Pair{
+		Cert:     cert,
+		CertFile: writePEM(t, dir, "cert.pem", "CERTIFICATE", der),
+		KeyFile:  writePEM(t, dir, "key.pem", "EC PRIVATE KEY", keyDER),
+	}
+}
+
+// TLSCertificate loads the pair for use in a tls.Config.
+func (p *Pair) TLSCertificate(t testing.TB) tls.Certificate {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+	if err != nil {
+		t.Fatalf("load key pair: %v", err)
+	}
+	return cert
+}
+
+// Pool returns a pool trusting only the CA.
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	return pool
+}
+
+func newKey(t testing.TB) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key
+}
+
+func serial(t testing.TB) *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		t.Fatalf("serial: %v", err)
+	}
+	return n
+}
+
+func writePEM(t testing.TB, dir, name, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+	return path
+}
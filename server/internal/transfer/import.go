@@ -0,0 +1,187 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-auth-totp/internal/crypto"
+	"go-auth-totp/internal/storage"
+	"io"
+)
+
+// maxLineSize bounds a single JSON line; a user with a handful of recovery
+// codes is well under 4 KiB.
+const maxLineSize = 1 << 20
+
+// ImportOptions controls Import.
+type ImportOptions struct {
+	// Rewrap converts secrets from the export's key to the local key.
+	// Leave nil when the export was already wrapped for this deployment.
+	Rewrap *Rewrapper
+	// Crypto is the local encryption service. Every imported secret must
+	// decrypt with it, and it is used to compare secrets with existing users.
+	Crypto crypto.CryptoService
+	// DryRun reports what would happen without writing.
+	DryRun bool
+}
+
+// Outcome classifies what happened to one record.
+type Outcome string
+
+const (
+	OutcomeCreated   Outcome = "created"
+	OutcomeUnchanged Outcome = "unchanged"
+	OutcomeConflict  Outcome = "conflict"
+	OutcomeFailed    Outcome = "failed"
+)
+
+// Problem describes a record that was not imported.
+type Problem struct {
+	Line    int     `json:"line"`
+	UserID  string  `json:"user_id,omitempty"`
+	Outcome Outcome `json:"outcome"`
+	Reason  string  `json:"reason"`
+}
+
+// ImportResult summarises an import. Re-running the same import yields only
+// Unchanged records, so imports are safe to retry.
+type ImportResult struct {
+	Created   int       `json:"created"`
+	Unchanged int       `json:"unchanged"`
+	Conflicts int       `json:"conflicts"`
+	Failed    int       `json:"failed"`
+	Problems  []Problem `json:"problems,omitempty"`
+}
+
+func (r *ImportResult) record(line int, userID string, outcome Outcome, reason string) {
+	switch outcome {
+	case OutcomeCreated:
+		r.Created++
+		return
+	case OutcomeUnchanged:
+		r.Unchanged++
+		return
+	case OutcomeConflict:
+		r.Conflicts++
+	case OutcomeFailed:
+		r.Failed++
+	}
+	r.Problems = append(r.Problems, Problem{Line: line, UserID: userID, Outcome: outcome, Reason: reason})
+}
+
+// Import reads an export stream and creates users that do not exist yet in
+// ctx's tenant.
+// Existing users are never overwritten: identical ones count as Unchanged,
+// differing ones are reported as conflicts. A malformed header aborts the
+// import; malformed user lines are reported and skipped.
+func Import(ctx context.Context, repo storage.Repository, r io.Reader, opts ImportOptions) (*ImportResult, error) {
+	if opts.Crypto == nil {
+		return nil, errors.New("transfer: ImportOptions.Crypto is required")
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("transfer: empty input")
+	}
+	var header Header
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Type != "header" || header.Format != Format {
+		return nil, errors.New("transfer: input is not a user export (missing header)")
+	}
+	if header.Version != FormatVersion {
+		return nil, fmt.Errorf("transfer: unsupported export version %d (want %d)", header.Version, FormatVersion)
+	}
+
+	result := &ImportResult{}
+	line := 1
+	for scanner.Scan() {
+		line++
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+
+		var rec UserRecord
+		if err := json.Unmarshal(raw, &rec); err != nil || rec.Type != "user" || rec.ID == "" {
+			result.record(line, rec.ID, OutcomeFailed, "malformed user record")
+			continue
+		}
+
+		outcome, reason, err := importUser(ctx, repo, rec, opts)
+		if err != nil {
+			// Storage failures abort: continuing would report misleading results.
+			return result, fmt.Errorf("line %d (%s): %w", line, rec.ID, err)
+		}
+		result.record(line, rec.ID, outcome, reason)
+	}
+	return result, scanner.Err()
+}
+
+func importUser(ctx context.Context, repo storage.Repository, rec UserRecord, opts ImportOptions) (Outcome, string, error) {
+	blob, err := opts.Rewrap.Rewrap(rec.EncryptedSecret)
+	if err != nil {
+		return OutcomeFailed, err.Error(), nil
+	}
+	secret, err := opts.Crypto.Decrypt(blob)
+	if err != nil {
+		return OutcomeFailed, "secret does not decrypt with the local key (wrong -source-key?)", nil
+	}
+	user := rec.toUser()
+	user.EncryptedSecret = blob
+
+	existing, err := repo.GetUser(ctx, rec.ID)
+	switch {
+	case errors.Is(err, storage.ErrUserNotFound):
+		if opts.DryRun {
+			return OutcomeCreated, "", nil
+		}
+		err := repo.SaveUser(ctx, user)
+		if errors.Is(err, storage.ErrConflict) {
+			return OutcomeConflict, "user was created concurrently", nil
+		}
+		if err != nil {
+			return "", "", err
+		}
+		return OutcomeCreated, "", nil
+	case err != nil:
+		return "", "", err
+	}
+
+	if reason := diff(existing, user, secret, opts.Crypto); reason != "" {
+		return OutcomeConflict, reason, nil
+	}
+	return OutcomeUnchanged, "", nil
+}
+
+// diff compares the security-relevant state of an existing user with an
+// imported one. Ciphertexts are compared by plaintext because re-wrapping
+// uses a fresh nonce. Usage metadata is ignored: it keeps changing after
+// an import and must not turn a re-run into a conflict.
+func diff(existing, imported *storage.User, importedSecret []byte, cs crypto.CryptoService) string {
+	existingSecret, err := cs.Decrypt(existing.EncryptedSecret)
+	if err != nil {
+		return "existing secret does not decrypt with the local key"
+	}
+	if !bytes.Equal(existingSecret, importedSecret) {
+		return "secret differs"
+	}
+	if existing.Enabled != imported.Enabled {
+		return "enabled state differs"
+	}
+	if len(existing.RecoveryCodes) != len(imported.RecoveryCodes) {
+		return "recovery codes differ"
+	}
+	for i, c := range existing.RecoveryCodes {
+		if c.Hash != imported.RecoveryCodes[i].Hash || c.Used() != imported.RecoveryCodes[i].Used() {
+			return "recovery codes differ"
+		}
+	}
+	return ""
+}
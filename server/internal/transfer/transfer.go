@@ -0,0 +1,174 @@
+// Package transfer moves users between deployments as JSON Lines.
+//
+// The first line is a header record; every following line is one user with
+// its (still encrypted) TOTP secret, usage metadata and hashed recovery
+// codes. Plaintext secrets never appear in the stream: they are either kept
+// under the source master key or re-wrapped for the target's key.
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-auth-totp/internal/crypto"
+	"go-auth-totp/internal/storage"
+	"io"
+	"time"
+)
+
+const (
+	// Format identifies the stream in the header record.
+	Format = "go-auth-totp/users"
+	// FormatVersion is bumped on incompatible record changes.
+	FormatVersion = 1
+)
+
+// Header is the first record of an export.
+type Header struct {
+	Type       string    `json:"type"` // always "header"
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+// UserRecord is one exported user.
+type UserRecord struct {
+	Type               string               `json:"type"` // always "user"
+	ID                 string               `json:"id"`
+	EncryptedSecret    string               `json:"encrypted_secret"`
+	Enabled            bool                 `json:"enabled"`
+	CreatedAt          time.Time            `json:"created_at"`
+	EnabledAt          *time.Time           `json:"enabled_at,omitempty"`
+	StaticPasswordHash string               `json:"static_password_hash,omitempty"`
+	LastVerifiedAt     *time.Time           `json:"last_verified_at,omitempty"`
+	LastFailedAt       *time.Time           `json:"last_failed_at,omitempty"`
+	FailedAttempts     int                  `json:"failed_attempts"`
+	TotalFailures      int                  `json:"total_failures"`
+	RecoveryCodes      []RecoveryCodeRecord `json:"recovery_codes"`
+}
+
+// RecoveryCodeRecord is a hashed recovery code.
+type RecoveryCodeRecord struct {
+	Hash   string     `json:"hash"`
+	UsedAt *time.Time `json:"used_at,omitempty"`
+}
+
+// Rewrapper re-encrypts secrets from one master key to another.
+// A nil *Rewrapper passes ciphertext through unchanged.
+type Rewrapper struct {
+	From crypto.CryptoService
+	To   crypto.CryptoService
+}
+
+// Rewrap decrypts blob with From and encrypts the plaintext with To.
+func (rw *Rewrapper) Rewrap(blob string) (string, error) {
+	if rw == nil {
+		return blob, nil
+	}
+	plain, err := rw.From.Decrypt(blob)
+	if err != nil {
+		return "", fmt.Errorf("decrypt with source key: %w", err)
+	}
+	return rw.To.Encrypt(plain)
+}
+
+func toRecord(u *storage.User) UserRecord {
+	rec := UserRecord{
+		Type:               "user",
+		ID:                 u.ID,
+		EncryptedSecret:    u.EncryptedSecret,
+		Enabled:            u.Enabled,
+		CreatedAt:          u.CreatedAt,
+		EnabledAt:          optionalTime(u.EnabledAt),
+		StaticPasswordHash: u.StaticPasswordHash,
+		LastVerifiedAt:     optionalTime(u.LastVerifiedAt),
+		LastFailedAt:       optionalTime(u.LastFailedAt),
+		FailedAttempts:     u.FailedAttempts,
+		TotalFailures:      u.TotalFailures,
+		RecoveryCodes:      make([]RecoveryCodeRecord, 0, len(u.RecoveryCodes)),
+	}
+	for _, c := range u.RecoveryCodes {
+		rec.RecoveryCodes = append(rec.RecoveryCodes, RecoveryCodeRecord{Hash: c.Hash, UsedAt: optionalTime(c.UsedAt)})
+	}
+	return rec
+}
+
+func (rec UserRecord) toUser() *storage.User {
+	u := &storage.User{
+		ID:                 rec.ID,
+		EncryptedSecret:    rec.EncryptedSecret,
+		Enabled:            rec.Enabled,
+		CreatedAt:          rec.CreatedAt,
+		EnabledAt:          derefTime(rec.EnabledAt),
+		StaticPasswordHash: rec.StaticPasswordHash,
+		LastVerifiedAt:     derefTime(rec.LastVerifiedAt),
+		LastFailedAt:       derefTime(rec.LastFailedAt),
+		FailedAttempts:     rec.FailedAttempts,
+		TotalFailures:      rec.TotalFailures,
+	}
+	for _, c := range rec.RecoveryCodes {
+		u.RecoveryCodes = append(u.RecoveryCodes, storage.RecoveryCode{Hash: c.Hash, UsedAt: derefTime(c.UsedAt)})
+	}
+	return u
+}
+
+// Export writes every user of ctx's tenant (see storage.WithTenant) to w
+// and returns how many were written. Users deleted while the export runs
+// are skipped.
+func Export(ctx context.Context, repo storage.Repository, w io.Writer, rw *Rewrapper) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	header := Header{Type: "header", Format: Format, Version: FormatVersion, ExportedAt: time.Now().UTC()}
+	if err := enc.Encode(header); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	opts := storage.ListUsersOptions{Limit: storage.MaxListLimit}
+	for {
+		page, err := repo.ListUsers(ctx, opts)
+		if err != nil {
+			return count, err
+		}
+		for _, listed := range page.Users {
+			// ListUsers does not load recovery codes.
+			u, err := repo.GetUser(ctx, listed.ID)
+			if errors.Is(err, storage.ErrUserNotFound) {
+				continue
+			}
+			if err != nil {
+				return count, fmt.Errorf("load %s: %w", listed.ID, err)
+			}
+			rec := toRecord(u)
+			if rec.EncryptedSecret, err = rw.Rewrap(u.EncryptedSecret); err != nil {
+				return count, fmt.Errorf("user %s: %w", u.ID, err)
+			}
+			if err := enc.Encode(rec); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	return count, bw.Flush()
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func derefTime(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
@@ -0,0 +1,182 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"go-auth-totp/internal/crypto"
+	"go-auth-totp/internal/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newCrypto(t *testing.T, b byte) crypto.CryptoService {
+	t.Helper()
+	svc, err := crypto.NewAESGCMEncryption(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatalf("crypto: %v", err)
+	}
+	return svc
+}
+
+func seed(t *testing.T, repo storage.Repository, cs crypto.CryptoService, id string) {
+	t.Helper()
+	blob, err := cs.Encrypt([]byte("secret-" + id))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	u := &storage.User{
+		ID:              id,
+		EncryptedSecret: blob,
+		Enabled:         true,
+		EnabledAt:       time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		RecoveryCodes:   storage.NewRecoveryCodes([]string{"h1", "h2"}),
+	}
+	u.RecoveryCodes[0].UsedAt = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	ctx := storage.WithTenant(context.Background(), storage.DefaultTenant)
+	if err := repo.SaveUser(ctx, u); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+	if err := repo.RecordAttempt(ctx, id, false, time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("RecordAttempt: %v", err)
+	}
+}
+
+func TestExportImportRewrapsAndIsIdempotent(t *testing.T) {
+	ctx := storage.WithTenant(context.Background(), storage.DefaultTenant)
+	sourceKey, targetKey := newCrypto(t, 1), newCrypto(t, 2)
+
+	source := storage.NewInMemoryRepository()
+	for _, id := range []string{"alice", "bob", "carol"} {
+		seed(t, source, sourceKey, id)
+	}
+
+	var buf bytes.Buffer
+	n, err := Export(ctx, source, &buf, &Rewrapper{From: sourceKey, To: targetKey})
+	if err != nil || n != 3 {
+		t.Fatalf("Export = %d, %v", n, err)
+	}
+	if strings.Contains(buf.String(), "secret-alice") {
+		t.Fatal("export contains a plaintext secret")
+	}
+	export := buf.String()
+
+	target := storage.NewInMemoryRepository()
+	res, err := Import(ctx, target, strings.NewReader(export), ImportOptions{Crypto: targetKey})
+	if err != nil || res.Created != 3 || len(res.Problems) != 0 {
+		t.Fatalf("Import = %+v, %v", res, err)
+	}
+
+	got, err := target.GetUser(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	plain, err := targetKey.Decrypt(got.EncryptedSecret)
+	if err != nil || string(plain) != "secret-alice" {
+		t.Fatalf("imported secret = %q, %v", plain, err)
+	}
+	if !got.Enabled || got.TotalFailures != 1 || got.EnabledAt.IsZero() || !got.RecoveryCodes[0].Used() || got.RecoveryCodes[1].Used() {
+		t.Fatalf("imported user lost state: %+v", got)
+	}
+
+	// Re-running the import changes nothing.
+	res, err = Import(ctx, target, strings.NewReader(export), ImportOptions{Crypto: targetKey})
+	if err != nil || res.Unchanged != 3 || res.Created != 0 {
+		t.Fatalf("second Import = %+v, %v", res, err)
+	}
+
+	// A diverged user is reported, not overwritten.
+	got.Enabled = false
+	if err := target.SaveUser(ctx, got); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+	res, err = Import(ctx, target, strings.NewReader(export), ImportOptions{Crypto: targetKey})
+	if err != nil || res.Conflicts != 1 || res.Problems[0].UserID != "alice" {
+		t.Fatalf("conflicting Import = %+v, %v", res, err)
+	}
+	if u, _ := target.GetUser(ctx, "alice"); u.Enabled {
+		t.Fatal("import overwrote a conflicting user")
+	}
+}
+
+// deletingRepo deletes a user just before it is loaded, as a concurrent
+// DELETE /users/{id} would during an export.
+type deletingRepo struct {
+	storage.Repository
+	victim string
+}
+
+func (r deletingRepo) GetUser(ctx context.Context, id string) (*storage.User, error) {
+	if id == r.victim {
+		r.Repository.DeleteUser(ctx, id)
+	}
+	return r.Repository.GetUser(ctx, id)
+}
+
+func TestExportSkipsUsersDeletedDuringExport(t *testing.T) {
+	ctx := storage.WithTenant(context.Background(), storage.DefaultTenant)
+	key := newCrypto(t, 1)
+	repo := storage.NewInMemoryRepository()
+	for _, id := range []string{"alice", "bob", "carol"} {
+		seed(t, repo, key, id)
+	}
+
+	var buf bytes.Buffer
+	n, err := Export(ctx, deletingRepo{Repository: repo, victim: "bob"}, &buf, nil)
+	if err != nil || n != 2 {
+		t.Fatalf("Export = %d, %v; want 2, nil", n, err)
+	}
+	if strings.Contains(buf.String(), `"id":"bob"`) {
+		t.Fatal("export contains the deleted user")
+	}
+}
+
+func TestImportWithSourceKey(t *testing.T) {
+	ctx := storage.WithTenant(context.Background(), storage.DefaultTenant)
+	sourceKey, targetKey := newCrypto(t, 1), newCrypto(t, 2)
+	source := storage.NewInMemoryRepository()
+	seed(t, source, sourceKey, "alice")
+
+	var buf bytes.Buffer
+	if _, err := Export(ctx, source, &buf, nil); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	// Without the source key the secret cannot be verified, so nothing is written.
+	target := storage.NewInMemoryRepository()
+	res, err := Import(ctx, target, bytes.NewReader(buf.Bytes()), ImportOptions{Crypto: targetKey})
+	if err != nil || res.Failed != 1 {
+		t.Fatalf("Import without source key = %+v, %v", res, err)
+	}
+
+	opts := ImportOptions{Crypto: targetKey, Rewrap: &Rewrapper{From: sourceKey, To: targetKey}, DryRun: true}
+	res, err = Import(ctx, target, bytes.NewReader(buf.Bytes()), opts)
+	if err != nil || res.Created != 1 {
+		t.Fatalf("dry-run Import = %+v, %v", res, err)
+	}
+	if _, err := target.GetUser(ctx, "alice"); err == nil {
+		t.Fatal("dry run wrote a user")
+	}
+
+	opts.DryRun = false
+	res, err = Import(ctx, target, bytes.NewReader(buf.Bytes()), opts)
+	if err != nil || res.Created != 1 {
+		t.Fatalf("Import with source key = %+v, %v", res, err)
+	}
+}
+
+func TestImportRejectsBadInput(t *testing.T) {
+	ctx := storage.WithTenant(context.Background(), storage.DefaultTenant)
+	cs := newCrypto(t, 1)
+	repo := storage.NewInMemoryRepository()
+
+	if _, err := Import(ctx, repo, strings.NewReader(`{"type":"user","id":"x"}`), ImportOptions{Crypto: cs}); err == nil {
+		t.Fatal("expected error for missing header")
+	}
+
+	input := `{"type":"header","format":"go-auth-totp/users","version":1}` + "\n" + `not json` + "\n"
+	res, err := Import(ctx, repo, strings.NewReader(input), ImportOptions{Crypto: cs})
+	if err != nil || res.Failed != 1 || res.Problems[0].Line != 2 {
+		t.Fatalf("Import = %+v, %v", res, err)
+	}
+}
@@ -0,0 +1,218 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Options tune a Dispatcher. Zero fields take the defaults below.
+type Options struct {
+	// MaxAttempts is how often a delivery is tried before it is
+	// dead-lettered.
+	MaxAttempts int
+	// RetryBase is the wait after the first failure; it doubles with each
+	// further failure, up to MaxRetryDelay.
+	RetryBase     time.Duration
+	MaxRetryDelay time.Duration
+	// PollInterval is how often Run looks for due deliveries.
+	PollInterval time.Duration
+	// Timeout bounds each attempt.
+	Timeout time.Duration
+	// BatchSize is the most deliveries attempted per poll.
+	BatchSize int
+	// Client sends the requests; it must not follow redirects.
+	Client *http.Client
+}
+
+const (
+	defaultMaxAttempts   = 8
+	defaultRetryBase     = 30 * time.Second
+	defaultMaxRetryDelay = 6 * time.Hour
+	defaultPollInterval  = 5 * time.Second
+	defaultTimeout       = 10 * time.Second
+	defaultBatchSize     = 50
+	// maxLastError bounds the error kept with a delivery.
+	maxLastError = 512
+)
+
+// Dispatcher sends due deliveries from the outbox.
+type Dispatcher struct {
+	store   storage.WebhookStore
+	tenants *tenant.Registry
+	opts    Options
+	now     func() time.Time
+}
+
+// NewDispatcher returns a Dispatcher sending deliveries from store, signed
+// with secrets decrypted by the owning tenant's key.
+func NewDispatcher(store storage.WebhookStore, tenants *tenant.Registry, opts Options) *Dispatcher {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultMaxAttempts
+	}
+	if opts.RetryBase <= 0 {
+		opts.RetryBase = defaultRetryBase
+	}
+	if opts.MaxRetryDelay <= 0 {
+		opts.MaxRetryDelay = defaultMaxRetryDelay
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultPollInterval
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.Client == nil {
+		// A redirect is a failed delivery: following it could send the
+		// signed payload somewhere the tenant never registered.
+		opts.Client = &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+	}
+	return &Dispatcher{store: store, tenants: tenants, opts: opts, now: time.Now}
+}
+
+// Run delivers due events every PollInterval until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		// Keep going while full batches come back, so a backlog drains
+		// without waiting for the ticker.
+		for {
+			n, err := d.DeliverDue(ctx)
+			if err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "Webhook dispatch failed", "error", err)
+			}
+			if err != nil || n < d.opts.BatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue makes one attempt at each due delivery, up to BatchSize, and
+// returns how many it attempted.
+func (d *Dispatcher) DeliverDue(ctx context.Context) (int, error) {
+	due, err := d.store.DueWebhookDeliveries(ctx, d.now(), d.opts.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	for i, delivery := range due {
+		if ctx.Err() != nil {
+			return i, ctx.Err()
+		}
+		d.attempt(ctx, delivery)
+		// Save with a fresh context: the attempt was made and must not be
+		// repeated just because the dispatcher is stopping.
+		if err := d.store.UpdateWebhookDelivery(context.WithoutCancel(ctx), delivery); err != nil {
+			return i + 1, err
+		}
+	}
+	return len(due), nil
+}
+
+// attempt sends delivery once and updates it with the outcome.
+func (d *Dispatcher) attempt(ctx context.Context, delivery *storage.WebhookDelivery) {
+	status, err := d.send(ctx, delivery)
+	delivery.Attempts++
+	delivery.LastStatus = status
+	now := d.now().UTC()
+	log := slog.With("delivery_id", delivery.ID, "endpoint_id", delivery.EndpointID, "event", delivery.EventType,
+		"tenant", delivery.TenantID, "attempt", delivery.Attempts)
+
+	switch {
+	case err == nil:
+		delivery.Status = storage.DeliveryDelivered
+		delivery.DeliveredAt = now
+		delivery.LastError = ""
+		log.DebugContext(ctx, "Webhook delivered", "status", status)
+		return
+	case errors.Is(err, storage.ErrWebhookNotFound):
+		// The endpoint was removed; nobody is waiting for this any more.
+		delivery.Status = storage.DeliveryDead
+	case delivery.Attempts >= d.opts.MaxAttempts:
+		delivery.Status = storage.DeliveryDead
+	default:
+		delivery.NextAttemptAt = now.Add(d.backoff(delivery.Attempts))
+	}
+	delivery.LastError = err.Error()
+	if len(delivery.LastError) > maxLastError {
+		delivery.LastError = delivery.LastError[:maxLastError]
+	}
+	if delivery.Status == storage.DeliveryDead {
+		// Nothing is scheduled any more; keep when the last attempt was.
+		delivery.NextAttemptAt = now
+		log.WarnContext(ctx, "Webhook dead-lettered", "status", status, "error", err)
+	} else {
+		log.InfoContext(ctx, "Webhook attempt failed, will retry", "status", status, "error", err,
+			"next_attempt_at", delivery.NextAttemptAt)
+	}
+}
+
+// backoff is the wait after the given number of failed attempts.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.opts.RetryBase
+	for i := 1; i < attempts && delay < d.opts.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, d.opts.MaxRetryDelay)
+}
+
+// send POSTs the delivery and returns the response status, if any. Any
+// status outside 2xx is an error.
+func (d *Dispatcher) send(ctx context.Context, delivery *storage.WebhookDelivery) (int, error) {
+	endpoint, err := d.store.GetWebhookEndpoint(ctx, delivery.EndpointID)
+	if err != nil {
+		return 0, err
+	}
+	t, ok := d.tenants.Get(endpoint.TenantID)
+	if !ok {
+		return 0, fmt.Errorf("unknown tenant %q", endpoint.TenantID)
+	}
+	secret, err := t.Crypto.Decrypt(endpoint.Secret)
+	if err != nil {
+		return 0, fmt.Errorf("decrypt webhook secret: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(d.now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-auth-totp-webhooks")
+	req.Header.Set(HeaderEventID, delivery.EventID)
+	req.Header.Set(HeaderEvent, delivery.EventType)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(secret, timestamp, delivery.Payload))
+
+	resp, err := d.opts.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,190 @@
+// Package webhook notifies other services of security events.
+//
+// Each tenant registers endpoints with the event types they want. Events
+// are written to an outbox (storage.WebhookStore) as one delivery per
+// endpoint, in the same transaction as the user change they report (see
+// Notifier.WithEvents), and a Dispatcher POSTs them, signed with the endpoint's secret
+// (see Sign), retrying with exponential backoff until the delivery
+// succeeds or is dead-lettered. Delivery is at least once: receivers
+// should drop repeated event IDs.
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Event types.
+const (
+	EventTOTPEnabled      = "totp.enabled"
+	EventTOTPDisabled     = "totp.disabled"
+	EventRecoveryCodeUsed = "recovery_code.used"
+	EventRecoveryCodesLow = "recovery_codes.low"
+	allEvents             = "*"
+)
+
+var validEvents = map[string]bool{
+	EventTOTPEnabled: true, EventTOTPDisabled: true, EventRecoveryCodeUsed: true, EventRecoveryCodesLow: true,
+	allEvents: true,
+}
+
+// ParseEvents parses a comma-separated list of event types; "*" subscribes
+// to all of them.
+func ParseEvents(s string) ([]string, error) {
+	var events []string
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(s, ",") {
+		ev := strings.TrimSpace(part)
+		if ev == "" {
+			continue
+		}
+		if !validEvents[ev] {
+			return nil, fmt.Errorf("unknown event %q (want %s, %s, %s, %s or *)", ev,
+				EventTOTPEnabled, EventTOTPDisabled, EventRecoveryCodeUsed, EventRecoveryCodesLow)
+		}
+		if !seen[ev] {
+			seen[ev] = true
+			events = append(events, ev)
+		}
+	}
+	if len(events) == 0 {
+		return nil, errors.New("at least one event is required")
+	}
+	return events, nil
+}
+
+// Event is what callers describe; the Notifier adds the tenant, an ID and
+// the time.
+type Event struct {
+	Type   string
+	UserID string
+	// Data holds event-specific fields, e.g. the remaining recovery codes.
+	// It must never contain codes or secrets.
+	Data map[string]any
+}
+
+// Payload is the JSON body POSTed to endpoints.
+type Payload struct {
+	ID       string         `json:"id"`
+	Type     string         `json:"type"`
+	TenantID string         `json:"tenant_id"`
+	UserID   string         `json:"user_id,omitempty"`
+	Time     time.Time      `json:"time"`
+	Data     map[string]any `json:"data,omitempty"`
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Registered is a newly created endpoint. Secret is only available here;
+// the store keeps it encrypted.
+type Registered struct {
+	Endpoint *storage.WebhookEndpoint
+	Secret   []byte
+}
+
+// Register creates an endpoint for t that receives events, and saves it in
+// store.
+func Register(ctx context.Context, store storage.WebhookStore, t *tenant.Tenant, rawURL string, events []string) (*Registered, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q: want an absolute http(s) URL", rawURL)
+	}
+	if len(events) == 0 {
+		return nil, errors.New("at least one event is required")
+	}
+
+	id, err := randomHex(6)
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	encrypted, err := t.Crypto.Encrypt(secret)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt webhook secret: %w", err)
+	}
+
+	endpoint := &storage.WebhookEndpoint{
+		ID:       id,
+		TenantID: t.ID,
+		URL:      u.String(),
+		Events:   append([]string(nil), events...),
+		Secret:   encrypted,
+	}
+	if err := store.CreateWebhookEndpoint(ctx, endpoint); err != nil {
+		return nil, err
+	}
+	return &Registered{Endpoint: endpoint, Secret: secret}, nil
+}
+
+// Notifier writes events to the outbox. A nil *Notifier sends nothing.
+type Notifier struct {
+	store storage.WebhookStore
+}
+
+// NewNotifier returns a Notifier writing to store.
+func NewNotifier(store storage.WebhookStore) *Notifier {
+	return &Notifier{store: store}
+}
+
+// WithEvents returns ctx carrying events for the context's tenant, so the
+// SaveUser, DeleteUser or DisableUser made with it queues them in the
+// same transaction (see storage.WithWebhookEvents). A nil *Notifier
+// returns ctx unchanged.
+func (n *Notifier) WithEvents(ctx context.Context, events ...Event) (context.Context, error) {
+	if n == nil || len(events) == 0 {
+		return ctx, nil
+	}
+	tenantID, err := storage.TenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	queued := make([]storage.WebhookEvent, 0, len(events))
+	for _, e := range events {
+		id, err := randomHex(16)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := json.Marshal(Payload{
+			ID:       id,
+			Type:     e.Type,
+			TenantID: tenantID,
+			UserID:   e.UserID,
+			Time:     time.Now().UTC(),
+			Data:     e.Data,
+		})
+		if err != nil {
+			return nil, err
+		}
+		queued = append(queued, storage.WebhookEvent{ID: id, Type: e.Type, Payload: payload})
+	}
+	return storage.WithWebhookEvents(ctx, queued...), nil
+}
+
+// DeadLetters returns up to limit dead deliveries of the context's tenant
+// with IDs above afterID.
+func (n *Notifier) DeadLetters(ctx context.Context, afterID int64, limit int) ([]*storage.WebhookDelivery, error) {
+	return n.store.ListDeadWebhookDeliveries(ctx, afterID, limit)
+}
+
+// Retry queues a dead delivery of the context's tenant again.
+func (n *Notifier) Retry(ctx context.Context, id int64) error {
+	return n.store.RetryWebhookDelivery(ctx, id, time.Now())
+}
@@ -0,0 +1,300 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"go-auth-totp/internal/crypto"
+	"go-auth-totp/internal/storage"
+	"go-auth-totp/internal/tenant"
+	"go-auth-totp/pkg/totp"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is an httptest server that records deliveries and answers
+// with the next status from fail, then 204.
+type receiver struct {
+	*httptest.Server
+	mu         sync.Mutex
+	fail       []int
+	deliveries []received
+}
+
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+func newReceiver(t *testing.T, fail ...int) *receiver {
+	rcv := &receiver{fail: fail}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		rcv.deliveries = append(rcv.deliveries, received{r.Header.Clone(), body})
+		if len(rcv.fail) > 0 {
+			status := rcv.fail[0]
+			rcv.fail = rcv.fail[1:]
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+func (rcv *receiver) received() []received {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]received(nil), rcv.deliveries...)
+}
+
+// setup returns an in-memory store, a registry with the acme tenant and a
+// dispatcher whose clock is *now.
+func setup(t *testing.T, opts Options) (*storage.InMemoryRepository, *tenant.Tenant, *Dispatcher, *time.Time) {
+	t.Helper()
+	cs, err := crypto.NewAESGCMEncryption(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatalf("crypto: %v", err)
+	}
+	acme, err := tenant.New("acme", "Acme", totp.DefaultPolicy(), cs)
+	if err != nil {
+		t.Fatalf("tenant.New: %v", err)
+	}
+	reg := tenant.NewRegistry("")
+	if err := reg.Add(acme); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	store := storage.NewInMemoryRepository()
+	d := NewDispatcher(store, reg, opts)
+	// A little ahead, so events queued by the test are due.
+	now := time.Now().Add(time.Second)
+	d.now = func() time.Time { return now }
+	return store, acme, d, &now
+}
+
+func register(t *testing.T, store storage.WebhookStore, tn *tenant.Tenant, url string, events ...string) *Registered {
+	t.Helper()
+	reg, err := Register(context.Background(), store, tn, url, events)
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	return reg
+}
+
+// notify queues e the way the services do: with a user write, here the
+// creation of a throwaway user.
+func notify(t *testing.T, store storage.Repository, ctx context.Context, e Event) {
+	t.Helper()
+	ctx, err := NewNotifier(nil).WithEvents(ctx, e)
+	if err != nil {
+		t.Fatalf("WithEvents: %v", err)
+	}
+	id, _ := randomHex(4)
+	if err := store.SaveUser(ctx, &storage.User{ID: "user-" + id}); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+}
+
+func deliverDue(t *testing.T, d *Dispatcher, want int) {
+	t.Helper()
+	n, err := d.DeliverDue(context.Background())
+	if err != nil {
+		t.Fatalf("DeliverDue: %v", err)
+	}
+	if n != want {
+		t.Fatalf("DeliverDue attempted %d deliveries, want %d", n, want)
+	}
+}
+
+func TestDeliverySignedAndFiltered(t *testing.T) {
+	store, acme, d, now := setup(t, Options{})
+	all := newReceiver(t)
+	recoveryOnly := newReceiver(t)
+	allReg := register(t, store, acme, all.URL, "*")
+	register(t, store, acme, recoveryOnly.URL, EventRecoveryCodeUsed)
+
+	ctx := storage.WithTenant(context.Background(), "acme")
+	notify(t, store, ctx, Event{Type: EventTOTPEnabled, UserID: "alice"})
+	// Other tenants' events never reach acme's endpoints.
+	notify(t, store, storage.WithTenant(context.Background(), "globex"), Event{Type: EventTOTPEnabled, UserID: "bob"})
+	deliverDue(t, d, 1)
+
+	if got := recoveryOnly.received(); len(got) != 0 {
+		t.Fatalf("unsubscribed endpoint got %d deliveries", len(got))
+	}
+	got := all.received()
+	if len(got) != 1 {
+		t.Fatalf("endpoint got %d deliveries, want 1", len(got))
+	}
+	if err := VerifySignature(got[0].header, got[0].body, allReg.Secret, *now, time.Minute); err != nil {
+		t.Fatalf("VerifySignature: %v", err)
+	}
+	var p Payload
+	if err := json.Unmarshal(got[0].body, &p); err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	if p.Type != EventTOTPEnabled || p.TenantID != "acme" || p.UserID != "alice" || p.ID == "" ||
+		got[0].header.Get(HeaderEventID) != p.ID || got[0].header.Get(HeaderEvent) != EventTOTPEnabled {
+		t.Fatalf("payload = %+v, headers = %v", p, got[0].header)
+	}
+
+	// Tampered bodies, other secrets and stale timestamps are rejected.
+	if err := VerifySignature(got[0].header, append(got[0].body, ' '), allReg.Secret, *now, time.Minute); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("tampered body: err = %v", err)
+	}
+	if err := VerifySignature(got[0].header, got[0].body, []byte("other"), *now, time.Minute); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("wrong secret: err = %v", err)
+	}
+	if err := VerifySignature(got[0].header, got[0].body, allReg.Secret, now.Add(time.Hour), time.Minute); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("stale timestamp: err = %v", err)
+	}
+
+	// Delivered events are not sent again.
+	deliverDue(t, d, 0)
+}
+
+func TestRetriesWithBackoff(t *testing.T) {
+	store, acme, d, now := setup(t, Options{RetryBase: time.Minute})
+	rcv := newReceiver(t, http.StatusInternalServerError, http.StatusServiceUnavailable)
+	register(t, store, acme, rcv.URL, EventRecoveryCodeUsed)
+	ctx := storage.WithTenant(context.Background(), "acme")
+	notify(t, store, ctx, Event{Type: EventRecoveryCodeUsed, UserID: "alice", Data: map[string]any{"remaining": 9}})
+
+	start := *now
+	for i, wait := range []time.Duration{time.Minute, 2 * time.Minute} {
+		deliverDue(t, d, 1)
+		// Not due again until the backoff has passed.
+		*now = now.Add(wait - time.Second)
+		deliverDue(t, d, 0)
+		*now = now.Add(time.Second)
+		if got := len(rcv.received()); got != i+1 {
+			t.Fatalf("after attempt %d the endpoint got %d deliveries", i+1, got)
+		}
+	}
+	if !now.Equal(start.Add(3 * time.Minute)) {
+		t.Fatalf("clock = %v", now)
+	}
+	deliverDue(t, d, 1)
+
+	got := rcv.received()
+	if len(got) != 3 {
+		t.Fatalf("endpoint got %d deliveries, want 3", len(got))
+	}
+	// Retries carry the same event.
+	if !bytes.Equal(got[0].body, got[2].body) || got[0].header.Get(HeaderEventID) != got[2].header.Get(HeaderEventID) {
+		t.Fatalf("retry differs from the first attempt")
+	}
+	due, _ := store.DueWebhookDeliveries(ctx, now.Add(24*time.Hour), 10)
+	if len(due) != 0 {
+		t.Fatalf("delivered event still due: %+v", due)
+	}
+}
+
+func TestDeadLetterAndRetry(t *testing.T) {
+	store, acme, d, now := setup(t, Options{MaxAttempts: 2, RetryBase: time.Second})
+	rcv := newReceiver(t, http.StatusInternalServerError, http.StatusFound)
+	register(t, store, acme, rcv.URL, EventTOTPDisabled)
+	ctx := storage.WithTenant(context.Background(), "acme")
+	n := NewNotifier(store)
+	notify(t, store, ctx, Event{Type: EventTOTPDisabled, UserID: "alice"})
+
+	deliverDue(t, d, 1)
+	*now = now.Add(time.Second)
+	deliverDue(t, d, 1) // a redirect is not followed and counts as a failure
+	*now = now.Add(time.Hour)
+	deliverDue(t, d, 0)
+
+	dead, err := n.DeadLetters(ctx, 0, 10)
+	if err != nil {
+		t.Fatalf("DeadLetters: %v", err)
+	}
+	if len(dead) != 1 || dead[0].Attempts != 2 || dead[0].LastStatus != http.StatusFound || dead[0].LastError == "" {
+		t.Fatalf("dead letters = %+v", dead)
+	}
+
+	if err := n.Retry(ctx, dead[0].ID); err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	// The dispatcher's clock is an hour ahead, so the retry is due.
+	deliverDue(t, d, 1)
+	if dead, _ := n.DeadLetters(ctx, 0, 10); len(dead) != 0 {
+		t.Fatalf("dead letters after a successful retry = %+v", dead)
+	}
+	if got := len(rcv.received()); got != 3 {
+		t.Fatalf("endpoint got %d deliveries, want 3", got)
+	}
+}
+
+func TestRemovedEndpointIsDeadLettered(t *testing.T) {
+	store, acme, d, _ := setup(t, Options{})
+	rcv := newReceiver(t)
+	reg := register(t, store, acme, rcv.URL, "*")
+	ctx := storage.WithTenant(context.Background(), "acme")
+	n := NewNotifier(store)
+	notify(t, store, ctx, Event{Type: EventTOTPEnabled, UserID: "alice"})
+	if err := store.DeleteWebhookEndpoint(ctx, reg.Endpoint.ID); err != nil {
+		t.Fatalf("DeleteWebhookEndpoint: %v", err)
+	}
+
+	deliverDue(t, d, 1)
+	if dead, _ := n.DeadLetters(ctx, 0, 10); len(dead) != 1 || dead[0].Attempts != 1 {
+		t.Fatalf("dead letters = %+v", dead)
+	}
+	if got := len(rcv.received()); got != 0 {
+		t.Fatalf("removed endpoint got %d deliveries", got)
+	}
+}
+
+func TestEventsQueuedWithTheirWrite(t *testing.T) {
+	store, acme, d, _ := setup(t, Options{})
+	rcv := newReceiver(t)
+	register(t, store, acme, rcv.URL, "*")
+	ctx := storage.WithTenant(context.Background(), "acme")
+	ctx, err := NewNotifier(store).WithEvents(ctx, Event{Type: EventTOTPDisabled, UserID: "alice"})
+	if err != nil {
+		t.Fatalf("WithEvents: %v", err)
+	}
+
+	// A write that fails queues nothing.
+	if err := store.DeleteUser(ctx, "alice"); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Fatalf("DeleteUser(missing) err = %v", err)
+	}
+	deliverDue(t, d, 0)
+
+	if err := store.SaveUser(storage.WithTenant(context.Background(), "acme"), &storage.User{ID: "alice"}); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+	if err := store.DeleteUser(ctx, "alice"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	deliverDue(t, d, 1)
+
+	// A nil Notifier attaches nothing.
+	if got, err := (*Notifier)(nil).WithEvents(ctx, Event{Type: EventTOTPEnabled}); got != ctx || err != nil {
+		t.Fatalf("nil Notifier: WithEvents = %v, %v", got, err)
+	}
+}
+
+func TestRegisterValidation(t *testing.T) {
+	store, acme, _, _ := setup(t, Options{})
+	for _, url := range []string{"", "ftp://example.com/hook", "/relative", "https://"} {
+		if _, err := Register(context.Background(), store, acme, url, []string{"*"}); err == nil {
+			t.Errorf("Register(%q) succeeded", url)
+		}
+	}
+	if _, err := ParseEvents("totp.enabled,nope"); err == nil {
+		t.Error("ParseEvents accepted an unknown event")
+	}
+	events, err := ParseEvents(" totp.enabled, recovery_codes.low,totp.enabled")
+	if err != nil || len(events) != 2 {
+		t.Errorf("ParseEvents = %v, %v", events, err)
+	}
+}
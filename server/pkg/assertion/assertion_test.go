@@ -0,0 +1,155 @@
+package assertion
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fixedClock struct{ t time.Time }
+
+func (c *fixedClock) Now() time.Time { return c.t }
+
+func newSigner(t *testing.T, clock *fixedClock) *Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	return NewSigner(key, SignerOptions{Issuer: "totp", TTL: time.Minute, Clock: clock})
+}
+
+func TestSignAndVerify(t *testing.T) {
+	clock := &fixedClock{time.Unix(1_700_000_000, 0)}
+	s := newSigner(t, clock)
+	token, issued, err := s.Sign(Claims{Subject: "alice", Audience: "billing", Tenant: "acme", Method: MethodTOTP, Credential: "totp"})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if issued.Issuer != "totp" || issued.ExpiresAt != clock.t.Add(time.Minute).Unix() || issued.AuthTime != clock.t.Unix() || issued.ID == "" {
+		t.Fatalf("issued claims = %+v", issued)
+	}
+
+	v := &Verifier{Keys: s.JWKS(), Issuer: "totp", Audience: "billing", Tenant: "acme", Clock: clock}
+	c, err := v.Verify(context.Background(), token)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if *c != *issued {
+		t.Fatalf("claims = %+v, want %+v", c, issued)
+	}
+
+	other := newSigner(t, clock)
+	otherToken, _, _ := other.Sign(Claims{Subject: "alice", Audience: "billing", Tenant: "acme"})
+	evilToken, _, _ := s.Sign(Claims{Subject: "alice", Audience: "billing", Tenant: "evil"})
+	parts := strings.Split(token, ".")
+	forgedClaims, _ := json.Marshal(Claims{Subject: "mallory", Audience: "billing", Tenant: "acme", Issuer: "totp", AuthTime: 1, ExpiresAt: issued.ExpiresAt})
+	noneHeader, _ := json.Marshal(header{Alg: "none", Kid: s.KeyID()})
+
+	tests := []struct {
+		name  string
+		token string
+		v     Verifier
+	}{
+		{"wrong audience", token, Verifier{Keys: s.JWKS(), Audience: "payroll", Tenant: "acme", Clock: clock}},
+		{"no audience configured", token, Verifier{Keys: s.JWKS(), Tenant: "acme", Clock: clock}},
+		{"other tenant", evilToken, Verifier{Keys: s.JWKS(), Audience: "billing", Tenant: "acme", Clock: clock}},
+		{"no tenant configured", token, Verifier{Keys: s.JWKS(), Audience: "billing", Clock: clock}},
+		{"wrong issuer", token, Verifier{Keys: s.JWKS(), Issuer: "other", Audience: "billing", Tenant: "acme", Clock: clock}},
+		{"expired", token, Verifier{Keys: s.JWKS(), Audience: "billing", Tenant: "acme", Clock: &fixedClock{clock.t.Add(time.Minute)}}},
+		{"unknown key", otherToken, Verifier{Keys: s.JWKS(), Audience: "billing", Tenant: "acme", Clock: clock}},
+		{"altered claims", parts[0] + "." + b64.EncodeToString(forgedClaims) + "." + parts[2], Verifier{Keys: s.JWKS(), Audience: "billing", Tenant: "acme", Clock: clock}},
+		{"alg none", b64.EncodeToString(noneHeader) + "." + parts[1] + ".", Verifier{Keys: s.JWKS(), Audience: "billing", Tenant: "acme", Clock: clock}},
+		{"garbage", "not.a.token", Verifier{Keys: s.JWKS(), Audience: "billing", Tenant: "acme", Clock: clock}},
+	}
+	for _, tc := range tests {
+		if _, err := tc.v.Verify(context.Background(), tc.token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: err = %v, want ErrInvalidToken", tc.name, err)
+		}
+	}
+
+	// Leeway absorbs small clock differences.
+	lenient := Verifier{Keys: s.JWKS(), Audience: "billing", Tenant: "acme", Leeway: 30 * time.Second, Clock: &fixedClock{clock.t.Add(time.Minute + 10*time.Second)}}
+	if _, err := lenient.Verify(context.Background(), token); err != nil {
+		t.Errorf("within leeway: %v", err)
+	}
+}
+
+func TestRemoteKeySet(t *testing.T) {
+	clock := &fixedClock{time.Now()}
+	current := newSigner(t, clock)
+	var fetches atomic.Int32
+	var served atomic.Value
+	served.Store(current.JWKS())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(served.Load())
+	}))
+	defer srv.Close()
+
+	keys := NewRemoteKeySet(srv.URL)
+	keys.MinRefresh = time.Hour
+	v := &Verifier{Keys: keys, Audience: "billing", Tenant: "acme", Clock: clock}
+	token, _, _ := current.Sign(Claims{Subject: "alice", Audience: "billing", Tenant: "acme"})
+	for i := 0; i < 3; i++ {
+		if _, err := v.Verify(context.Background(), token); err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("fetched %d times, want 1", n)
+	}
+
+	// A rotated key is not fetched again within MinRefresh...
+	rotated := newSigner(t, clock)
+	served.Store(rotated.JWKS())
+	rotatedToken, _, _ := rotated.Sign(Claims{Subject: "alice", Audience: "billing", Tenant: "acme"})
+	if _, err := v.Verify(context.Background(), rotatedToken); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("rotated key within MinRefresh: err = %v", err)
+	}
+	// ...but is once it has passed.
+	keys.MinRefresh = time.Nanosecond
+	if _, err := v.Verify(context.Background(), rotatedToken); err != nil {
+		t.Fatalf("rotated key: %v", err)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("fetched %d times, want 2", n)
+	}
+}
+
+func TestLoadPrivateKeyFile(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadPrivateKeyFile(path)
+	if err != nil {
+		t.Fatalf("LoadPrivateKeyFile: %v", err)
+	}
+	if !loaded.Equal(key) {
+		t.Fatal("loaded a different key")
+	}
+	if err := os.WriteFile(path, []byte("nope"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPrivateKeyFile(path); err == nil {
+		t.Fatal("loaded a key from garbage")
+	}
+}
@@ -0,0 +1,154 @@
+package assertion
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// JWK is an Ed25519 public key in JSON Web Key form (RFC 8037).
+type JWK struct {
+	Kty string `json:"kty"` // "OKP"
+	Crv string `json:"crv"` // "Ed25519"
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+}
+
+// NewJWK returns the JWK of pub.
+func NewJWK(pub ed25519.PublicKey) JWK {
+	return JWK{Kty: "OKP", Crv: "Ed25519", X: b64.EncodeToString(pub), Kid: KeyID(pub), Use: "sig", Alg: Algorithm}
+}
+
+// PublicKey decodes the key, failing for anything but an Ed25519 key.
+func (k JWK) PublicKey() (ed25519.PublicKey, error) {
+	if k.Kty != "OKP" || k.Crv != "Ed25519" {
+		return nil, fmt.Errorf("unsupported key type %s/%s", k.Kty, k.Crv)
+	}
+	x, err := b64.DecodeString(k.X)
+	if err != nil || len(x) != ed25519.PublicKeySize {
+		return nil, errors.New("malformed Ed25519 key")
+	}
+	return ed25519.PublicKey(x), nil
+}
+
+// JWKS is a JSON Web Key Set, as served on /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// KeySet looks up verification keys by key ID.
+type KeySet interface {
+	PublicKey(ctx context.Context, kid string) (ed25519.PublicKey, error)
+}
+
+// ErrUnknownKey is returned by a KeySet that has no key with the given ID.
+var ErrUnknownKey = errors.New("unknown key ID")
+
+// PublicKey implements KeySet with a fixed set of keys.
+func (s JWKS) PublicKey(_ context.Context, kid string) (ed25519.PublicKey, error) {
+	for _, k := range s.Keys {
+		if k.Kid == kid {
+			return k.PublicKey()
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// RemoteKeySet fetches the JWKS of a TOTP server and caches it. An unknown
+// key ID triggers a refetch, at most once per MinRefresh, so rotated keys
+// are picked up without hammering the server.
+type RemoteKeySet struct {
+	URL    string
+	Client *http.Client // nil means http.DefaultClient
+	// MinRefresh is the least time between fetches; zero means a minute.
+	MinRefresh time.Duration
+
+	mu        sync.Mutex
+	keys      JWKS
+	fetchedAt time.Time
+}
+
+// NewRemoteKeySet returns a RemoteKeySet for the JWKS at url.
+func NewRemoteKeySet(url string) *RemoteKeySet {
+	return &RemoteKeySet{URL: url}
+}
+
+func (r *RemoteKeySet) PublicKey(ctx context.Context, kid string) (ed25519.PublicKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if key, err := r.keys.PublicKey(ctx, kid); err == nil {
+		return key, nil
+	}
+	minRefresh := r.MinRefresh
+	if minRefresh <= 0 {
+		minRefresh = time.Minute
+	}
+	if !r.fetchedAt.IsZero() && time.Since(r.fetchedAt) < minRefresh {
+		return nil, ErrUnknownKey
+	}
+	if err := r.fetch(ctx); err != nil {
+		return nil, err
+	}
+	return r.keys.PublicKey(ctx, kid)
+}
+
+// fetch replaces the cached keys. Callers hold mu.
+func (r *RemoteKeySet) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.URL, nil)
+	if err != nil {
+		return err
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch JWKS: %s", resp.Status)
+	}
+	var keys JWKS
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&keys); err != nil {
+		return fmt.Errorf("decode JWKS: %w", err)
+	}
+	r.keys = keys
+	r.fetchedAt = time.Now()
+	return nil
+}
+
+// LoadPrivateKeyFile reads a PEM-encoded PKCS #8 Ed25519 private key, as
+// written by "openssl genpkey -algorithm ed25519".
+func LoadPrivateKeyFile(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PEM PRIVATE KEY block", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return edKey, nil
+}
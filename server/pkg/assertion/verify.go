@@ -0,0 +1,69 @@
+package assertion
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"go-auth-totp/pkg/timeutil"
+	"time"
+)
+
+// Verifier checks assertions.
+type Verifier struct {
+	Keys KeySet
+	// Issuer, when set, must match the "iss" claim.
+	Issuer string
+	// Audience must match the "aud" claim: a service only accepts
+	// assertions minted for it.
+	Audience string
+	// Tenant must match the "tid" claim. Subjects are only unique within
+	// a tenant, so without it an assertion for alice of another tenant
+	// would pass as this tenant's alice.
+	Tenant string
+	// Leeway tolerates clock skew when checking expiry.
+	Leeway time.Duration
+	Clock  timeutil.Clock
+}
+
+// Verify checks token's signature, issuer, audience, tenant and expiry and
+// returns its claims. All failures wrap ErrInvalidToken.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	h, c, sig, signingInput, err := parse(token)
+	if err != nil {
+		return nil, err
+	}
+	// The algorithm is fixed, never taken from the token.
+	if h.Alg != Algorithm {
+		return nil, fmt.Errorf("%w: unexpected algorithm %q", ErrInvalidToken, h.Alg)
+	}
+	key, err := v.Keys.PublicKey(ctx, h.Kid)
+	if err != nil {
+		if errors.Is(err, ErrUnknownKey) {
+			return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, h.Kid)
+		}
+		return nil, err
+	}
+	if !ed25519.Verify(key, []byte(signingInput), sig) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	clock := v.Clock
+	if clock == nil {
+		clock = timeutil.RealClock{}
+	}
+	now := clock.Now()
+	switch {
+	case v.Issuer != "" && c.Issuer != v.Issuer:
+		return nil, fmt.Errorf("%w: issuer %q", ErrInvalidToken, c.Issuer)
+	case v.Audience == "" || c.Audience != v.Audience:
+		return nil, fmt.Errorf("%w: audience %q", ErrInvalidToken, c.Audience)
+	case v.Tenant == "" || c.Tenant != v.Tenant:
+		return nil, fmt.Errorf("%w: tenant %q", ErrInvalidToken, c.Tenant)
+	case !now.Before(c.Expiry().Add(v.Leeway)):
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	case c.Subject == "" || c.AuthTime == 0:
+		return nil, fmt.Errorf("%w: missing subject or auth time", ErrInvalidToken)
+	}
+	return c, nil
+}
@@ -0,0 +1,59 @@
+package stepup
+
+import (
+	"context"
+	"go-auth-totp/pkg/assertion"
+	"go-auth-totp/pkg/timeutil"
+	"go-auth-totp/pkg/totp"
+)
+
+// TOTP checks a code against a raw secret. *totp.Verifier satisfies it.
+type TOTP interface {
+	Verify(secret []byte, code string) (bool, error)
+}
+
+// SecretFunc returns userID's decrypted TOTP secret, or ErrNotEnrolled.
+type SecretFunc func(ctx context.Context, userID string) ([]byte, error)
+
+// Local checks codes in-process, for services that share the TOTP
+// server's database and encryption key.
+//
+// Unlike the server it keeps no attempt counter, so pair it with the
+// service's own rate limiting. Nor does it remember used codes: a code
+// stays valid for its whole window, and anyone who sees it can replay it.
+type Local struct {
+	// TOTP nil means totp.DefaultPolicy: 6 digits, 30 second steps and one
+	// step of drift either way. Use totp.NewPolicyVerifier for others.
+	TOTP   TOTP
+	Secret SecretFunc
+	Clock  timeutil.Clock
+}
+
+// NewLocal returns a Local using the default policy.
+func NewLocal(secret SecretFunc) *Local {
+	return &Local{Secret: secret}
+}
+
+func (l *Local) CheckCode(ctx context.Context, userID, code string) (*Proof, error) {
+	clock := l.Clock
+	if clock == nil {
+		clock = timeutil.RealClock{}
+	}
+	v := l.TOTP
+	if v == nil {
+		v = totp.NewPolicyVerifier(clock, totp.DefaultPolicy())
+	}
+
+	secret, err := l.Secret(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	valid, err := v.Verify(secret, code)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, ErrInvalidCode
+	}
+	return &Proof{UserID: userID, Method: assertion.MethodTOTP, AuthTime: clock.Now()}, nil
+}
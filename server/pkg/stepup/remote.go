@@ -0,0 +1,112 @@
+package stepup
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-auth-totp/pkg/assertion"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Remote checks codes by calling a TOTP server's /v1/validate endpoint.
+//
+// Failures are told apart by the error body's code, never its message:
+// invalid_code is ErrInvalidCode, user_not_found and not_enabled are
+// ErrNotEnrolled, and a 429 is ErrRateLimited. Any other 4xx, such as an
+// unknown tenant or a rejected API key, is ErrMisconfigured. Transport
+// errors and 5xx responses are the only errors that mean the server is
+// unavailable.
+type Remote struct {
+	// BaseURL is the server, or a tenant on it: "https://totp.internal" or
+	// "https://totp.internal/t/acme".
+	BaseURL string
+	// APIKey needs the validate scope.
+	APIKey string
+	// Audience, when set, asks the server for an assertion, which the
+	// middleware hands back to the client.
+	Audience string
+	Client   *http.Client // nil means http.DefaultClient
+}
+
+// NewRemote returns a Remote for the server at baseURL.
+func NewRemote(baseURL, apiKey, audience string) *Remote {
+	return &Remote{BaseURL: baseURL, APIKey: apiKey, Audience: audience}
+}
+
+func (c *Remote) CheckCode(ctx context.Context, userID, code string) (*Proof, error) {
+	body, err := json.Marshal(map[string]string{"user_id": userID, "code": code, "audience": c.Audience})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(c.BaseURL, "/")+"/v1/validate", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("validate: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, fmt.Errorf("validate: %s", resp.Status)
+	}
+
+	var out struct {
+		Error     string `json:"error"`
+		Code      string `json:"code"`
+		Assertion string `json:"assertion"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&out); err != nil {
+		return nil, fmt.Errorf("%w: validate: decode %s response: %v", ErrMisconfigured, resp.Status, err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		authTime := time.Now()
+		if out.Assertion != "" {
+			if authTime, err = assertionAuthTime(out.Assertion); err != nil {
+				return nil, fmt.Errorf("%w: validate: %v", ErrMisconfigured, err)
+			}
+		}
+		return &Proof{UserID: userID, Method: assertion.MethodTOTP, AuthTime: authTime, Assertion: out.Assertion}, nil
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return nil, ErrRateLimited
+	case out.Code == "invalid_code":
+		return nil, ErrInvalidCode
+	case out.Code == "user_not_found", out.Code == "not_enabled":
+		return nil, ErrNotEnrolled
+	}
+	return nil, fmt.Errorf("%w: validate: %s: %s", ErrMisconfigured, resp.Status, out.Error)
+}
+
+// assertionAuthTime reads the auth_time claim of an assertion. The
+// assertion comes straight from the server, so its signature is left to
+// the Verifier that checks it when the client presents it again.
+func assertionAuthTime(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("malformed assertion")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed assertion: %w", err)
+	}
+	var c assertion.Claims
+	if err := json.Unmarshal(payload, &c); err != nil || c.AuthTime == 0 {
+		return time.Time{}, errors.New("assertion has no auth_time")
+	}
+	return c.AuthenticatedAt(), nil
+}
@@ -0,0 +1,240 @@
+// Package stepup is net/http middleware that makes a route require a
+// recent second factor from the signed-in user.
+//
+// A request proves the second factor in one of two ways:
+//
+//   - an assertion from the TOTP server in the X-Step-Up-Assertion header,
+//     checked offline against the server's JWKS, or
+//   - a code in the X-Step-Up-Code header, checked by a CodeChecker: Local
+//     verifies it in-process, Remote asks the TOTP server.
+//
+// Without either, or when the proof is older than the route allows, the
+// middleware answers 401 with a Challenge telling the client what to send.
+//
+//	step := stepup.New(stepup.Options{
+//		Assertions: &assertion.Verifier{Keys: assertion.NewRemoteKeySet(jwksURL), Audience: "billing", Tenant: "acme"},
+//		Codes:      stepup.NewRemote(totpURL, apiKey, "billing"),
+//		UserID:     func(r *http.Request) string { return session(r).UserID },
+//	})
+//	mux.Handle("/payouts", step.Require(2*time.Minute)(payouts))
+package stepup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-auth-totp/pkg/assertion"
+	"go-auth-totp/pkg/timeutil"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Headers read and written by the middleware.
+const (
+	// HeaderAssertion carries an assertion. A successful code check
+	// through a checker that obtains one (Remote) echoes it back in the
+	// response, so the client can reuse it on the next sensitive request.
+	HeaderAssertion = "X-Step-Up-Assertion"
+	// HeaderCode carries a TOTP code.
+	HeaderCode = "X-Step-Up-Code"
+)
+
+// DefaultMaxAge is the freshness Require(0) asks for.
+const DefaultMaxAge = 5 * time.Minute
+
+// Challenge reasons.
+const (
+	ReasonMissing     = "missing"      // no assertion or code was sent
+	ReasonInvalid     = "invalid"      // the assertion did not verify or is for another user
+	ReasonStale       = "stale"        // the second factor is older than the route allows
+	ReasonInvalidCode = "invalid_code" // the code was wrong
+)
+
+// Errors returned by a CodeChecker.
+var (
+	ErrInvalidCode = errors.New("invalid code")
+	// ErrNotEnrolled means the user has no second factor to step up with.
+	ErrNotEnrolled = errors.New("two-factor authentication not enabled")
+	ErrRateLimited = errors.New("too many attempts")
+	// ErrMisconfigured means the checker cannot work as configured: a
+	// wrong URL, tenant or API key. Unlike an unreachable server it is
+	// never a reason to let anyone in.
+	ErrMisconfigured = errors.New("step-up check misconfigured")
+)
+
+// Proof is a satisfied step-up.
+type Proof struct {
+	UserID string
+	// Method is assertion.MethodTOTP or assertion.MethodRecovery.
+	Method   string
+	AuthTime time.Time
+	// Assertion is the assertion presented or obtained, if any.
+	Assertion string
+}
+
+// CodeChecker verifies a code typed in by the user. It returns
+// ErrInvalidCode for a wrong code.
+type CodeChecker interface {
+	CheckCode(ctx context.Context, userID, code string) (*Proof, error)
+}
+
+// Challenge is the body of a 401 from the middleware.
+type Challenge struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+	// MaxAge is how recent, in seconds, the second factor must be.
+	MaxAge int `json:"max_age"`
+	// Audience is the audience to ask the TOTP server to mint an
+	// assertion for.
+	Audience string `json:"audience,omitempty"`
+	// Methods lists the headers the route accepts: "assertion", "code".
+	Methods []string `json:"methods"`
+}
+
+// Options configure a Middleware. UserID and at least one of Assertions
+// and Codes are required.
+type Options struct {
+	// Assertions verifies assertions in HeaderAssertion. Its Audience
+	// names this service and its Tenant the tenant of the users.
+	Assertions *assertion.Verifier
+	// Codes checks codes in HeaderCode. Nil accepts assertions only.
+	Codes CodeChecker
+	// UserID returns the user the request is signed in as, or "" for none.
+	// The service's own session middleware must run first.
+	UserID func(*http.Request) string
+	Clock  timeutil.Clock
+}
+
+// Middleware guards routes. Create one with New and wrap each sensitive
+// route with Require.
+type Middleware struct {
+	opts Options
+}
+
+// New returns a Middleware. It panics if opts cannot accept any proof.
+func New(opts Options) *Middleware {
+	if opts.UserID == nil {
+		panic("stepup: Options.UserID is required")
+	}
+	if opts.Assertions == nil && opts.Codes == nil {
+		panic("stepup: Options.Assertions or Options.Codes is required")
+	}
+	if opts.Clock == nil {
+		opts.Clock = timeutil.RealClock{}
+	}
+	return &Middleware{opts: opts}
+}
+
+// Require returns middleware that lets a request through only if the user
+// presented a second factor within maxAge. Zero means DefaultMaxAge.
+//
+// An assertion can be no fresher than the TOTP server's ASSERTION_TTL
+// allows, so a maxAge above it only matters for code checks.
+func (m *Middleware) Require(maxAge time.Duration) func(http.Handler) http.Handler {
+	if maxAge <= 0 {
+		maxAge = DefaultMaxAge
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID := m.opts.UserID(r)
+			if userID == "" {
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Not signed in"})
+				return
+			}
+
+			proof, reason, err := m.check(r, userID)
+			if err != nil {
+				m.fail(w, r, err)
+				return
+			}
+			if reason == "" && m.opts.Clock.Now().Sub(proof.AuthTime) > maxAge {
+				reason = ReasonStale
+			}
+			if reason != "" {
+				m.challenge(w, reason, maxAge)
+				return
+			}
+			if r.Header.Get(HeaderAssertion) == "" && proof.Assertion != "" {
+				w.Header().Set(HeaderAssertion, proof.Assertion)
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proofKey{}, proof)))
+		})
+	}
+}
+
+// check looks for proof in r. It returns a challenge reason when there is
+// none, and an error when it could not tell.
+func (m *Middleware) check(r *http.Request, userID string) (*Proof, string, error) {
+	if token := r.Header.Get(HeaderAssertion); token != "" && m.opts.Assertions != nil {
+		c, err := m.opts.Assertions.Verify(r.Context(), token)
+		switch {
+		case errors.Is(err, assertion.ErrInvalidToken):
+			slog.DebugContext(r.Context(), "Rejected step-up assertion", "user_id", userID, "error", err)
+			return nil, ReasonInvalid, nil
+		case err != nil:
+			return nil, "", err
+		case c.Subject != userID:
+			return nil, ReasonInvalid, nil
+		}
+		return &Proof{UserID: c.Subject, Method: c.Method, AuthTime: c.AuthenticatedAt(), Assertion: token}, "", nil
+	}
+
+	if code := r.Header.Get(HeaderCode); code != "" && m.opts.Codes != nil {
+		proof, err := m.opts.Codes.CheckCode(r.Context(), userID, code)
+		if errors.Is(err, ErrInvalidCode) {
+			return nil, ReasonInvalidCode, nil
+		}
+		return proof, "", err
+	}
+	return nil, ReasonMissing, nil
+}
+
+func (m *Middleware) challenge(w http.ResponseWriter, reason string, maxAge time.Duration) {
+	c := Challenge{
+		Error:   "Step-up authentication required",
+		Reason:  reason,
+		MaxAge:  int(maxAge / time.Second),
+		Methods: []string{},
+	}
+	if m.opts.Assertions != nil {
+		c.Audience = m.opts.Assertions.Audience
+		c.Methods = append(c.Methods, "assertion")
+	}
+	if m.opts.Codes != nil {
+		c.Methods = append(c.Methods, "code")
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`StepUp reason=%q, max_age=%d`, reason, c.MaxAge))
+	writeJSON(w, http.StatusUnauthorized, c)
+}
+
+// fail answers a request whose proof could not be checked.
+func (m *Middleware) fail(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "Rate limit exceeded"})
+	case errors.Is(err, ErrNotEnrolled):
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "Two-factor authentication is not enabled"})
+	case errors.Is(err, ErrMisconfigured):
+		slog.ErrorContext(r.Context(), "Step-up check misconfigured", "path", r.URL.Path, "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Step-up check failed"})
+	default:
+		slog.ErrorContext(r.Context(), "Step-up check failed", "path", r.URL.Path, "error", err)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "Step-up check unavailable"})
+	}
+}
+
+type proofKey struct{}
+
+// FromContext returns the proof the middleware accepted for the request.
+func FromContext(ctx context.Context) (*Proof, bool) {
+	p, ok := ctx.Value(proofKey{}).(*Proof)
+	return p, ok
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,241 @@
+package stepup
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"go-auth-totp/pkg/assertion"
+	"go-auth-totp/pkg/totp"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fixedClock struct{ t time.Time }
+
+func (c *fixedClock) Now() time.Time { return c.t }
+
+var secret = []byte("12345678901234567890")
+
+func secrets(_ context.Context, userID string) ([]byte, error) {
+	if userID != "alice" {
+		return nil, ErrNotEnrolled
+	}
+	return secret, nil
+}
+
+type result struct {
+	code      int
+	challenge Challenge
+	header    http.Header
+	proof     *Proof
+}
+
+// serve runs a request for user through mw and reports what happened.
+func serve(t *testing.T, mw func(http.Handler) http.Handler, user string, header map[string]string) result {
+	t.Helper()
+	var res result
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res.proof, _ = FromContext(r.Context())
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/payouts", nil)
+	req.Header.Set("X-User", user)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	res.code, res.header = rec.Code, rec.Header()
+	if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != "" {
+		if err := json.NewDecoder(rec.Body).Decode(&res.challenge); err != nil {
+			t.Fatalf("decode challenge: %v", err)
+		}
+	}
+	return res
+}
+
+func userFromHeader(r *http.Request) string { return r.Header.Get("X-User") }
+
+func TestAssertions(t *testing.T) {
+	clock := &fixedClock{time.Unix(1_700_000_000, 0)}
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer := assertion.NewSigner(key, assertion.SignerOptions{Issuer: "totp", TTL: 10 * time.Minute, Clock: clock})
+	token, _, _ := signer.Sign(assertion.Claims{Subject: "alice", Audience: "billing", Tenant: "acme", Method: assertion.MethodTOTP})
+	otherAudience, _, _ := signer.Sign(assertion.Claims{Subject: "alice", Audience: "wiki", Tenant: "acme"})
+	otherTenant, _, _ := signer.Sign(assertion.Claims{Subject: "alice", Audience: "billing", Tenant: "globex"})
+
+	step := New(Options{
+		Assertions: &assertion.Verifier{Keys: signer.JWKS(), Issuer: "totp", Audience: "billing", Tenant: "acme", Clock: clock},
+		UserID:     userFromHeader,
+		Clock:      clock,
+	})
+	strict, lax := step.Require(time.Minute), step.Require(5*time.Minute)
+
+	res := serve(t, strict, "alice", nil)
+	want := Challenge{Error: "Step-up authentication required", Reason: ReasonMissing, MaxAge: 60, Audience: "billing", Methods: []string{"assertion"}}
+	if res.code != http.StatusUnauthorized || res.challenge.Reason != want.Reason || res.challenge.MaxAge != want.MaxAge ||
+		res.challenge.Audience != want.Audience || len(res.challenge.Methods) != 1 || res.challenge.Methods[0] != "assertion" {
+		t.Fatalf("missing proof = %d %+v, want 401 %+v", res.code, res.challenge, want)
+	}
+
+	res = serve(t, strict, "alice", map[string]string{HeaderAssertion: token})
+	if res.code != http.StatusOK || res.proof == nil || res.proof.UserID != "alice" || !res.proof.AuthTime.Equal(clock.t) {
+		t.Fatalf("fresh assertion = %d %+v", res.code, res.proof)
+	}
+
+	// Freshness is per route: two minutes later only the lax route passes.
+	clock.t = clock.t.Add(2 * time.Minute)
+	if res := serve(t, strict, "alice", map[string]string{HeaderAssertion: token}); res.challenge.Reason != ReasonStale {
+		t.Fatalf("stale assertion = %d %+v, want %s", res.code, res.challenge, ReasonStale)
+	}
+	if res := serve(t, lax, "alice", map[string]string{HeaderAssertion: token}); res.code != http.StatusOK {
+		t.Fatalf("lax route = %d, want 200", res.code)
+	}
+
+	for name, tc := range map[string]struct{ user, token string }{
+		"other user":     {"bob", token},
+		"other audience": {"alice", otherAudience},
+		"other tenant":   {"alice", otherTenant},
+		"garbage":        {"alice", "not.a.token"},
+	} {
+		if res := serve(t, lax, tc.user, map[string]string{HeaderAssertion: tc.token}); res.challenge.Reason != ReasonInvalid {
+			t.Errorf("%s = %d %+v, want %s", name, res.code, res.challenge, ReasonInvalid)
+		}
+	}
+
+	if res := serve(t, lax, "", map[string]string{HeaderAssertion: token}); res.code != http.StatusUnauthorized || res.challenge.Reason != "" {
+		t.Errorf("signed out = %d %+v, want a plain 401", res.code, res.challenge)
+	}
+}
+
+func TestLocalCodes(t *testing.T) {
+	clock := &fixedClock{time.Unix(1_700_000_000, 0)}
+	code, err := totp.NewGenerator().GenerateCode(secret, uint64(clock.t.Unix()))
+	if err != nil {
+		t.Fatalf("GenerateCode: %v", err)
+	}
+	step := New(Options{Codes: &Local{Secret: secrets, Clock: clock}, UserID: userFromHeader, Clock: clock})
+	mw := step.Require(0)
+
+	res := serve(t, mw, "alice", map[string]string{HeaderCode: code})
+	if res.code != http.StatusOK || res.proof.Method != assertion.MethodTOTP || res.header.Get(HeaderAssertion) != "" {
+		t.Fatalf("valid code = %d %+v", res.code, res.proof)
+	}
+	wrong := "000000"
+	if wrong == code {
+		wrong = "111111"
+	}
+	if res := serve(t, mw, "alice", map[string]string{HeaderCode: wrong}); res.challenge.Reason != ReasonInvalidCode || res.challenge.MaxAge != 300 {
+		t.Fatalf("wrong code = %d %+v", res.code, res.challenge)
+	}
+	if res := serve(t, mw, "bob", map[string]string{HeaderCode: code}); res.code != http.StatusForbidden {
+		t.Fatalf("not enrolled = %d, want 403", res.code)
+	}
+	// Assertions are ignored when only codes are configured.
+	if res := serve(t, mw, "alice", map[string]string{HeaderAssertion: "x.y.z"}); res.challenge.Reason != ReasonMissing {
+		t.Fatalf("assertion without verifier = %d %+v", res.code, res.challenge)
+	}
+}
+
+func TestRemoteCodes(t *testing.T) {
+	// The proof dates from the assertion, not from when it arrived.
+	authTime := time.Unix(time.Now().Unix()-10, 0)
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signed, _, _ := assertion.NewSigner(key, assertion.SignerOptions{Issuer: "totp"}).Sign(assertion.Claims{
+		Subject: "alice", Audience: "billing", Tenant: "acme", Method: assertion.MethodTOTP, AuthTime: authTime.Unix()})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.URL.Path != "/t/acme/v1/validate" || r.Header.Get("X-API-Key") != "tk_test" || req["audience"] != "billing" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "bad request " + r.URL.Path})
+			return
+		}
+		switch req["code"] {
+		case "123456":
+			json.NewEncoder(w).Encode(map[string]string{"status": "valid", "assertion": signed})
+		case "429429":
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Rate limit exceeded", "code": "rate_limited"})
+		case "500500":
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Verification error"})
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid code", "code": "invalid_code"})
+		}
+	}))
+	defer server.Close()
+
+	step := New(Options{Codes: NewRemote(server.URL+"/t/acme/", "tk_test", "billing"), UserID: userFromHeader})
+	mw := step.Require(time.Minute)
+
+	res := serve(t, mw, "alice", map[string]string{HeaderCode: "123456"})
+	if res.code != http.StatusOK || res.header.Get(HeaderAssertion) != signed || res.proof.Assertion != signed ||
+		!res.proof.AuthTime.Equal(authTime) {
+		t.Fatalf("valid code = %d %v %+v", res.code, res.header, res.proof)
+	}
+	if res := serve(t, mw, "alice", map[string]string{HeaderCode: "654321"}); res.challenge.Reason != ReasonInvalidCode {
+		t.Fatalf("wrong code = %d %+v", res.code, res.challenge)
+	}
+	if res := serve(t, mw, "alice", map[string]string{HeaderCode: "429429"}); res.code != http.StatusTooManyRequests {
+		t.Fatalf("rate limited = %d, want 429", res.code)
+	}
+	// Server trouble fails closed.
+	if res := serve(t, mw, "alice", map[string]string{HeaderCode: "500500"}); res.code != http.StatusServiceUnavailable {
+		t.Fatalf("server error = %d, want 503", res.code)
+	}
+}
+
+func TestRemoteErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		status int
+		body   string
+		want   error // nil means the server is unavailable
+	}{
+		"invalid code":    {http.StatusUnauthorized, `{"error":"Invalid code","code":"invalid_code"}`, ErrInvalidCode},
+		"reworded":        {http.StatusUnauthorized, `{"error":"Wrong code","code":"invalid_code"}`, ErrInvalidCode},
+		"user not found":  {http.StatusNotFound, `{"error":"User not found","code":"user_not_found"}`, ErrNotEnrolled},
+		"not enabled":     {http.StatusPreconditionFailed, `{"error":"TOTP not enabled","code":"not_enabled"}`, ErrNotEnrolled},
+		"rate limited":    {http.StatusTooManyRequests, `{"error":"Rate limit exceeded"}`, ErrRateLimited},
+		"no code":         {http.StatusNotFound, `{"error":"User not found"}`, ErrMisconfigured},
+		"unknown tenant":  {http.StatusNotFound, `{"error":"Unknown tenant"}`, ErrMisconfigured},
+		"invalid API key": {http.StatusUnauthorized, `{"error":"Invalid API key"}`, ErrMisconfigured},
+		"missing scope":   {http.StatusForbidden, `{"error":"API key lacks the validate scope"}`, ErrMisconfigured},
+		"not JSON":        {http.StatusOK, `<html>`, ErrMisconfigured},
+		"bad assertion":   {http.StatusOK, `{"status":"valid","assertion":"x.y"}`, ErrMisconfigured},
+		"server error":    {http.StatusInternalServerError, `{"error":"Verification error"}`, nil},
+		"bad gateway":     {http.StatusBadGateway, `<html>`, nil},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+			io.WriteString(w, tc.body)
+		}))
+		_, err := NewRemote(server.URL, "tk_test", "").CheckCode(context.Background(), "alice", "123456")
+		server.Close()
+		if err == nil {
+			t.Errorf("%s: CheckCode succeeded", name)
+			continue
+		}
+		for _, sentinel := range []error{ErrNotEnrolled, ErrMisconfigured, ErrInvalidCode, ErrRateLimited} {
+			if errors.Is(err, sentinel) != (sentinel == tc.want) {
+				t.Errorf("%s: CheckCode = %v, want %v", name, err, tc.want)
+			}
+		}
+	}
+
+	// A misconfigured checker denies with a 500 rather than a 503.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, `{"error":"Invalid API key"}`)
+	}))
+	defer server.Close()
+	mw := New(Options{Codes: NewRemote(server.URL, "tk_wrong", ""), UserID: userFromHeader}).Require(time.Minute)
+	if res := serve(t, mw, "alice", map[string]string{HeaderCode: "123456"}); res.code != http.StatusInternalServerError {
+		t.Fatalf("misconfigured = %d, want 500", res.code)
+	}
+}
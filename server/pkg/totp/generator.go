@@ -1,3 +1,6 @@
+// Package totp generates and verifies RFC 6238 time-based one-time
+// passwords. It is shared by the server and by services that check codes
+// in-process with pkg/stepup.
 package totp
 
 import (
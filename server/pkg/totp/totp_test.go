@@ -49,7 +49,7 @@ func TestVerifyWindow(t *testing.T) {
 	mockTime := time.Unix(1234567890, 0)
 	clock := MockClock{Time: mockTime}
 
-	verifier := NewVerifier(clock, nil)
+	verifier := NewVerifier(clock)
 	verifier.Window = 1 // +/- 1 step
 
 	// T (Current)
@@ -2,7 +2,8 @@ package totp
 
 import (
 	"crypto/subtle"
-	"go-auth-totp/internal/config"
+	"errors"
+	"fmt"
 	"go-auth-totp/pkg/timeutil"
 )
 
@@ -15,18 +16,47 @@ type Verifier struct {
 	Window uint64
 }
 
-// NewVerifier creates a secure verifier with default settings.
-func NewVerifier(clock timeutil.Clock, cfg *config.Config) *Verifier {
+// Policy describes the codes a tenant's authenticator apps produce and how
+// much clock drift the server tolerates.
+type Policy struct {
+	Digits int
+	Period uint64 // seconds
+	Window uint64 // steps accepted before and after the current one
+}
+
+// DefaultPolicy is the Google Authenticator compatible policy.
+func DefaultPolicy() Policy {
+	return Policy{Digits: 6, Period: 30, Window: 1}
+}
+
+// Validate rejects policies authenticator apps cannot follow.
+func (p Policy) Validate() error {
+	if p.Digits < 6 || p.Digits > 8 {
+		return fmt.Errorf("digits must be between 6 and 8, got %d", p.Digits)
+	}
+	if p.Period == 0 {
+		return errors.New("period must be positive")
+	}
+	return nil
+}
+
+// NewPolicyVerifier creates a verifier for codes following p.
+func NewPolicyVerifier(clock timeutil.Clock, p Policy) *Verifier {
 	if clock == nil {
 		clock = timeutil.RealClock{}
 	}
 	return &Verifier{
-		generator: NewGenerator(),
+		generator: &Generator{Digits: p.Digits, Period: p.Period},
 		clock:     clock,
-		Window:    uint64(cfg.WindowSize), // Allow +/- 30/60 seconds drift (offset user clock)
+		Window:    p.Window,
 	}
 }
 
+// NewVerifier creates a verifier following DefaultPolicy.
+func NewVerifier(clock timeutil.Clock) *Verifier {
+	return NewPolicyVerifier(clock, DefaultPolicy())
+}
+
 // Verify checks if the provided code is valid for the given secret at the current time.
 // It checks the current time step and +/- Window steps.
 // Returns true if valid, false otherwise.
@@ -45,8 +75,6 @@ func (v *Verifier) Verify(secret []byte, inputCode string) (bool, error) {
 	end := currentStep + v.Window
 	matched := 0
 
-	// log.Printf("DEBUG: Verifying Input: %s at Time: %d (Step: %d)", inputCode, currentTime, currentStep)
-
 	for step := start; step <= end; step++ {
 		// Calculate what the time would be for this step (approx, just need step for generation)
 		validCode, err := v.generator.generateHOTP(secret, step)
@@ -54,8 +82,6 @@ func (v *Verifier) Verify(secret []byte, inputCode string) (bool, error) {
 			return false, err
 		}
 
-		// log.Printf("DEBUG: Step %d -> Expected: %s", step, validCode)
-
 		// subtle.ConstantTimeCompare returns 1 if equal, 0 otherwise
 		if subtle.ConstantTimeCompare([]byte(validCode), []byte(inputCode)) == 1 {
 			matched = 1
@@ -0,0 +1,10 @@
+// Package totpv1 is the generated Go client and server code for the gRPC
+// API defined in proto/totp/v1/totp.proto.
+//
+//	conn, err := grpc.NewClient("totp.internal:9090", grpc.WithTransportCredentials(creds))
+//	client := totpv1.NewTOTPServiceClient(conn)
+//	ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", apiKey)
+//	_, err = client.Validate(ctx, &totpv1.ValidateRequest{UserId: "alice", Code: code})
+package totpv1
+
+//go:generate protoc -I ../../proto --go_out=../.. --go_opt=module=go-auth-totp --go-grpc_out=../.. --go-grpc_opt=module=go-auth-totp totp/v1/totp.proto